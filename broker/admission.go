@@ -0,0 +1,188 @@
+package broker
+
+import (
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"github.com/habakke/hmq/metrics"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+// bucketSweepInterval is how often the buckets of source IPs that are full
+// again are removed
+const bucketSweepInterval = time.Minute
+
+// admission limits the client connections of the broker, over all listeners
+type admission struct {
+	info AdmissionInfo
+	// conns is the number of open connections
+	conns int64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// tokenBucket holds the connections a source IP may open
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newAdmission(info AdmissionInfo) *admission {
+	return &admission{
+		info:    info,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// admit counts a new connection, it returns false when the broker already
+// has its maximum number of connections
+func (a *admission) admit() bool {
+	n := atomic.AddInt64(&a.conns, 1)
+	if max := a.info.MaxConnections; max > 0 && n > int64(max) {
+		atomic.AddInt64(&a.conns, -1)
+		return false
+	}
+	return true
+}
+
+func (a *admission) release() {
+	atomic.AddInt64(&a.conns, -1)
+}
+
+// burst is the number of connections a source IP may open at once
+func (a *admission) burst() float64 {
+	if a.info.ConnectionBurst > 0 {
+		return float64(a.info.ConnectionBurst)
+	}
+	return math.Max(1, math.Ceil(a.info.ConnectionRate))
+}
+
+// allow takes a token from the bucket of ip, it returns false when ip opens
+// connections faster than the configured rate
+func (a *admission) allow(ip string, now time.Time) bool {
+	if a.info.ConnectionRate <= 0 {
+		return true
+	}
+	burst := a.burst()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now.Sub(a.swept) > bucketSweepInterval {
+		a.sweep(now, burst)
+	}
+	tb, ok := a.buckets[ip]
+	if !ok {
+		tb = &tokenBucket{tokens: burst, last: now}
+		a.buckets[ip] = tb
+	}
+	tb.refill(now, a.info.ConnectionRate, burst)
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// sweep removes the buckets that refilled, a.mu must be held
+func (a *admission) sweep(now time.Time, burst float64) {
+	for ip, tb := range a.buckets {
+		if tb.refill(now, a.info.ConnectionRate, burst); tb.tokens >= burst {
+			delete(a.buckets, ip)
+		}
+	}
+	a.swept = now
+}
+
+func (tb *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens = math.Min(burst, tb.tokens+elapsed.Seconds()*rate)
+		tb.last = now
+	}
+}
+
+// handleClient serves a client connection accepted by l once it is admitted
+// by the connection limits of the broker and the listener
+func (b *Broker) handleClient(l *listener, conn net.Conn) {
+	ip := remoteIP(conn)
+	if !b.admission.allow(ip, time.Now()) {
+		log.Warn("connection rate exceeded, connection refused", zap.String("hp", l.info.Address), zap.String("remote", ip))
+		_ = b.metrics.Inc(metrics.MetricNumberOfRateLimitedConnections)
+		b.refuse(conn, packets.ReasonConnectionRateExceeded)
+		return
+	}
+	if !b.admission.admit() {
+		log.Warn("broker connection limit reached, connection refused", zap.String("hp", l.info.Address), zap.String("remote", ip))
+		_ = b.metrics.Inc(metrics.MetricNumberOfRefusedConnections)
+		b.refuse(conn, packets.ReasonServerBusy)
+		return
+	}
+	defer b.admission.release()
+	if !l.admit() {
+		log.Warn("listener connection limit reached, connection refused", zap.String("hp", l.info.Address), zap.String("remote", ip))
+		_ = b.metrics.Inc(metrics.MetricNumberOfRefusedConnections)
+		b.refuse(conn, packets.ReasonServerBusy)
+		return
+	}
+	defer l.release()
+
+	b.handleConnection(CLIENT, conn, l)
+}
+
+// refuse answers the CONNECT packet of a client that is not admitted with
+// reason after the backoff delay, so clients reconnecting in a loop slow
+// down, and closes the connection. The CONNECT packet is read with the
+// connect timeout and packet size limit of admitted clients.
+func (b *Broker) refuse(conn net.Conn, reason byte) {
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(b.connectTimeout())); err != nil {
+		return
+	}
+	packet, err := packets.ReadPacketLimit(conn, packets.Version311, b.packetLimit(CLIENT))
+	if err != nil {
+		return
+	}
+	connect, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+
+	if delay := time.Duration(b.admission.info.BackoffDelay) * time.Millisecond; delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-b.quit:
+			timer.Stop()
+			return
+		}
+	}
+
+	version := connect.ProtocolVersion
+	if connect.Validate() == packets.ErrRefusedBadProtocolVersion {
+		version = packets.Version311
+	}
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = reason
+	_ = conn.SetWriteDeadline(time.Now().Add(b.connectTimeout()))
+	if err := connack.Encode(conn, version); err != nil {
+		log.Debug("send connack error, ", zap.Error(err), zap.String("clientID", connect.ClientIdentifier))
+	}
+}
+
+// remoteIP returns the IP address of the client of conn
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if ws, ok := conn.(*websocket.Conn); ok {
+		addr = ws.Request().RemoteAddr
+	}
+	ip, _, _ := net.SplitHostPort(addr)
+	return ip
+}
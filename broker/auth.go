@@ -1,7 +1,15 @@
 package broker
 
 import (
+	"crypto/tls"
+	"errors"
+	"net"
 	"strings"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"github.com/habakke/hmq/plugins/auth"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
 )
 
 const (
@@ -10,7 +18,16 @@ const (
 )
 
 func (b *Broker) CheckTopicAuth(action, clientID, username, ip, topic string) bool {
-	if b.auth != nil {
+	return checkTopicAuth(b.auth, action, clientID, username, ip, topic)
+}
+
+func checkTopicAuth(a auth.Auth, action, clientID, username, ip, topic string) bool {
+	// the $SYS tree is published by the broker only
+	if action == PUB && strings.HasPrefix(topic, "$SYS/") {
+		return false
+	}
+
+	if a != nil {
 		if strings.HasPrefix(topic, "$SYS/broker/connection/clients/") {
 			return true
 		}
@@ -23,7 +40,7 @@ func (b *Broker) CheckTopicAuth(action, clientID, username, ip, topic string) bo
 			topic = substr[2]
 		}
 
-		return b.auth.CheckACL(action, clientID, username, ip, topic)
+		return a.CheckACL(action, clientID, username, ip, topic)
 	}
 
 	return true
@@ -31,10 +48,121 @@ func (b *Broker) CheckTopicAuth(action, clientID, username, ip, topic string) bo
 }
 
 func (b *Broker) CheckConnectAuth(clientID, username, password string) bool {
-	if b.auth != nil {
-		return b.auth.CheckConnect(clientID, username, password)
+	return checkConnectAuth(b.auth, clientID, username, password, nil, 0)
+}
+
+// checkConnectAuth checks the credentials of a client connecting over conn,
+// which may be nil
+func checkConnectAuth(a auth.Auth, clientID, username, password string, conn net.Conn, protocol byte) bool {
+	if ca, ok := a.(auth.ConnectInfoAuth); ok {
+		var ip, cn string
+		if conn != nil {
+			ip, cn = remoteIP(conn), certCN(conn)
+		}
+		return ca.CheckConnectInfo(clientID, username, password, ip, protocol, cn)
+	}
+	if a != nil {
+		return a.CheckConnect(clientID, username, password)
 	}
 
 	return true
 
 }
+
+// CheckEnhancedAuth runs one step of MQTT 5.0 enhanced authentication and
+// returns the authentication data for the client together with the reason
+// code to answer with.
+func (b *Broker) CheckEnhancedAuth(clientID, method string, data []byte) ([]byte, byte) {
+	return checkEnhancedAuth(b.auth, clientID, method, data)
+}
+
+func checkEnhancedAuth(a auth.Auth, clientID, method string, data []byte) ([]byte, byte) {
+	ea, ok := a.(auth.EnhancedAuth)
+	if !ok {
+		return nil, packets.ReasonBadAuthenticationMethod
+	}
+
+	resp, done, err := ea.Authenticate(clientID, method, data)
+	switch {
+	case errors.Is(err, auth.ErrUnsupportedMethod):
+		return nil, packets.ReasonBadAuthenticationMethod
+	case err != nil:
+		log.Warn("enhanced authentication failed", zap.Error(err), zap.String("clientID", clientID))
+		return nil, packets.ReasonNotAuthorized
+	case !done:
+		return resp, packets.ReasonContinueAuthentication
+	}
+	return resp, packets.ReasonSuccess
+}
+
+// keepAuthState keeps the state the auth plugin holds for the client when it
+// closes, the connection taking it over uses it
+func (c *client) keepAuthState() {
+	c.mu.Lock()
+	c.authKept = true
+	c.mu.Unlock()
+}
+
+// authDisconnected tells the auth plugin of the closed client c it is gone
+func (b *Broker) authDisconnected(c *client) {
+	c.mu.Lock()
+	kept := c.authKept
+	c.mu.Unlock()
+	if kept {
+		return
+	}
+	if da, ok := c.authPlugin().(auth.DisconnectAuth); ok {
+		da.Disconnected(c.info.clientID, c.info.username)
+	}
+}
+
+// authPlugins returns the auth plugins of the broker and its listeners,
+// each once
+func (b *Broker) authPlugins() []auth.Auth {
+	var plugins []auth.Auth
+	seen := make(map[auth.Auth]bool)
+	add := func(a auth.Auth) {
+		if a != nil && !seen[a] {
+			seen[a] = true
+			plugins = append(plugins, a)
+		}
+	}
+	add(b.auth)
+	for _, l := range b.clientListeners {
+		add(l.auth)
+	}
+	return plugins
+}
+
+// ReloadAuth reloads the rules of the auth plugins implementing
+// auth.Reloader. Plugins failing to reload keep their rules, the first error
+// is returned.
+func (b *Broker) ReloadAuth() error {
+	var err error
+	for _, a := range b.authPlugins() {
+		if r, ok := a.(auth.Reloader); ok {
+			if rerr := r.Reload(); rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+	}
+	return err
+}
+
+// certCN returns the common name of the certificate the client of conn
+// authenticated with, if any
+func certCN(conn net.Conn) string {
+	var state tls.ConnectionState
+	switch c := conn.(type) {
+	case *tls.Conn:
+		state = c.ConnectionState()
+	case *websocket.Conn:
+		if r := c.Request(); r != nil && r.TLS != nil {
+			state = *r.TLS
+		}
+	}
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
@@ -5,7 +5,8 @@ import (
 	"go.uber.org/zap"
 )
 
-func (b *Broker) Publish(e *bridge.Elements) {
+// publishBridge sends a client event to the bridge
+func (b *Broker) publishBridge(e *bridge.Elements) {
 	if b.bridgeMQ != nil {
 		err := b.bridgeMQ.Publish(e)
 		if err != nil {
@@ -1,9 +1,11 @@
 package broker
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/habakke/hmq/metrics"
+	"io"
 	"net"
 	"net/http"
 	"sync"
@@ -16,10 +18,9 @@ import (
 	"github.com/habakke/hmq/broker/lib/sessions"
 	"github.com/habakke/hmq/broker/lib/topics"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/habakke/hmq/broker/lib/packets"
 	"github.com/habakke/hmq/pool"
 	"go.uber.org/zap"
-	"golang.org/x/net/websocket"
 )
 
 const (
@@ -27,21 +28,32 @@ const (
 	MessagePoolMessageNum = 1024
 )
 
+// DefaultConnectTimeout bounds the time between accepting a connection and
+// receiving its CONNECT packet
+const DefaultConnectTimeout = 10 * time.Second
+
 type Message struct {
 	client *client
 	packet packets.ControlPacket
 }
 
 type Broker struct {
-	id          string
-	started     bool
-	mu          sync.Mutex
-	config      *Config
-	tlsConfig   *tls.Config
-	wpool       *pool.WorkerPool
-	clients     sync.Map
-	routes      sync.Map
-	remotes     sync.Map
+	id      string
+	started bool
+	mu      sync.Mutex
+	config  *Config
+	wpool   *pool.WorkerPool
+	clients sync.Map
+	routes  sync.Map
+	// offlineClients holds the last connection of offline clients with a
+	// persistent session, their subscriptions stay in the topic tree
+	offlineClients sync.Map
+	remotes        sync.Map
+	// wills holds the will messages of closed clients waiting for their
+	// delay
+	wills pendingWills
+	// localSubs holds the in-process subscriptions
+	localSubs   sync.Map
 	nodes       map[string]interface{}
 	clusterPool chan *Message
 	topicsMgr   *topics.Manager
@@ -49,6 +61,22 @@ type Broker struct {
 	auth        auth.Auth
 	bridgeMQ    bridge.BridgeMQ
 	metrics     *metrics.Manager
+	shares      *shareDispatcher
+	hooks       *hookChain
+	stats       *brokerStats
+	admission   *admission
+	userLimits  *userLimits
+	// clientListeners accept the client connections, listeners holds the
+	// open network listeners
+	clientListeners []*listener
+	listeners       []net.Listener
+	servers         []*http.Server
+	httpServer      *http.Server
+	// readers holds the connections of the running read loops, guarded by
+	// mu, readersDone is done when they returned
+	readers     map[*client]net.Conn
+	readersDone sync.WaitGroup
+	quit        chan struct{}
 }
 
 //lint:ignore U1000 This may be used later
@@ -73,33 +101,49 @@ func NewBroker(config *Config) (*Broker, error) {
 		wpool:       pool.New(config.Worker),
 		nodes:       make(map[string]interface{}),
 		clusterPool: make(chan *Message),
+		quit:        make(chan struct{}),
+		readers:     make(map[*client]net.Conn),
+		shares:      newShareDispatcher(config.Shared),
+		stats:       newBrokerStats(),
+		hooks:       &hookChain{},
+		admission:   newAdmission(config.Admission),
+		userLimits:  &userLimits{users: make(map[string]*userBuckets)},
 	}
 
 	var err error
-	b.topicsMgr, err = topics.NewManager("mem")
+	b.topicsMgr, err = topics.NewManager(b.config.Retain.Provider)
 	if err != nil {
 		log.Error("new topic manager error", zap.Error(err))
 		return nil, err
 	}
+	if err = b.topicsMgr.Open(b.config.Retain.Path); err != nil {
+		log.Error("open retained message store error", zap.Error(err), zap.String("path", b.config.Retain.Path))
+		return nil, err
+	}
 
-	b.sessionMgr, err = sessions.NewManager("mem")
+	b.sessionMgr, err = sessions.NewManager(b.config.Session.Provider)
 	if err != nil {
 		log.Error("new session manager error", zap.Error(err))
 		return nil, err
 	}
+	if err = b.sessionMgr.Open(b.config.Session.Path); err != nil {
+		log.Error("open session store error", zap.Error(err), zap.String("path", b.config.Session.Path))
+		return nil, err
+	}
+	b.restoreSessions()
+
+	b.auth = b.config.Plugin.Auth
+	b.bridgeMQ = b.config.Plugin.Bridge
 
-	if b.config.TlsPort != "" {
-		tlsconfig, err := NewTLSConfig(b.config.TlsInfo)
+	for _, info := range b.config.listeners() {
+		l, err := newListener(info, b.auth, b.config.Plugin.AuthConfig)
 		if err != nil {
-			log.Error("new tlsConfig error", zap.Error(err))
+			log.Error("new listener error", zap.Error(err))
 			return nil, err
 		}
-		b.tlsConfig = tlsconfig
+		b.clientListeners = append(b.clientListeners, l)
 	}
 
-	b.auth = b.config.Plugin.Auth
-	b.bridgeMQ = b.config.Plugin.Bridge
-
 	return b, nil
 }
 
@@ -130,9 +174,9 @@ func (b *Broker) Start() {
 		go InitHTTP(b)
 	}
 
-	//listen client over tcp
-	if b.config.Port != "" {
-		go b.StartClientListening(false)
+	//listen for clients over tcp, tls and websocket
+	for _, l := range b.clientListeners {
+		go b.serveListener(l)
 	}
 
 	//listen for cluster
@@ -140,96 +184,264 @@ func (b *Broker) Start() {
 		go b.StartClusterListening()
 	}
 
-	//listen for websocket
-	if b.config.WsPort != "" {
-		go b.StartWebsocketListening()
-	}
-
-	//listen client over tls
-	if b.config.TlsPort != "" {
-		go b.StartClientListening(true)
-	}
-
 	//connect on other node in cluster
 	if b.config.Router != "" {
 		go b.processClusterInfo()
 		b.ConnectToDiscovery()
 	}
 
+	//publish $SYS statistics
+	if b.config.SysInterval >= 0 {
+		interval := time.Duration(b.config.SysInterval) * time.Second
+		if interval == 0 {
+			interval = defaultSysInterval
+		}
+		go b.sysLoop(interval)
+	}
+
+	//remove expired retained messages and sessions
+	go b.expiryLoop(time.Duration(b.config.MessageExpiry.SweepInterval) * time.Second)
+	go b.sessionLoop(time.Duration(b.config.Session.ReapInterval) * time.Second)
+
+	b.mu.Lock()
 	b.started = true
+	b.mu.Unlock()
 }
 
-func (b *Broker) StartWebsocketListening() {
-	path := b.config.WsPath
-	hp := ":" + b.config.WsPort
-	log.Info("Start Websocket Listener on:", zap.String("hp", hp), zap.String("path", path))
-	ws := &websocket.Server{Handler: websocket.Handler(b.wsHandler)}
-	mux := http.NewServeMux()
-	mux.Handle(path, ws)
-	var err error
-	if b.config.WsTLS {
-		err = http.ListenAndServeTLS(hp, b.config.TlsInfo.CertFile, b.config.TlsInfo.KeyFile, mux)
-	} else {
-		err = http.ListenAndServe(hp, mux)
+// Shutdown gracefully stops the broker. It stops accepting connections and
+// reading from the clients, runs the work already queued in the worker pool,
+// disconnects all clients from the workers processing their packets, saves
+// their sessions and closes the bridge and the HTTP server. When ctx is done
+// before the clients are closed the remaining steps still run, the clients
+// not closed yet are left to the workers, and the context error is returned.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.mu.Lock()
+	if b.shuttingDown() {
+		b.mu.Unlock()
+		return nil
 	}
+	close(b.quit)
+	listeners, servers := b.listeners, b.servers
+	b.listeners, b.servers = nil, nil
+	readers := make([]net.Conn, 0, len(b.readers))
+	for _, conn := range b.readers {
+		readers = append(readers, conn)
+	}
+	b.mu.Unlock()
+
+	log.Info("shutting down broker")
+
+	for _, l := range listeners {
+		if err := l.Close(); err != nil {
+			log.Error("close listener error", zap.Error(err))
+		}
+	}
+
+	// the read loops return once their read times out, the clients stay
+	// connected until they are closed below
+	now := time.Now()
+	for _, conn := range readers {
+		_ = conn.SetReadDeadline(now)
+	}
+	err := b.waitReaders(ctx)
 	if err != nil {
-		log.Error("ListenAndServe:" + err.Error())
-		return
+		log.Error("stop read loops error", zap.Error(err))
+	}
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Error("shutdown websocket server error", zap.Error(err))
+		}
 	}
-}
 
-func (b *Broker) wsHandler(ws *websocket.Conn) {
-	// io.Copy(ws, ws)
-	ws.PayloadType = websocket.BinaryFrame
-	b.handleConnection(CLIENT, ws)
-}
+	if derr := b.wpool.Drain(ctx); derr != nil {
+		log.Error("drain worker pool error", zap.Error(derr))
+		if err == nil {
+			err = derr
+		}
+	}
 
-func (b *Broker) StartClientListening(Tls bool) {
-	var err error
-	var l net.Listener
-	// Retry listening indefinitely so that specifying IP addresses
-	// (e.g. --host=10.0.0.217) starts working once the IP address is actually
-	// configured on the interface.
-	for {
-		if Tls {
-			hp := b.config.TlsHost + ":" + b.config.TlsPort
-			l, err = tls.Listen("tcp", hp, b.tlsConfig)
-			log.Info("Start TLS Listening client on ", zap.String("hp", hp))
-		} else {
-			hp := b.config.Host + ":" + b.config.Port
-			l, err = net.Listen("tcp", hp)
-			log.Info("Start Listening client on ", zap.String("hp", hp))
+	var ids []string
+	var clients []*client
+	b.clients.Range(func(key, value interface{}) bool {
+		if c, ok := value.(*client); ok {
+			if c.isPersistent() {
+				ids = append(ids, c.info.clientID)
+			}
+			clients = append(clients, c)
 		}
-		if err != nil {
-			log.Error("Error listening on ", zap.Error(err))
-			time.Sleep(1 * time.Second)
-		} else {
-			break // successfully listening
+		return true
+	})
+	if cerr := b.closeClients(ctx, clients); cerr != nil {
+		log.Error("close clients error", zap.Error(cerr))
+		if err == nil {
+			err = cerr
 		}
 	}
-	tmpDelay := 10 * ACCEPT_MIN_SLEEP
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				log.Error("Temporary Client Accept Error(%v), sleeping %dms",
-					zap.Error(ne), zap.Duration("sleeping", tmpDelay/time.Millisecond))
-				time.Sleep(tmpDelay)
-				tmpDelay *= 2
-				if tmpDelay > ACCEPT_MAX_SLEEP {
-					tmpDelay = ACCEPT_MAX_SLEEP
-				}
-			} else {
-				log.Error("Accept error: %v", zap.Error(err))
+	// packets of cluster connections are not processed by the worker pool,
+	// their read loops are stopped
+	closeAll := func(key, value interface{}) bool {
+		if c, ok := value.(*client); ok {
+			c.Close()
+		}
+		return true
+	}
+	b.routes.Range(closeAll)
+	b.remotes.Range(closeAll)
+
+	for _, id := range ids {
+		if err := b.sessionMgr.Save(id); err != nil {
+			log.Error("save session error", zap.Error(err), zap.String("ClientID", id))
+		}
+	}
+	if err := b.sessionMgr.Close(); err != nil {
+		log.Error("close session manager error", zap.Error(err))
+	}
+	if err := b.topicsMgr.Close(); err != nil {
+		log.Error("close topics manager error", zap.Error(err))
+	}
+
+	if c, ok := b.bridgeMQ.(bridge.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Error("close bridge error", zap.Error(err))
+		}
+	}
+	for _, a := range b.authPlugins() {
+		if c, ok := a.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Error("close auth plugin error", zap.Error(err))
 			}
+		}
+	}
+
+	b.mu.Lock()
+	srv := b.httpServer
+	b.mu.Unlock()
+	if srv != nil {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Error("shutdown http server error", zap.Error(err))
+		}
+	}
+
+	b.mu.Lock()
+	b.started = false
+	b.mu.Unlock()
+	return err
+}
+
+// closeClients disconnects clients in the worker shards processing their
+// packets and waits until the packets queued for them are written
+func (b *Broker) closeClients(ctx context.Context, clients []*client) error {
+	for _, c := range clients {
+		c := c
+		err := b.wpool.SubmitContext(ctx, c.info.clientID, func() {
+			c.sendDisconnect(packets.ReasonServerShuttingDown)
+			c.Close()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := b.wpool.Drain(ctx); err != nil {
+		return err
+	}
+	for _, c := range clients {
+		if c.out == nil {
 			continue
 		}
-		tmpDelay = ACCEPT_MIN_SLEEP
-		go b.handleConnection(CLIENT, conn)
+		select {
+		case <-c.out.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
 
+// waitReaders waits until the read loops returned or ctx is done
+func (b *Broker) waitReaders(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		b.readersDone.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+func (b *Broker) connectTimeout() time.Duration {
+	if b.config.ConnectTimeout <= 0 {
+		return DefaultConnectTimeout
+	}
+	return time.Duration(b.config.ConnectTimeout) * time.Second
+}
+
+// packetLimit is the maximum size of the packets read from a connection of
+// typ, cluster connections are not limited
+func (b *Broker) packetLimit(typ int) int {
+	if typ != CLIENT {
+		return 0
+	}
+	return b.config.MaxPacketSize
+}
+
+func (b *Broker) shuttingDown() bool {
+	select {
+	case <-b.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// trackListener registers l to be closed on shutdown. It returns false and
+// closes l when the broker is already shutting down.
+func (b *Broker) trackListener(l net.Listener) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.shuttingDown() {
+		_ = l.Close()
+		return false
+	}
+	b.listeners = append(b.listeners, l)
+	return true
+}
+
+// trackReader registers the read loop of c reading from conn. It returns
+// false when the broker is already shutting down.
+func (b *Broker) trackReader(c *client, conn net.Conn) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.shuttingDown() {
+		return false
+	}
+	b.readers[c] = conn
+	b.readersDone.Add(1)
+	return true
+}
+
+func (b *Broker) untrackReader(c *client) {
+	b.mu.Lock()
+	delete(b.readers, c)
+	b.mu.Unlock()
+	b.readersDone.Done()
+}
+
+// trackServer registers srv to be shut down on shutdown. It returns false
+// when the broker is already shutting down.
+func (b *Broker) trackServer(srv *http.Server) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.shuttingDown() {
+		return false
+	}
+	b.servers = append(b.servers, srv)
+	return true
+}
+
 func (b *Broker) StartClusterListening() {
 	var hp string = b.config.Cluster.Host + ":" + b.config.Cluster.Port
 	log.Info("Start Listening cluster on ", zap.String("hp", hp))
@@ -239,11 +451,17 @@ func (b *Broker) StartClusterListening() {
 		log.Error("Error listening on ", zap.Error(e))
 		return
 	}
+	if !b.trackListener(l) {
+		return
+	}
 
 	tmpDelay := 10 * ACCEPT_MIN_SLEEP
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if b.shuttingDown() {
+				return
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				log.Error("Temporary Client Accept Error(%v), sleeping %dms",
 					zap.Error(ne), zap.Duration("sleeping", tmpDelay/time.Millisecond))
@@ -259,35 +477,60 @@ func (b *Broker) StartClusterListening() {
 		}
 		tmpDelay = ACCEPT_MIN_SLEEP
 
-		go b.handleConnection(ROUTER, conn)
+		go b.handleConnection(ROUTER, conn, nil)
 	}
 }
 
-func (b *Broker) handleConnection(typ int, conn net.Conn) {
+// handleConnection serves a client or router connection, l is the listener
+// that accepted a client connection
+func (b *Broker) handleConnection(typ int, conn net.Conn, l *listener) {
+	// the CONNECT packet and the enhanced authentication exchange have to be
+	// received before the connect timeout
+	if err := conn.SetReadDeadline(time.Now().Add(b.connectTimeout())); err != nil {
+		log.Error("set connect timeout error: ", zap.Error(err))
+		_ = conn.Close()
+		return
+	}
+
 	//process connect packet
-	packet, err := packets.ReadPacket(conn)
+	packet, err := packets.ReadPacketLimit(conn, packets.Version311, b.packetLimit(typ))
 	if err != nil {
-		log.Error("read connect packet error: ", zap.Error(err))
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			log.Warn("connect timeout, connection closed", zap.String("remote", conn.RemoteAddr().String()))
+			_ = b.metrics.Inc(metrics.MetricNumberOfConnectTimeouts)
+		} else if errors.Is(err, packets.ErrPacketTooLarge) {
+			log.Warn("connect packet too large, connection closed", zap.String("remote", conn.RemoteAddr().String()))
+			_ = b.metrics.Inc(metrics.MetricNumberOfOversizedPackets)
+		} else {
+			log.Error("read connect packet error: ", zap.Error(err))
+		}
+		_ = conn.Close()
 		return
 	}
 	if packet == nil {
 		log.Error("received nil packet")
+		_ = conn.Close()
 		return
 	}
 	msg, ok := packet.(*packets.ConnectPacket)
 	if !ok {
 		log.Error("received msg that was not Connect")
+		_ = conn.Close()
 		return
 	}
 
-	log.Info("read connect from ", zap.String("clientID", msg.ClientIdentifier))
+	log.Info("read connect from ", zap.String("clientID", msg.ClientIdentifier), zap.Uint8("version", msg.ProtocolVersion), zap.String("remote", conn.RemoteAddr().String()))
 
+	version := msg.ProtocolVersion
 	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
-	connack.SessionPresent = msg.CleanSession
 	connack.ReturnCode = msg.Validate()
 
 	if connack.ReturnCode != packets.Accepted {
-		err = connack.Write(conn)
+		if connack.ReturnCode == packets.ErrRefusedBadProtocolVersion {
+			// the client may not understand a newer CONNACK
+			version = packets.Version311
+		}
+		err = connack.Encode(conn, version)
 		if err != nil {
 			log.Error("send connack error, ", zap.Error(err), zap.String("clientID", msg.ClientIdentifier))
 			return
@@ -295,9 +538,45 @@ func (b *Broker) handleConnection(typ int, conn net.Conn) {
 		return
 	}
 
-	if typ == CLIENT && !b.CheckConnectAuth(string(msg.ClientIdentifier), string(msg.Username), string(msg.Password)) {
+	if version >= packets.Version5 {
+		connack.Properties = &packets.Properties{
+			TopicAliasMaximum: packets.Uint16Ptr(maxTopicAlias),
+		}
+		if limit := b.packetLimit(typ); limit > 0 {
+			connack.Properties.MaximumPacketSize = packets.Uint32Ptr(uint32(limit))
+		}
+		if max := b.config.Delivery.MaxAwaitingRel; max > 0 && max <= 65535 {
+			connack.Properties.ReceiveMaximum = packets.Uint16Ptr(uint16(max))
+		}
+		if msg.ClientIdentifier == "" {
+			msg.ClientIdentifier = GenUniqueId()
+			connack.Properties.AssignedClientID = msg.ClientIdentifier
+		}
+	}
+
+	a := b.auth
+	if l != nil {
+		a = l.auth
+	}
+
+	var authMethod string
+	if typ == CLIENT && msg.Properties != nil && msg.Properties.AuthMethod != "" {
+		authMethod = msg.Properties.AuthMethod
+		connack.ReturnCode = b.enhancedAuth(a, conn, msg, connack.Properties, b.packetLimit(typ))
+	} else if typ == CLIENT && !checkConnectAuth(a, string(msg.ClientIdentifier), string(msg.Username), string(msg.Password), conn, version) {
 		connack.ReturnCode = packets.ErrRefusedNotAuthorised
-		err = connack.Write(conn)
+	}
+
+	if connack.ReturnCode == packets.Accepted && typ == CLIENT {
+		requestedID := msg.ClientIdentifier
+		connack.ReturnCode = b.hooks.onConnect(connectInfo(conn, msg), msg)
+		if msg.ClientIdentifier != requestedID && version >= packets.Version5 {
+			connack.Properties.AssignedClientID = msg.ClientIdentifier
+		}
+	}
+
+	if connack.ReturnCode != packets.Accepted {
+		err = connack.Encode(conn, version)
 		if err != nil {
 			log.Error("send connack error, ", zap.Error(err), zap.String("clientID", msg.ClientIdentifier))
 			return
@@ -305,35 +584,29 @@ func (b *Broker) handleConnection(typ int, conn net.Conn) {
 		return
 	}
 
-	err = connack.Write(conn)
-	if err != nil {
-		log.Error("send connack error, ", zap.Error(err), zap.String("clientID", msg.ClientIdentifier))
-		return
+	info := info{
+		clientID:        msg.ClientIdentifier,
+		username:        msg.Username,
+		password:        msg.Password,
+		keepalive:       msg.Keepalive,
+		willMsg:         newWill(msg),
+		protocolVersion: version,
+		authMethod:      authMethod,
 	}
-
-	willmsg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
-	if msg.WillFlag {
-		willmsg.Qos = msg.WillQos
-		willmsg.TopicName = msg.WillTopic
-		willmsg.Retain = msg.WillRetain
-		willmsg.Payload = msg.WillMessage
-		willmsg.Dup = msg.Dup
-	} else {
-		willmsg = nil
+	if msg.Properties != nil && msg.Properties.MaximumPacketSize != nil {
+		info.maxPacketSize = *msg.Properties.MaximumPacketSize
 	}
-	info := info{
-		clientID:  msg.ClientIdentifier,
-		username:  msg.Username,
-		password:  msg.Password,
-		keepalive: msg.Keepalive,
-		willMsg:   willmsg,
+	if msg.Properties != nil && msg.Properties.ReceiveMaximum != nil {
+		info.receiveMaximum = *msg.Properties.ReceiveMaximum
 	}
 
 	c := &client{
-		typ:    typ,
-		broker: b,
-		conn:   conn,
-		info:   info,
+		typ:       typ,
+		broker:    b,
+		conn:      conn,
+		info:      info,
+		listener:  l,
+		readLimit: b.packetLimit(typ),
 	}
 
 	c.init()
@@ -343,6 +616,10 @@ func (b *Broker) handleConnection(typ int, conn net.Conn) {
 		log.Error("get session error: ", zap.String("clientID", c.info.clientID))
 		return
 	}
+	if typ == CLIENT {
+		c.limits = b.publishLimits(a, c)
+		c.info.willDelay = b.willDelay(c, msg)
+	}
 
 	cid := c.info.clientID
 
@@ -356,14 +633,26 @@ func (b *Broker) handleConnection(typ int, conn net.Conn) {
 			log.Warn("client exist, close old...", zap.String("clientID", c.info.clientID))
 			ol, ok := old.(*client)
 			if ok {
+				// the client is still there, no will on takeover
+				ol.discardWill()
+				if ol.info.username == c.info.username {
+					ol.keepAuthState()
+				}
+				ol.sendDisconnect(packets.ReasonSessionTakenOver)
 				ol.Close()
 			}
 		}
+		b.cancelWill(cid)
+		if !connack.SessionPresent {
+			b.discardSession(cid)
+		}
 		b.clients.Store(cid, c)
+		c.trackInflight()
+		b.stats.connected()
 
 		b.OnlineOfflineNotification(cid, true)
 		{
-			b.Publish(&bridge.Elements{
+			b.publishBridge(&bridge.Elements{
 				ClientID:  string(msg.ClientIdentifier),
 				Username:  string(msg.Username),
 				Action:    bridge.Connect,
@@ -382,16 +671,79 @@ func (b *Broker) handleConnection(typ int, conn net.Conn) {
 		b.routes.Store(cid, c)
 	}
 
+	// the CONNACK is only sent once the session is known so that Session
+	// Present is accurate, packets queued for the client meanwhile follow it
+	err = connack.Encode(conn, version)
+	if err != nil {
+		log.Error("send connack error, ", zap.Error(err), zap.String("clientID", msg.ClientIdentifier))
+		c.Close()
+		return
+	}
+	c.startWriter()
+	// the read loop sets its own deadlines from the keep alive
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		log.Error("clear connect timeout error: ", zap.Error(err), zap.String("clientID", msg.ClientIdentifier))
+	}
+
+	if connack.SessionPresent {
+		c.resumeSession()
+	}
+
 	_ = b.metrics.Inc(metrics.MetricNumberOfClients)
 	c.readLoop()
 	_ = b.metrics.Dec(metrics.MetricNumberOfClients)
 }
 
+// enhancedAuth runs the MQTT 5.0 enhanced authentication exchange started by
+// the CONNECT packet and returns the CONNACK reason code. The authentication
+// method and final authentication data are added to props.
+func (b *Broker) enhancedAuth(a auth.Auth, conn net.Conn, msg *packets.ConnectPacket, props *packets.Properties, limit int) byte {
+	method := msg.Properties.AuthMethod
+	data := msg.Properties.AuthData
+	for {
+		resp, rc := checkEnhancedAuth(a, msg.ClientIdentifier, method, data)
+		if rc == packets.ReasonSuccess {
+			props.AuthMethod = method
+			props.AuthData = resp
+			return rc
+		}
+		if rc != packets.ReasonContinueAuthentication {
+			return rc
+		}
+
+		ap := packets.NewControlPacket(packets.Auth).(*packets.AuthPacket)
+		ap.ReasonCode = packets.ReasonContinueAuthentication
+		ap.Properties = &packets.Properties{AuthMethod: method, AuthData: resp}
+		if err := ap.Encode(conn, packets.Version5); err != nil {
+			log.Error("send auth error, ", zap.Error(err), zap.String("clientID", msg.ClientIdentifier))
+			return packets.ReasonUnspecifiedError
+		}
+
+		packet, err := packets.ReadPacketLimit(conn, packets.Version5, limit)
+		if err != nil {
+			log.Error("read auth packet error: ", zap.Error(err), zap.String("clientID", msg.ClientIdentifier))
+			if errors.Is(err, packets.ErrPacketTooLarge) {
+				_ = b.metrics.Inc(metrics.MetricNumberOfOversizedPackets)
+				return packets.ReasonPacketTooLarge
+			}
+			return packets.ReasonMalformedPacket
+		}
+		ap, ok := packet.(*packets.AuthPacket)
+		if !ok || ap.ReasonCode != packets.ReasonContinueAuthentication || ap.Properties == nil || ap.Properties.AuthMethod != method {
+			return packets.ReasonProtocolError
+		}
+		data = ap.Properties.AuthData
+	}
+}
+
 func (b *Broker) ConnectToDiscovery() {
 	var conn net.Conn
 	var err error
 	var tempDelay time.Duration = 0
 	for {
+		if b.shuttingDown() {
+			return
+		}
 		conn, err = net.Dial("tcp", b.config.Router)
 		if err != nil {
 			log.Error("Error trying to connect to route: ", zap.Error(err))
@@ -427,6 +779,7 @@ func (b *Broker) ConnectToDiscovery() {
 	}
 
 	c.init()
+	c.startWriter()
 
 	c.SendConnect()
 	c.SendInfo()
@@ -455,7 +808,7 @@ func (b *Broker) connectRouter(id, addr string) {
 	max := 32 * time.Second
 	for {
 
-		if !b.checkNodeExist(id, addr) {
+		if !b.checkNodeExist(id, addr) || b.shuttingDown() {
 			return
 		}
 
@@ -503,6 +856,7 @@ func (b *Broker) connectRouter(id, addr string) {
 		info:   info,
 	}
 	c.init()
+	c.startWriter()
 	b.remotes.Store(cid, c)
 
 	c.SendConnect()
@@ -564,6 +918,12 @@ func (b *Broker) SendLocalSubsToRouter(c *client) {
 		}
 		return true
 	})
+	b.localSubs.Range(func(key, _ interface{}) bool {
+		sub := key.(*localSubscription)
+		subInfo.Topics = append(subInfo.Topics, sub.filter)
+		subInfo.Qoss = append(subInfo.Qoss, sub.qos)
+		return true
+	})
 	if len(subInfo.Topics) > 0 {
 		err := c.WriterPacket(subInfo)
 		if err != nil {
@@ -614,6 +974,8 @@ func (b *Broker) removeClient(c *client) {
 }
 
 func (b *Broker) PublishMessage(packet *packets.PublishPacket) {
+	b.setExpiry(packet, time.Now())
+
 	var subs []interface{}
 	var qoss []byte
 	b.mu.Lock()
@@ -625,12 +987,15 @@ func (b *Broker) PublishMessage(packet *packets.PublishPacket) {
 	}
 
 	for _, sub := range subs {
-		s, ok := sub.(*subscription)
-		if ok {
-			err := s.client.WriterPacket(packet)
-			if err != nil {
-				log.Error("write message error,  ", zap.Error(err))
+		switch s := sub.(type) {
+		case *subscription:
+			p := b.hooks.onDeliver(s.client.hookInfo(), s.deliveryPacket(packet, false))
+			if p == nil {
+				continue
 			}
+			s.client.deliver(p)
+		case *localSubscription:
+			s.deliver(packet, false)
 		}
 	}
 }
@@ -1,18 +1,29 @@
 package broker
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/habakke/hmq/broker/lib/packets"
 	"github.com/habakke/hmq/metrics"
+	"github.com/habakke/hmq/plugins/auth"
 	"github.com/prometheus/common/expfmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
 )
 
 const (
@@ -27,6 +38,8 @@ type BrokerTests struct {
 var (
 	bt BrokerTests
 	b  Broker
+	// testBroker is the broker the tests connect to
+	testBroker *Broker
 )
 
 func TestMain(m *testing.M) {
@@ -60,11 +73,12 @@ func startBroker() {
 	config := DefaultConfig
 	config.HTTPPort = "8080"
 
-	b, err := NewBroker(config)
+	var err error
+	testBroker, err = NewBroker(config)
 	if err != nil {
 		log.Fatal(fmt.Sprintf("New Broker error: %e", err))
 	}
-	b.Start()
+	testBroker.Start()
 }
 
 func (bt *BrokerTests) connect() {
@@ -77,6 +91,31 @@ func (bt *BrokerTests) connect() {
 	bt.client = c
 }
 
+// newTestBroker starts a broker of its own for tests that need a config
+// different from the one of testBroker. It has no listeners, HTTP server or
+// $SYS topics unless configure adds them, and is shut down when the test
+// ends.
+func newTestBroker(t *testing.T, configure func(config *Config)) *Broker {
+	config := *DefaultConfig
+	config.Port, config.HTTPPort, config.SysInterval = "", "", -1
+	config.Listeners = nil
+	if configure != nil {
+		configure(&config)
+	}
+
+	b, err := NewBroker(&config)
+	if err != nil {
+		t.Fatalf("new broker: %v", err)
+	}
+	b.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = b.Shutdown(ctx)
+	})
+	return b
+}
+
 func (bt *BrokerTests) publishMessage(topic string, message string, wg *sync.WaitGroup) error {
 	if token := bt.client.Publish(topic, 0, false, message); token.Wait() && token.Error() != nil {
 		return token.Error()
@@ -146,3 +185,1507 @@ func TestBrokerPubSub(t *testing.T) {
 		t.Fatal("metric 0, but should be 1")
 	}
 }
+
+func readPacketV5(t *testing.T, conn net.Conn) packets.ControlPacket {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packets.ReadPacketVersion(conn, packets.Version5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func connectV5(t *testing.T, props *packets.Properties) (net.Conn, *packets.ConnackPacket) {
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.CleanSession = true
+	connect.Properties = props
+	return dialV5(t, connect)
+}
+
+func dialV5(t *testing.T, connect *packets.ConnectPacket) (net.Conn, *packets.ConnackPacket) {
+	return dialV5Addr(t, "127.0.0.1:1883", connect)
+}
+
+func dialV5Addr(t *testing.T, addr string, connect *packets.ConnectPacket) (net.Conn, *packets.ConnackPacket) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = packets.Version5
+	connect.Keepalive = 30
+	if err := connect.Encode(conn, packets.Version5); err != nil {
+		t.Fatal(err)
+	}
+
+	connack, ok := readPacketV5(t, conn).(*packets.ConnackPacket)
+	if !ok {
+		t.Fatal("expected connack")
+	}
+	return conn, connack
+}
+
+func TestBrokerMQTT5(t *testing.T) {
+	conn, connack := connectV5(t, nil)
+	defer conn.Close()
+
+	assert.Equal(t, packets.ReasonSuccess, connack.ReturnCode)
+	assert.NotEmpty(t, connack.Properties.AssignedClientID)
+
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{"mqtt5/test"}
+	sub.Qoss = []byte{1}
+	sub.Properties = &packets.Properties{SubscriptionIdentifier: []int{7}}
+	assert.Nil(t, sub.Encode(conn, packets.Version5))
+
+	suback, ok := readPacketV5(t, conn).(*packets.SubackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{1}, suback.ReturnCodes)
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.MessageID = 2
+	pub.TopicName = "mqtt5/test"
+	pub.Payload = []byte(defaultPacketPayload)
+	pub.Properties = &packets.Properties{
+		TopicAlias: packets.Uint16Ptr(1),
+		User:       []packets.UserProperty{{Key: "origin", Value: "test"}},
+	}
+	assert.Nil(t, pub.Encode(conn, packets.Version5))
+
+	var received *packets.PublishPacket
+	for i := 0; i < 2; i++ {
+		switch p := readPacketV5(t, conn).(type) {
+		case *packets.PubackPacket:
+			assert.Equal(t, uint16(2), p.MessageID)
+			assert.Equal(t, packets.ReasonSuccess, p.ReasonCode)
+		case *packets.PublishPacket:
+			received = p
+		}
+	}
+	if assert.NotNil(t, received) {
+		assert.Equal(t, "mqtt5/test", received.TopicName)
+		assert.Equal(t, []int{7}, received.Properties.SubscriptionIdentifier)
+		assert.Equal(t, pub.Properties.User, received.Properties.User)
+		assert.Nil(t, received.Properties.TopicAlias)
+	}
+
+	// publish again using only the topic alias registered above
+	pub = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Payload = []byte(defaultPacketPayload)
+	pub.Properties = &packets.Properties{TopicAlias: packets.Uint16Ptr(1)}
+	assert.Nil(t, pub.Encode(conn, packets.Version5))
+
+	received, ok = readPacketV5(t, conn).(*packets.PublishPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, "mqtt5/test", received.TopicName)
+	}
+
+	unsub := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	unsub.MessageID = 3
+	unsub.Topics = []string{"mqtt5/test", "mqtt5/unknown"}
+	assert.Nil(t, unsub.Encode(conn, packets.Version5))
+
+	unsuback, ok := readPacketV5(t, conn).(*packets.UnsubackPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, []byte{packets.ReasonSuccess, packets.ReasonNoSubscriptionExisted}, unsuback.ReasonCodes)
+	}
+
+	assert.Nil(t, packets.NewControlPacket(packets.Disconnect).Encode(conn, packets.Version5))
+}
+
+func TestBrokerMQTT5BadAuthMethod(t *testing.T) {
+	conn, connack := connectV5(t, &packets.Properties{AuthMethod: "SCRAM-SHA-1"})
+	defer conn.Close()
+
+	assert.Equal(t, packets.ReasonBadAuthenticationMethod, connack.ReturnCode)
+}
+
+func TestBrokerPersistentSession(t *testing.T) {
+	persistent := func() *packets.ConnectPacket {
+		connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		connect.ClientIdentifier = "persistent-session"
+		connect.Properties = &packets.Properties{SessionExpiryInterval: packets.Uint32Ptr(60)}
+		return connect
+	}
+
+	conn, connack := dialV5(t, persistent())
+	assert.False(t, connack.SessionPresent)
+
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{"persistent/test"}
+	sub.Qoss = []byte{1}
+	assert.Nil(t, sub.Encode(conn, packets.Version5))
+	_, ok := readPacketV5(t, conn).(*packets.SubackPacket)
+	assert.True(t, ok)
+
+	assert.Nil(t, packets.NewControlPacket(packets.Disconnect).Encode(conn, packets.Version5))
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// publish while the subscriber is offline
+	pubConn, _ := connectV5(t, nil)
+	defer pubConn.Close()
+	for i, payload := range []string{"dropped", "first", "second"} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 1
+		if payload == "dropped" {
+			pub.Qos = 0
+		}
+		pub.MessageID = uint16(i + 1)
+		pub.TopicName = "persistent/test"
+		pub.Payload = []byte(payload)
+		assert.Nil(t, pub.Encode(pubConn, packets.Version5))
+		if pub.Qos > 0 {
+			_, ok = readPacketV5(t, pubConn).(*packets.PubackPacket)
+			assert.True(t, ok)
+		}
+	}
+
+	conn, connack = dialV5(t, persistent())
+	defer conn.Close()
+	assert.True(t, connack.SessionPresent)
+
+	for _, payload := range []string{"first", "second"} {
+		pub, ok := readPacketV5(t, conn).(*packets.PublishPacket)
+		if assert.True(t, ok) {
+			assert.Equal(t, payload, string(pub.Payload))
+			puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			puback.MessageID = pub.MessageID
+			assert.Nil(t, puback.Encode(conn, packets.Version5))
+		}
+	}
+
+	// the restored subscription receives new messages as well
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "persistent/test"
+	pub.Payload = []byte("online")
+	assert.Nil(t, pub.Encode(pubConn, packets.Version5))
+	received, ok := readPacketV5(t, conn).(*packets.PublishPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, "online", string(received.Payload))
+	}
+
+	// the subscriptions of the previous connection are replaced
+	var subs []interface{}
+	var qoss []byte
+	assert.Nil(t, testBroker.topicsMgr.Subscribers([]byte("persistent/test"), 1, &subs, &qoss))
+	online, _ := testBroker.clients.Load("persistent-session")
+	if assert.Len(t, subs, 1) {
+		assert.True(t, subs[0].(*subscription).client == online)
+	}
+
+	// a clean session discards the stored one, it does not expire
+	hook := &expiryHook{expired: make(chan string, 10)}
+	testBroker.AddHook(hook)
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	clean := persistent()
+	clean.CleanSession = true
+	conn, connack = dialV5(t, clean)
+	assert.False(t, connack.SessionPresent)
+	select {
+	case id := <-hook.expired:
+		t.Fatalf("session %s expired", id)
+	default:
+	}
+	assert.Nil(t, packets.NewControlPacket(packets.Disconnect).Encode(conn, packets.Version5))
+	conn.Close()
+}
+
+func TestBrokerDeliveryPacketIds(t *testing.T) {
+	conn, _ := connectV5(t, nil)
+	defer conn.Close()
+
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{"delivery/qos0", "delivery/qos2"}
+	sub.Qoss = []byte{0, 2}
+	assert.Nil(t, sub.Encode(conn, packets.Version5))
+	_, ok := readPacketV5(t, conn).(*packets.SubackPacket)
+	assert.True(t, ok)
+
+	// both publishers use the same packet identifier
+	pubConn1, _ := connectV5(t, nil)
+	defer pubConn1.Close()
+	pubConn2, _ := connectV5(t, nil)
+	defer pubConn2.Close()
+
+	publish := func(pubConn net.Conn, topic string) {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 1
+		pub.MessageID = 10
+		pub.TopicName = topic
+		pub.Payload = []byte(defaultPacketPayload)
+		assert.Nil(t, pub.Encode(pubConn, packets.Version5))
+		_, ok := readPacketV5(t, pubConn).(*packets.PubackPacket)
+		assert.True(t, ok)
+	}
+	publish(pubConn1, "delivery/qos0")
+	publish(pubConn1, "delivery/qos2")
+	publish(pubConn2, "delivery/qos2")
+
+	received, ok := readPacketV5(t, conn).(*packets.PublishPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, "delivery/qos0", received.TopicName)
+		assert.Equal(t, byte(0), received.Qos)
+	}
+
+	ids := make(map[uint16]bool)
+	for i := 0; i < 2; i++ {
+		received, ok = readPacketV5(t, conn).(*packets.PublishPacket)
+		if assert.True(t, ok) {
+			assert.Equal(t, byte(1), received.Qos)
+			assert.NotZero(t, received.MessageID)
+			ids[received.MessageID] = true
+
+			puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			puback.MessageID = received.MessageID
+			assert.Nil(t, puback.Encode(conn, packets.Version5))
+		}
+	}
+	assert.Len(t, ids, 2)
+}
+
+func TestBrokerSharedSubscriptionGroups(t *testing.T) {
+	var members []net.Conn
+	for _, group := range []string{"g1", "g1", "g2", "g2"} {
+		conn, _ := connectV5(t, nil)
+		defer conn.Close()
+
+		sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		sub.MessageID = 1
+		sub.Topics = []string{"$share/" + group + "/shared/test"}
+		sub.Qoss = []byte{0}
+		assert.Nil(t, sub.Encode(conn, packets.Version5))
+		_, ok := readPacketV5(t, conn).(*packets.SubackPacket)
+		assert.True(t, ok)
+		members = append(members, conn)
+	}
+
+	pubConn, _ := connectV5(t, nil)
+	defer pubConn.Close()
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "shared/test"
+	pub.Payload = []byte(defaultPacketPayload)
+	assert.Nil(t, pub.Encode(pubConn, packets.Version5))
+
+	received := make([]int, len(members))
+	for i, conn := range members {
+		_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if _, err := packets.ReadPacketVersion(conn, packets.Version5); err == nil {
+			received[i]++
+		}
+	}
+	assert.Equal(t, 1, received[0]+received[1], "group g1")
+	assert.Equal(t, 1, received[2]+received[3], "group g2")
+}
+
+func TestShareDispatcherStrategies(t *testing.T) {
+	newSub := func(clientID string, inflight int) *subscription {
+		c := &client{status: Connected, info: info{clientID: clientID}, inflight: make(map[uint16]*inflightElem)}
+		for i := 0; i < inflight; i++ {
+			c.inflight[uint16(i+1)] = &inflightElem{}
+		}
+		return &subscription{client: c, topic: "a/b", share: true, groupName: "g"}
+	}
+	subs := []*subscription{newSub("c1", 2), newSub("c2", 0), newSub("c3", 1)}
+
+	d := newShareDispatcher(SharedInfo{Strategy: ShareRoundRobin, Groups: map[string]string{}})
+	var picked []string
+	for i := 0; i < 4; i++ {
+		picked = append(picked, d.pick("g/a/b", subs, "publisher").client.info.clientID)
+	}
+	assert.Equal(t, []string{"c1", "c2", "c3", "c1"}, picked)
+
+	d.strategy = ShareLeastInflight
+	assert.Equal(t, "c2", d.pick("g/a/b", subs, "publisher").client.info.clientID)
+
+	d.strategy = ShareHash
+	first := d.pick("g/a/b", subs, "publisher")
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, d.pick("g/a/b", []*subscription{subs[2], subs[0], subs[1]}, "publisher"))
+	}
+
+	d.strategy = ShareSticky
+	first = d.pick("g/a/b", subs, "publisher")
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, d.pick("g/a/b", subs, "other"))
+	}
+	first.client.status = Disconnected
+	assert.NotEqual(t, first, d.pick("g/a/b", subs, "publisher"))
+	first.client.status = Connected
+
+	// the state of a group is kept until its last member leaves
+	d.join("g/a/b")
+	d.join("g/a/b")
+	d.leave("g/a/b")
+	assert.Contains(t, d.sticky, "g/a/b")
+	d.leave("g/a/b")
+	assert.NotContains(t, d.sticky, "g/a/b")
+	assert.NotContains(t, d.next, "g/a/b")
+	assert.Empty(t, d.members)
+
+	// the strategy can be set per group
+	d = newShareDispatcher(SharedInfo{Strategy: ShareRandom, Groups: map[string]string{"g": ShareLeastInflight}})
+	assert.Equal(t, "c2", d.pick("g/a/b", subs[:2], "publisher").client.info.clientID)
+}
+
+func TestBrokerSysStats(t *testing.T) {
+	conn, _ := connectV5(t, nil)
+	defer conn.Close()
+
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{"+/broker/version", "$SYS/broker/version"}
+	sub.Qoss = []byte{0, 0}
+	assert.Nil(t, sub.Encode(conn, packets.Version5))
+	_, ok := readPacketV5(t, conn).(*packets.SubackPacket)
+	assert.True(t, ok)
+
+	// only the subscription starting with $SYS matches the retained version
+	received, ok := readPacketV5(t, conn).(*packets.PublishPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, "$SYS/broker/version", received.TopicName)
+		assert.Equal(t, Version, string(received.Payload))
+		assert.True(t, received.Retain)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, err := packets.ReadPacketVersion(conn, packets.Version5)
+	assert.NotNil(t, err)
+
+	// clients may not publish to the $SYS tree
+	pubConn, _ := connectV5(t, nil)
+	defer pubConn.Close()
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.MessageID = 1
+	pub.TopicName = "$SYS/broker/version"
+	pub.Payload = []byte("fake")
+	assert.Nil(t, pub.Encode(pubConn, packets.Version5))
+	puback, ok := readPacketV5(t, pubConn).(*packets.PubackPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, packets.ReasonNotAuthorized, puback.ReasonCode)
+	}
+}
+
+func TestOutQueuePolicies(t *testing.T) {
+	publish := func(qos byte, topic string) *packets.PublishPacket {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.Qos = qos
+		p.TopicName = topic
+		return p
+	}
+
+	q := newOutQueue(OutboundInfo{QueueSize: 2, Policy: SlowConsumerDropQos0})
+	for _, topic := range []string{"a", "b"} {
+		dropped, err := q.push(publish(0, topic))
+		assert.Nil(t, err)
+		assert.Zero(t, dropped)
+	}
+	dropped, err := q.push(publish(1, "c"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dropped)
+	p, _ := q.pop()
+	assert.Equal(t, "b", p.(*packets.PublishPacket).TopicName)
+	p, _ = q.pop()
+	assert.Equal(t, "c", p.(*packets.PublishPacket).TopicName)
+
+	// a queue without QoS 0 messages can not make room
+	_, _ = q.push(publish(1, "d"))
+	_, _ = q.push(publish(1, "e"))
+	dropped, err = q.push(publish(0, "f"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dropped)
+	_, err = q.push(publish(1, "g"))
+	assert.Equal(t, errSlowConsumer, err)
+
+	q = newOutQueue(OutboundInfo{QueueSize: 1, Policy: SlowConsumerDisconnect})
+	_, _ = q.push(publish(0, "a"))
+	_, err = q.push(publish(0, "b"))
+	assert.Equal(t, errSlowConsumer, err)
+
+	// a blocked producer continues once the writer makes room
+	q = newOutQueue(OutboundInfo{QueueSize: 1, WriteTimeout: 5, Policy: SlowConsumerBlock})
+	q.start()
+	_, _ = q.push(publish(0, "a"))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = q.pop()
+	}()
+	_, err = q.push(publish(0, "b"))
+	assert.Nil(t, err)
+	p, _ = q.pop()
+	assert.Equal(t, "b", p.(*packets.PublishPacket).TopicName)
+}
+
+func TestBrokerEmbeddedPubSub(t *testing.T) {
+	assert.Nil(t, testBroker.Publish("embedded/retained", []byte("kept"), 1, true))
+
+	received := make(chan string, 10)
+	unsubscribe, err := testBroker.Subscribe("embedded/#", 0, func(topic string, payload []byte, qos byte, retained bool) {
+		assert.Equal(t, byte(0), qos)
+		received <- fmt.Sprintf("%s %s %v", topic, payload, retained)
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	next := func() string {
+		select {
+		case msg := <-received:
+			return msg
+		case <-time.After(5 * time.Second):
+			return "timeout"
+		}
+	}
+	assert.Equal(t, "embedded/retained kept true", next())
+
+	// messages of network clients reach the in-process subscriber
+	conn, _ := connectV5(t, nil)
+	defer conn.Close()
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.MessageID = 1
+	pub.TopicName = "embedded/device"
+	pub.Payload = []byte("telemetry")
+	assert.Nil(t, pub.Encode(conn, packets.Version5))
+	_, ok := readPacketV5(t, conn).(*packets.PubackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, "embedded/device telemetry false", next())
+
+	// and the messages published in process reach network clients
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 2
+	sub.Topics = []string{"embedded/command"}
+	sub.Qoss = []byte{1}
+	assert.Nil(t, sub.Encode(conn, packets.Version5))
+	_, ok = readPacketV5(t, conn).(*packets.SubackPacket)
+	assert.True(t, ok)
+	assert.Nil(t, testBroker.Publish("embedded/command", []byte("reboot"), 1, false))
+	msg, ok := readPacketV5(t, conn).(*packets.PublishPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, "reboot", string(msg.Payload))
+		assert.Equal(t, byte(1), msg.Qos)
+	}
+	assert.Equal(t, "embedded/command reboot false", next())
+
+	unsubscribe()
+	assert.Nil(t, testBroker.Publish("embedded/after", []byte("gone"), 0, false))
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected message after unsubscribe: %s", msg)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	assert.NotNil(t, testBroker.Publish("embedded/+", nil, 0, false))
+	assert.Nil(t, testBroker.Publish("embedded/retained", nil, 0, true))
+}
+
+// testHook changes the traffic of clients with an identifier starting with
+// "hooked"
+type testHook struct {
+	HookBase
+	disconnected chan string
+}
+
+func (h *testHook) OnConnect(client ClientInfo, connect *packets.ConnectPacket) byte {
+	switch connect.ClientIdentifier {
+	case "hooked-banned":
+		return packets.ReasonBanned
+	case "hooked-rename":
+		connect.ClientIdentifier = "hooked-renamed"
+	}
+	return packets.Accepted
+}
+
+func (h *testHook) OnPublish(client ClientInfo, packet *packets.PublishPacket) bool {
+	if !strings.HasPrefix(client.ClientID, "hooked") {
+		return true
+	}
+	if packet.TopicName == "hooks/drop" {
+		return false
+	}
+	packet.TopicName = "hooks/" + client.ClientID + "/" + strings.TrimPrefix(packet.TopicName, "hooks/")
+	return true
+}
+
+func (h *testHook) OnSubscribe(client ClientInfo, sub *SubscriptionRequest) byte {
+	if !strings.HasPrefix(client.ClientID, "hooked") {
+		return packets.ReasonSuccess
+	}
+	if sub.Filter == "hooks/forbidden" {
+		return packets.ReasonTopicFilterInvalid
+	}
+	sub.Qos = 0
+	return packets.ReasonSuccess
+}
+
+func (h *testHook) OnDeliver(client ClientInfo, packet *packets.PublishPacket) bool {
+	if strings.HasPrefix(client.ClientID, "hooked") {
+		packet.Payload = append([]byte("delivered "), packet.Payload...)
+	}
+	return true
+}
+
+func (h *testHook) OnDisconnect(client ClientInfo) {
+	if strings.HasPrefix(client.ClientID, "hooked") {
+		h.disconnected <- client.ClientID
+	}
+}
+
+func TestBrokerHooks(t *testing.T) {
+	hook := &testHook{disconnected: make(chan string, 10)}
+	testBroker.AddHook(hook)
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.CleanSession = true
+	connect.ClientIdentifier = "hooked-banned"
+	conn, connack := dialV5(t, connect)
+	conn.Close()
+	assert.Equal(t, packets.ReasonBanned, connack.ReturnCode)
+
+	connect = packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.CleanSession = true
+	connect.ClientIdentifier = "hooked-rename"
+	conn, connack = dialV5(t, connect)
+	assert.Equal(t, byte(packets.Accepted), connack.ReturnCode)
+	if assert.NotNil(t, connack.Properties) {
+		assert.Equal(t, "hooked-renamed", connack.Properties.AssignedClientID)
+	}
+
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{"hooks/#", "hooks/forbidden"}
+	sub.Qoss = []byte{1, 1}
+	assert.Nil(t, sub.Encode(conn, packets.Version5))
+	suback, ok := readPacketV5(t, conn).(*packets.SubackPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, []byte{0, packets.ReasonTopicFilterInvalid}, suback.ReturnCodes)
+	}
+
+	for _, topic := range []string{"hooks/drop", "hooks/kept"} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = topic
+		pub.Payload = []byte("payload")
+		assert.Nil(t, pub.Encode(conn, packets.Version5))
+	}
+	msg, ok := readPacketV5(t, conn).(*packets.PublishPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, "hooks/hooked-renamed/kept", msg.TopicName)
+		assert.Equal(t, "delivered payload", string(msg.Payload))
+	}
+
+	conn.Close()
+	select {
+	case id := <-hook.disconnected:
+		assert.Equal(t, "hooked-renamed", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnDisconnect not called")
+	}
+}
+
+// rewriteHook moves the topics and filters of rewrite/ to secret/
+type rewriteHook struct {
+	HookBase
+}
+
+func (rewriteHook) OnPublish(client ClientInfo, packet *packets.PublishPacket) bool {
+	packet.TopicName = strings.Replace(packet.TopicName, "rewrite/", "secret/", 1)
+	return true
+}
+
+func (rewriteHook) OnSubscribe(client ClientInfo, sub *SubscriptionRequest) byte {
+	sub.Filter = strings.Replace(sub.Filter, "rewrite/", "secret/", 1)
+	return packets.ReasonSuccess
+}
+
+// secretAuth denies the topics of secret/
+type secretAuth struct{}
+
+func (secretAuth) CheckConnect(clientID, username, password string) bool { return true }
+func (secretAuth) CheckACL(action, clientID, username, ip, topic string) bool {
+	return !strings.HasPrefix(topic, "secret/")
+}
+
+func TestBrokerHooksBeforeACL(t *testing.T) {
+	b := newTestBroker(t, func(config *Config) {
+		config.Plugin.Auth = secretAuth{}
+		config.Listeners = []ListenerInfo{{Protocol: ListenerTCP, Address: "127.0.0.1:18836"}}
+	})
+	b.AddHook(rewriteHook{})
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", "127.0.0.1:18836"); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.CleanSession = true
+	conn, _ := dialV5Addr(t, "127.0.0.1:18836", connect)
+	defer conn.Close()
+
+	// the filters and topics rewritten by the hook are checked
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{"rewrite/#", "public/#"}
+	sub.Qoss = []byte{1, 1}
+	assert.Nil(t, sub.Encode(conn, packets.Version5))
+	suback, ok := readPacketV5(t, conn).(*packets.SubackPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, []byte{packets.ReasonNotAuthorized, 1}, suback.ReturnCodes)
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "rewrite/data"
+	pub.Qos = 1
+	pub.MessageID = 2
+	pub.Payload = []byte("payload")
+	assert.Nil(t, pub.Encode(conn, packets.Version5))
+	puback, ok := readPacketV5(t, conn).(*packets.PubackPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, packets.ReasonNotAuthorized, puback.ReasonCode)
+	}
+}
+
+func TestBrokerListeners(t *testing.T) {
+	var listeners []*listener
+	for _, info := range []ListenerInfo{
+		{Protocol: ListenerTCP, Address: "127.0.0.1:18831", Mountpoint: "tenant1/", MaxConnections: 1},
+		{Protocol: ListenerTCP, Address: "127.0.0.1:18832"},
+	} {
+		l, err := newListener(info, testBroker.auth, auth.Config{})
+		if !assert.Nil(t, err) {
+			return
+		}
+		go testBroker.serveListener(l)
+		listeners = append(listeners, l)
+	}
+
+	connect := func(addr string) (net.Conn, *packets.ConnackPacket) {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 50; i++ {
+			if conn, err = net.Dial("tcp", addr); err == nil {
+				conn.Close()
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		// wait for the probe to be released from the connection limit
+		for i := 0; i < 50 && atomic.LoadInt64(&listeners[0].conns) > 0; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		c := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		c.CleanSession = true
+		return dialV5Addr(t, addr, c)
+	}
+
+	mounted, _ := connect("127.0.0.1:18831")
+	defer mounted.Close()
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{"data"}
+	sub.Qoss = []byte{0}
+	assert.Nil(t, sub.Encode(mounted, packets.Version5))
+	_, ok := readPacketV5(t, mounted).(*packets.SubackPacket)
+	assert.True(t, ok)
+
+	// the mounted listener allows a single connection
+	refused := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	refused.CleanSession = true
+	conn, connack := dialV5Addr(t, "127.0.0.1:18831", refused)
+	if assert.NotNil(t, connack) {
+		assert.Equal(t, packets.ReasonServerBusy, connack.ReturnCode)
+		conn.Close()
+	}
+
+	plain, _ := connect("127.0.0.1:18832")
+	defer plain.Close()
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "tenant1/data"
+	pub.Payload = []byte(defaultPacketPayload)
+	assert.Nil(t, pub.Encode(plain, packets.Version5))
+
+	msg, ok := readPacketV5(t, mounted).(*packets.PublishPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, "data", msg.TopicName)
+		assert.Equal(t, defaultPacketPayload, string(msg.Payload))
+	}
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v2 := append([]byte{}, proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 203, 0, 113, 7, 10, 0, 0, 1, 0x13, 0x88, 0x07, 0x5b)
+
+	for name, tt := range map[string]struct {
+		header string
+		remote string
+		err    bool
+	}{
+		"v1 tcp4":    {header: "PROXY TCP4 192.0.2.1 10.0.0.1 5000 1883\r\n", remote: "192.0.2.1:5000"},
+		"v1 tcp6":    {header: "PROXY TCP6 2001:db8::1 ::1 5000 1883\r\n", remote: "[2001:db8::1]:5000"},
+		"v1 unknown": {header: "PROXY UNKNOWN\r\n", remote: "pipe"},
+		"v1 broken":  {header: "PROXY TCP4 192.0.2.1\r\n", err: true},
+		"v2 tcp4":    {header: string(v2), remote: "203.0.113.7:5000"},
+		"missing":    {header: "\x10\x0c\x00\x04MQTT\x04\x02\x00\x3c\x00\x00", err: true},
+	} {
+		server, client := net.Pipe()
+		go func() {
+			_, _ = client.Write([]byte(tt.header + "after"))
+		}()
+		conn, err := readProxyHeader(server)
+		if tt.err {
+			assert.NotNil(t, err, name)
+		} else if assert.Nil(t, err, name) {
+			assert.Equal(t, tt.remote, conn.RemoteAddr().String(), name)
+			rest := make([]byte, 5)
+			_, err = io.ReadFull(conn, rest)
+			assert.Nil(t, err, name)
+			assert.Equal(t, "after", string(rest), name)
+		}
+		server.Close()
+		client.Close()
+	}
+
+	l, err := newListener(ListenerInfo{Protocol: ListenerTCP, Address: "127.0.0.1:0", ProxyProtocol: true, ProxyTrustedCIDRs: []string{"10.0.0.0/8"}}, nil, auth.Config{})
+	if assert.Nil(t, err) {
+		assert.True(t, l.trusted(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+		assert.False(t, l.trusted(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}))
+	}
+	_, err = newListener(ListenerInfo{Protocol: ListenerWS, Address: ":0", ProxyProtocol: true}, nil, auth.Config{})
+	assert.NotNil(t, err)
+	// every source has to be trusted explicitly
+	_, err = newListener(ListenerInfo{Protocol: ListenerTCP, Address: ":0", ProxyProtocol: true}, nil, auth.Config{})
+	assert.NotNil(t, err)
+}
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(AdmissionInfo{MaxConnections: 2, ConnectionRate: 1, ConnectionBurst: 2})
+	assert.True(t, a.admit())
+	assert.True(t, a.admit())
+	assert.False(t, a.admit())
+	a.release()
+	assert.True(t, a.admit())
+
+	now := time.Now()
+	assert.True(t, a.allow("192.0.2.1", now))
+	assert.True(t, a.allow("192.0.2.1", now))
+	assert.False(t, a.allow("192.0.2.1", now))
+	assert.True(t, a.allow("192.0.2.2", now))
+	assert.True(t, a.allow("192.0.2.1", now.Add(time.Second)))
+	assert.False(t, a.allow("192.0.2.1", now.Add(time.Second)))
+
+	// full buckets are swept
+	assert.True(t, a.allow("192.0.2.3", now.Add(2*bucketSweepInterval)))
+	assert.Len(t, a.buckets, 1)
+
+	unlimited := newAdmission(AdmissionInfo{})
+	for i := 0; i < 100; i++ {
+		assert.True(t, unlimited.admit())
+		assert.True(t, unlimited.allow("192.0.2.1", now))
+	}
+
+	// refused connections are read with the packet size limit
+	b := newTestBroker(t, func(config *Config) {
+		config.MaxPacketSize = 64
+	})
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go b.refuse(server, packets.ReasonServerBusy)
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName, connect.ProtocolVersion = "MQTT", packets.Version5
+	connect.ClientIdentifier = strings.Repeat("x", 128)
+	_ = connect.Encode(conn, packets.Version5)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestBrokerConnectTimeoutAndPacketLimit(t *testing.T) {
+	var err error
+	newTestBroker(t, func(config *Config) {
+		config.ConnectTimeout, config.MaxPacketSize = 1, 1024
+		config.Listeners = []ListenerInfo{{Protocol: ListenerTCP, Address: "127.0.0.1:18834"}}
+	})
+
+	// connections that never send CONNECT are closed
+	var idle net.Conn
+	for i := 0; i < 50; i++ {
+		if idle, err = net.Dial("tcp", "127.0.0.1:18834"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if assert.Nil(t, err) {
+		_ = idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = idle.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+		idle.Close()
+	}
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.CleanSession = true
+	conn, connack := dialV5Addr(t, "127.0.0.1:18834", connect)
+	defer conn.Close()
+	if assert.NotNil(t, connack.Properties) && assert.NotNil(t, connack.Properties.MaximumPacketSize) {
+		assert.Equal(t, uint32(1024), *connack.Properties.MaximumPacketSize)
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "limit/large"
+	pub.Payload = make([]byte, 2048)
+	assert.Nil(t, pub.Encode(conn, packets.Version5))
+
+	disconnect, ok := readPacketV5(t, conn).(*packets.DisconnectPacket)
+	if assert.True(t, ok) {
+		assert.Equal(t, packets.ReasonPacketTooLarge, disconnect.ReasonCode)
+	}
+}
+
+func TestBrokerShutdown(t *testing.T) {
+	b := newTestBroker(t, func(config *Config) {
+		config.Listeners = []ListenerInfo{{Protocol: ListenerTCP, Address: "127.0.0.1:18835"}}
+	})
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", "127.0.0.1:18835"); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var conns []net.Conn
+	for _, id := range []string{"shutdown-clean", "shutdown-persistent"} {
+		connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		connect.ClientIdentifier = id
+		if id == "shutdown-persistent" {
+			connect.Properties = &packets.Properties{SessionExpiryInterval: packets.Uint32Ptr(60)}
+		}
+		conn, connack := dialV5Addr(t, "127.0.0.1:18835", connect)
+		defer conn.Close()
+		assert.Equal(t, packets.ReasonSuccess, connack.ReturnCode)
+
+		sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		sub.MessageID = 1
+		sub.Topics = []string{"shutdown/test"}
+		sub.Qoss = []byte{1}
+		assert.Nil(t, sub.Encode(conn, packets.Version5))
+		_, ok := readPacketV5(t, conn).(*packets.SubackPacket)
+		assert.True(t, ok)
+		conns = append(conns, conn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, b.Shutdown(ctx))
+
+	// the clients are told why they are disconnected
+	for _, conn := range conns {
+		disconnect, ok := readPacketV5(t, conn).(*packets.DisconnectPacket)
+		if assert.True(t, ok) {
+			assert.Equal(t, packets.ReasonServerShuttingDown, disconnect.ReasonCode)
+		}
+		_, err := conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	}
+	b.clients.Range(func(key, value interface{}) bool {
+		t.Errorf("client %v not closed", key)
+		return true
+	})
+	_, ok := b.offlineClients.Load("shutdown-persistent")
+	assert.True(t, ok)
+	b.mu.Lock()
+	assert.Len(t, b.readers, 0)
+	assert.False(t, b.started)
+	b.mu.Unlock()
+
+	_, err := net.Dial("tcp", "127.0.0.1:18835")
+	assert.NotNil(t, err)
+	assert.Nil(t, b.Shutdown(ctx))
+}
+
+func TestBrokerRestart(t *testing.T) {
+	first := newTestBroker(t, nil)
+	assert.Nil(t, first.Publish("restart/test", []byte("first"), 0, true))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, first.Shutdown(ctx))
+
+	// a broker created after another one shut down does not share its state
+	b := newTestBroker(t, nil)
+	received := make(chan string, 2)
+	unsubscribe, err := b.Subscribe("restart/#", 0, func(topic string, payload []byte, qos byte, retained bool) {
+		received <- string(payload)
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer unsubscribe()
+	assert.Nil(t, b.Publish("restart/test", []byte("second"), 0, true))
+	select {
+	case payload := <-received:
+		assert.Equal(t, "second", payload)
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+type limitedAuth struct {
+	limits map[string]auth.Limits
+}
+
+func (a *limitedAuth) CheckACL(action, clientID, username, ip, topic string) bool { return true }
+func (a *limitedAuth) CheckConnect(clientID, username, password string) bool      { return true }
+func (a *limitedAuth) Limits(clientID, username string) (auth.Limits, bool) {
+	l, ok := a.limits[username]
+	return l, ok
+}
+
+func TestPublishLimits(t *testing.T) {
+	now := time.Now()
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = "a"
+	packet.Payload = make([]byte, 9)
+
+	throttle := &publishLimits{policy: PublishThrottle}
+	throttle.add(newRateBucket(2, 2, now), newRateBucket(100, 0, now))
+	for i := 0; i < 2; i++ {
+		wait, reason := throttle.take(packet, now)
+		assert.Equal(t, time.Duration(0), wait)
+		assert.Equal(t, byte(0), reason)
+	}
+	wait, _ := throttle.take(packet, now)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	for i := 0; i < 5; i++ {
+		wait, _ = throttle.take(packet, now)
+	}
+	assert.Equal(t, time.Second, wait, "the debt is capped at one burst")
+
+	disconnect := &publishLimits{policy: PublishDisconnect}
+	disconnect.add(nil, newRateBucket(10, 20, now))
+	_, reason := disconnect.take(packet, now)
+	assert.Equal(t, byte(0), reason)
+	_, reason = disconnect.take(packet, now)
+	assert.Equal(t, byte(0), reason)
+	_, reason = disconnect.take(packet, now)
+	assert.Equal(t, packets.ReasonQuotaExceeded, reason)
+	_, reason = disconnect.take(packet, now.Add(time.Second))
+	assert.Equal(t, byte(0), reason)
+
+	ul := &userLimits{users: make(map[string]*userBuckets)}
+	m1, _ := ul.acquire("user", auth.Limits{MessageRate: 1}, now)
+	m2, b2 := ul.acquire("user", auth.Limits{MessageRate: 5}, now)
+	assert.True(t, m1 == m2)
+	assert.Nil(t, b2)
+	assert.Equal(t, float64(5), m1.rate)
+	// a client without a message rate keeps the bucket of the others
+	m3, b3 := ul.acquire("user", auth.Limits{ByteRate: 100}, now)
+	assert.True(t, m1 == m3)
+	assert.Equal(t, float64(5), m3.rate)
+	assert.Equal(t, float64(100), b3.rate)
+	ul.release("user")
+	ul.release("user")
+	ul.release("user")
+	assert.Len(t, ul.users, 0)
+
+	// limits of the auth plugin replace the configured ones
+	b := newTestBroker(t, func(config *Config) {
+		config.PublishLimits = PublishLimitsInfo{Client: auth.Limits{MessageRate: 10}, Policy: PublishThrottle}
+	})
+	a := &limitedAuth{limits: map[string]auth.Limits{"vip": {MessageRate: 100, ByteRate: 1000}}}
+	c := &client{broker: b, info: info{clientID: "c1", username: "vip"}}
+	pl := b.publishLimits(a, c)
+	if assert.NotNil(t, pl) && assert.Len(t, pl.messages, 2) {
+		assert.Equal(t, float64(100), pl.messages[0].rate)
+		assert.Len(t, pl.bytes, 2)
+		assert.True(t, c.limitedUser)
+		b.userLimits.release("vip")
+	}
+	c = &client{broker: b, info: info{clientID: "c2", username: "other"}}
+	pl = b.publishLimits(a, c)
+	if assert.NotNil(t, pl) {
+		assert.Len(t, pl.messages, 1)
+		assert.Len(t, pl.bytes, 0)
+		assert.False(t, c.limitedUser)
+	}
+
+	// a throttled client stops waiting when the broker shuts down
+	c = &client{broker: b, ctx: context.Background(), limits: &publishLimits{policy: PublishThrottle}}
+	c.limits.add(newRateBucket(0.01, 1, time.Now()), nil)
+	throttled := make(chan bool)
+	go func() {
+		throttled <- c.limitPublish(packet) && c.limitPublish(packet)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, b.Shutdown(ctx))
+	select {
+	case ok := <-throttled:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("throttled client not woken by shutdown")
+	}
+}
+
+func TestInflightWindowAndDeadLetter(t *testing.T) {
+	b := newTestBroker(t, func(config *Config) {
+		config.Delivery = DeliveryInfo{RetryInterval: 10, MaxRetryInterval: 30, MaxRetries: 1, DeadLetterTopic: "inflight/dead"}
+	})
+
+	dead := make(chan string, 1)
+	unsubscribe, err := b.Subscribe("inflight/dead", 1, func(topic string, payload []byte, qos byte, retained bool) {
+		dead <- string(payload)
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer unsubscribe()
+
+	server, conn := net.Pipe()
+	defer conn.Close()
+	received := make(chan *packets.PublishPacket, 10)
+	go func() {
+		for {
+			p, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			received <- p.(*packets.PublishPacket)
+		}
+	}()
+
+	c := &client{typ: CLIENT, broker: b, conn: server, info: info{clientID: "inflight", protocolVersion: packets.Version311, receiveMaximum: 2}}
+	c.inflight = make(map[uint16]*inflightElem)
+	defer func() {
+		c.resetRetryTimer()
+		c.conn = nil
+	}()
+
+	for i := 0; i < 4; i++ {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = "inflight/data"
+		p.Qos = 1
+		p.Payload = []byte(strconv.Itoa(i))
+		c.deliver(p)
+	}
+	next := func() *packets.PublishPacket {
+		select {
+		case p := <-received:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for publish")
+			return nil
+		}
+	}
+	first, second := next(), next()
+	assert.Equal(t, "0", string(first.Payload))
+	assert.Equal(t, "1", string(second.Payload))
+	c.inflightMu.RLock()
+	assert.Len(t, c.pending, 2)
+	c.inflightMu.RUnlock()
+
+	assert.True(t, c.ackInflight(first.MessageID))
+	assert.Equal(t, "2", string(next().Payload))
+
+	// the unacknowledged message is sent again once, then given up
+	age := func() {
+		c.inflightMu.Lock()
+		c.inflight[second.MessageID].timestamp -= 1000
+		c.inflightMu.Unlock()
+	}
+	age()
+	c.retryDelivery()
+	retried := next()
+	assert.True(t, retried.Dup)
+	assert.Equal(t, "1", string(retried.Payload))
+
+	age()
+	c.retryDelivery()
+	select {
+	case payload := <-dead:
+		var dl deadLetter
+		if assert.Nil(t, json.Unmarshal([]byte(payload), &dl)) {
+			assert.Equal(t, "inflight", dl.ClientID)
+			assert.Equal(t, "inflight/data", dl.Topic)
+			assert.Equal(t, byte(1), dl.Qos)
+			assert.Equal(t, 1, dl.Retries)
+			assert.Equal(t, "1", string(dl.Payload))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dead letter")
+	}
+	third := next()
+	assert.Equal(t, "3", string(third.Payload))
+
+	// MQTT 5.0 clients only get messages again when they reconnect
+	c.info.protocolVersion = packets.Version5
+	c.inflightMu.Lock()
+	c.inflight[third.MessageID].timestamp -= 1000
+	c.inflightMu.Unlock()
+	c.retryDelivery()
+	select {
+	case p := <-received:
+		t.Fatalf("unexpected resend of %q", p.Payload)
+	case <-time.After(300 * time.Millisecond):
+	}
+	c.inflightMu.Lock()
+	c.inflight[third.MessageID].timestamp -= 1000
+	c.inflightMu.Unlock()
+	c.retryDelivery()
+	select {
+	case payload := <-dead:
+		var dl deadLetter
+		if assert.Nil(t, json.Unmarshal([]byte(payload), &dl)) {
+			assert.Equal(t, "3", string(dl.Payload))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dead letter")
+	}
+}
+
+func TestOversizedDelivery(t *testing.T) {
+	b := newTestBroker(t, nil)
+	server, conn := net.Pipe()
+	defer conn.Close()
+	received := make(chan *packets.PublishPacket, 10)
+	go func() {
+		for {
+			p, err := packets.ReadPacketVersion(conn, packets.Version5)
+			if err != nil {
+				return
+			}
+			received <- p.(*packets.PublishPacket)
+		}
+	}()
+
+	c := &client{typ: CLIENT, broker: b, conn: server, info: info{clientID: "oversized", protocolVersion: packets.Version5, receiveMaximum: 1, maxPacketSize: 64}}
+	c.inflight = make(map[uint16]*inflightElem)
+	c.out = newOutQueue(b.config.Outbound)
+	c.startWriter()
+	defer func() {
+		c.resetRetryTimer()
+		c.out.discard()
+	}()
+
+	dropped := atomic.LoadUint64(&b.stats.publishDropped)
+	for _, payload := range []string{strings.Repeat("x", 128), "small"} {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = "oversized/data"
+		p.Qos = 1
+		p.Payload = []byte(payload)
+		b.wpool.Submit(c.info.clientID, func() {
+			c.deliver(p)
+		})
+	}
+
+	// the oversized message leaves the inflight window to the next one
+	select {
+	case p := <-received:
+		assert.Equal(t, "small", string(p.Payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for publish")
+	}
+	assert.Nil(t, b.wpool.Drain(context.Background()))
+	c.inflightMu.RLock()
+	assert.Len(t, c.inflight, 1)
+	assert.Len(t, c.pending, 0)
+	c.inflightMu.RUnlock()
+	assert.Equal(t, dropped+1, atomic.LoadUint64(&b.stats.publishDropped))
+}
+
+func TestMessageExpiry(t *testing.T) {
+	b := newTestBroker(t, func(config *Config) {
+		config.MessageExpiry.Topics = []TopicExpiry{{Topic: "expiry/+/short", Expiry: 5}, {Topic: "expiry/#", Expiry: 60}}
+	})
+
+	now := time.Now()
+	newPublish := func(topic string, qos byte, payload string) *packets.PublishPacket {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = topic
+		p.Qos = qos
+		p.Payload = []byte(payload)
+		return p
+	}
+
+	// the message expiry interval comes first, then the first matching topic
+	v5 := newPublish("expiry/a/short", 1, "v5")
+	v5.Properties = &packets.Properties{MessageExpiry: packets.Uint32Ptr(30)}
+	b.setExpiry(v5, now)
+	assert.Equal(t, now.Add(30*time.Second), v5.Expiry)
+	short := newPublish("expiry/a/short", 1, "short")
+	b.setExpiry(short, now)
+	assert.Equal(t, now.Add(5*time.Second), short.Expiry)
+	long := newPublish("expiry/b", 1, "long")
+	b.setExpiry(long, now)
+	assert.Equal(t, now.Add(60*time.Second), long.Expiry)
+	never := newPublish("other", 1, "never")
+	b.setExpiry(never, now)
+	assert.True(t, never.Expiry.IsZero())
+
+	// the interval sent on is the time left, rounded up
+	p := remainingExpiry(v5, now.Add(10*time.Second+time.Millisecond))
+	assert.Equal(t, uint32(20), *p.Properties.MessageExpiry)
+	assert.Equal(t, uint32(30), *v5.Properties.MessageExpiry)
+
+	// expired retained messages are not returned and are swept
+	retained := newPublish("expiry/retained", 0, "retained")
+	retained.Retain = true
+	retained.Expiry = time.Now().Add(-time.Second)
+	assert.Nil(t, b.topicsMgr.Retain(retained))
+	var rmsgs []*packets.PublishPacket
+	assert.Nil(t, b.topicsMgr.Retained([]byte("expiry/#"), &rmsgs))
+	assert.Len(t, rmsgs, 0)
+	assert.Equal(t, []string{"expiry/retained"}, b.topicsMgr.ExpireRetained(time.Now()))
+
+	// expired messages are not delivered to the client
+	server, conn := net.Pipe()
+	defer conn.Close()
+	received := make(chan *packets.PublishPacket, 10)
+	go func() {
+		for {
+			p, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			received <- p.(*packets.PublishPacket)
+		}
+	}()
+
+	c := &client{typ: CLIENT, broker: b, conn: server, info: info{clientID: "expiry", protocolVersion: packets.Version311, receiveMaximum: 1}}
+	c.inflight = make(map[uint16]*inflightElem)
+	defer func() {
+		c.resetRetryTimer()
+		c.conn = nil
+	}()
+
+	expired := newPublish("expiry/data", 1, "expired")
+	expired.Expiry = time.Now().Add(-time.Second)
+	c.deliver(expired)
+	first := newPublish("expiry/data", 1, "first")
+	c.deliver(first)
+	pending := newPublish("expiry/data", 1, "pending")
+	pending.Expiry = time.Now().Add(time.Hour)
+	c.deliver(pending)
+
+	select {
+	case p := <-received:
+		assert.Equal(t, "first", string(p.Payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for publish")
+	}
+
+	// the queued message expires while it waits for the inflight window
+	c.inflightMu.Lock()
+	c.pending[0].Expiry = time.Now().Add(-time.Second)
+	c.inflightMu.Unlock()
+	c.inflightMu.RLock()
+	id := uint16(0)
+	for k := range c.inflight {
+		id = k
+	}
+	c.inflightMu.RUnlock()
+	assert.True(t, c.ackInflight(id))
+	c.inflightMu.RLock()
+	assert.Len(t, c.pending, 0)
+	assert.Len(t, c.inflight, 0)
+	c.inflightMu.RUnlock()
+	select {
+	case p := <-received:
+		t.Fatalf("expired message %q delivered", p.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type expiryHook struct {
+	HookBase
+	expired chan string
+}
+
+func (h *expiryHook) OnSessionExpired(clientID string) {
+	select {
+	case h.expired <- clientID:
+	default:
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	hook := &expiryHook{expired: make(chan string, 10)}
+	testBroker.AddHook(hook)
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ClientIdentifier = "expiring-session"
+	connect.Properties = &packets.Properties{SessionExpiryInterval: packets.Uint32Ptr(30)}
+	conn, connack := dialV5(t, connect)
+	assert.False(t, connack.SessionPresent)
+
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{"expiring/test"}
+	sub.Qoss = []byte{1}
+	assert.Nil(t, sub.Encode(conn, packets.Version5))
+	_, ok := readPacketV5(t, conn).(*packets.SubackPacket)
+	assert.True(t, ok)
+
+	// the client shortens the interval when disconnecting
+	disconnect := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	disconnect.Properties = &packets.Properties{SessionExpiryInterval: packets.Uint32Ptr(10)}
+	assert.Nil(t, disconnect.Encode(conn, packets.Version5))
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	testBroker.reapSessions(time.Now())
+	_, err := testBroker.sessionMgr.Get("expiring-session")
+	assert.Nil(t, err)
+
+	testBroker.reapSessions(time.Now().Add(11 * time.Second))
+	select {
+	case id := <-hook.expired:
+		assert.Equal(t, "expiring-session", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnSessionExpired not called")
+	}
+	_, err = testBroker.sessionMgr.Get("expiring-session")
+	assert.NotNil(t, err)
+	_, ok = testBroker.offlineClients.Load("expiring-session")
+	assert.False(t, ok)
+
+	var subs []interface{}
+	var qoss []byte
+	assert.Nil(t, testBroker.topicsMgr.Subscribers([]byte("expiring/test"), 1, &subs, &qoss))
+	assert.Len(t, subs, 0)
+
+	// an expired session is not resumed
+	connect = packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ClientIdentifier = "expiring-session"
+	connect.Properties = &packets.Properties{SessionExpiryInterval: packets.Uint32Ptr(0)}
+	conn, connack = dialV5(t, connect)
+	assert.False(t, connack.SessionPresent)
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	connect.Properties = nil
+	conn, connack = dialV5(t, connect)
+	defer conn.Close()
+	assert.False(t, connack.SessionPresent)
+}
+
+func TestSessionExpiryV5(t *testing.T) {
+	// without a Session Expiry Interval the session ends with the connection
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ClientIdentifier = "v5-session-ending"
+	conn, _ := dialV5(t, connect)
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	_, err := testBroker.sessionMgr.Get("v5-session-ending")
+	assert.NotNil(t, err)
+	conn, connack := dialV5(t, connect)
+	conn.Close()
+	assert.False(t, connack.SessionPresent)
+
+	// a clean start with an interval keeps the new session after disconnecting
+	connect = packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ClientIdentifier = "v5-session-expiring"
+	connect.CleanSession = true
+	connect.Properties = &packets.Properties{SessionExpiryInterval: packets.Uint32Ptr(60)}
+	conn, _ = dialV5(t, connect)
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	_, ok := testBroker.offlineClients.Load("v5-session-expiring")
+	assert.True(t, ok)
+
+	connect.CleanSession = false
+	connect.Properties = nil
+	conn, connack = dialV5(t, connect)
+	defer conn.Close()
+	assert.True(t, connack.SessionPresent)
+}
+
+func TestWillDelay(t *testing.T) {
+	wills := make(chan string, 10)
+	unsubscribe, err := testBroker.Subscribe("will/#", 1, func(topic string, payload []byte, qos byte, retained bool) {
+		wills <- string(payload)
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer unsubscribe()
+
+	connectWill := func(payload string) net.Conn {
+		connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		connect.ClientIdentifier = "will-delay"
+		connect.Properties = &packets.Properties{SessionExpiryInterval: packets.Uint32Ptr(60)}
+		connect.WillFlag = true
+		connect.WillQos = 1
+		connect.WillTopic = "will/delay"
+		connect.WillMessage = []byte(payload)
+		connect.WillProperties = &packets.Properties{WillDelayInterval: packets.Uint32Ptr(1)}
+		conn, connack := dialV5(t, connect)
+		assert.Equal(t, byte(packets.Accepted), connack.ReturnCode)
+		return conn
+	}
+	noWill := func() {
+		select {
+		case payload := <-wills:
+			t.Fatalf("unexpected will %q", payload)
+		case <-time.After(1500 * time.Millisecond):
+		}
+	}
+
+	// a client reconnecting within the delay cancels its will
+	conn := connectWill("blip")
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	conn = connectWill("takeover")
+	noWill()
+
+	// no will when the connection is taken over by the same client
+	taken := conn
+	conn = connectWill("gone")
+	defer taken.Close()
+	noWill()
+
+	conn.Close()
+	select {
+	case payload := <-wills:
+		assert.Equal(t, "gone", payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("will not published")
+	}
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ClientIdentifier = "will-delay"
+	connect.CleanSession = true
+	conn, _ = dialV5(t, connect)
+	assert.Nil(t, packets.NewControlPacket(packets.Disconnect).Encode(conn, packets.Version5))
+	conn.Close()
+}
+
+type reloadingAuth struct {
+	limitedAuth
+	reloads int
+	err     error
+}
+
+func (a *reloadingAuth) Reload() error {
+	a.reloads++
+	return a.err
+}
+
+func TestReloadAuth(t *testing.T) {
+	shared := &reloadingAuth{}
+	failing := &reloadingAuth{err: errors.New("acl.conf:3: unknown type")}
+	b := &Broker{auth: shared, clientListeners: []*listener{{auth: shared}, {auth: failing}, {auth: &limitedAuth{}}}}
+
+	assert.Equal(t, failing.err, b.ReloadAuth())
+	assert.Equal(t, 1, shared.reloads, "plugins shared by listeners are reloaded once")
+	assert.Equal(t, 1, failing.reloads)
+
+	failing.err = nil
+	assert.Nil(t, b.ReloadAuth())
+}
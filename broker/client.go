@@ -13,14 +13,13 @@ import (
 	"time"
 	"unicode/utf8"
 
-	"github.com/eapache/queue"
-
 	"github.com/habakke/hmq/broker/lib/sessions"
 	"github.com/habakke/hmq/broker/lib/topics"
+	"github.com/habakke/hmq/metrics"
 	"github.com/habakke/hmq/plugins/bridge"
 	"golang.org/x/net/websocket"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/habakke/hmq/broker/lib/packets"
 	"go.uber.org/zap"
 )
 
@@ -47,11 +46,16 @@ const (
 
 const (
 	awaitRelTimeout int64 = 20
-	retryInterval   int64 = 20
 )
 
+// maxTopicAlias is the Topic Alias Maximum announced to MQTT 5.0 clients
+const maxTopicAlias uint16 = 64
+
 var (
 	groupCompile = regexp.MustCompile(_GroupTopicRegexp)
+
+	errAwaitingRelFull = errors.New("DROPPED_QOS2_PACKET_FOR_TOO_MANY_AWAITING_REL")
+	errPacketIdInUse   = errors.New("RC_PACKET_IDENTIFIER_IN_USE")
 )
 
 type client struct {
@@ -74,10 +78,24 @@ type client struct {
 	awaitingRel    map[uint16]int64
 	maxAwaitingRel int
 	inflight       map[uint16]*inflightElem
+	// pending holds the messages waiting for room in the inflight window,
+	// guarded by inflightMu
+	pending        []*packets.PublishPacket
 	inflightMu     sync.RWMutex
-	mqueue         *queue.Queue
+	lastPacketID   uint16
 	retryTimer     *time.Timer
 	retryTimerLock sync.Mutex
+	topicAliases   map[uint16]string
+	out            *outQueue
+	listener       *listener
+	limits         *publishLimits
+	// readLimit is the maximum size of the packets read from the client
+	readLimit int
+	// limitedUser is set when the client holds the limits of its username
+	limitedUser bool
+	// authKept is set when a connection of the same client and username
+	// took over, the auth plugin keeps its state for it. Guarded by mu.
+	authKept bool
 }
 
 type InflightStatus uint8
@@ -91,6 +109,8 @@ type inflightElem struct {
 	status    InflightStatus
 	packet    *packets.PublishPacket
 	timestamp int64
+	// retries is the number of times the packet was sent again
+	retries int
 }
 type subscription struct {
 	client    *client
@@ -98,16 +118,28 @@ type subscription struct {
 	qos       byte
 	share     bool
 	groupName string
+
+	// MQTT 5.0 subscription options
+	noLocal           bool
+	retainAsPublished bool
+	retainHandling    byte
+	identifier        int
 }
 
 type info struct {
-	clientID  string
-	username  string
-	password  []byte
-	keepalive uint16
-	willMsg   *packets.PublishPacket
-	localIP   string
-	remoteIP  string
+	clientID        string
+	username        string
+	password        []byte
+	keepalive       uint16
+	willMsg         *packets.PublishPacket
+	localIP         string
+	remoteIP        string
+	protocolVersion byte
+	maxPacketSize   uint32
+	receiveMaximum  uint16
+	authMethod      string
+	// willDelay is the time in seconds the will message is delayed
+	willDelay uint32
 }
 
 type route struct {
@@ -138,7 +170,9 @@ func (c *client) init() {
 	c.routeSubMap = make(map[string]uint64)
 	c.awaitingRel = make(map[uint16]int64)
 	c.inflight = make(map[uint16]*inflightElem)
-	c.mqueue = queue.New()
+	c.maxAwaitingRel = c.broker.config.Delivery.MaxAwaitingRel
+	c.topicAliases = make(map[uint16]string)
+	c.out = newOutQueue(c.broker.config.Outbound)
 }
 
 func (c *client) readLoop() {
@@ -147,6 +181,14 @@ func (c *client) readLoop() {
 	if nc == nil || b == nil {
 		return
 	}
+	if !b.trackReader(c, nc) {
+		b.SubmitWork(c.info.clientID, &Message{
+			client: c,
+			packet: DisconnectedPacket,
+		})
+		return
+	}
+	defer b.untrackReader(c)
 
 	keepAlive := time.Second * time.Duration(c.info.keepalive)
 	timeOut := keepAlive + (keepAlive / 2)
@@ -168,10 +210,27 @@ func (c *client) readLoop() {
 					return
 				}
 			}
+			// a shutdown after the deadline was set makes the read time out
+			if b.shuttingDown() {
+				return
+			}
 
-			packet, err := packets.ReadPacket(nc)
+			packet, err := packets.ReadPacketLimit(b.stats.reader(nc), c.info.protocolVersion, c.readLimit)
 			if err != nil {
+				// the broker stops reading when shutting down and closes
+				// the client itself
+				if b.shuttingDown() {
+					return
+				}
 				log.Error("read packet error: ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+				if errors.Is(err, packets.ErrPacketTooLarge) {
+					_ = b.metrics.Inc(metrics.MetricNumberOfOversizedPackets)
+					c.sendDisconnect(packets.ReasonPacketTooLarge)
+				} else if errors.Is(err, packets.ErrMalformedPacket) || errors.Is(err, packets.ErrInvalidRemainingSize) {
+					c.sendDisconnect(packets.ReasonMalformedPacket)
+				} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					c.sendDisconnect(packets.ReasonKeepAliveTimeout)
+				}
 				msg := &Message{
 					client: c,
 					packet: DisconnectedPacket,
@@ -179,10 +238,28 @@ func (c *client) readLoop() {
 				b.SubmitWork(c.info.clientID, msg)
 				return
 			}
+			b.stats.received(packet)
+
+			if pub, ok := packet.(*packets.PublishPacket); ok && !c.limitPublish(pub) {
+				if c.ctx.Err() == nil {
+					b.SubmitWork(c.info.clientID, &Message{
+						client: c,
+						packet: DisconnectedPacket,
+					})
+				}
+				return
+			}
 
-			// if packet is disconnect from client, then need to break the read packet loop and clear will msg.
-			if _, isDisconnect := packet.(*packets.DisconnectPacket); isDisconnect {
-				c.info.willMsg = nil
+			// if packet is disconnect from client, then need to break the read packet loop and clear will msg,
+			// unless an MQTT 5.0 client explicitly asks for the will message to be published.
+			if dp, isDisconnect := packet.(*packets.DisconnectPacket); isDisconnect {
+				if dp.ReasonCode != packets.ReasonDisconnectWithWillMessage {
+					c.discardWill()
+				}
+				// an MQTT 5.0 client may change the session expiry interval
+				if dp.Properties != nil && dp.Properties.SessionExpiryInterval != nil && c.session != nil {
+					c.session.SetExpiry(*dp.Properties.SessionExpiryInterval)
+				}
 				c.cancelFunc()
 			}
 
@@ -268,7 +345,8 @@ func ProcessMessage(msg *Message) {
 		// If a Server or Client receives a Control Packet
 		// containing ill-formed UTF-8 it MUST close the Network Connection
 
-		_ = c.conn.Close()
+		c.sendDisconnect(packets.ReasonMalformedPacket)
+		c.closeConn()
 
 		// Update client status
 		//c.status = Disconnected
@@ -284,27 +362,24 @@ func ProcessMessage(msg *Message) {
 	case *packets.PublishPacket:
 		c.ProcessPublish(ca)
 	case *packets.PubackPacket:
-		c.inflightMu.Lock()
-		if _, found := c.inflight[ca.MessageID]; found {
-			delete(c.inflight, ca.MessageID)
-		} else {
+		if !c.ackInflight(ca.MessageID) {
 			log.Error("Duplicated PUBACK PacketId", zap.Uint16("MessageID", ca.MessageID))
 		}
-		c.inflightMu.Unlock()
 	case *packets.PubrecPacket:
-		c.inflightMu.RLock()
+		c.inflightMu.Lock()
 		ielem, found := c.inflight[ca.MessageID]
-		c.inflightMu.RUnlock()
 		if found {
 			if ielem.status == Publish {
 				ielem.status = Pubrel
 				ielem.timestamp = time.Now().Unix()
+				c.inflightChanged()
 			} else if ielem.status == Pubrel {
 				log.Error("Duplicated PUBREC PacketId", zap.Uint16("MessageID", ca.MessageID))
 			}
 		} else {
 			log.Error("The PUBREC PacketId is not found.", zap.Uint16("MessageID", ca.MessageID))
 		}
+		c.inflightMu.Unlock()
 
 		pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
 		pubrel.MessageID = ca.MessageID
@@ -321,9 +396,7 @@ func ProcessMessage(msg *Message) {
 			return
 		}
 	case *packets.PubcompPacket:
-		c.inflightMu.Lock()
-		delete(c.inflight, ca.MessageID)
-		c.inflightMu.Unlock()
+		c.ackInflight(ca.MessageID)
 	case *packets.SubscribePacket:
 		c.ProcessSubscribe(ca)
 	case *packets.SubackPacket:
@@ -335,6 +408,8 @@ func ProcessMessage(msg *Message) {
 	case *packets.PingrespPacket:
 	case *packets.DisconnectPacket:
 		c.Close()
+	case *packets.AuthPacket:
+		c.ProcessAuth(ca)
 	default:
 		log.Info("Recv Unknow message.......", zap.String("ClientID", c.info.clientID))
 	}
@@ -392,26 +467,43 @@ func (c *client) processRouterPublish(packet *packets.PublishPacket) {
 
 func (c *client) processClientPublish(packet *packets.PublishPacket) {
 
+	if rc := c.resolveTopicAlias(packet); rc != packets.ReasonSuccess {
+		log.Error("invalid topic alias, ", zap.String("ClientID", c.info.clientID))
+		c.sendDisconnect(rc)
+		c.Close()
+		return
+	}
+
+	packet.TopicName = c.mount(packet.TopicName)
+
+	// messages dropped by a hook are acknowledged but not forwarded, the
+	// topic a hook rewrote is the one checked by the auth plugin
+	forward := c.broker.hooks.onPublish(c.hookInfo(), packet)
 	topic := packet.TopicName
 
-	if !c.broker.CheckTopicAuth(PUB, c.info.clientID, c.info.username, c.info.remoteIP, topic) {
+	if !checkTopicAuth(c.authPlugin(), PUB, c.info.clientID, c.info.username, c.info.remoteIP, topic) {
 		log.Error("Pub Topics Auth failed, ", zap.String("topic", topic), zap.String("ClientID", c.info.clientID))
+		c.sendPublishAck(packet, packets.ReasonNotAuthorized)
 		return
 	}
 
-	//publish kafka
-	c.broker.Publish(&bridge.Elements{
-		ClientID:  c.info.clientID,
-		Username:  c.info.username,
-		Action:    bridge.Publish,
-		Timestamp: time.Now().Unix(),
-		Payload:   string(packet.Payload),
-		Topic:     topic,
-	})
+	if forward {
+		//publish kafka
+		c.broker.publishBridge(&bridge.Elements{
+			ClientID:  c.info.clientID,
+			Username:  c.info.username,
+			Action:    bridge.Publish,
+			Timestamp: time.Now().Unix(),
+			Payload:   string(packet.Payload),
+			Topic:     packet.TopicName,
+		})
+	}
 
 	switch packet.Qos {
 	case QosAtMostOnce:
-		c.ProcessPublishMessage(packet)
+		if forward {
+			c.ProcessPublishMessage(packet)
+		}
 	case QosAtLeastOnce:
 		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
 		puback.MessageID = packet.MessageID
@@ -419,9 +511,17 @@ func (c *client) processClientPublish(packet *packets.PublishPacket) {
 			log.Error("send puback error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
 			return
 		}
-		c.ProcessPublishMessage(packet)
+		if forward {
+			c.ProcessPublishMessage(packet)
+		}
 	case QosExactlyOnce:
 		if err := c.registerPublishPacketId(packet.MessageID); err != nil {
+			if err == errPacketIdInUse {
+				// retransmission of a message that is already being processed
+				c.sendPublishAck(packet, packets.ReasonSuccess)
+			} else {
+				c.sendPublishAck(packet, packets.ReasonReceiveMaximumExceeded)
+			}
 			return
 		} else {
 			pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
@@ -430,7 +530,9 @@ func (c *client) processClientPublish(packet *packets.PublishPacket) {
 				log.Error("send pubrec error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
 				return
 			}
-			c.ProcessPublishMessage(packet)
+			if forward {
+				c.ProcessPublishMessage(packet)
+			}
 		}
 		return
 	default:
@@ -440,6 +542,62 @@ func (c *client) processClientPublish(packet *packets.PublishPacket) {
 
 }
 
+// resolveTopicAlias replaces an MQTT 5.0 topic alias by the topic it was
+// registered for and registers new aliases. The alias is removed from the
+// packet so it is not forwarded to subscribers.
+func (c *client) resolveTopicAlias(packet *packets.PublishPacket) byte {
+	if packet.Properties == nil || packet.Properties.TopicAlias == nil {
+		if packet.TopicName == "" {
+			return packets.ReasonProtocolError
+		}
+		return packets.ReasonSuccess
+	}
+
+	alias := *packet.Properties.TopicAlias
+	if alias == 0 || alias > maxTopicAlias {
+		return packets.ReasonTopicAliasInvalid
+	}
+	if packet.TopicName == "" {
+		topic, ok := c.topicAliases[alias]
+		if !ok {
+			return packets.ReasonProtocolError
+		}
+		packet.TopicName = topic
+	} else {
+		c.topicAliases[alias] = packet.TopicName
+	}
+	packet.Properties.TopicAlias = nil
+	return packets.ReasonSuccess
+}
+
+// sendPublishAck answers a QoS 1 or 2 publish that is not forwarded. MQTT
+// 3.1.1 has no way to report a failure, so only successful acknowledgements
+// are sent to older clients.
+func (c *client) sendPublishAck(packet *packets.PublishPacket, reasonCode byte) {
+	if reasonCode != packets.ReasonSuccess && c.info.protocolVersion < packets.Version5 {
+		return
+	}
+
+	var ack packets.ControlPacket
+	switch packet.Qos {
+	case QosAtLeastOnce:
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = packet.MessageID
+		puback.ReasonCode = reasonCode
+		ack = puback
+	case QosExactlyOnce:
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = packet.MessageID
+		pubrec.ReasonCode = reasonCode
+		ack = pubrec
+	default:
+		return
+	}
+	if err := c.WriterPacket(ack); err != nil {
+		log.Error("send publish ack error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+	}
+}
+
 func (c *client) ProcessPublishMessage(packet *packets.PublishPacket) {
 
 	b := c.broker
@@ -447,6 +605,7 @@ func (c *client) ProcessPublishMessage(packet *packets.PublishPacket) {
 		return
 	}
 	typ := c.typ
+	b.setExpiry(packet, time.Now())
 
 	if packet.Retain {
 		if err := c.topicsMgr.Retain(packet); err != nil {
@@ -460,34 +619,46 @@ func (c *client) ProcessPublishMessage(packet *packets.PublishPacket) {
 		return
 	}
 
-	// fmt.Println("psubs num: ", len(c.subs))
-	if len(c.subs) == 0 {
+	b.route(packet, c.subs, c.info.clientID, typ)
+}
+
+// route delivers packet to the subscribers matching its topic. publisherID
+// and typ identify the connection the packet was received from.
+func (b *Broker) route(packet *packets.PublishPacket, subs []interface{}, publisherID string, typ int) {
+	// fmt.Println("psubs num: ", len(subs))
+	if len(subs) == 0 {
 		return
 	}
 
-	var qsub []int
-	for i, sub := range c.subs {
-		s, ok := sub.(*subscription)
-		if ok {
+	var shared map[string][]*subscription
+	for _, sub := range subs {
+		switch s := sub.(type) {
+		case *subscription:
 			if s.client.typ == ROUTER {
 				if typ != CLIENT {
 					continue
 				}
 			}
+			if s.noLocal && typ == CLIENT && s.client.info.clientID == publisherID {
+				continue
+			}
 			if s.share {
-				qsub = append(qsub, i)
+				if shared == nil {
+					shared = make(map[string][]*subscription)
+				}
+				key := shareGroupKey(s)
+				shared[key] = append(shared[key], s)
 			} else {
 				publish(s, packet)
 			}
-
+		case *localSubscription:
+			s.deliver(packet, false)
 		}
-
 	}
 
-	if len(qsub) > 0 {
-		idx := r.Intn(len(qsub))
-		sub := c.subs[qsub[idx]].(*subscription)
-		publish(sub, packet)
+	// every share group receives the message once
+	for key, subs := range shared {
+		publish(b.shares.pick(key, subs, publisherID), packet)
 	}
 
 }
@@ -518,17 +689,33 @@ func (c *client) processClientSubscribe(packet *packets.SubscribePacket) {
 	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
 	suback.MessageID = packet.MessageID
 	var retcodes []byte
+	var rmsgs []*packets.PublishPacket
+	c.rmsgs = c.rmsgs[0:0]
+
+	var identifier int
+	if packet.Properties != nil && len(packet.Properties.SubscriptionIdentifier) > 0 {
+		identifier = packet.Properties.SubscriptionIdentifier[0]
+	}
 
 	for i, topic := range topics {
-		t := topic
-		//check topic auth for client
-		if !b.CheckTopicAuth(SUB, c.info.clientID, c.info.username, c.info.remoteIP, topic) {
-			log.Error("Sub topic Auth failed: ", zap.String("topic", topic), zap.String("ClientID", c.info.clientID))
-			retcodes = append(retcodes, QosFailure)
+		topic = c.mount(topic)
+		req := SubscriptionRequest{Filter: topic, Qos: qoss[i]}
+		if rc := b.hooks.onSubscribe(c.hookInfo(), &req); rc != packets.ReasonSuccess {
+			retcodes = append(retcodes, rc)
 			continue
 		}
+		//check topic auth for client, on the filter rewritten by the hooks
+		if !checkTopicAuth(c.authPlugin(), SUB, c.info.clientID, c.info.username, c.info.remoteIP, req.Filter) {
+			log.Error("Sub topic Auth failed: ", zap.String("topic", req.Filter), zap.String("ClientID", c.info.clientID))
+			retcodes = append(retcodes, packets.ReasonNotAuthorized)
+			continue
+		}
+		// the rewritten filter is also what the cluster is told about
+		topic, qoss[i] = req.Filter, req.Qos
+		topics[i] = topic
+		t := topic
 
-		b.Publish(&bridge.Elements{
+		b.publishBridge(&bridge.Elements{
 			ClientID:  c.info.clientID,
 			Username:  c.info.username,
 			Action:    bridge.Subscribe,
@@ -541,7 +728,7 @@ func (c *client) processClientSubscribe(packet *packets.SubscribePacket) {
 		if strings.HasPrefix(topic, "$share/") {
 			substr := groupCompile.FindStringSubmatch(topic)
 			if len(substr) != 3 {
-				retcodes = append(retcodes, QosFailure)
+				retcodes = append(retcodes, packets.ReasonTopicFilterInvalid)
 				continue
 			}
 			share = true
@@ -549,32 +736,54 @@ func (c *client) processClientSubscribe(packet *packets.SubscribePacket) {
 			topic = substr[2]
 		}
 
-		if oldSub, exist := c.subMap[t]; exist {
-			_ = c.topicsMgr.Unsubscribe([]byte(oldSub.topic), oldSub)
+		oldSub, exist := c.subMap[t]
+		if exist {
+			_ = c.unsubscribe(oldSub)
 			delete(c.subMap, t)
 		}
 
 		sub := &subscription{
-			topic:     topic,
-			qos:       qoss[i],
-			client:    c,
-			share:     share,
-			groupName: groupName,
+			topic:      topic,
+			qos:        qoss[i],
+			client:     c,
+			share:      share,
+			groupName:  groupName,
+			identifier: identifier,
+		}
+		if i < len(packet.Options) {
+			sub.noLocal = packet.Options[i].NoLocal
+			sub.retainAsPublished = packet.Options[i].RetainAsPublished
+			sub.retainHandling = packet.Options[i].RetainHandling
 		}
 
-		rqos, err := c.topicsMgr.Subscribe([]byte(topic), qoss[i], sub)
+		rqos, err := c.subscribe(sub)
 		if err != nil {
 			log.Error("subscribe error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
-			retcodes = append(retcodes, QosFailure)
+			retcodes = append(retcodes, packets.ReasonTopicFilterInvalid)
 			continue
 		}
 
 		c.subMap[t] = sub
 
-		_ = c.session.AddTopic(t, qoss[i])
+		ssub := sessions.Subscription{Topic: t, Qos: qoss[i], Identifier: identifier}
+		if i < len(packet.Options) {
+			ssub.Options = packet.Options[i]
+		}
+		_ = c.session.AddSubscription(ssub)
 		retcodes = append(retcodes, rqos)
-		_ = c.topicsMgr.Retained([]byte(topic), &c.rmsgs)
 
+		// MQTT 5.0 retain handling: 0 always sends retained messages, 1 only
+		// for new subscriptions and 2 never. Shared subscriptions never
+		// receive retained messages.
+		if !share && (sub.retainHandling == 0 || (sub.retainHandling == 1 && !exist)) {
+			rmsgs = rmsgs[0:0]
+			_ = c.topicsMgr.Retained([]byte(topic), &rmsgs)
+			for _, rm := range rmsgs {
+				if p := b.hooks.onDeliver(c.hookInfo(), sub.deliveryPacket(rm, true)); p != nil {
+					c.rmsgs = append(c.rmsgs, p)
+				}
+			}
+		}
 	}
 
 	suback.ReturnCodes = retcodes
@@ -589,11 +798,8 @@ func (c *client) processClientSubscribe(packet *packets.SubscribePacket) {
 
 	//process retain message
 	for _, rm := range c.rmsgs {
-		if err := c.WriterPacket(rm); err != nil {
-			log.Error("Error publishing retained message:", zap.Any("err", err), zap.String("ClientID", c.info.clientID))
-		} else {
-			log.Info("process retain  message: ", zap.Any("packet", packet), zap.String("ClientID", c.info.clientID))
-		}
+		c.deliver(rm)
+		log.Info("process retain  message: ", zap.Any("packet", packet), zap.String("ClientID", c.info.clientID))
 	}
 }
 
@@ -628,15 +834,18 @@ func (c *client) processRouterSubscribe(packet *packets.SubscribePacket) {
 			topic = substr[2]
 		}
 
+		// other brokers need the retain flag to keep their retained
+		// messages in sync
 		sub := &subscription{
-			topic:     topic,
-			qos:       qoss[i],
-			client:    c,
-			share:     share,
-			groupName: groupName,
+			topic:             topic,
+			qos:               qoss[i],
+			client:            c,
+			share:             share,
+			groupName:         groupName,
+			retainAsPublished: true,
 		}
 
-		rqos, err := c.topicsMgr.Subscribe([]byte(topic), qoss[i], sub)
+		rqos, err := c.subscribe(sub)
 		if err != nil {
 			log.Error("subscribe error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
 			retcodes = append(retcodes, QosFailure)
@@ -657,6 +866,27 @@ func (c *client) processRouterSubscribe(packet *packets.SubscribePacket) {
 	}
 }
 
+// subscribe adds sub to the topic tree, the members of share groups are
+// counted by the share dispatcher
+func (c *client) subscribe(sub *subscription) (byte, error) {
+	qos, err := c.topicsMgr.Subscribe([]byte(sub.topic), sub.qos, sub)
+	if err == nil && sub.share && c.broker != nil {
+		c.broker.shares.join(shareGroupKey(sub))
+	}
+	return qos, err
+}
+
+// unsubscribe removes sub from the topic tree
+func (c *client) unsubscribe(sub *subscription) error {
+	if err := c.topicsMgr.Unsubscribe([]byte(sub.topic), sub); err != nil {
+		return err
+	}
+	if sub.share && c.broker != nil {
+		c.broker.shares.leave(shareGroupKey(sub))
+	}
+	return nil
+}
+
 func (c *client) ProcessUnSubscribe(packet *packets.UnsubscribePacket) {
 	switch c.typ {
 	case CLIENT:
@@ -684,7 +914,7 @@ func (c *client) processRouterUnSubscribe(packet *packets.UnsubscribePacket) {
 				continue
 			}
 
-			_ = c.topicsMgr.Unsubscribe([]byte(sub.topic), sub)
+			_ = c.unsubscribe(sub)
 			delete(c.subMap, topic)
 		}
 
@@ -709,12 +939,15 @@ func (c *client) processClientUnSubscribe(packet *packets.UnsubscribePacket) {
 		return
 	}
 	topics := packet.Topics
+	reasonCodes := make([]byte, 0, len(topics))
 
-	for _, topic := range topics {
+	for i, topic := range topics {
+		topic = c.mount(topic)
+		topics[i] = topic
 		{
 			//publish kafka
 
-			b.Publish(&bridge.Elements{
+			b.publishBridge(&bridge.Elements{
 				ClientID:  c.info.clientID,
 				Username:  c.info.username,
 				Action:    bridge.Unsubscribe,
@@ -726,15 +959,19 @@ func (c *client) processClientUnSubscribe(packet *packets.UnsubscribePacket) {
 
 		sub, exist := c.subMap[topic]
 		if exist {
-			_ = c.topicsMgr.Unsubscribe([]byte(sub.topic), sub)
+			_ = c.unsubscribe(sub)
 			_ = c.session.RemoveTopic(topic)
 			delete(c.subMap, topic)
+			reasonCodes = append(reasonCodes, packets.ReasonSuccess)
+		} else {
+			reasonCodes = append(reasonCodes, packets.ReasonNoSubscriptionExisted)
 		}
 
 	}
 
 	unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
 	unsuback.MessageID = packet.MessageID
+	unsuback.ReasonCodes = reasonCodes
 
 	err := c.WriterPacket(unsuback)
 	if err != nil {
@@ -770,7 +1007,7 @@ func (c *client) Close() {
 	// c.status = Disconnected
 
 	b := c.broker
-	b.Publish(&bridge.Elements{
+	b.publishBridge(&bridge.Elements{
 		ClientID:  c.info.clientID,
 		Username:  c.info.username,
 		Action:    bridge.Disconnect,
@@ -778,41 +1015,57 @@ func (c *client) Close() {
 	})
 
 	if c.conn != nil {
-		_ = c.conn.Close()
+		c.closeConn()
 		c.conn = nil
 	}
 
 	subs := c.subMap
+	persistent := c.isPersistent()
 
 	if b != nil {
 		b.removeClient(c)
-		for _, sub := range subs {
-			// guard against race condition where a client gets Close() but wasn't initialized yet fully
-			if sub == nil || b.topicsMgr == nil {
-				continue
+		if persistent {
+			c.suspendSession()
+		} else {
+			if c.typ == CLIENT {
+				b.deleteSession(c)
 			}
-			err := b.topicsMgr.Unsubscribe([]byte(sub.topic), sub)
-			if err != nil {
-				log.Error("unsubscribe error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+			for _, sub := range subs {
+				// guard against race condition where a client gets Close() but wasn't initialized yet fully
+				if sub == nil || b.topicsMgr == nil {
+					continue
+				}
+				err := c.unsubscribe(sub)
+				if err != nil {
+					log.Error("unsubscribe error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+				}
 			}
 		}
 
+		if c.limitedUser {
+			b.userLimits.release(c.info.username)
+		}
+
 		if c.typ == CLIENT {
-			b.BroadcastUnSubscribe(subs)
+			if !persistent {
+				b.BroadcastUnSubscribe(subs)
+			}
+			b.authDisconnected(c)
 			//offline notification
 			b.OnlineOfflineNotification(c.info.clientID, false)
+			b.hooks.onDisconnect(c.hookInfo())
 		}
 
-		if c.info.willMsg != nil {
-			b.PublishMessage(c.info.willMsg)
+		if will := c.takeWill(); will != nil {
+			b.scheduleWill(c, will)
 		}
 
-		if c.typ == CLUSTER {
+		if c.typ == CLUSTER && !b.shuttingDown() {
 			b.ConnectToDiscovery()
 		}
 
 		//do reconnect
-		if c.typ == REMOTE {
+		if c.typ == REMOTE && !b.shuttingDown() {
 			go b.connectRouter(c.route.remoteID, c.route.remoteUrl)
 		}
 	}
@@ -837,19 +1090,73 @@ func (c *client) WriterPacket(packet packets.ControlPacket) error {
 		return errors.New("connect lost ....")
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return packet.Write(c.conn)
+	if c.out != nil {
+		return c.queuePacket(packet)
+	}
+	if err := c.write(c.conn, packet); err != errExceedsMaxPacketSize {
+		return err
+	}
+	c.discardOversized(packet)
+	return nil
+}
+
+// sendDisconnect notifies an MQTT 5.0 client why the server is closing the
+// connection. Older protocol levels have no server side DISCONNECT.
+func (c *client) sendDisconnect(reasonCode byte) {
+	if c.info.protocolVersion < packets.Version5 {
+		return
+	}
+	disconnect := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	disconnect.ReasonCode = reasonCode
+	if err := c.WriterPacket(disconnect); err != nil {
+		log.Error("send disconnect error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+	}
+}
+
+// ProcessAuth handles MQTT 5.0 re-authentication. A failed exchange closes
+// the connection.
+func (c *client) ProcessAuth(packet *packets.AuthPacket) {
+	if c.status == Disconnected {
+		return
+	}
+
+	method := ""
+	var data []byte
+	if packet.Properties != nil {
+		method = packet.Properties.AuthMethod
+		data = packet.Properties.AuthData
+	}
+	if c.info.authMethod == "" || method != c.info.authMethod ||
+		(packet.ReasonCode != packets.ReasonReAuthenticate && packet.ReasonCode != packets.ReasonContinueAuthentication) {
+		c.sendDisconnect(packets.ReasonProtocolError)
+		c.Close()
+		return
+	}
+
+	resp, rc := checkEnhancedAuth(c.authPlugin(), c.info.clientID, method, data)
+	if rc != packets.ReasonSuccess && rc != packets.ReasonContinueAuthentication {
+		log.Warn("re-authentication failed", zap.String("ClientID", c.info.clientID))
+		c.sendDisconnect(rc)
+		c.Close()
+		return
+	}
+
+	ap := packets.NewControlPacket(packets.Auth).(*packets.AuthPacket)
+	ap.ReasonCode = rc
+	ap.Properties = &packets.Properties{AuthMethod: method, AuthData: resp}
+	if err := c.WriterPacket(ap); err != nil {
+		log.Error("send auth error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+	}
 }
 
 func (c *client) registerPublishPacketId(packetId uint16) error {
 	if c.isAwaitingFull() {
 		log.Error("Dropped qos2 packet for too many awaiting_rel", zap.Uint16("id", packetId))
-		return errors.New("DROPPED_QOS2_PACKET_FOR_TOO_MANY_AWAITING_REL")
+		return errAwaitingRelFull
 	}
 
 	if _, found := c.awaitingRel[packetId]; found {
-		return errors.New("RC_PACKET_IDENTIFIER_IN_USE")
+		return errPacketIdInUse
 	}
 	c.awaitingRel[packetId] = time.Now().Unix()
 	time.AfterFunc(time.Duration(awaitRelTimeout)*time.Second, c.expireAwaitingRel)
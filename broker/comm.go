@@ -8,8 +8,8 @@ import (
 	"github.com/tidwall/gjson"
 	"go.uber.org/zap"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
 	uuid "github.com/google/uuid"
+	"github.com/habakke/hmq/broker/lib/packets"
 )
 
 const (
@@ -143,7 +143,61 @@ func unWrapPublishPacket(packet *packets.PublishPacket) *packets.PublishPacket {
 	return p
 }
 
+// deliveryPacket returns the packet to send to the subscriber. The QoS is
+// downgraded to the QoS granted to the subscription and the retain flag is
+// only kept for retained messages sent on subscribe, unless an MQTT 5.0
+// subscriber asked for Retain As Published. Changes are made on a copy so the
+// packet can be shared between subscribers. Other brokers in the cluster
+// downgrade the QoS for their own subscribers.
+func (sub *subscription) deliveryPacket(packet *packets.PublishPacket, retained bool) *packets.PublishPacket {
+	retain := packet.Retain && (retained || sub.retainAsPublished)
+	qos := packet.Qos
+	if sub.qos < qos && sub.client.typ != ROUTER {
+		qos = sub.qos
+	}
+	if retain == packet.Retain && qos == packet.Qos && !packet.Dup && sub.identifier == 0 {
+		return packet
+	}
+
+	p := *packet
+	p.Retain = retain
+	p.Qos = qos
+	p.Dup = false
+	if sub.identifier != 0 {
+		p.Properties = packet.Properties.Copy()
+		if p.Properties == nil {
+			p.Properties = &packets.Properties{}
+		}
+		p.Properties.SubscriptionIdentifier = []int{sub.identifier}
+	}
+	return &p
+}
+
 func publish(sub *subscription, packet *packets.PublishPacket) {
+	packet = sub.deliveryPacket(packet, false)
+	if b := sub.client.broker; b != nil {
+		if packet = b.hooks.onDeliver(sub.client.hookInfo(), packet); packet == nil {
+			return
+		}
+	}
+
+	// the session of an offline client queues the message instead
+	if s := sub.client.session; sub.client.typ == CLIENT && s != nil && s.Enqueue(packet) {
+		return
+	}
+	sub.client.deliver(packet)
+}
+
+// deliver sends packet to the client. QoS 1 and 2 messages are sent with a
+// packet identifier allocated by this client and kept in flight until they
+// are acknowledged.
+func (c *client) deliver(packet *packets.PublishPacket) {
+	now := time.Now()
+	if c.expired(packet, now) {
+		return
+	}
+	packet = remainingExpiry(c.unmount(packet), now)
+
 	// var p *packets.PublishPacket
 	// if sub.client.info.username != "root" {
 	// 	p = unWrapPublishPacket(packet)
@@ -157,89 +211,48 @@ func publish(sub *subscription, packet *packets.PublishPacket) {
 
 	switch packet.Qos {
 	case QosAtMostOnce:
-		err := sub.client.WriterPacket(packet)
+		err := c.WriterPacket(packet)
 		if err != nil {
 			log.Error("process message for psub error,  ", zap.Error(err))
 		}
 	case QosAtLeastOnce, QosExactlyOnce:
-		sub.client.inflightMu.Lock()
-		sub.client.inflight[packet.MessageID] = &inflightElem{status: Publish, packet: packet, timestamp: time.Now().Unix()}
-		sub.client.inflightMu.Unlock()
-		err := sub.client.WriterPacket(packet)
-		if err != nil {
-			log.Error("process message for psub error,  ", zap.Error(err))
+		c.inflightMu.Lock()
+		if c.inflightFull() {
+			// the message waits until acknowledgements make room for it
+			c.queuePending(packet)
+			c.inflightMu.Unlock()
+			return
+		}
+		packet = c.addInflight(packet)
+		c.inflightMu.Unlock()
+		if packet == nil {
+			return
 		}
-		sub.client.ensureRetryTimer()
+		c.writeInflight([]*packets.PublishPacket{packet})
 	default:
-		log.Error("publish with unknown qos", zap.String("ClientID", sub.client.info.clientID))
+		log.Error("publish with unknown qos", zap.String("ClientID", c.info.clientID))
 		return
 	}
 }
 
-// timer for retry delivery
-func (c *client) ensureRetryTimer(interval ...int64) {
-	if c.retryTimer != nil {
-		return
-	}
-	if len(interval) > 1 {
-		return
-	}
-	timerInterval := retryInterval
-	if len(interval) == 1 {
-		timerInterval = interval[0]
-	}
-	c.retryTimerLock.Lock()
-	c.retryTimer = time.AfterFunc(time.Duration(timerInterval)*time.Second, c.retryDelivery)
-	c.retryTimerLock.Unlock()
-}
-
-func (c *client) resetRetryTimer() {
-	if c.retryTimer == nil {
-		return
-	}
-	// reset timer
-	c.retryTimerLock.Lock()
-	c.retryTimer = nil
-	c.retryTimerLock.Unlock()
-
-}
-
-func (c *client) retryDelivery() {
-	c.resetRetryTimer()
-	c.inflightMu.RLock()
-	ilen := len(c.inflight)
-	if c.conn == nil || ilen == 0 { //Reset timer when client offline OR inflight is empty
-		c.inflightMu.RUnlock()
-		return
+// nextPacketID returns a free packet identifier for an outgoing QoS 1 or 2
+// message. A redelivered message keeps its identifier when it is still free.
+// c.inflightMu must be held.
+func (c *client) nextPacketID(packet *packets.PublishPacket) (uint16, bool) {
+	if packet.Dup && packet.MessageID != 0 {
+		if _, found := c.inflight[packet.MessageID]; !found {
+			return packet.MessageID, true
+		}
 	}
 
-	// copy the to be retried elements out of the map to only hold the lock for a short time and use the new slice later to iterate
-	// through them
-	toRetryEle := make([]*inflightElem, 0, ilen)
-	for _, infEle := range c.inflight {
-		toRetryEle = append(toRetryEle, infEle)
-	}
-	c.inflightMu.RUnlock()
-	now := time.Now().Unix()
-
-	for _, infEle := range toRetryEle {
-		age := now - infEle.timestamp
-		if age >= retryInterval {
-			if infEle.status == Publish {
-				_ = c.WriterPacket(infEle.packet)
-				infEle.timestamp = now
-			} else if infEle.status == Pubrel {
-				pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
-				pubrel.MessageID = infEle.packet.MessageID
-				_ = c.WriterPacket(pubrel)
-				infEle.timestamp = now
-			}
-		} else {
-			if age < 0 {
-				age = 0
-			}
-			c.ensureRetryTimer(retryInterval - age)
+	for i := 0; i < 65535; i++ {
+		c.lastPacketID++
+		if c.lastPacketID == 0 {
+			c.lastPacketID = 1
+		}
+		if _, found := c.inflight[c.lastPacketID]; !found {
+			return c.lastPacketID, true
 		}
 	}
-	c.ensureRetryTimer()
+	return 0, false
 }
@@ -10,7 +10,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/habakke/hmq/broker/lib/sessions"
 	"github.com/habakke/hmq/logger"
 	"github.com/habakke/hmq/plugins/auth"
 	"github.com/habakke/hmq/plugins/bridge"
@@ -18,30 +21,62 @@ import (
 )
 
 type Config struct {
-	Worker   int       `json:"workerNum"`
-	HTTPPort string    `json:"httpPort"`
-	Host     string    `json:"host"`
-	Port     string    `json:"port"`
-	Cluster  RouteInfo `json:"cluster"`
-	Router   string    `json:"router"`
-	TlsHost  string    `json:"tlsHost"`
-	TlsPort  string    `json:"tlsPort"`
-	WsPath   string    `json:"wsPath"`
-	WsPort   string    `json:"wsPort"`
-	WsTLS    bool      `json:"wsTLS"`
-	TlsInfo  TLSInfo   `json:"tlsInfo"`
-	Debug    bool      `json:"debug"`
-	Plugin   Plugins   `json:"plugins"`
+	Worker   int          `json:"workerNum"`
+	HTTPPort string       `json:"httpPort"`
+	Host     string       `json:"host"`
+	Port     string       `json:"port"`
+	Cluster  RouteInfo    `json:"cluster"`
+	Router   string       `json:"router"`
+	TlsHost  string       `json:"tlsHost"`
+	TlsPort  string       `json:"tlsPort"`
+	WsPath   string       `json:"wsPath"`
+	WsPort   string       `json:"wsPort"`
+	WsTLS    bool         `json:"wsTLS"`
+	TlsInfo  TLSInfo      `json:"tlsInfo"`
+	Session  SessionInfo  `json:"session"`
+	Retain   RetainInfo   `json:"retain"`
+	Shared   SharedInfo   `json:"sharedSubscription"`
+	Outbound OutboundInfo `json:"outbound"`
+	// Admission limits the client connections over all listeners
+	Admission AdmissionInfo `json:"admission"`
+	// ConnectTimeout is how long in seconds a new connection may take to
+	// send its CONNECT packet
+	ConnectTimeout int `json:"connectTimeout"`
+	// MaxPacketSize limits the size in bytes of the packets sent by clients,
+	// 0 only applies the limit of the protocol
+	MaxPacketSize int `json:"maxPacketSize"`
+	// PublishLimits limit the messages clients publish
+	PublishLimits PublishLimitsInfo `json:"publishLimits"`
+	// Delivery configures the delivery of QoS 1 and 2 messages
+	Delivery DeliveryInfo `json:"delivery"`
+	// WillDelay is how long in seconds the will message of a client is
+	// delayed when it has no MQTT 5.0 Will Delay Interval, the will is not
+	// published when the client reconnects before
+	WillDelay int `json:"willDelay"`
+	// MessageExpiry configures when messages that are not delivered yet are
+	// discarded
+	MessageExpiry ExpiryInfo `json:"messageExpiry"`
+	// Listeners accept client connections next to the ones configured by
+	// port, tlsPort and wsPort
+	Listeners []ListenerInfo `json:"listeners"`
+	// SysInterval is how often in seconds the $SYS statistics are
+	// published, 0 uses the default and a negative value disables them
+	SysInterval int     `json:"sysInterval"`
+	Debug       bool    `json:"debug"`
+	Plugin      Plugins `json:"plugins"`
 }
 
 type Plugins struct {
 	Auth   auth.Auth
 	Bridge bridge.BridgeMQ
+	// AuthConfig configures the auth plugins of the broker and the listeners
+	AuthConfig auth.Config
 }
 
 type NamedPlugins struct {
 	Auth   string
 	Bridge string
+	auth.Config
 }
 
 type RouteInfo struct {
@@ -49,6 +84,121 @@ type RouteInfo struct {
 	Port string `json:"port"`
 }
 
+type SessionInfo struct {
+	Provider          string `json:"provider"`
+	Path              string `json:"path"`
+	MaxQueuedMessages int    `json:"maxQueuedMessages"`
+	QueueDropPolicy   string `json:"queueDropPolicy"`
+	// ExpiryInterval is how long in seconds a persistent session of an MQTT
+	// 3.1.1 client is kept after its client disconnected, 0 keeps it until
+	// the client cleans it
+	ExpiryInterval int `json:"expiryInterval"`
+	// ReapInterval is how often in seconds expired sessions are removed
+	ReapInterval int `json:"reapInterval"`
+}
+
+type RetainInfo struct {
+	Provider string `json:"provider"`
+	Path     string `json:"path"`
+}
+
+type SharedInfo struct {
+	// Strategy picks the member of a share group receiving a message
+	Strategy string `json:"strategy"`
+	// Groups overrides the strategy per share group name
+	Groups map[string]string `json:"groups"`
+}
+
+type ListenerInfo struct {
+	// Protocol is tcp, tls, ws or wss
+	Protocol string `json:"protocol"`
+	// Address is the host:port to listen on
+	Address string `json:"address"`
+	// Path is the HTTP path of websocket listeners
+	Path string `json:"path"`
+	// TLS configures tls and wss listeners
+	TLS *TLSInfo `json:"tls"`
+	// Auth names the auth plugin checking the clients of the listener,
+	// the broker plugin is used when empty
+	Auth string `json:"auth"`
+	// MaxConnections limits the open connections, 0 is unlimited
+	MaxConnections int `json:"maxConnections"`
+	// Mountpoint prefixes the topics of the clients of the listener
+	Mountpoint string `json:"mountpoint"`
+	// ProxyProtocol reads a PROXY protocol v1 or v2 header from tcp and tls
+	// connections coming from ProxyTrustedCIDRs
+	ProxyProtocol bool `json:"proxyProtocol"`
+	// ProxyTrustedCIDRs are the networks of the proxies, they are required
+	// with ProxyProtocol
+	ProxyTrustedCIDRs []string `json:"proxyTrustedCIDRs"`
+}
+
+type OutboundInfo struct {
+	// QueueSize is the number of packets queued per client
+	QueueSize int `json:"queueSize"`
+	// WriteTimeout bounds a write to a client in seconds
+	WriteTimeout int `json:"writeTimeout"`
+	// Policy is applied when the queue of a client is full
+	Policy string `json:"slowConsumerPolicy"`
+}
+
+type AdmissionInfo struct {
+	// MaxConnections limits the open client connections, 0 is unlimited
+	MaxConnections int `json:"maxConnections"`
+	// ConnectionRate is the number of new connections per second accepted
+	// from a source IP, 0 is unlimited
+	ConnectionRate float64 `json:"connectionRate"`
+	// ConnectionBurst is the number of connections a source IP may open at
+	// once, the rate rounded up when 0
+	ConnectionBurst int `json:"connectionBurst"`
+	// BackoffDelay is how long in milliseconds refused clients wait for
+	// their CONNACK
+	BackoffDelay int `json:"backoffDelay"`
+}
+
+type PublishLimitsInfo struct {
+	// Client limits every client
+	Client auth.Limits `json:"client"`
+	// Username limits the clients of a username together
+	Username auth.Limits `json:"username"`
+	// Policy is applied to clients exceeding their limits
+	Policy string `json:"policy"`
+}
+
+type DeliveryInfo struct {
+	// MaxInflight limits the unacknowledged QoS 1 and 2 messages sent to a
+	// client, further messages wait in order, 0 is unlimited
+	MaxInflight int `json:"maxInflight"`
+	// RetryInterval is how long in seconds a message waits for its
+	// acknowledgement before it is sent again, doubled after every retry
+	RetryInterval int `json:"retryInterval"`
+	// MaxRetryInterval caps the retry interval in seconds
+	MaxRetryInterval int `json:"maxRetryInterval"`
+	// MaxRetries is the number of times a message is sent again before its
+	// delivery is given up, 0 retries forever
+	MaxRetries int `json:"maxRetries"`
+	// DeadLetterTopic receives the messages that were given up
+	DeadLetterTopic string `json:"deadLetterTopic"`
+	// MaxAwaitingRel limits the QoS 2 messages received from a client
+	// waiting for their PUBREL, 0 is unlimited
+	MaxAwaitingRel int `json:"maxAwaitingRel"`
+}
+
+type ExpiryInfo struct {
+	// Topics set the expiry of the messages published without an MQTT 5.0
+	// Message Expiry Interval, the first matching topic filter applies
+	Topics []TopicExpiry `json:"topics"`
+	// SweepInterval is how often in seconds expired retained messages are
+	// removed
+	SweepInterval int `json:"sweepInterval"`
+}
+
+type TopicExpiry struct {
+	Topic string `json:"topic"`
+	// Expiry is the time in seconds a message is kept
+	Expiry int `json:"expiry"`
+}
+
 type TLSInfo struct {
 	Verify   bool   `json:"verify"`
 	CaFile   string `json:"caFile"`
@@ -60,12 +210,48 @@ var DefaultConfig *Config = &Config{
 	Worker: 4096,
 	Host:   "0.0.0.0",
 	Port:   "1883",
+	Session: SessionInfo{
+		Provider:          "mem",
+		MaxQueuedMessages: sessions.DefaultMaxQueued,
+		QueueDropPolicy:   sessions.DropOldest,
+		ReapInterval:      int(DefaultSessionReapInterval / time.Second),
+	},
+	Retain: RetainInfo{
+		Provider: "mem",
+	},
+	Shared: SharedInfo{
+		Strategy: ShareRandom,
+	},
+	Outbound: OutboundInfo{
+		QueueSize:    DefaultOutboundQueueSize,
+		WriteTimeout: int(DefaultWriteTimeout / time.Second),
+		Policy:       SlowConsumerDropQos0,
+	},
+	ConnectTimeout: int(DefaultConnectTimeout / time.Second),
+	PublishLimits: PublishLimitsInfo{
+		Policy: PublishThrottle,
+	},
+	Delivery: DeliveryInfo{
+		RetryInterval:    int(DefaultRetryInterval / time.Second),
+		MaxRetryInterval: int(DefaultMaxRetryInterval / time.Second),
+	},
+	MessageExpiry: ExpiryInfo{
+		SweepInterval: int(DefaultExpirySweepInterval / time.Second),
+	},
 }
 
 var (
 	log = logger.Prod().Named("broker")
 )
 
+const (
+	// defaultSessionPath is where the disk session provider stores sessions
+	defaultSessionPath = "data/sessions.log"
+	// defaultRetainPath is where the disk topics provider stores retained
+	// messages
+	defaultRetainPath = "data/retained.log"
+)
+
 func showHelp() {
 	fmt.Printf("%s\n", usageStr)
 	os.Exit(0)
@@ -166,7 +352,8 @@ func (p *Plugins) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
-	p.Auth = auth.NewAuth(named.Auth)
+	p.AuthConfig = named.Config
+	p.Auth = auth.NewAuthConfig(named.Auth, named.Config)
 	p.Bridge = bridge.NewBridgeMQ(named.Bridge)
 	return nil
 }
@@ -194,6 +381,113 @@ func (config *Config) check() error {
 		}
 	}
 
+	switch config.Session.Provider {
+	case "":
+		config.Session.Provider = "mem"
+	case "disk":
+		if config.Session.Path == "" {
+			config.Session.Path = defaultSessionPath
+		}
+	}
+	switch config.Retain.Provider {
+	case "":
+		config.Retain.Provider = "mem"
+	case "disk":
+		if config.Retain.Path == "" {
+			config.Retain.Path = defaultRetainPath
+		}
+	}
+
+	if config.Shared.Strategy == "" {
+		config.Shared.Strategy = ShareRandom
+	}
+	if err := validShareStrategy(config.Shared.Strategy); err != nil {
+		return err
+	}
+	for _, strategy := range config.Shared.Groups {
+		if err := validShareStrategy(strategy); err != nil {
+			return err
+		}
+	}
+
+	if config.Session.MaxQueuedMessages == 0 {
+		config.Session.MaxQueuedMessages = sessions.DefaultMaxQueued
+	}
+	switch config.Session.QueueDropPolicy {
+	case "":
+		config.Session.QueueDropPolicy = sessions.DropOldest
+	case sessions.DropOldest, sessions.DropNewest:
+	default:
+		return fmt.Errorf("unknown session queue drop policy %q", config.Session.QueueDropPolicy)
+	}
+	if config.Session.ExpiryInterval < 0 || int64(config.Session.ExpiryInterval) >= sessions.ExpiryNever {
+		return fmt.Errorf("invalid session expiry interval %d", config.Session.ExpiryInterval)
+	}
+	if config.Session.ReapInterval <= 0 {
+		config.Session.ReapInterval = int(DefaultSessionReapInterval / time.Second)
+	}
+
+	if config.Outbound.QueueSize <= 0 {
+		config.Outbound.QueueSize = DefaultOutboundQueueSize
+	}
+	if config.Outbound.WriteTimeout <= 0 {
+		config.Outbound.WriteTimeout = int(DefaultWriteTimeout / time.Second)
+	}
+	if config.Outbound.Policy == "" {
+		config.Outbound.Policy = SlowConsumerDropQos0
+	}
+	if err := validSlowConsumerPolicy(config.Outbound.Policy); err != nil {
+		return err
+	}
+
+	if config.Admission.MaxConnections < 0 || config.Admission.ConnectionRate < 0 ||
+		config.Admission.ConnectionBurst < 0 || config.Admission.BackoffDelay < 0 {
+		return errors.New("admission limits must not be negative")
+	}
+
+	if config.ConnectTimeout <= 0 {
+		config.ConnectTimeout = int(DefaultConnectTimeout / time.Second)
+	}
+	if config.MaxPacketSize < 0 {
+		return errors.New("max packet size must not be negative")
+	}
+
+	if config.PublishLimits.Policy == "" {
+		config.PublishLimits.Policy = PublishThrottle
+	}
+	if err := validPublishPolicy(config.PublishLimits.Policy); err != nil {
+		return err
+	}
+
+	if config.Delivery.RetryInterval <= 0 {
+		config.Delivery.RetryInterval = int(DefaultRetryInterval / time.Second)
+	}
+	if config.Delivery.MaxRetryInterval <= 0 {
+		config.Delivery.MaxRetryInterval = int(DefaultMaxRetryInterval / time.Second)
+	}
+	if config.Delivery.MaxRetryInterval < config.Delivery.RetryInterval {
+		config.Delivery.MaxRetryInterval = config.Delivery.RetryInterval
+	}
+	if config.Delivery.MaxInflight < 0 || config.Delivery.MaxRetries < 0 || config.Delivery.MaxAwaitingRel < 0 {
+		return errors.New("delivery limits must not be negative")
+	}
+	if strings.ContainsAny(config.Delivery.DeadLetterTopic, "+#") {
+		return fmt.Errorf("invalid dead letter topic %q", config.Delivery.DeadLetterTopic)
+	}
+
+	if config.WillDelay < 0 {
+		return errors.New("will delay must not be negative")
+	}
+
+	if config.MessageExpiry.SweepInterval <= 0 {
+		config.MessageExpiry.SweepInterval = int(DefaultExpirySweepInterval / time.Second)
+	}
+	for _, te := range config.MessageExpiry.Topics {
+		if te.Topic == "" || te.Expiry <= 0 {
+			return fmt.Errorf("invalid message expiry for topic %q", te.Topic)
+		}
+	}
+
 	if config.TlsPort != "" {
 		if config.TlsInfo.CertFile == "" || config.TlsInfo.KeyFile == "" {
 			log.Error("tls config error, no cert or key file.")
@@ -203,6 +497,11 @@ func (config *Config) check() error {
 			config.TlsHost = "0.0.0.0"
 		}
 	}
+	for _, l := range config.Listeners {
+		if err := validListener(l); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
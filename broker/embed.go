@@ -0,0 +1,161 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"github.com/habakke/hmq/broker/lib/topics"
+	"go.uber.org/zap"
+)
+
+// MessageHandler receives the messages of an in-process subscription. The
+// handlers of a subscription are called one at a time, in order.
+type MessageHandler func(topic string, payload []byte, qos byte, retained bool)
+
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// Publish sends a message to the subscribers of topic from within the broker
+// process, as if it was published by a client. Publishing is not checked by
+// the auth plugin.
+func (b *Broker) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("%w %q", ErrInvalidTopic, topic)
+	}
+	if !topics.ValidQos(qos) {
+		return fmt.Errorf("invalid QoS %d", qos)
+	}
+
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = topic
+	packet.Qos = qos
+	packet.Retain = retain
+	packet.Payload = payload
+	return b.publishPacket(packet)
+}
+
+// publishPacket sends a message of the broker to the subscribers of its topic
+func (b *Broker) publishPacket(packet *packets.PublishPacket) error {
+	b.setExpiry(packet, time.Now())
+	if packet.Retain {
+		if err := b.topicsMgr.Retain(packet); err != nil {
+			return err
+		}
+	}
+
+	var subs []interface{}
+	var qoss []byte
+	if err := b.topicsMgr.Subscribers([]byte(packet.TopicName), packet.Qos, &subs, &qoss); err != nil {
+		return err
+	}
+	b.route(packet, subs, "", CLIENT)
+	return nil
+}
+
+// Subscribe calls handler for every message matching filter, delivered with
+// at most qos. Retained messages matching filter are delivered first. The
+// returned function removes the subscription. Shared subscriptions are not
+// supported.
+func (b *Broker) Subscribe(filter string, qos byte, handler MessageHandler) (func(), error) {
+	if handler == nil {
+		return nil, errors.New("nil message handler")
+	}
+	if strings.HasPrefix(filter, "$share/") {
+		return nil, fmt.Errorf("%w %q: shared subscriptions are not supported in process", ErrInvalidTopic, filter)
+	}
+
+	sub := &localSubscription{
+		filter:  filter,
+		qos:     qos,
+		handler: handler,
+		queue:   newOutQueue(b.config.Outbound),
+	}
+	if _, err := b.topicsMgr.Subscribe([]byte(filter), qos, sub); err != nil {
+		return nil, err
+	}
+	b.localSubs.Store(sub, struct{}{})
+
+	sub.queue.start()
+	go sub.run()
+
+	var rmsgs []*packets.PublishPacket
+	_ = b.topicsMgr.Retained([]byte(filter), &rmsgs)
+	for _, rm := range rmsgs {
+		sub.deliver(rm, true)
+	}
+
+	subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	subscribe.Topics = []string{filter}
+	subscribe.Qoss = []byte{qos}
+	go b.BroadcastSubOrUnsubMessage(subscribe)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.unsubscribeLocal(sub)
+		})
+	}, nil
+}
+
+func (b *Broker) unsubscribeLocal(sub *localSubscription) {
+	if err := b.topicsMgr.Unsubscribe([]byte(sub.filter), sub); err != nil {
+		log.Error("unsubscribe error, ", zap.Error(err), zap.String("topic", sub.filter))
+	}
+	b.localSubs.Delete(sub)
+	sub.queue.discard()
+
+	unsubscribe := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	unsubscribe.Topics = []string{sub.filter}
+	go b.BroadcastSubOrUnsubMessage(unsubscribe)
+}
+
+// localSubscription is a subscription of the broker process itself. It is
+// stored in the topic tree next to the client subscriptions, its messages
+// are queued and passed to the handler by a goroutine of its own.
+type localSubscription struct {
+	filter  string
+	qos     byte
+	handler MessageHandler
+	queue   *outQueue
+}
+
+// deliver queues packet for the handler, the QoS is downgraded to the QoS of
+// the subscription
+func (s *localSubscription) deliver(packet *packets.PublishPacket, retained bool) {
+	p := *packet
+	p.Retain = packet.Retain && retained
+	if s.qos < p.Qos {
+		p.Qos = s.qos
+	}
+	if _, err := s.queue.push(&p); err != nil {
+		log.Warn("in-process subscriber is too slow, message dropped", zap.String("topic", packet.TopicName), zap.String("filter", s.filter))
+	}
+}
+
+func (s *localSubscription) run() {
+	defer close(s.queue.done)
+
+	for {
+		packet, ok := s.queue.pop()
+		if !ok {
+			return
+		}
+		p := packet.(*packets.PublishPacket)
+		if p.Expired(time.Now()) {
+			continue
+		}
+		s.handle(p)
+	}
+}
+
+func (s *localSubscription) handle(p *packets.PublishPacket) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("in-process message handler panic", zap.Any("recover", err), zap.String("filter", s.filter))
+		}
+	}()
+	s.handler(p.TopicName, p.Payload, p.Qos, p.Retain)
+}
@@ -0,0 +1,100 @@
+package broker
+
+import (
+	"strings"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"github.com/habakke/hmq/metrics"
+	"go.uber.org/zap"
+)
+
+// DefaultExpirySweepInterval is how often expired retained messages are
+// removed
+const DefaultExpirySweepInterval = time.Minute
+
+// setExpiry sets when packet expires, from its MQTT 5.0 Message Expiry
+// Interval or else from the first configured topic filter matching its topic.
+// Packets that already have an expiry keep it.
+func (b *Broker) setExpiry(packet *packets.PublishPacket, now time.Time) {
+	if !packet.Expiry.IsZero() {
+		return
+	}
+	if packet.Properties != nil && packet.Properties.MessageExpiry != nil {
+		packet.Expiry = now.Add(time.Duration(*packet.Properties.MessageExpiry) * time.Second)
+		return
+	}
+	for _, te := range b.config.MessageExpiry.Topics {
+		if matchTopic(te.Topic, packet.TopicName) {
+			packet.Expiry = now.Add(time.Duration(te.Expiry) * time.Second)
+			return
+		}
+	}
+}
+
+// expired reports whether packet expired at now before it was delivered to
+// the client and counts it
+func (c *client) expired(packet *packets.PublishPacket, now time.Time) bool {
+	if !packet.Expired(now) {
+		return false
+	}
+	log.Debug("message expired, discarded", zap.String("ClientID", c.info.clientID), zap.String("topic", packet.TopicName))
+	if c.broker != nil {
+		_ = c.broker.metrics.Inc(metrics.MetricNumberOfExpiredMessages)
+	}
+	return true
+}
+
+// remainingExpiry returns packet with its Message Expiry Interval set to the
+// time left until it expires, rounded up
+func remainingExpiry(packet *packets.PublishPacket, now time.Time) *packets.PublishPacket {
+	if packet.Expiry.IsZero() || packet.Properties == nil || packet.Properties.MessageExpiry == nil {
+		return packet
+	}
+	left := uint32((packet.Expiry.Sub(now) + time.Second - 1) / time.Second)
+	if left == *packet.Properties.MessageExpiry {
+		return packet
+	}
+	p := *packet
+	p.Properties = packet.Properties.Copy()
+	p.Properties.MessageExpiry = packets.Uint32Ptr(left)
+	return &p
+}
+
+// expiryLoop removes the expired retained messages every interval
+func (b *Broker) expiryLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.quit:
+			return
+		case now := <-ticker.C:
+			if n := len(b.topicsMgr.ExpireRetained(now)); n > 0 {
+				log.Debug("expired retained messages removed", zap.Int("count", n))
+				for i := 0; i < n; i++ {
+					_ = b.metrics.Inc(metrics.MetricNumberOfExpiredMessages)
+				}
+			}
+		}
+	}
+}
+
+// matchTopic reports whether topic matches the topic filter, wildcards do
+// not match the first level of $ topics
+func matchTopic(filter, topic string) bool {
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (fs[0] == "+" || fs[0] == "#") {
+		return false
+	}
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
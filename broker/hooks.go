@@ -0,0 +1,176 @@
+package broker
+
+import (
+	"net"
+	"sync"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+)
+
+// ClientInfo describes the client a hook is called for
+type ClientInfo struct {
+	ClientID        string
+	Username        string
+	RemoteIP        string
+	ProtocolVersion byte
+}
+
+// SubscriptionRequest is a topic filter a client subscribes to
+type SubscriptionRequest struct {
+	Filter string
+	Qos    byte
+}
+
+// Hook observes and changes what the broker does with clients and their
+// messages. Hooks are called in the order they were added with AddHook,
+// from the worker processing the client, so they must not block. Embed
+// HookBase to implement only some of the methods.
+type Hook interface {
+	// OnConnect is called once a client is authenticated. The client
+	// identifier of connect may be rewritten. Returning a CONNACK return
+	// code or reason code other than packets.Accepted rejects the client.
+	OnConnect(client ClientInfo, connect *packets.ConnectPacket) byte
+
+	// OnPublish is called for every message published by a client, before
+	// the auth plugin checks the topic. The topic, payload and properties of
+	// packet may be changed, returning false drops the message. Dropped
+	// messages are still acknowledged.
+	OnPublish(client ClientInfo, packet *packets.PublishPacket) bool
+
+	// OnSubscribe is called for every topic filter a client subscribes to,
+	// before the auth plugin checks the filter. The filter may be rewritten
+	// and the QoS downgraded, returning a reason code of 0x80 or above
+	// rejects the subscription.
+	OnSubscribe(client ClientInfo, sub *SubscriptionRequest) byte
+
+	// OnDeliver is called before a message is sent to a subscriber with a
+	// copy of the message that may be changed, returning false skips the
+	// subscriber. The payload is shared between subscribers, replace it
+	// instead of modifying it.
+	OnDeliver(client ClientInfo, packet *packets.PublishPacket) bool
+
+	// OnDisconnect is called when the connection of a client is closed
+	OnDisconnect(client ClientInfo)
+
+	// OnSessionExpired is called when the persistent session of a client
+	// expires, not when the client replaces it with a clean session
+	OnSessionExpired(clientID string)
+}
+
+// HookBase implements Hook without changing anything
+type HookBase struct{}
+
+func (HookBase) OnConnect(ClientInfo, *packets.ConnectPacket) byte { return packets.Accepted }
+func (HookBase) OnPublish(ClientInfo, *packets.PublishPacket) bool { return true }
+func (HookBase) OnSubscribe(ClientInfo, *SubscriptionRequest) byte { return packets.ReasonSuccess }
+func (HookBase) OnDeliver(ClientInfo, *packets.PublishPacket) bool { return true }
+func (HookBase) OnDisconnect(ClientInfo)                           {}
+func (HookBase) OnSessionExpired(string)                           {}
+
+// hookChain runs the hooks added to the broker in order
+type hookChain struct {
+	mu    sync.RWMutex
+	hooks []Hook
+}
+
+// AddHook appends h to the hooks of the broker
+func (b *Broker) AddHook(h Hook) {
+	b.hooks.mu.Lock()
+	defer b.hooks.mu.Unlock()
+
+	hooks := make([]Hook, len(b.hooks.hooks), len(b.hooks.hooks)+1)
+	copy(hooks, b.hooks.hooks)
+	b.hooks.hooks = append(hooks, h)
+}
+
+func (hc *hookChain) list() []Hook {
+	if hc == nil {
+		return nil
+	}
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	return hc.hooks
+}
+
+func (hc *hookChain) onConnect(client ClientInfo, connect *packets.ConnectPacket) byte {
+	for _, h := range hc.list() {
+		if rc := h.OnConnect(client, connect); rc != packets.Accepted {
+			return rc
+		}
+		client.ClientID = connect.ClientIdentifier
+	}
+	return packets.Accepted
+}
+
+func (hc *hookChain) onPublish(client ClientInfo, packet *packets.PublishPacket) bool {
+	for _, h := range hc.list() {
+		if !h.OnPublish(client, packet) {
+			return false
+		}
+	}
+	return true
+}
+
+func (hc *hookChain) onSubscribe(client ClientInfo, sub *SubscriptionRequest) byte {
+	requested := sub.Qos
+	for _, h := range hc.list() {
+		if rc := h.OnSubscribe(client, sub); rc >= packets.ReasonUnspecifiedError {
+			return rc
+		}
+		// hooks may only downgrade the QoS
+		if sub.Qos > requested {
+			sub.Qos = requested
+		}
+	}
+	return packets.ReasonSuccess
+}
+
+// onDeliver returns the packet to send to the subscriber, or nil when it is
+// skipped
+func (hc *hookChain) onDeliver(client ClientInfo, packet *packets.PublishPacket) *packets.PublishPacket {
+	hooks := hc.list()
+	if len(hooks) == 0 {
+		return packet
+	}
+
+	p := *packet
+	p.Properties = packet.Properties.Copy()
+	for _, h := range hooks {
+		if !h.OnDeliver(client, &p) {
+			return nil
+		}
+	}
+	return &p
+}
+
+func (hc *hookChain) onDisconnect(client ClientInfo) {
+	for _, h := range hc.list() {
+		h.OnDisconnect(client)
+	}
+}
+
+func (hc *hookChain) onSessionExpired(clientID string) {
+	for _, h := range hc.list() {
+		h.OnSessionExpired(clientID)
+	}
+}
+
+// hookInfo describes c to the hooks
+func (c *client) hookInfo() ClientInfo {
+	return ClientInfo{
+		ClientID:        c.info.clientID,
+		Username:        c.info.username,
+		RemoteIP:        c.info.remoteIP,
+		ProtocolVersion: c.info.protocolVersion,
+	}
+}
+
+// connectInfo describes a client that is not accepted yet to the hooks
+func connectInfo(conn net.Conn, connect *packets.ConnectPacket) ClientInfo {
+	return ClientInfo{
+		ClientID:        connect.ClientIdentifier,
+		Username:        connect.Username,
+		RemoteIP:        remoteIP(conn),
+		ProtocolVersion: connect.ProtocolVersion,
+	}
+}
@@ -1,8 +1,11 @@
 package broker
 
 import (
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 	"github.com/habakke/hmq/metrics"
+	"go.uber.org/zap"
 )
 
 func InitHTTP(b *Broker) {
@@ -13,6 +16,17 @@ func InitHTTP(b *Broker) {
 	b.metrics.Init(router)
 	_ = b.metrics.Add(metrics.MetricNumberOfMessages, "Total number of packets received")
 	_ = b.metrics.Add(metrics.MetricNumberOfClients, "Total number of clients connected")
+	_ = b.metrics.Add(metrics.MetricNumberOfDroppedMessages, "Total number of messages dropped from full outbound queues")
+	_ = b.metrics.Add(metrics.MetricNumberOfSlowConsumers, "Total number of clients disconnected as slow consumers")
+	_ = b.metrics.Add(metrics.MetricNumberOfRefusedConnections, "Total number of connections refused by connection limits")
+	_ = b.metrics.Add(metrics.MetricNumberOfRateLimitedConnections, "Total number of connections refused by the connection rate limit")
+	_ = b.metrics.Add(metrics.MetricNumberOfConnectTimeouts, "Total number of connections closed before sending CONNECT")
+	_ = b.metrics.Add(metrics.MetricNumberOfOversizedPackets, "Total number of clients disconnected for exceeding the maximum packet size")
+	_ = b.metrics.Add(metrics.MetricNumberOfThrottledMessages, "Total number of messages delayed by publish limits")
+	_ = b.metrics.Add(metrics.MetricNumberOfRateLimitedClients, "Total number of clients disconnected for exceeding their publish limits")
+	_ = b.metrics.Add(metrics.MetricNumberOfDeadLetters, "Total number of messages given up after the maximum number of retries")
+	_ = b.metrics.Add(metrics.MetricNumberOfExpiredMessages, "Total number of messages discarded because they expired")
+	_ = b.metrics.Add(metrics.MetricNumberOfExpiredSessions, "Total number of persistent sessions removed because they expired")
 
 	router.DELETE("api/v1/connections/:clientid", func(c *gin.Context) {
 		clientid := c.Param("clientid")
@@ -29,5 +43,24 @@ func InitHTTP(b *Broker) {
 		c.JSON(200, &resp)
 	})
 
-	_ = router.Run(":" + b.config.HTTPPort)
+	router.POST("api/v1/auth/reload", func(c *gin.Context) {
+		if err := b.ReloadAuth(); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"code": 1, "error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"code": 0})
+	})
+
+	srv := &http.Server{Addr: ":" + b.config.HTTPPort, Handler: router}
+	b.mu.Lock()
+	if b.shuttingDown() {
+		b.mu.Unlock()
+		return
+	}
+	b.httpServer = srv
+	b.mu.Unlock()
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Error("http server error", zap.Error(err))
+	}
 }
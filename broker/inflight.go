@@ -0,0 +1,336 @@
+package broker
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"github.com/habakke/hmq/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultRetryInterval is the time before an unacknowledged message is
+	// sent again for the first time
+	DefaultRetryInterval = 20 * time.Second
+	// DefaultMaxRetryInterval caps the doubling retry interval
+	DefaultMaxRetryInterval = 5 * time.Minute
+)
+
+// maxInflight is the number of QoS 1 and 2 messages the client may have
+// unacknowledged, the smaller of the configured limit and the Receive
+// Maximum of an MQTT 5.0 client. It is 0 when unlimited.
+func (c *client) maxInflight() int {
+	max := 0
+	if c.broker != nil {
+		max = c.broker.config.Delivery.MaxInflight
+	}
+	if rm := int(c.info.receiveMaximum); rm > 0 && (max == 0 || rm < max) {
+		max = rm
+	}
+	return max
+}
+
+// inflightFull reports whether a message has to wait before it is sent,
+// pending messages go first to keep the order. c.inflightMu must be held.
+func (c *client) inflightFull() bool {
+	if len(c.pending) > 0 {
+		return true
+	}
+	max := c.maxInflight()
+	return max > 0 && len(c.inflight) >= max
+}
+
+// queuePending queues packet until there is room in the inflight window,
+// packets beyond the session queue limit are dropped. c.inflightMu must be
+// held.
+func (c *client) queuePending(packet *packets.PublishPacket) {
+	if max := c.broker.config.Session.MaxQueuedMessages; max > 0 && len(c.pending) >= max {
+		log.Warn("inflight window full, message dropped", zap.String("ClientID", c.info.clientID), zap.String("topic", packet.TopicName))
+		c.broker.stats.dropped()
+		_ = c.broker.metrics.Inc(metrics.MetricNumberOfDroppedMessages)
+		return
+	}
+	c.pending = append(c.pending, packet)
+	c.inflightChanged()
+}
+
+// addInflight allocates a packet identifier for packet and keeps it in
+// flight until it is acknowledged. It returns the packet to send, or nil
+// when no identifier is free. c.inflightMu must be held.
+func (c *client) addInflight(packet *packets.PublishPacket) *packets.PublishPacket {
+	id, ok := c.nextPacketID(packet)
+	if !ok {
+		log.Error("no packet identifier available, message dropped", zap.String("ClientID", c.info.clientID), zap.String("topic", packet.TopicName))
+		return nil
+	}
+	p := *packet
+	p.MessageID = id
+	c.inflight[id] = &inflightElem{status: Publish, packet: &p, timestamp: time.Now().Unix()}
+	c.inflightChanged()
+	return &p
+}
+
+// fillInflight moves pending messages into the inflight window while it has
+// room and returns them to be sent. c.inflightMu must be held.
+func (c *client) fillInflight() []*packets.PublishPacket {
+	var send []*packets.PublishPacket
+	now := time.Now()
+	for len(c.pending) > 0 {
+		if max := c.maxInflight(); max > 0 && len(c.inflight) >= max {
+			break
+		}
+		packet := c.pending[0]
+		c.pending[0] = nil
+		c.pending = c.pending[1:]
+		if c.expired(packet, now) {
+			continue
+		}
+		if p := c.addInflight(remainingExpiry(packet, now)); p != nil {
+			send = append(send, p)
+		}
+	}
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+	return send
+}
+
+func (c *client) writeInflight(send []*packets.PublishPacket) {
+	if len(send) == 0 {
+		return
+	}
+	for _, packet := range send {
+		if err := c.WriterPacket(packet); err != nil {
+			log.Error("process message for psub error,  ", zap.Error(err))
+		}
+	}
+	c.ensureRetryTimer(c.retryBackoff(0))
+}
+
+// ackInflight ends the delivery of message id and sends the pending
+// messages that fit into the inflight window now. It reports whether id was
+// in flight.
+func (c *client) ackInflight(id uint16) bool {
+	c.inflightMu.Lock()
+	_, found := c.inflight[id]
+	delete(c.inflight, id)
+	if found {
+		c.inflightChanged()
+	}
+	send := c.fillInflight()
+	c.inflightMu.Unlock()
+
+	c.writeInflight(send)
+	return found
+}
+
+// discardInflight ends the delivery of packet, a message in flight that is
+// not sent, and sends the pending messages that fit into the inflight window
+// now
+func (c *client) discardInflight(packet *packets.PublishPacket) {
+	c.inflightMu.Lock()
+	if elem, found := c.inflight[packet.MessageID]; !found || elem.packet != packet {
+		c.inflightMu.Unlock()
+		return
+	}
+	delete(c.inflight, packet.MessageID)
+	c.inflightChanged()
+	send := c.fillInflight()
+	c.inflightMu.Unlock()
+
+	c.writeInflight(send)
+}
+
+// retryBackoff is the number of seconds to wait for an acknowledgement after
+// a message was sent retries times before, doubled on every retry
+func (c *client) retryBackoff(retries int) int64 {
+	interval, max := DefaultRetryInterval, DefaultMaxRetryInterval
+	if c.broker != nil {
+		delivery := c.broker.config.Delivery
+		if delivery.RetryInterval > 0 {
+			interval = time.Duration(delivery.RetryInterval) * time.Second
+		}
+		if delivery.MaxRetryInterval > 0 {
+			max = time.Duration(delivery.MaxRetryInterval) * time.Second
+		}
+	}
+	for i := 0; i < retries && interval < max; i++ {
+		interval *= 2
+	}
+	if interval > max {
+		interval = max
+	}
+	return int64(interval / time.Second)
+}
+
+// ensureRetryTimer retries the delivery in interval seconds unless a retry is
+// already scheduled
+func (c *client) ensureRetryTimer(interval int64) {
+	c.retryTimerLock.Lock()
+	defer c.retryTimerLock.Unlock()
+	if c.retryTimer != nil {
+		return
+	}
+	c.retryTimer = time.AfterFunc(time.Duration(interval)*time.Second, c.submitRetry)
+}
+
+// submitRetry runs retryDelivery in the worker shard of the client, like
+// the other changes of its inflight window
+func (c *client) submitRetry() {
+	if c.broker == nil {
+		c.retryDelivery()
+		return
+	}
+	c.broker.wpool.Submit(c.info.clientID, c.retryDelivery)
+}
+
+func (c *client) resetRetryTimer() {
+	// reset timer
+	c.retryTimerLock.Lock()
+	c.retryTimer = nil
+	c.retryTimerLock.Unlock()
+}
+
+// retryDelivery sends the messages that are not acknowledged in time again.
+// Messages that reached the maximum number of retries are given up and sent
+// to the dead-letter topic, messages that expired are discarded. MQTT 5.0
+// only allows resending when the client reconnects, so messages to MQTT 5.0
+// clients are not sent again, they are given up after as many retry
+// intervals.
+func (c *client) retryDelivery() {
+	c.resetRetryTimer()
+	if c.conn == nil {
+		return
+	}
+
+	maxRetries := 0
+	if c.broker != nil {
+		maxRetries = c.broker.config.Delivery.MaxRetries
+	}
+	t := time.Now()
+	now := t.Unix()
+	next := int64(-1)
+	var resend []packets.ControlPacket
+	var expired []*inflightElem
+	dropped := false
+	resends := c.info.protocolVersion < packets.Version5
+
+	c.inflightMu.Lock()
+	for id, infEle := range c.inflight {
+		age := now - infEle.timestamp
+		if age < 0 {
+			age = 0
+		}
+		if wait := c.retryBackoff(infEle.retries) - age; wait > 0 {
+			if next < 0 || wait < next {
+				next = wait
+			}
+			continue
+		}
+		if maxRetries > 0 && infEle.retries >= maxRetries {
+			delete(c.inflight, id)
+			expired = append(expired, infEle)
+			continue
+		}
+
+		if infEle.status == Publish {
+			if c.expired(infEle.packet, t) {
+				delete(c.inflight, id)
+				dropped = true
+				continue
+			}
+			if resends {
+				p := *remainingExpiry(infEle.packet, t)
+				p.Dup = true
+				resend = append(resend, &p)
+			}
+		} else if infEle.status == Pubrel && resends {
+			pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pubrel.MessageID = infEle.packet.MessageID
+			resend = append(resend, pubrel)
+		}
+		infEle.retries++
+		infEle.timestamp = now
+		if wait := c.retryBackoff(infEle.retries); next < 0 || wait < next {
+			next = wait
+		}
+	}
+	var send []*packets.PublishPacket
+	if len(expired) > 0 || dropped {
+		c.inflightChanged()
+		send = c.fillInflight()
+	}
+	c.inflightMu.Unlock()
+
+	for _, packet := range resend {
+		_ = c.WriterPacket(packet)
+	}
+	for _, infEle := range expired {
+		c.giveUp(infEle)
+	}
+	c.writeInflight(send)
+	if next >= 0 {
+		c.ensureRetryTimer(next)
+	}
+}
+
+// deadLetter is the payload of the messages published to the dead-letter
+// topic, it wraps the message given up
+type deadLetter struct {
+	ClientID  string `json:"clientid"`
+	Username  string `json:"username"`
+	Topic     string `json:"topic"`
+	Qos       byte   `json:"qos"`
+	Retries   int    `json:"retries"`
+	Payload   []byte `json:"payload"`
+	Timestamp int64  `json:"ts"`
+}
+
+// giveUp ends the delivery of a message that was not acknowledged after the
+// maximum number of retries. Messages the client did not receive are
+// published to the dead-letter topic wrapped in a deadLetter, MQTT 5.0
+// subscribers get the same information as user properties.
+func (c *client) giveUp(infEle *inflightElem) {
+	packet := infEle.packet
+	log.Warn("message not acknowledged after max retries, delivery given up", zap.String("ClientID", c.info.clientID), zap.String("topic", packet.TopicName), zap.Int("retries", infEle.retries))
+	b := c.broker
+	if b == nil || infEle.status != Publish {
+		return
+	}
+	_ = b.metrics.Inc(metrics.MetricNumberOfDeadLetters)
+
+	topic := b.config.Delivery.DeadLetterTopic
+	if topic == "" || packet.TopicName == topic {
+		return
+	}
+	payload, err := json.Marshal(deadLetter{
+		ClientID:  c.info.clientID,
+		Username:  c.info.username,
+		Topic:     packet.TopicName,
+		Qos:       packet.Qos,
+		Retries:   infEle.retries,
+		Payload:   packet.Payload,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		log.Error("encode dead letter error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+		return
+	}
+	dl := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	dl.TopicName = topic
+	dl.Qos = packet.Qos
+	dl.Payload = payload
+	dl.Properties = &packets.Properties{
+		User: []packets.UserProperty{
+			{Key: "original-topic", Value: packet.TopicName},
+			{Key: "client-id", Value: c.info.clientID},
+			{Key: "username", Value: c.info.username},
+			{Key: "retries", Value: strconv.Itoa(infEle.retries)},
+		},
+	}
+	if err := b.publishPacket(dl); err != nil {
+		log.Error("publish dead letter error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+	}
+}
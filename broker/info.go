@@ -5,7 +5,7 @@ import (
 	"time"
 
 	simplejson "github.com/bitly/go-simplejson"
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/habakke/hmq/broker/lib/packets"
 	"go.uber.org/zap"
 )
 
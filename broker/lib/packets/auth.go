@@ -0,0 +1,64 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// AuthPacket is an internal representation of the fields of the MQTT 5.0
+// Auth packet used for enhanced authentication
+type AuthPacket struct {
+	FixedHeader
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (a *AuthPacket) String() string {
+	return fmt.Sprintf("%s reasoncode: %d", a.FixedHeader, a.ReasonCode)
+}
+
+func (a *AuthPacket) Write(w io.Writer) error {
+	return a.Encode(w, Version5)
+}
+
+// Encode encodes the packet. AUTH only exists in MQTT 5.0, so it is always
+// encoded as such.
+func (a *AuthPacket) Encode(w io.Writer, version byte) error {
+	var body bytes.Buffer
+
+	if a.ReasonCode != ReasonSuccess || a.Properties != nil {
+		body.WriteByte(a.ReasonCode)
+		body.Write(encodeProperties(a.Properties))
+	}
+
+	return writePacket(w, &a.FixedHeader, body.Bytes())
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (a *AuthPacket) Unpack(b io.Reader) error {
+	return a.Decode(b, Version5)
+}
+
+// Decode decodes the packet body. AUTH packets are rejected below MQTT 5.0.
+func (a *AuthPacket) Decode(b io.Reader, version byte) error {
+	if version < Version5 {
+		return ErrUnsupportedPacket
+	}
+	rest, err := decodeRest(b)
+	if err != nil || len(rest) == 0 {
+		return err
+	}
+	a.ReasonCode = rest[0]
+	if len(rest) > 1 {
+		a.Properties, err = decodeProperties(bytes.NewReader(rest[1:]))
+	}
+	return err
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (a *AuthPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
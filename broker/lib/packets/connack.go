@@ -0,0 +1,70 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// ConnackPacket is an internal representation of the fields of the
+// Connack MQTT packet
+type ConnackPacket struct {
+	FixedHeader
+	SessionPresent bool
+	// ReturnCode holds the MQTT 3.1.1 return code or the MQTT 5.0 reason
+	// code. It is converted to the protocol level it is encoded for.
+	ReturnCode byte
+
+	// MQTT 5.0 only
+	Properties *Properties
+}
+
+func (ca *ConnackPacket) String() string {
+	return fmt.Sprintf("%s sessionpresent: %t returncode: %d properties: %s", ca.FixedHeader, ca.SessionPresent, ca.ReturnCode, ca.Properties)
+}
+
+func (ca *ConnackPacket) Write(w io.Writer) error {
+	return ca.Encode(w, Version311)
+}
+
+// Encode encodes the packet for the given protocol level
+func (ca *ConnackPacket) Encode(w io.Writer, version byte) error {
+	var body bytes.Buffer
+
+	body.WriteByte(boolToByte(ca.SessionPresent))
+	body.WriteByte(ConnackReasonCode(ca.ReturnCode, version))
+	if version >= Version5 {
+		body.Write(encodeProperties(ca.Properties))
+	}
+
+	return writePacket(w, &ca.FixedHeader, body.Bytes())
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (ca *ConnackPacket) Unpack(b io.Reader) error {
+	return ca.Decode(b, Version311)
+}
+
+// Decode decodes the packet body for the given protocol level
+func (ca *ConnackPacket) Decode(b io.Reader, version byte) error {
+	flags, err := decodeByte(b)
+	if err != nil {
+		return err
+	}
+	ca.SessionPresent = 1&flags > 0
+	ca.ReturnCode, err = decodeByte(b)
+	if err != nil {
+		return err
+	}
+	if version >= Version5 {
+		ca.Properties, err = decodeProperties(b)
+	}
+	return err
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (ca *ConnackPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
@@ -0,0 +1,189 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// ConnectPacket is an internal representation of the fields of the
+// Connect MQTT packet
+type ConnectPacket struct {
+	FixedHeader
+	ProtocolName    string
+	ProtocolVersion byte
+	CleanSession    bool
+	WillFlag        bool
+	WillQos         byte
+	WillRetain      bool
+	UsernameFlag    bool
+	PasswordFlag    bool
+	ReservedBit     byte
+	Keepalive       uint16
+
+	ClientIdentifier string
+	WillTopic        string
+	WillMessage      []byte
+	Username         string
+	Password         []byte
+
+	// MQTT 5.0 only
+	Properties     *Properties
+	WillProperties *Properties
+}
+
+func (c *ConnectPacket) String() string {
+	var password string
+	if len(c.Password) > 0 {
+		password = "<redacted>"
+	}
+	return fmt.Sprintf("%s protocolversion: %d protocolname: %s cleansession: %t willflag: %t WillQos: %d WillRetain: %t Usernameflag: %t Passwordflag: %t keepalive: %d clientId: %s willtopic: %s willmessage: %s Username: %s Password: %s properties: %s", c.FixedHeader, c.ProtocolVersion, c.ProtocolName, c.CleanSession, c.WillFlag, c.WillQos, c.WillRetain, c.UsernameFlag, c.PasswordFlag, c.Keepalive, c.ClientIdentifier, c.WillTopic, c.WillMessage, c.Username, password, c.Properties)
+}
+
+func (c *ConnectPacket) Write(w io.Writer) error {
+	return c.Encode(w, c.ProtocolVersion)
+}
+
+// Encode encodes the packet. The protocol level written is the one stored in
+// the packet, version only selects the MQTT 5.0 specific fields.
+func (c *ConnectPacket) Encode(w io.Writer, version byte) error {
+	var body bytes.Buffer
+
+	body.Write(encodeString(c.ProtocolName))
+	body.WriteByte(c.ProtocolVersion)
+	body.WriteByte(boolToByte(c.CleanSession)<<1 | boolToByte(c.WillFlag)<<2 | c.WillQos<<3 | boolToByte(c.WillRetain)<<5 | boolToByte(c.PasswordFlag)<<6 | boolToByte(c.UsernameFlag)<<7)
+	body.Write(encodeUint16(c.Keepalive))
+	if version >= Version5 {
+		body.Write(encodeProperties(c.Properties))
+	}
+	body.Write(encodeString(c.ClientIdentifier))
+	if c.WillFlag {
+		if version >= Version5 {
+			body.Write(encodeProperties(c.WillProperties))
+		}
+		body.Write(encodeString(c.WillTopic))
+		body.Write(encodeBytes(c.WillMessage))
+	}
+	if c.UsernameFlag {
+		body.Write(encodeString(c.Username))
+	}
+	if c.PasswordFlag {
+		body.Write(encodeBytes(c.Password))
+	}
+
+	return writePacket(w, &c.FixedHeader, body.Bytes())
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (c *ConnectPacket) Unpack(b io.Reader) error {
+	return c.Decode(b, Version311)
+}
+
+// Decode decodes the packet body. The protocol level announced in the packet
+// takes precedence over version since it is only known once read.
+func (c *ConnectPacket) Decode(b io.Reader, version byte) error {
+	var err error
+	c.ProtocolName, err = decodeString(b)
+	if err != nil {
+		return err
+	}
+	c.ProtocolVersion, err = decodeByte(b)
+	if err != nil {
+		return err
+	}
+	options, err := decodeByte(b)
+	if err != nil {
+		return err
+	}
+	c.ReservedBit = 1 & options
+	c.CleanSession = 1&(options>>1) > 0
+	c.WillFlag = 1&(options>>2) > 0
+	c.WillQos = 3 & (options >> 3)
+	c.WillRetain = 1&(options>>5) > 0
+	c.PasswordFlag = 1&(options>>6) > 0
+	c.UsernameFlag = 1&(options>>7) > 0
+	c.Keepalive, err = decodeUint16(b)
+	if err != nil {
+		return err
+	}
+	v5 := c.ProtocolVersion >= Version5
+	if v5 {
+		if c.Properties, err = decodeProperties(b); err != nil {
+			return err
+		}
+	}
+	c.ClientIdentifier, err = decodeString(b)
+	if err != nil {
+		return err
+	}
+	if c.WillFlag {
+		if v5 {
+			if c.WillProperties, err = decodeProperties(b); err != nil {
+				return err
+			}
+		}
+		c.WillTopic, err = decodeString(b)
+		if err != nil {
+			return err
+		}
+		c.WillMessage, err = decodeBytes(b)
+		if err != nil {
+			return err
+		}
+	}
+	if c.UsernameFlag {
+		c.Username, err = decodeString(b)
+		if err != nil {
+			return err
+		}
+	}
+	if c.PasswordFlag {
+		c.Password, err = decodeBytes(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate performs validation of the fields of a Connect packet. The
+// returned code is an MQTT 3.1.1 return code, use ConnackReasonCode to
+// convert it for MQTT 5.0 clients.
+func (c *ConnectPacket) Validate() byte {
+	if c.PasswordFlag && !c.UsernameFlag && c.ProtocolVersion < Version5 {
+		return ErrRefusedBadUsernameOrPassword
+	}
+	if c.ReservedBit != 0 {
+		// Bad reserved bit
+		return ErrProtocolViolation
+	}
+	if (c.ProtocolName == "MQIsdp" && c.ProtocolVersion != Version31) ||
+		(c.ProtocolName == "MQTT" && c.ProtocolVersion != Version311 && c.ProtocolVersion != Version5) {
+		// Mismatched or unsupported protocol version
+		return ErrRefusedBadProtocolVersion
+	}
+	if c.ProtocolName != "MQIsdp" && c.ProtocolName != "MQTT" {
+		// Bad protocol name
+		return ErrProtocolViolation
+	}
+	if c.WillQos > 2 || (!c.WillFlag && (c.WillQos != 0 || c.WillRetain)) {
+		return ErrProtocolViolation
+	}
+	if len(c.ClientIdentifier) > 65535 || len(c.Username) > 65535 || len(c.Password) > 65535 {
+		// Bad size field
+		return ErrProtocolViolation
+	}
+	if len(c.ClientIdentifier) == 0 && !c.CleanSession && c.ProtocolVersion < Version5 {
+		// Bad client identifier
+		return ErrRefusedIDRejected
+	}
+	return Accepted
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (c *ConnectPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
@@ -0,0 +1,67 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// DisconnectPacket is an internal representation of the fields of the
+// Disconnect MQTT packet
+type DisconnectPacket struct {
+	FixedHeader
+
+	// MQTT 5.0 only
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (d *DisconnectPacket) String() string {
+	return fmt.Sprintf("%s reasoncode: %d", d.FixedHeader, d.ReasonCode)
+}
+
+func (d *DisconnectPacket) Write(w io.Writer) error {
+	return d.Encode(w, Version311)
+}
+
+// Encode encodes the packet for the given protocol level
+func (d *DisconnectPacket) Encode(w io.Writer, version byte) error {
+	var body bytes.Buffer
+
+	if version >= Version5 && (d.ReasonCode != ReasonNormalDisconnection || d.Properties != nil) {
+		body.WriteByte(d.ReasonCode)
+		if d.Properties != nil {
+			body.Write(encodeProperties(d.Properties))
+		}
+	}
+
+	return writePacket(w, &d.FixedHeader, body.Bytes())
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (d *DisconnectPacket) Unpack(b io.Reader) error {
+	return d.Decode(b, Version311)
+}
+
+// Decode decodes the packet body for the given protocol level
+func (d *DisconnectPacket) Decode(b io.Reader, version byte) error {
+	if version < Version5 {
+		return nil
+	}
+	rest, err := decodeRest(b)
+	if err != nil || len(rest) == 0 {
+		return err
+	}
+	d.ReasonCode = rest[0]
+	if len(rest) > 1 {
+		d.Properties, err = decodeProperties(bytes.NewReader(rest[1:]))
+	}
+	return err
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (d *DisconnectPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
@@ -0,0 +1,455 @@
+// Package packets implements encoding and decoding of MQTT 3.1, 3.1.1 and 5.0
+// control packets.
+//
+// The API follows the one of github.com/eclipse/paho.mqtt.golang/packets so
+// the broker can handle packets of every protocol level through the same
+// types. Packets read from the wire carry the fields of the protocol level
+// they were decoded with; fields that only exist in MQTT 5.0 (properties and
+// reason codes) are ignored when a packet is encoded for an older level.
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Protocol levels as sent in the CONNECT packet
+const (
+	Version31  byte = 3
+	Version311 byte = 4
+	Version5   byte = 5
+)
+
+// ControlPacket defines the interface for structs intended to hold
+// decoded MQTT packets, either from being read or before being
+// written
+type ControlPacket interface {
+	// Write encodes the packet using MQTT 3.1.1
+	Write(io.Writer) error
+	// Encode encodes the packet for the given protocol level
+	Encode(w io.Writer, version byte) error
+	// Unpack decodes the packet body using MQTT 3.1.1
+	Unpack(io.Reader) error
+	// Decode decodes the packet body for the given protocol level
+	Decode(r io.Reader, version byte) error
+	String() string
+	Details() Details
+}
+
+// PacketNames maps the constants for each of the MQTT packet types
+// to a string representation of their name.
+var PacketNames = map[uint8]string{
+	1:  "CONNECT",
+	2:  "CONNACK",
+	3:  "PUBLISH",
+	4:  "PUBACK",
+	5:  "PUBREC",
+	6:  "PUBREL",
+	7:  "PUBCOMP",
+	8:  "SUBSCRIBE",
+	9:  "SUBACK",
+	10: "UNSUBSCRIBE",
+	11: "UNSUBACK",
+	12: "PINGREQ",
+	13: "PINGRESP",
+	14: "DISCONNECT",
+	15: "AUTH",
+}
+
+// Below are the constants assigned to each of the MQTT packet types
+const (
+	Connect     = 1
+	Connack     = 2
+	Publish     = 3
+	Puback      = 4
+	Pubrec      = 5
+	Pubrel      = 6
+	Pubcomp     = 7
+	Subscribe   = 8
+	Suback      = 9
+	Unsubscribe = 10
+	Unsuback    = 11
+	Pingreq     = 12
+	Pingresp    = 13
+	Disconnect  = 14
+	Auth        = 15
+)
+
+// Below are the const definitions for error codes returned by
+// Connect()
+const (
+	Accepted                        = 0x00
+	ErrRefusedBadProtocolVersion    = 0x01
+	ErrRefusedIDRejected            = 0x02
+	ErrRefusedServerUnavailable     = 0x03
+	ErrRefusedBadUsernameOrPassword = 0x04
+	ErrRefusedNotAuthorised         = 0x05
+	ErrNetworkError                 = 0xFE
+	ErrProtocolViolation            = 0xFF
+)
+
+// ConnackReturnCodes is a map of the error codes constants for Connect()
+// to a string representation of the error
+var ConnackReturnCodes = map[uint8]string{
+	0:   "Connection Accepted",
+	1:   "Connection Refused: Bad Protocol Version",
+	2:   "Connection Refused: Client Identifier Rejected",
+	3:   "Connection Refused: Server Unavailable",
+	4:   "Connection Refused: Username or Password in unknown format",
+	5:   "Connection Refused: Not Authorised",
+	254: "Connection Error",
+	255: "Connection Refused: Protocol Violation",
+}
+
+var (
+	ErrMalformedPacket      = errors.New("malformed packet")
+	ErrUnsupportedPacket    = errors.New("unsupported packet type")
+	ErrInvalidRemainingSize = errors.New("invalid remaining length")
+	ErrPacketTooLarge       = errors.New("packet too large")
+)
+
+// ReadPacket takes an instance of an io.Reader (such as net.Conn) and attempts
+// to read an MQTT 3.1.1 packet from the stream. A CONNECT packet is always
+// decoded according to the protocol level it announces.
+func ReadPacket(r io.Reader) (ControlPacket, error) {
+	return ReadPacketVersion(r, Version311)
+}
+
+// ReadPacketVersion reads a packet from the stream and decodes it according to
+// the given protocol level. It returns a ControlPacket representing the
+// decoded MQTT packet and an error. One of these returns will always be nil,
+// a nil ControlPacket indicating an error occurred.
+func ReadPacketVersion(r io.Reader, version byte) (ControlPacket, error) {
+	return ReadPacketLimit(r, version, 0)
+}
+
+// ReadPacketLimit reads a packet like ReadPacketVersion, packets larger than
+// maxSize bytes including the fixed header are rejected with
+// ErrPacketTooLarge before their body is read. A maxSize of 0 only applies
+// the limit of the protocol.
+func ReadPacketLimit(r io.Reader, version byte, maxSize int) (ControlPacket, error) {
+	var fh FixedHeader
+	b := make([]byte, 1)
+
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fh.unpack(b[0], r)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && 1+len(encodeLength(fh.RemainingLength))+fh.RemainingLength > maxSize {
+		return nil, ErrPacketTooLarge
+	}
+
+	cp, err := NewControlPacketWithHeader(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	packetBytes := make([]byte, fh.RemainingLength)
+	n, err := io.ReadFull(r, packetBytes)
+	if err != nil {
+		return nil, err
+	}
+	if n != fh.RemainingLength {
+		return nil, errors.New("failed to read expected data")
+	}
+
+	err = cp.Decode(bytes.NewBuffer(packetBytes), version)
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// NewControlPacket is used to create a new ControlPacket of the type specified
+// by packetType, this is usually done by reference to the packet type constants
+// defined in packets.go. The newly created ControlPacket is empty and a pointer
+// is returned.
+func NewControlPacket(packetType byte) ControlPacket {
+	switch packetType {
+	case Connect:
+		return &ConnectPacket{FixedHeader: FixedHeader{MessageType: Connect}}
+	case Connack:
+		return &ConnackPacket{FixedHeader: FixedHeader{MessageType: Connack}}
+	case Disconnect:
+		return &DisconnectPacket{FixedHeader: FixedHeader{MessageType: Disconnect}}
+	case Publish:
+		return &PublishPacket{FixedHeader: FixedHeader{MessageType: Publish}}
+	case Puback:
+		return &PubackPacket{FixedHeader: FixedHeader{MessageType: Puback}}
+	case Pubrec:
+		return &PubrecPacket{FixedHeader: FixedHeader{MessageType: Pubrec}}
+	case Pubrel:
+		return &PubrelPacket{FixedHeader: FixedHeader{MessageType: Pubrel, Qos: 1}}
+	case Pubcomp:
+		return &PubcompPacket{FixedHeader: FixedHeader{MessageType: Pubcomp}}
+	case Subscribe:
+		return &SubscribePacket{FixedHeader: FixedHeader{MessageType: Subscribe, Qos: 1}}
+	case Suback:
+		return &SubackPacket{FixedHeader: FixedHeader{MessageType: Suback}}
+	case Unsubscribe:
+		return &UnsubscribePacket{FixedHeader: FixedHeader{MessageType: Unsubscribe, Qos: 1}}
+	case Unsuback:
+		return &UnsubackPacket{FixedHeader: FixedHeader{MessageType: Unsuback}}
+	case Pingreq:
+		return &PingreqPacket{FixedHeader: FixedHeader{MessageType: Pingreq}}
+	case Pingresp:
+		return &PingrespPacket{FixedHeader: FixedHeader{MessageType: Pingresp}}
+	case Auth:
+		return &AuthPacket{FixedHeader: FixedHeader{MessageType: Auth}}
+	}
+	return nil
+}
+
+// NewControlPacketWithHeader is used to create a new ControlPacket of the type
+// specified within the FixedHeader that is passed to the function.
+// The newly created ControlPacket is empty and a pointer is returned.
+func NewControlPacketWithHeader(fh FixedHeader) (ControlPacket, error) {
+	switch fh.MessageType {
+	case Connect:
+		return &ConnectPacket{FixedHeader: fh}, nil
+	case Connack:
+		return &ConnackPacket{FixedHeader: fh}, nil
+	case Disconnect:
+		return &DisconnectPacket{FixedHeader: fh}, nil
+	case Publish:
+		return &PublishPacket{FixedHeader: fh}, nil
+	case Puback:
+		return &PubackPacket{FixedHeader: fh}, nil
+	case Pubrec:
+		return &PubrecPacket{FixedHeader: fh}, nil
+	case Pubrel:
+		return &PubrelPacket{FixedHeader: fh}, nil
+	case Pubcomp:
+		return &PubcompPacket{FixedHeader: fh}, nil
+	case Subscribe:
+		return &SubscribePacket{FixedHeader: fh}, nil
+	case Suback:
+		return &SubackPacket{FixedHeader: fh}, nil
+	case Unsubscribe:
+		return &UnsubscribePacket{FixedHeader: fh}, nil
+	case Unsuback:
+		return &UnsubackPacket{FixedHeader: fh}, nil
+	case Pingreq:
+		return &PingreqPacket{FixedHeader: fh}, nil
+	case Pingresp:
+		return &PingrespPacket{FixedHeader: fh}, nil
+	case Auth:
+		return &AuthPacket{FixedHeader: fh}, nil
+	}
+	return nil, fmt.Errorf("%w 0x%x", ErrUnsupportedPacket, fh.MessageType)
+}
+
+// Details struct returned by the Details() function called on
+// ControlPackets to present details of the Qos and MessageID
+// of the ControlPacket
+type Details struct {
+	Qos       byte
+	MessageID uint16
+}
+
+// FixedHeader is a struct to hold the decoded information from
+// the fixed header of an MQTT ControlPacket
+type FixedHeader struct {
+	MessageType     byte
+	Dup             bool
+	Qos             byte
+	Retain          bool
+	RemainingLength int
+}
+
+func (fh FixedHeader) String() string {
+	return fmt.Sprintf("%s: dup: %t qos: %d retain: %t rLength: %d", PacketNames[fh.MessageType], fh.Dup, fh.Qos, fh.Retain, fh.RemainingLength)
+}
+
+func boolToByte(b bool) byte {
+	switch b {
+	case true:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// pack encodes the fixed header for a packet with the given body length. The
+// header itself is left untouched so a packet can be encoded concurrently for
+// several receivers.
+func (fh *FixedHeader) pack(remainingLength int) bytes.Buffer {
+	var header bytes.Buffer
+	header.WriteByte(fh.MessageType<<4 | boolToByte(fh.Dup)<<3 | fh.Qos<<1 | boolToByte(fh.Retain))
+	header.Write(encodeLength(remainingLength))
+	return header
+}
+
+func (fh *FixedHeader) unpack(typeAndFlags byte, r io.Reader) error {
+	fh.MessageType = typeAndFlags >> 4
+	fh.Dup = (typeAndFlags>>3)&0x01 > 0
+	fh.Qos = (typeAndFlags >> 1) & 0x03
+	fh.Retain = typeAndFlags&0x01 > 0
+
+	var err error
+	fh.RemainingLength, err = decodeLength(r)
+	return err
+}
+
+// writePacket writes the fixed header followed by the body to w in a single
+// call so packets of concurrent writers never interleave.
+func writePacket(w io.Writer, fh *FixedHeader, body []byte) error {
+	packet := fh.pack(len(body))
+	packet.Write(body)
+	_, err := packet.WriteTo(w)
+	return err
+}
+
+func decodeByte(b io.Reader) (byte, error) {
+	num := make([]byte, 1)
+	_, err := io.ReadFull(b, num)
+	if err != nil {
+		return 0, ErrMalformedPacket
+	}
+
+	return num[0], nil
+}
+
+func decodeUint16(b io.Reader) (uint16, error) {
+	num := make([]byte, 2)
+	_, err := io.ReadFull(b, num)
+	if err != nil {
+		return 0, ErrMalformedPacket
+	}
+	return binary.BigEndian.Uint16(num), nil
+}
+
+func encodeUint16(num uint16) []byte {
+	bytesResult := make([]byte, 2)
+	binary.BigEndian.PutUint16(bytesResult, num)
+	return bytesResult
+}
+
+func decodeUint32(b io.Reader) (uint32, error) {
+	num := make([]byte, 4)
+	_, err := io.ReadFull(b, num)
+	if err != nil {
+		return 0, ErrMalformedPacket
+	}
+	return binary.BigEndian.Uint32(num), nil
+}
+
+func encodeUint32(num uint32) []byte {
+	bytesResult := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytesResult, num)
+	return bytesResult
+}
+
+func encodeString(field string) []byte {
+	return encodeBytes([]byte(field))
+}
+
+func decodeString(b io.Reader) (string, error) {
+	buf, err := decodeBytes(b)
+	return string(buf), err
+}
+
+func decodeBytes(b io.Reader) ([]byte, error) {
+	fieldLength, err := decodeUint16(b)
+	if err != nil {
+		return nil, err
+	}
+
+	field := make([]byte, fieldLength)
+	_, err = io.ReadFull(b, field)
+	if err != nil {
+		return nil, ErrMalformedPacket
+	}
+
+	return field, nil
+}
+
+func decodeRest(b io.Reader) ([]byte, error) {
+	return ioutil.ReadAll(b)
+}
+
+func encodeBytes(field []byte) []byte {
+	fieldLength := make([]byte, 2)
+	binary.BigEndian.PutUint16(fieldLength, uint16(len(field)))
+	return append(fieldLength, field...)
+}
+
+func encodeLength(length int) []byte {
+	var encLength []byte
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		encLength = append(encLength, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return encLength
+}
+
+// decodeLength decodes a variable byte integer as used for the remaining
+// length and several MQTT 5.0 properties. At most four bytes are consumed.
+func decodeLength(r io.Reader) (int, error) {
+	var rLength uint32
+	var multiplier uint32
+	b := make([]byte, 1)
+	for {
+		if multiplier > 21 {
+			return 0, ErrInvalidRemainingSize
+		}
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return 0, err
+		}
+
+		digit := b[0]
+		rLength |= uint32(digit&127) << multiplier
+		if (digit & 128) == 0 {
+			break
+		}
+		multiplier += 7
+	}
+	return int(rLength), nil
+}
+
+// encodeAck encodes the body shared by PUBACK, PUBREC, PUBREL and PUBCOMP.
+// MQTT 5.0 allows leaving out a success reason code without properties.
+func encodeAck(messageID uint16, reasonCode byte, props *Properties, version byte) []byte {
+	body := encodeUint16(messageID)
+	if version < Version5 || (reasonCode == ReasonSuccess && props == nil) {
+		return body
+	}
+	body = append(body, reasonCode)
+	if props != nil {
+		body = append(body, encodeProperties(props)...)
+	}
+	return body
+}
+
+func decodeAck(b io.Reader, version byte) (uint16, byte, *Properties, error) {
+	messageID, err := decodeUint16(b)
+	if err != nil || version < Version5 {
+		return messageID, ReasonSuccess, nil, err
+	}
+	rest, err := decodeRest(b)
+	if err != nil || len(rest) == 0 {
+		return messageID, ReasonSuccess, nil, err
+	}
+	if len(rest) == 1 {
+		return messageID, rest[0], nil, nil
+	}
+	props, err := decodeProperties(bytes.NewReader(rest[1:]))
+	return messageID, rest[0], props, err
+}
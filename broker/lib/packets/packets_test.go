@@ -0,0 +1,198 @@
+package packets
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func roundTrip(t *testing.T, p ControlPacket, version byte) ControlPacket {
+	var buf bytes.Buffer
+	assert.Nil(t, p.Encode(&buf, version))
+
+	out, err := ReadPacketVersion(&buf, version)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, buf.Len())
+	return out
+}
+
+func TestConnectV5(t *testing.T) {
+	c := NewControlPacket(Connect).(*ConnectPacket)
+	c.ProtocolName = "MQTT"
+	c.ProtocolVersion = Version5
+	c.CleanSession = true
+	c.Keepalive = 30
+	c.ClientIdentifier = "client-1"
+	c.WillFlag = true
+	c.WillQos = 1
+	c.WillTopic = "will/topic"
+	c.WillMessage = []byte("gone")
+	c.UsernameFlag = true
+	c.Username = "user"
+	c.Properties = &Properties{
+		SessionExpiryInterval: Uint32Ptr(3600),
+		ReceiveMaximum:        Uint16Ptr(10),
+		User:                  []UserProperty{{Key: "k", Value: "v"}},
+	}
+	c.WillProperties = &Properties{WillDelayInterval: Uint32Ptr(5)}
+
+	// CONNECT announces its own protocol level, so it is read as a 3.1.1 packet
+	var buf bytes.Buffer
+	assert.Nil(t, c.Encode(&buf, Version5))
+	p, err := ReadPacket(&buf)
+	assert.Nil(t, err)
+
+	out := p.(*ConnectPacket)
+	assert.Equal(t, byte(Accepted), out.Validate())
+	assert.Equal(t, c.ClientIdentifier, out.ClientIdentifier)
+	assert.Equal(t, c.WillMessage, out.WillMessage)
+	assert.Equal(t, c.Username, out.Username)
+	assert.Equal(t, uint32(3600), *out.Properties.SessionExpiryInterval)
+	assert.Equal(t, uint16(10), *out.Properties.ReceiveMaximum)
+	assert.Equal(t, c.Properties.User, out.Properties.User)
+	assert.Equal(t, uint32(5), *out.WillProperties.WillDelayInterval)
+}
+
+func TestConnectValidate(t *testing.T) {
+	c := NewControlPacket(Connect).(*ConnectPacket)
+	c.ProtocolName = "MQTT"
+	c.ProtocolVersion = 6
+	assert.Equal(t, byte(ErrRefusedBadProtocolVersion), c.Validate())
+
+	// MQTT 5.0 allows an empty client identifier without clean start
+	c.ProtocolVersion = Version5
+	assert.Equal(t, byte(Accepted), c.Validate())
+	c.ProtocolVersion = Version311
+	assert.Equal(t, byte(ErrRefusedIDRejected), c.Validate())
+}
+
+func TestPublish(t *testing.T) {
+	p := NewControlPacket(Publish).(*PublishPacket)
+	p.Qos = 1
+	p.MessageID = 42
+	p.TopicName = "a/b"
+	p.Payload = []byte("payload")
+	p.Properties = &Properties{
+		MessageExpiry:          Uint32Ptr(60),
+		ContentType:            "text/plain",
+		CorrelationData:        []byte{1, 2},
+		SubscriptionIdentifier: []int{1, 300},
+	}
+
+	out := roundTrip(t, p, Version5).(*PublishPacket)
+	assert.Equal(t, p.TopicName, out.TopicName)
+	assert.Equal(t, p.MessageID, out.MessageID)
+	assert.Equal(t, p.Payload, out.Payload)
+	assert.Equal(t, p.Properties, out.Properties)
+
+	out = roundTrip(t, p, Version311).(*PublishPacket)
+	assert.Equal(t, p.Payload, out.Payload)
+	assert.Nil(t, out.Properties)
+}
+
+func TestSubscribeOptions(t *testing.T) {
+	s := NewControlPacket(Subscribe).(*SubscribePacket)
+	s.MessageID = 7
+	s.Topics = []string{"a/#", "b/+"}
+	s.Qoss = []byte{1, 2}
+	s.Options = []SubscribeOptions{{NoLocal: true}, {RetainAsPublished: true, RetainHandling: 2}}
+	s.Properties = &Properties{SubscriptionIdentifier: []int{9}}
+
+	out := roundTrip(t, s, Version5).(*SubscribePacket)
+	assert.Equal(t, s.Topics, out.Topics)
+	assert.Equal(t, s.Qoss, out.Qoss)
+	assert.Equal(t, s.Options, out.Options)
+	assert.Equal(t, []int{9}, out.Properties.SubscriptionIdentifier)
+}
+
+func TestAckReasonCodes(t *testing.T) {
+	pa := NewControlPacket(Puback).(*PubackPacket)
+	pa.MessageID = 3
+	pa.ReasonCode = ReasonNotAuthorized
+
+	out := roundTrip(t, pa, Version5).(*PubackPacket)
+	assert.Equal(t, ReasonNotAuthorized, out.ReasonCode)
+
+	out = roundTrip(t, pa, Version311).(*PubackPacket)
+	assert.Equal(t, uint16(3), out.MessageID)
+	assert.Equal(t, ReasonSuccess, out.ReasonCode)
+
+	sa := NewControlPacket(Suback).(*SubackPacket)
+	sa.ReturnCodes = []byte{1, ReasonNotAuthorized}
+	outSa := roundTrip(t, sa, Version311).(*SubackPacket)
+	assert.Equal(t, []byte{1, ReasonUnspecifiedError}, outSa.ReturnCodes)
+	outSa = roundTrip(t, sa, Version5).(*SubackPacket)
+	assert.Equal(t, sa.ReturnCodes, outSa.ReturnCodes)
+
+	ua := NewControlPacket(Unsuback).(*UnsubackPacket)
+	ua.ReasonCodes = []byte{ReasonSuccess, ReasonNoSubscriptionExisted}
+	outUa := roundTrip(t, ua, Version5).(*UnsubackPacket)
+	assert.Equal(t, ua.ReasonCodes, outUa.ReasonCodes)
+}
+
+func TestConnackReasonCode(t *testing.T) {
+	ca := NewControlPacket(Connack).(*ConnackPacket)
+	ca.ReturnCode = ErrRefusedNotAuthorised
+	ca.Properties = &Properties{AssignedClientID: "auto-1"}
+
+	out := roundTrip(t, ca, Version5).(*ConnackPacket)
+	assert.Equal(t, ReasonNotAuthorized, out.ReturnCode)
+	assert.Equal(t, "auto-1", out.Properties.AssignedClientID)
+
+	ca.ReturnCode = ReasonServerBusy
+	out = roundTrip(t, ca, Version311).(*ConnackPacket)
+	assert.Equal(t, byte(ErrRefusedServerUnavailable), out.ReturnCode)
+}
+
+func TestDisconnectAndAuth(t *testing.T) {
+	d := NewControlPacket(Disconnect).(*DisconnectPacket)
+	d.ReasonCode = ReasonSessionTakenOver
+	out := roundTrip(t, d, Version5).(*DisconnectPacket)
+	assert.Equal(t, ReasonSessionTakenOver, out.ReasonCode)
+
+	var buf bytes.Buffer
+	assert.Nil(t, d.Encode(&buf, Version311))
+	assert.Equal(t, []byte{Disconnect << 4, 0}, buf.Bytes())
+
+	a := NewControlPacket(Auth).(*AuthPacket)
+	a.ReasonCode = ReasonContinueAuthentication
+	a.Properties = &Properties{AuthMethod: "SCRAM-SHA-1", AuthData: []byte("data")}
+	outA := roundTrip(t, a, Version5).(*AuthPacket)
+	assert.Equal(t, a.ReasonCode, outA.ReasonCode)
+	assert.Equal(t, a.Properties, outA.Properties)
+}
+
+func TestMalformedProperties(t *testing.T) {
+	// PUBLISH qos 0, topic "a", property length 2 with an unknown property
+	raw := []byte{Publish << 4, 5, 0, 1, 'a', 2, 0x7F, 0}
+	_, err := ReadPacketVersion(bytes.NewReader(raw), Version5)
+	assert.ErrorIs(t, err, ErrMalformedPacket)
+
+	// a remaining length longer than four bytes is invalid
+	raw = []byte{Publish << 4, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}
+	_, err = ReadPacketVersion(bytes.NewReader(raw), Version5)
+	assert.ErrorIs(t, err, ErrInvalidRemainingSize)
+}
+
+func TestReadPacketLimit(t *testing.T) {
+	p := NewControlPacket(Publish).(*PublishPacket)
+	p.TopicName = "a/b"
+	p.Payload = make([]byte, 200)
+	var buf bytes.Buffer
+	assert.Nil(t, p.Encode(&buf, Version311))
+	size := buf.Len()
+
+	_, err := ReadPacketLimit(bytes.NewReader(buf.Bytes()), Version311, size-1)
+	assert.Equal(t, ErrPacketTooLarge, err)
+
+	out, err := ReadPacketLimit(bytes.NewReader(buf.Bytes()), Version311, size)
+	if assert.Nil(t, err) {
+		assert.Equal(t, p.Payload, out.(*PublishPacket).Payload)
+	}
+
+	// the body of an oversized packet is not read
+	huge := []byte{Publish << 4, 0xff, 0xff, 0xff, 0x7f}
+	_, err = ReadPacketLimit(bytes.NewReader(huge), Version311, 1024)
+	assert.Equal(t, ErrPacketTooLarge, err)
+}
@@ -0,0 +1,42 @@
+package packets
+
+import (
+	"io"
+)
+
+// PingreqPacket is an internal representation of the fields of the
+// Pingreq MQTT packet
+type PingreqPacket struct {
+	FixedHeader
+}
+
+func (pr *PingreqPacket) String() string {
+	return pr.FixedHeader.String()
+}
+
+func (pr *PingreqPacket) Write(w io.Writer) error {
+	return pr.Encode(w, Version311)
+}
+
+// Encode encodes the packet for the given protocol level
+func (pr *PingreqPacket) Encode(w io.Writer, version byte) error {
+	return writePacket(w, &pr.FixedHeader, nil)
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (pr *PingreqPacket) Unpack(b io.Reader) error {
+	return nil
+}
+
+// Decode decodes the details of a ControlPacket after the fixed
+// header has been read
+func (pr *PingreqPacket) Decode(b io.Reader, version byte) error {
+	return nil
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (pr *PingreqPacket) Details() Details {
+	return Details{Qos: 0, MessageID: 0}
+}
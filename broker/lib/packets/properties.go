@@ -0,0 +1,316 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// MQTT 5.0 property identifiers
+const (
+	PropPayloadFormat          byte = 0x01
+	PropMessageExpiry          byte = 0x02
+	PropContentType            byte = 0x03
+	PropResponseTopic          byte = 0x08
+	PropCorrelationData        byte = 0x09
+	PropSubscriptionIdentifier byte = 0x0B
+	PropSessionExpiryInterval  byte = 0x11
+	PropAssignedClientID       byte = 0x12
+	PropServerKeepAlive        byte = 0x13
+	PropAuthMethod             byte = 0x15
+	PropAuthData               byte = 0x16
+	PropRequestProblemInfo     byte = 0x17
+	PropWillDelayInterval      byte = 0x18
+	PropRequestResponseInfo    byte = 0x19
+	PropResponseInfo           byte = 0x1A
+	PropServerReference        byte = 0x1C
+	PropReasonString           byte = 0x1F
+	PropReceiveMaximum         byte = 0x21
+	PropTopicAliasMaximum      byte = 0x22
+	PropTopicAlias             byte = 0x23
+	PropMaximumQoS             byte = 0x24
+	PropRetainAvailable        byte = 0x25
+	PropUser                   byte = 0x26
+	PropMaximumPacketSize      byte = 0x27
+	PropWildcardSubAvailable   byte = 0x28
+	PropSubIDAvailable         byte = 0x29
+	PropSharedSubAvailable     byte = 0x2A
+)
+
+// UserProperty is a name/value pair sent as MQTT 5.0 User Property
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties holds the MQTT 5.0 properties of a packet. Optional numeric
+// properties are pointers so that an absent property can be told apart from
+// a zero value.
+type Properties struct {
+	PayloadFormat          *byte
+	MessageExpiry          *uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	SubscriptionIdentifier []int
+	SessionExpiryInterval  *uint32
+	AssignedClientID       string
+	ServerKeepAlive        *uint16
+	AuthMethod             string
+	AuthData               []byte
+	RequestProblemInfo     *byte
+	WillDelayInterval      *uint32
+	RequestResponseInfo    *byte
+	ResponseInfo           string
+	ServerReference        string
+	ReasonString           string
+	ReceiveMaximum         *uint16
+	TopicAliasMaximum      *uint16
+	TopicAlias             *uint16
+	MaximumQoS             *byte
+	RetainAvailable        *byte
+	User                   []UserProperty
+	MaximumPacketSize      *uint32
+	WildcardSubAvailable   *byte
+	SubIDAvailable         *byte
+	SharedSubAvailable     *byte
+}
+
+// Copy returns a deep copy of the properties, nil safe
+func (p *Properties) Copy() *Properties {
+	if p == nil {
+		return nil
+	}
+	n := *p
+	if p.CorrelationData != nil {
+		n.CorrelationData = append([]byte(nil), p.CorrelationData...)
+	}
+	if p.AuthData != nil {
+		n.AuthData = append([]byte(nil), p.AuthData...)
+	}
+	if p.SubscriptionIdentifier != nil {
+		n.SubscriptionIdentifier = append([]int(nil), p.SubscriptionIdentifier...)
+	}
+	if p.User != nil {
+		n.User = append([]UserProperty(nil), p.User...)
+	}
+	return &n
+}
+
+func (p *Properties) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%+v", *p)
+}
+
+// Uint16Ptr, Uint32Ptr and BytePtr are small helpers to fill in optional
+// properties.
+func Uint16Ptr(v uint16) *uint16 { return &v }
+func Uint32Ptr(v uint32) *uint32 { return &v }
+func BytePtr(v byte) *byte       { return &v }
+
+// encodeProperties encodes the properties including the leading property
+// length. A nil Properties encodes as an empty property list.
+func encodeProperties(p *Properties) []byte {
+	var b bytes.Buffer
+	if p != nil {
+		p.pack(&b)
+	}
+	return append(encodeLength(b.Len()), b.Bytes()...)
+}
+
+func (p *Properties) pack(b *bytes.Buffer) {
+	writeByte := func(id byte, v *byte) {
+		if v != nil {
+			b.WriteByte(id)
+			b.WriteByte(*v)
+		}
+	}
+	writeUint16 := func(id byte, v *uint16) {
+		if v != nil {
+			b.WriteByte(id)
+			b.Write(encodeUint16(*v))
+		}
+	}
+	writeUint32 := func(id byte, v *uint32) {
+		if v != nil {
+			b.WriteByte(id)
+			b.Write(encodeUint32(*v))
+		}
+	}
+	writeString := func(id byte, v string) {
+		if v != "" {
+			b.WriteByte(id)
+			b.Write(encodeString(v))
+		}
+	}
+	writeBytes := func(id byte, v []byte) {
+		if v != nil {
+			b.WriteByte(id)
+			b.Write(encodeBytes(v))
+		}
+	}
+
+	writeByte(PropPayloadFormat, p.PayloadFormat)
+	writeUint32(PropMessageExpiry, p.MessageExpiry)
+	writeString(PropContentType, p.ContentType)
+	writeString(PropResponseTopic, p.ResponseTopic)
+	writeBytes(PropCorrelationData, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifier {
+		b.WriteByte(PropSubscriptionIdentifier)
+		b.Write(encodeLength(id))
+	}
+	writeUint32(PropSessionExpiryInterval, p.SessionExpiryInterval)
+	writeString(PropAssignedClientID, p.AssignedClientID)
+	writeUint16(PropServerKeepAlive, p.ServerKeepAlive)
+	writeString(PropAuthMethod, p.AuthMethod)
+	writeBytes(PropAuthData, p.AuthData)
+	writeByte(PropRequestProblemInfo, p.RequestProblemInfo)
+	writeUint32(PropWillDelayInterval, p.WillDelayInterval)
+	writeByte(PropRequestResponseInfo, p.RequestResponseInfo)
+	writeString(PropResponseInfo, p.ResponseInfo)
+	writeString(PropServerReference, p.ServerReference)
+	writeString(PropReasonString, p.ReasonString)
+	writeUint16(PropReceiveMaximum, p.ReceiveMaximum)
+	writeUint16(PropTopicAliasMaximum, p.TopicAliasMaximum)
+	writeUint16(PropTopicAlias, p.TopicAlias)
+	writeByte(PropMaximumQoS, p.MaximumQoS)
+	writeByte(PropRetainAvailable, p.RetainAvailable)
+	for _, u := range p.User {
+		b.WriteByte(PropUser)
+		b.Write(encodeString(u.Key))
+		b.Write(encodeString(u.Value))
+	}
+	writeUint32(PropMaximumPacketSize, p.MaximumPacketSize)
+	writeByte(PropWildcardSubAvailable, p.WildcardSubAvailable)
+	writeByte(PropSubIDAvailable, p.SubIDAvailable)
+	writeByte(PropSharedSubAvailable, p.SharedSubAvailable)
+}
+
+// decodeProperties reads a property length followed by the properties. It
+// returns nil when the property list is empty.
+func decodeProperties(r io.Reader) (*Properties, error) {
+	length, err := decodeLength(r)
+	if err != nil {
+		return nil, ErrMalformedPacket
+	}
+	if length == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, ErrMalformedPacket
+	}
+
+	p := &Properties{}
+	b := bytes.NewBuffer(buf)
+	for b.Len() > 0 {
+		id, err := b.ReadByte()
+		if err != nil {
+			return nil, ErrMalformedPacket
+		}
+		if err := p.unpack(id, b); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *Properties) unpack(id byte, b *bytes.Buffer) error {
+	readByte := func(v **byte) error {
+		if *v != nil {
+			return fmt.Errorf("%w: duplicate property 0x%x", ErrMalformedPacket, id)
+		}
+		n, err := decodeByte(b)
+		*v = &n
+		return err
+	}
+	readUint16 := func(v **uint16) error {
+		if *v != nil {
+			return fmt.Errorf("%w: duplicate property 0x%x", ErrMalformedPacket, id)
+		}
+		n, err := decodeUint16(b)
+		*v = &n
+		return err
+	}
+	readUint32 := func(v **uint32) error {
+		if *v != nil {
+			return fmt.Errorf("%w: duplicate property 0x%x", ErrMalformedPacket, id)
+		}
+		n, err := decodeUint32(b)
+		*v = &n
+		return err
+	}
+
+	var err error
+	switch id {
+	case PropPayloadFormat:
+		err = readByte(&p.PayloadFormat)
+	case PropMessageExpiry:
+		err = readUint32(&p.MessageExpiry)
+	case PropContentType:
+		p.ContentType, err = decodeString(b)
+	case PropResponseTopic:
+		p.ResponseTopic, err = decodeString(b)
+	case PropCorrelationData:
+		p.CorrelationData, err = decodeBytes(b)
+	case PropSubscriptionIdentifier:
+		var sid int
+		sid, err = decodeLength(b)
+		if err == nil && sid == 0 {
+			err = fmt.Errorf("%w: subscription identifier 0", ErrMalformedPacket)
+		}
+		p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, sid)
+	case PropSessionExpiryInterval:
+		err = readUint32(&p.SessionExpiryInterval)
+	case PropAssignedClientID:
+		p.AssignedClientID, err = decodeString(b)
+	case PropServerKeepAlive:
+		err = readUint16(&p.ServerKeepAlive)
+	case PropAuthMethod:
+		p.AuthMethod, err = decodeString(b)
+	case PropAuthData:
+		p.AuthData, err = decodeBytes(b)
+	case PropRequestProblemInfo:
+		err = readByte(&p.RequestProblemInfo)
+	case PropWillDelayInterval:
+		err = readUint32(&p.WillDelayInterval)
+	case PropRequestResponseInfo:
+		err = readByte(&p.RequestResponseInfo)
+	case PropResponseInfo:
+		p.ResponseInfo, err = decodeString(b)
+	case PropServerReference:
+		p.ServerReference, err = decodeString(b)
+	case PropReasonString:
+		p.ReasonString, err = decodeString(b)
+	case PropReceiveMaximum:
+		err = readUint16(&p.ReceiveMaximum)
+	case PropTopicAliasMaximum:
+		err = readUint16(&p.TopicAliasMaximum)
+	case PropTopicAlias:
+		err = readUint16(&p.TopicAlias)
+	case PropMaximumQoS:
+		err = readByte(&p.MaximumQoS)
+	case PropRetainAvailable:
+		err = readByte(&p.RetainAvailable)
+	case PropUser:
+		var u UserProperty
+		if u.Key, err = decodeString(b); err == nil {
+			u.Value, err = decodeString(b)
+		}
+		p.User = append(p.User, u)
+	case PropMaximumPacketSize:
+		err = readUint32(&p.MaximumPacketSize)
+	case PropWildcardSubAvailable:
+		err = readByte(&p.WildcardSubAvailable)
+	case PropSubIDAvailable:
+		err = readByte(&p.SubIDAvailable)
+	case PropSharedSubAvailable:
+		err = readByte(&p.SharedSubAvailable)
+	default:
+		err = fmt.Errorf("%w: unknown property 0x%x", ErrMalformedPacket, id)
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// PubackPacket is an internal representation of the fields of the
+// Puback MQTT packet
+type PubackPacket struct {
+	FixedHeader
+	MessageID uint16
+
+	// MQTT 5.0 only
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (pa *PubackPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", pa.FixedHeader, pa.MessageID, pa.ReasonCode)
+}
+
+func (pa *PubackPacket) Write(w io.Writer) error {
+	return pa.Encode(w, Version311)
+}
+
+// Encode encodes the packet for the given protocol level
+func (pa *PubackPacket) Encode(w io.Writer, version byte) error {
+	return writePacket(w, &pa.FixedHeader, encodeAck(pa.MessageID, pa.ReasonCode, pa.Properties, version))
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (pa *PubackPacket) Unpack(b io.Reader) error {
+	return pa.Decode(b, Version311)
+}
+
+// Decode decodes the packet body for the given protocol level
+func (pa *PubackPacket) Decode(b io.Reader, version byte) error {
+	var err error
+	pa.MessageID, pa.ReasonCode, pa.Properties, err = decodeAck(b, version)
+	return err
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (pa *PubackPacket) Details() Details {
+	return Details{Qos: pa.Qos, MessageID: pa.MessageID}
+}
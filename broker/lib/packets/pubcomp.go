@@ -0,0 +1,49 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// PubcompPacket is an internal representation of the fields of the
+// Pubcomp MQTT packet
+type PubcompPacket struct {
+	FixedHeader
+	MessageID uint16
+
+	// MQTT 5.0 only
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (pc *PubcompPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", pc.FixedHeader, pc.MessageID, pc.ReasonCode)
+}
+
+func (pc *PubcompPacket) Write(w io.Writer) error {
+	return pc.Encode(w, Version311)
+}
+
+// Encode encodes the packet for the given protocol level
+func (pc *PubcompPacket) Encode(w io.Writer, version byte) error {
+	return writePacket(w, &pc.FixedHeader, encodeAck(pc.MessageID, pc.ReasonCode, pc.Properties, version))
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (pc *PubcompPacket) Unpack(b io.Reader) error {
+	return pc.Decode(b, Version311)
+}
+
+// Decode decodes the packet body for the given protocol level
+func (pc *PubcompPacket) Decode(b io.Reader, version byte) error {
+	var err error
+	pc.MessageID, pc.ReasonCode, pc.Properties, err = decodeAck(b, version)
+	return err
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (pc *PubcompPacket) Details() Details {
+	return Details{Qos: pc.Qos, MessageID: pc.MessageID}
+}
@@ -0,0 +1,101 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// PublishPacket is an internal representation of the fields of the
+// Publish MQTT packet
+type PublishPacket struct {
+	FixedHeader
+	TopicName string
+	MessageID uint16
+	Payload   []byte
+
+	// MQTT 5.0 only
+	Properties *Properties
+
+	// Expiry is when the message expires, it is not encoded. The zero time
+	// never expires.
+	Expiry time.Time
+}
+
+// Expired reports whether the message expired at now
+func (p *PublishPacket) Expired(now time.Time) bool {
+	return !p.Expiry.IsZero() && !now.Before(p.Expiry)
+}
+
+func (p *PublishPacket) String() string {
+	return fmt.Sprintf("%s topicName: %s MessageID: %d payload: %s properties: %s", p.FixedHeader, p.TopicName, p.MessageID, string(p.Payload), p.Properties)
+}
+
+func (p *PublishPacket) Write(w io.Writer) error {
+	return p.Encode(w, Version311)
+}
+
+// Encode encodes the packet for the given protocol level
+func (p *PublishPacket) Encode(w io.Writer, version byte) error {
+	var body bytes.Buffer
+
+	body.Write(encodeString(p.TopicName))
+	if p.Qos > 0 {
+		body.Write(encodeUint16(p.MessageID))
+	}
+	if version >= Version5 {
+		body.Write(encodeProperties(p.Properties))
+	}
+	body.Write(p.Payload)
+
+	return writePacket(w, &p.FixedHeader, body.Bytes())
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (p *PublishPacket) Unpack(b io.Reader) error {
+	return p.Decode(b, Version311)
+}
+
+// Decode decodes the packet body for the given protocol level
+func (p *PublishPacket) Decode(b io.Reader, version byte) error {
+	var err error
+	p.TopicName, err = decodeString(b)
+	if err != nil {
+		return err
+	}
+
+	if p.Qos > 0 {
+		p.MessageID, err = decodeUint16(b)
+		if err != nil {
+			return err
+		}
+	}
+	if version >= Version5 {
+		if p.Properties, err = decodeProperties(b); err != nil {
+			return err
+		}
+	}
+	p.Payload, err = decodeRest(b)
+
+	return err
+}
+
+// Copy creates a new PublishPacket with the same topic, payload and
+// properties but an empty fixed header, useful for when you want to deliver
+// a message with different properties such as Qos but the same content
+func (p *PublishPacket) Copy() *PublishPacket {
+	newP := NewControlPacket(Publish).(*PublishPacket)
+	newP.TopicName = p.TopicName
+	newP.Payload = p.Payload
+	newP.Properties = p.Properties.Copy()
+
+	return newP
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (p *PublishPacket) Details() Details {
+	return Details{Qos: p.Qos, MessageID: p.MessageID}
+}
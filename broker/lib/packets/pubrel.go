@@ -0,0 +1,49 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+// PubrelPacket is an internal representation of the fields of the
+// Pubrel MQTT packet
+type PubrelPacket struct {
+	FixedHeader
+	MessageID uint16
+
+	// MQTT 5.0 only
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (pr *PubrelPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d reasoncode: %d", pr.FixedHeader, pr.MessageID, pr.ReasonCode)
+}
+
+func (pr *PubrelPacket) Write(w io.Writer) error {
+	return pr.Encode(w, Version311)
+}
+
+// Encode encodes the packet for the given protocol level
+func (pr *PubrelPacket) Encode(w io.Writer, version byte) error {
+	return writePacket(w, &pr.FixedHeader, encodeAck(pr.MessageID, pr.ReasonCode, pr.Properties, version))
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (pr *PubrelPacket) Unpack(b io.Reader) error {
+	return pr.Decode(b, Version311)
+}
+
+// Decode decodes the packet body for the given protocol level
+func (pr *PubrelPacket) Decode(b io.Reader, version byte) error {
+	var err error
+	pr.MessageID, pr.ReasonCode, pr.Properties, err = decodeAck(b, version)
+	return err
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (pr *PubrelPacket) Details() Details {
+	return Details{Qos: pr.Qos, MessageID: pr.MessageID}
+}
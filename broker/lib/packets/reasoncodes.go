@@ -0,0 +1,103 @@
+package packets
+
+// MQTT 5.0 reason codes
+const (
+	ReasonSuccess                             byte = 0x00
+	ReasonNormalDisconnection                 byte = 0x00
+	ReasonGrantedQoS0                         byte = 0x00
+	ReasonGrantedQoS1                         byte = 0x01
+	ReasonGrantedQoS2                         byte = 0x02
+	ReasonDisconnectWithWillMessage           byte = 0x04
+	ReasonNoMatchingSubscribers               byte = 0x10
+	ReasonNoSubscriptionExisted               byte = 0x11
+	ReasonContinueAuthentication              byte = 0x18
+	ReasonReAuthenticate                      byte = 0x19
+	ReasonUnspecifiedError                    byte = 0x80
+	ReasonMalformedPacket                     byte = 0x81
+	ReasonProtocolError                       byte = 0x82
+	ReasonImplementationSpecificError         byte = 0x83
+	ReasonUnsupportedProtocolVersion          byte = 0x84
+	ReasonClientIdentifierNotValid            byte = 0x85
+	ReasonBadUsernameOrPassword               byte = 0x86
+	ReasonNotAuthorized                       byte = 0x87
+	ReasonServerUnavailable                   byte = 0x88
+	ReasonServerBusy                          byte = 0x89
+	ReasonBanned                              byte = 0x8A
+	ReasonServerShuttingDown                  byte = 0x8B
+	ReasonBadAuthenticationMethod             byte = 0x8C
+	ReasonKeepAliveTimeout                    byte = 0x8D
+	ReasonSessionTakenOver                    byte = 0x8E
+	ReasonTopicFilterInvalid                  byte = 0x8F
+	ReasonTopicNameInvalid                    byte = 0x90
+	ReasonPacketIdentifierInUse               byte = 0x91
+	ReasonPacketIdentifierNotFound            byte = 0x92
+	ReasonReceiveMaximumExceeded              byte = 0x93
+	ReasonTopicAliasInvalid                   byte = 0x94
+	ReasonPacketTooLarge                      byte = 0x95
+	ReasonMessageRateTooHigh                  byte = 0x96
+	ReasonQuotaExceeded                       byte = 0x97
+	ReasonAdministrativeAction                byte = 0x98
+	ReasonPayloadFormatInvalid                byte = 0x99
+	ReasonRetainNotSupported                  byte = 0x9A
+	ReasonQoSNotSupported                     byte = 0x9B
+	ReasonUseAnotherServer                    byte = 0x9C
+	ReasonServerMoved                         byte = 0x9D
+	ReasonSharedSubscriptionsNotSupported     byte = 0x9E
+	ReasonConnectionRateExceeded              byte = 0x9F
+	ReasonMaximumConnectTime                  byte = 0xA0
+	ReasonSubscriptionIdentifiersNotSupported byte = 0xA1
+	ReasonWildcardSubscriptionsNotSupported   byte = 0xA2
+)
+
+// connackCodesV5 maps MQTT 3.1.1 CONNACK return codes to their MQTT 5.0
+// counterparts
+var connackCodesV5 = map[byte]byte{
+	Accepted:                        ReasonSuccess,
+	ErrRefusedBadProtocolVersion:    ReasonUnsupportedProtocolVersion,
+	ErrRefusedIDRejected:            ReasonClientIdentifierNotValid,
+	ErrRefusedServerUnavailable:     ReasonServerUnavailable,
+	ErrRefusedBadUsernameOrPassword: ReasonBadUsernameOrPassword,
+	ErrRefusedNotAuthorised:         ReasonNotAuthorized,
+	ErrProtocolViolation:            ReasonProtocolError,
+}
+
+// connackCodesV3 maps MQTT 5.0 CONNACK reason codes to the closest MQTT 3.1.1
+// return code
+var connackCodesV3 = map[byte]byte{
+	ReasonSuccess:                    Accepted,
+	ReasonUnsupportedProtocolVersion: ErrRefusedBadProtocolVersion,
+	ReasonClientIdentifierNotValid:   ErrRefusedIDRejected,
+	ReasonServerUnavailable:          ErrRefusedServerUnavailable,
+	ReasonServerBusy:                 ErrRefusedServerUnavailable,
+	ReasonServerShuttingDown:         ErrRefusedServerUnavailable,
+	ReasonConnectionRateExceeded:     ErrRefusedServerUnavailable,
+	ReasonQuotaExceeded:              ErrRefusedServerUnavailable,
+	ReasonBadUsernameOrPassword:      ErrRefusedBadUsernameOrPassword,
+	ReasonNotAuthorized:              ErrRefusedNotAuthorised,
+	ReasonBanned:                     ErrRefusedNotAuthorised,
+	ReasonBadAuthenticationMethod:    ErrRefusedNotAuthorised,
+}
+
+// ConnackReasonCode converts a CONNACK return code to the given protocol
+// level. Both MQTT 3.1.1 return codes and MQTT 5.0 reason codes are accepted.
+func ConnackReasonCode(code, version byte) byte {
+	if version >= Version5 {
+		if code < ReasonUnspecifiedError {
+			if rc, ok := connackCodesV5[code]; ok {
+				return rc
+			}
+		}
+		if code == ErrProtocolViolation {
+			return ReasonProtocolError
+		}
+		return code
+	}
+
+	if code <= ErrRefusedNotAuthorised {
+		return code
+	}
+	if rc, ok := connackCodesV3[code]; ok {
+		return rc
+	}
+	return ErrRefusedServerUnavailable
+}
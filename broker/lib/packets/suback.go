@@ -0,0 +1,76 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// SubackPacket is an internal representation of the fields of the
+// Suback MQTT packet
+type SubackPacket struct {
+	FixedHeader
+	MessageID uint16
+	// ReturnCodes holds the granted QoS or a failure code per topic. MQTT 5.0
+	// failure reason codes are sent as 0x80 to older clients.
+	ReturnCodes []byte
+
+	// MQTT 5.0 only
+	Properties *Properties
+}
+
+func (sa *SubackPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d", sa.FixedHeader, sa.MessageID)
+}
+
+func (sa *SubackPacket) Write(w io.Writer) error {
+	return sa.Encode(w, Version311)
+}
+
+// Encode encodes the packet for the given protocol level
+func (sa *SubackPacket) Encode(w io.Writer, version byte) error {
+	var body bytes.Buffer
+
+	body.Write(encodeUint16(sa.MessageID))
+	if version >= Version5 {
+		body.Write(encodeProperties(sa.Properties))
+		body.Write(sa.ReturnCodes)
+	} else {
+		for _, rc := range sa.ReturnCodes {
+			if rc >= ReasonUnspecifiedError {
+				rc = ReasonUnspecifiedError
+			}
+			body.WriteByte(rc)
+		}
+	}
+
+	return writePacket(w, &sa.FixedHeader, body.Bytes())
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (sa *SubackPacket) Unpack(b io.Reader) error {
+	return sa.Decode(b, Version311)
+}
+
+// Decode decodes the packet body for the given protocol level
+func (sa *SubackPacket) Decode(b io.Reader, version byte) error {
+	var err error
+	sa.MessageID, err = decodeUint16(b)
+	if err != nil {
+		return err
+	}
+	if version >= Version5 {
+		if sa.Properties, err = decodeProperties(b); err != nil {
+			return err
+		}
+	}
+	sa.ReturnCodes, err = decodeRest(b)
+	return err
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (sa *SubackPacket) Details() Details {
+	return Details{Qos: 0, MessageID: sa.MessageID}
+}
@@ -0,0 +1,115 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// SubscribeOptions holds the MQTT 5.0 subscription options of a topic
+// filter besides the maximum QoS
+type SubscribeOptions struct {
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
+}
+
+// SubscribePacket is an internal representation of the fields of the
+// Subscribe MQTT packet
+type SubscribePacket struct {
+	FixedHeader
+	MessageID uint16
+	Topics    []string
+	Qoss      []byte
+
+	// MQTT 5.0 only, Options has one entry per topic when decoded
+	Options    []SubscribeOptions
+	Properties *Properties
+}
+
+func (s *SubscribePacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d topics: %s", s.FixedHeader, s.MessageID, s.Topics)
+}
+
+func (s *SubscribePacket) Write(w io.Writer) error {
+	return s.Encode(w, Version311)
+}
+
+// Encode encodes the packet for the given protocol level
+func (s *SubscribePacket) Encode(w io.Writer, version byte) error {
+	var body bytes.Buffer
+
+	body.Write(encodeUint16(s.MessageID))
+	if version >= Version5 {
+		body.Write(encodeProperties(s.Properties))
+	}
+	for i, topic := range s.Topics {
+		body.Write(encodeString(topic))
+		opts := s.Qoss[i]
+		if version >= Version5 && i < len(s.Options) {
+			o := s.Options[i]
+			opts |= boolToByte(o.NoLocal)<<2 | boolToByte(o.RetainAsPublished)<<3 | (o.RetainHandling&0x03)<<4
+		}
+		body.WriteByte(opts)
+	}
+
+	return writePacket(w, &s.FixedHeader, body.Bytes())
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (s *SubscribePacket) Unpack(b io.Reader) error {
+	return s.Decode(b, Version311)
+}
+
+// Decode decodes the packet body for the given protocol level
+func (s *SubscribePacket) Decode(b io.Reader, version byte) error {
+	var err error
+	s.MessageID, err = decodeUint16(b)
+	if err != nil {
+		return err
+	}
+	if version >= Version5 {
+		if s.Properties, err = decodeProperties(b); err != nil {
+			return err
+		}
+	}
+	rest, err := decodeRest(b)
+	if err != nil {
+		return err
+	}
+	payload := bytes.NewBuffer(rest)
+	for payload.Len() > 0 {
+		topic, err := decodeString(payload)
+		if err != nil {
+			return err
+		}
+		s.Topics = append(s.Topics, topic)
+		opts, err := decodeByte(payload)
+		if err != nil {
+			return err
+		}
+		if version >= Version5 {
+			if opts&0xC0 != 0 || (opts>>4)&0x03 == 0x03 {
+				return fmt.Errorf("%w: invalid subscription options", ErrMalformedPacket)
+			}
+			s.Options = append(s.Options, SubscribeOptions{
+				NoLocal:           opts&0x04 > 0,
+				RetainAsPublished: opts&0x08 > 0,
+				RetainHandling:    (opts >> 4) & 0x03,
+			})
+			opts &= 0x03
+		}
+		s.Qoss = append(s.Qoss, opts)
+	}
+	if len(s.Topics) == 0 {
+		return fmt.Errorf("%w: subscribe without topics", ErrMalformedPacket)
+	}
+	return nil
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (s *SubscribePacket) Details() Details {
+	return Details{Qos: 1, MessageID: s.MessageID}
+}
@@ -0,0 +1,65 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// UnsubackPacket is an internal representation of the fields of the
+// Unsuback MQTT packet
+type UnsubackPacket struct {
+	FixedHeader
+	MessageID uint16
+
+	// MQTT 5.0 only, one reason code per topic of the UNSUBSCRIBE packet
+	ReasonCodes []byte
+	Properties  *Properties
+}
+
+func (ua *UnsubackPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d", ua.FixedHeader, ua.MessageID)
+}
+
+func (ua *UnsubackPacket) Write(w io.Writer) error {
+	return ua.Encode(w, Version311)
+}
+
+// Encode encodes the packet for the given protocol level
+func (ua *UnsubackPacket) Encode(w io.Writer, version byte) error {
+	var body bytes.Buffer
+
+	body.Write(encodeUint16(ua.MessageID))
+	if version >= Version5 {
+		body.Write(encodeProperties(ua.Properties))
+		body.Write(ua.ReasonCodes)
+	}
+
+	return writePacket(w, &ua.FixedHeader, body.Bytes())
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (ua *UnsubackPacket) Unpack(b io.Reader) error {
+	return ua.Decode(b, Version311)
+}
+
+// Decode decodes the packet body for the given protocol level
+func (ua *UnsubackPacket) Decode(b io.Reader, version byte) error {
+	var err error
+	ua.MessageID, err = decodeUint16(b)
+	if err != nil || version < Version5 {
+		return err
+	}
+	if ua.Properties, err = decodeProperties(b); err != nil {
+		return err
+	}
+	ua.ReasonCodes, err = decodeRest(b)
+	return err
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (ua *UnsubackPacket) Details() Details {
+	return Details{Qos: 0, MessageID: ua.MessageID}
+}
@@ -0,0 +1,83 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// UnsubscribePacket is an internal representation of the fields of the
+// Unsubscribe MQTT packet
+type UnsubscribePacket struct {
+	FixedHeader
+	MessageID uint16
+	Topics    []string
+
+	// MQTT 5.0 only
+	Properties *Properties
+}
+
+func (u *UnsubscribePacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d", u.FixedHeader, u.MessageID)
+}
+
+func (u *UnsubscribePacket) Write(w io.Writer) error {
+	return u.Encode(w, Version311)
+}
+
+// Encode encodes the packet for the given protocol level
+func (u *UnsubscribePacket) Encode(w io.Writer, version byte) error {
+	var body bytes.Buffer
+
+	body.Write(encodeUint16(u.MessageID))
+	if version >= Version5 {
+		body.Write(encodeProperties(u.Properties))
+	}
+	for _, topic := range u.Topics {
+		body.Write(encodeString(topic))
+	}
+
+	return writePacket(w, &u.FixedHeader, body.Bytes())
+}
+
+// Unpack decodes the details of a ControlPacket after the fixed
+// header has been read
+func (u *UnsubscribePacket) Unpack(b io.Reader) error {
+	return u.Decode(b, Version311)
+}
+
+// Decode decodes the packet body for the given protocol level
+func (u *UnsubscribePacket) Decode(b io.Reader, version byte) error {
+	var err error
+	u.MessageID, err = decodeUint16(b)
+	if err != nil {
+		return err
+	}
+	if version >= Version5 {
+		if u.Properties, err = decodeProperties(b); err != nil {
+			return err
+		}
+	}
+	rest, err := decodeRest(b)
+	if err != nil {
+		return err
+	}
+	payload := bytes.NewBuffer(rest)
+	for payload.Len() > 0 {
+		topic, err := decodeString(payload)
+		if err != nil {
+			return err
+		}
+		u.Topics = append(u.Topics, topic)
+	}
+	if len(u.Topics) == 0 {
+		return fmt.Errorf("%w: unsubscribe without topics", ErrMalformedPacket)
+	}
+	return nil
+}
+
+// Details returns a Details struct containing the Qos and
+// MessageID of this ControlPacket
+func (u *UnsubscribePacket) Details() Details {
+	return Details{Qos: 1, MessageID: u.MessageID}
+}
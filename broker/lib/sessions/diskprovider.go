@@ -0,0 +1,557 @@
+package sessions
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+)
+
+var _ SessionsProvider = (*diskProvider)(nil)
+
+func init() {
+	Register("disk", NewDiskProvider())
+}
+
+const (
+	// flushInterval is how often modified sessions are written to disk
+	flushInterval = time.Second
+
+	// compactMinRecords is the number of records the log must hold before
+	// it is compacted
+	compactMinRecords = 1024
+)
+
+var ErrProviderNotOpen = errors.New("Session: disk provider not open")
+
+// record is a line of the session log. The log is replayed in order on
+// open, the last record of a session wins.
+type record struct {
+	Op      string         `json:"op"`
+	ID      string         `json:"id"`
+	Session *sessionRecord `json:"session,omitempty"`
+}
+
+const (
+	opPut = "put"
+	opDel = "del"
+)
+
+type sessionRecord struct {
+	Connect       []byte         `json:"connect"`
+	Subscriptions []Subscription `json:"subscriptions"`
+	Queue         [][]byte       `json:"queue,omitempty"`
+	// Expiry holds when the queued messages expire in Unix nanoseconds, 0
+	// never expires
+	Expiry  []int64 `json:"expiry,omitempty"`
+	Dropped uint64  `json:"dropped,omitempty"`
+	// ExpiryInterval is the session expiry interval, sessions stored without
+	// one never expire
+	ExpiryInterval *uint32 `json:"expiryInterval,omitempty"`
+	// Disconnected is when the client disconnected in Unix nanoseconds
+	Disconnected int64 `json:"disconnected,omitempty"`
+}
+
+// diskProvider keeps sessions in memory and stores persistent sessions in
+// an append only log. Modified sessions are written every flushInterval and
+// on Save. The log is rewritten with only the live sessions when it holds
+// more than twice as many records as there are sessions.
+type diskProvider struct {
+	st        map[string]*Session
+	persisted map[string]bool
+	mu        sync.RWMutex
+
+	path    string
+	file    *os.File
+	records int
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func NewDiskProvider() *diskProvider {
+	return &diskProvider{
+		st:        make(map[string]*Session),
+		persisted: make(map[string]bool),
+	}
+}
+
+// NewProvider returns a diskProvider to open for every manager
+func (p *diskProvider) NewProvider() SessionsProvider {
+	return NewDiskProvider()
+}
+
+// Open loads the sessions stored at path and starts writing changes to it
+func (p *diskProvider) Open(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.file != nil {
+		return fmt.Errorf("store/Open: disk provider already open at %s", p.path)
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	p.path = path
+	p.st = make(map[string]*Session)
+	p.persisted = make(map[string]bool)
+	if err := p.load(); err != nil {
+		return err
+	}
+	if err := p.compact(); err != nil {
+		return err
+	}
+
+	p.quit = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.flushLoop(p.quit, p.done)
+
+	return nil
+}
+
+func (p *diskProvider) New(id string) (*Session, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// a new session replaces any stored one
+	if p.persisted[id] {
+		if err := p.write(record{Op: opDel, ID: id}); err != nil {
+			return nil, err
+		}
+		delete(p.persisted, id)
+	}
+
+	p.st[id] = &Session{id: id}
+	return p.st[id], nil
+}
+
+func (p *diskProvider) Get(id string) (*Session, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	sess, ok := p.st[id]
+	if !ok {
+		return nil, fmt.Errorf("store/Get: No session found for key %s", id)
+	}
+
+	return sess, nil
+}
+
+func (p *diskProvider) Del(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.st, id)
+	if p.persisted[id] {
+		// the session is gone from memory, a failed write only means it
+		// comes back after a restart
+		_ = p.write(record{Op: opDel, ID: id})
+		delete(p.persisted, id)
+	}
+}
+
+// Save writes the session to disk and syncs the log
+func (p *diskProvider) Save(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.st[id]
+	if !ok {
+		return ErrKeyNotAvailable
+	}
+	if err := p.store(id, s); err != nil {
+		return err
+	}
+	if p.file == nil {
+		return ErrProviderNotOpen
+	}
+	return p.file.Sync()
+}
+
+func (p *diskProvider) Count() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.st)
+}
+
+func (p *diskProvider) Range(f func(id string, s *Session) bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for id, s := range p.st {
+		if !f(id, s) {
+			return
+		}
+	}
+}
+
+// Close writes all modified sessions, compacts the log and closes it
+func (p *diskProvider) Close() error {
+	p.mu.Lock()
+	if p.file == nil {
+		p.mu.Unlock()
+		return nil
+	}
+	quit, done := p.quit, p.done
+	p.mu.Unlock()
+
+	close(quit)
+	<-done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.flush(); err != nil {
+		return err
+	}
+	if err := p.compact(); err != nil {
+		return err
+	}
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
+
+func (p *diskProvider) flushLoop(quit, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			// errors are reported by the next Save or Close
+			_ = p.flush()
+			p.mu.Unlock()
+		}
+	}
+}
+
+// flush writes the modified sessions and syncs the log, p.mu must be held
+func (p *diskProvider) flush() error {
+	var written bool
+	for id, s := range p.st {
+		if !s.takeDirty() {
+			continue
+		}
+		if err := p.store(id, s); err != nil {
+			return err
+		}
+		written = true
+	}
+	if !written {
+		return nil
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+
+	if p.records > compactMinRecords && p.records > 2*len(p.persisted) {
+		return p.compact()
+	}
+	return nil
+}
+
+// store appends the session to the log, clean sessions are not stored.
+// p.mu must be held.
+func (p *diskProvider) store(id string, s *Session) error {
+	rec, err := s.record()
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return nil
+	}
+	if err := p.write(record{Op: opPut, ID: id, Session: rec}); err != nil {
+		return err
+	}
+	p.persisted[id] = true
+	return nil
+}
+
+// write appends rec to the log, p.mu must be held
+func (p *diskProvider) write(rec record) error {
+	if p.file == nil {
+		return ErrProviderNotOpen
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := p.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	p.records++
+	return nil
+}
+
+// load replays the log at p.path. A trailing record without newline was
+// cut short by a crash and is ignored.
+func (p *diskProvider) load() error {
+	f, err := os.Open(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("store/Open: %s:%d: %v", p.path, line, err)
+		}
+		switch rec.Op {
+		case opPut:
+			s, err := sessionFromRecord(rec.ID, rec.Session)
+			if err != nil {
+				return fmt.Errorf("store/Open: %s:%d: %v", p.path, line, err)
+			}
+			p.st[rec.ID] = s
+			p.persisted[rec.ID] = true
+		case opDel:
+			delete(p.st, rec.ID)
+			delete(p.persisted, rec.ID)
+		default:
+			return fmt.Errorf("store/Open: %s:%d: unknown operation %q", p.path, line, rec.Op)
+		}
+	}
+}
+
+// compact rewrites the log with the stored sessions only and reopens it
+// for appending, p.mu must be held
+func (p *diskProvider) compact() error {
+	tmp := p.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	records := 0
+	for id := range p.persisted {
+		s, ok := p.st[id]
+		if !ok {
+			continue
+		}
+		rec, err := s.record()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if rec == nil {
+			continue
+		}
+		data, err := json.Marshal(record{Op: opPut, ID: id, Session: rec})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		_, _ = w.Write(data)
+		_ = w.WriteByte('\n')
+		records++
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if p.file != nil {
+		_ = p.file.Close()
+		p.file = nil
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		// keep appending to the old log
+		_ = os.Remove(tmp)
+		if rerr := p.reopen(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := p.reopen(); err != nil {
+		return err
+	}
+	p.records = records
+	return nil
+}
+
+// reopen opens the log at p.path for appending, p.mu must be held
+func (p *diskProvider) reopen() error {
+	f, err := os.OpenFile(p.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	p.file = f
+	return nil
+}
+
+// record returns the stored form of the session, or nil for sessions that
+// do not outlive their connection. The messages in flight to a connected
+// client are stored in front of the queue.
+func (s *Session) record() (*sessionRecord, error) {
+	s.mu.Lock()
+	if !s.initted || !s.persistent() {
+		s.mu.Unlock()
+		return nil, nil
+	}
+	// the client locks its inflight window, which must not wait for s.mu
+	track := s.inflight
+	s.mu.Unlock()
+	var inflight []*packets.PublishPacket
+	if track != nil {
+		inflight = track()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inflight == nil {
+		// suspended meanwhile, the messages were queued
+		inflight = nil
+	}
+
+	var buf bytes.Buffer
+	cmsg := storedConnect(s.cmsg)
+	if err := cmsg.Encode(&buf, cmsg.ProtocolVersion); err != nil {
+		return nil, err
+	}
+	expiry := s.expiry
+	rec := &sessionRecord{
+		Connect:        buf.Bytes(),
+		Dropped:        s.dropped,
+		ExpiryInterval: &expiry,
+	}
+	if !s.disconnected.IsZero() {
+		rec.Disconnected = s.disconnected.UnixNano()
+	}
+	for _, sub := range s.topics {
+		rec.Subscriptions = append(rec.Subscriptions, sub)
+	}
+	queue := append(inflight, s.queue...)
+	for _, msg := range queue {
+		var buf bytes.Buffer
+		if err := msg.Encode(&buf, packets.Version5); err != nil {
+			return nil, err
+		}
+		rec.Queue = append(rec.Queue, buf.Bytes())
+		if !msg.Expiry.IsZero() {
+			if rec.Expiry == nil {
+				rec.Expiry = make([]int64, len(rec.Queue)-1, len(queue))
+			}
+			rec.Expiry = append(rec.Expiry, msg.Expiry.UnixNano())
+		} else if rec.Expiry != nil {
+			rec.Expiry = append(rec.Expiry, 0)
+		}
+	}
+	s.dirty = false
+
+	return rec, nil
+}
+
+// storedConnect returns the part of the CONNECT packet a stored session
+// needs. Credentials, the will and the properties are not stored.
+func storedConnect(cmsg *packets.ConnectPacket) *packets.ConnectPacket {
+	c := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	c.ProtocolName = cmsg.ProtocolName
+	c.ProtocolVersion = cmsg.ProtocolVersion
+	c.CleanSession = cmsg.CleanSession
+	c.Keepalive = cmsg.Keepalive
+	c.ClientIdentifier = cmsg.ClientIdentifier
+	return c
+}
+
+// sessionFromRecord restores a stored session. The client is offline until
+// it reconnects, so the session starts queueing messages.
+func sessionFromRecord(id string, rec *sessionRecord) (*Session, error) {
+	if rec == nil {
+		return nil, errors.New("missing session")
+	}
+
+	p, err := packets.ReadPacket(bytes.NewReader(rec.Connect))
+	if err != nil {
+		return nil, err
+	}
+	cmsg, ok := p.(*packets.ConnectPacket)
+	if !ok {
+		return nil, errors.New("stored session is not a CONNECT packet")
+	}
+
+	s := &Session{
+		id:         id,
+		cmsg:       cmsg,
+		topics:     make(map[string]Subscription, len(rec.Subscriptions)),
+		maxQueued:  DefaultMaxQueued,
+		dropPolicy: DropOldest,
+		dropped:    rec.Dropped,
+		offline:    true,
+		initted:    true,
+		expiry:     ExpiryNever,
+		// the expiry of sessions stored while online starts with the restart
+		disconnected: time.Now(),
+	}
+	if rec.ExpiryInterval != nil {
+		s.expiry = *rec.ExpiryInterval
+	}
+	if rec.Disconnected != 0 {
+		s.disconnected = time.Unix(0, rec.Disconnected)
+	}
+	for _, sub := range rec.Subscriptions {
+		s.topics[sub.Topic] = sub
+	}
+	for i, data := range rec.Queue {
+		p, err := packets.ReadPacketVersion(bytes.NewReader(data), packets.Version5)
+		if err != nil {
+			return nil, err
+		}
+		msg, ok := p.(*packets.PublishPacket)
+		if !ok {
+			return nil, errors.New("stored message is not a PUBLISH packet")
+		}
+		if i < len(rec.Expiry) && rec.Expiry[i] != 0 {
+			msg.Expiry = time.Unix(0, rec.Expiry[i])
+		}
+		s.queue = append(s.queue, msg)
+	}
+
+	return s, nil
+}
+
+// takeDirty reports whether the session changed since it was last stored
+func (s *Session) takeDirty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dirty := s.dirty
+	s.dirty = false
+	return dirty
+}
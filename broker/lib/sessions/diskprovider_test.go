@@ -0,0 +1,228 @@
+package sessions
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func newConnect(id string, clean bool) *packets.ConnectPacket {
+	c := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	c.ProtocolName = "MQTT"
+	c.ProtocolVersion = packets.Version311
+	c.ClientIdentifier = id
+	c.CleanSession = clean
+	return c
+}
+
+func newPublish(payload string) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.Qos = 1
+	p.MessageID = 1
+	p.TopicName = "a/b"
+	p.Payload = []byte(payload)
+	return p
+}
+
+func TestDiskProviderRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+
+	p := NewDiskProvider()
+	assert.Nil(t, p.Open(path))
+
+	s, err := p.New("persistent")
+	assert.Nil(t, err)
+	connect := newConnect("persistent", false)
+	connect.UsernameFlag, connect.Username = true, "alice"
+	connect.PasswordFlag, connect.Password = true, []byte("secret")
+	connect.WillFlag, connect.WillTopic, connect.WillMessage = true, "will", []byte("gone")
+	assert.Nil(t, s.Init(connect))
+	assert.Nil(t, s.AddSubscription(Subscription{Topic: "a/#", Qos: 1, Options: packets.SubscribeOptions{NoLocal: true}}))
+	s.Suspend(nil)
+	assert.True(t, s.Enqueue(newPublish("first")))
+	assert.True(t, s.Enqueue(newPublish("second")))
+	assert.Nil(t, p.Save("persistent"))
+
+	clean, err := p.New("clean")
+	assert.Nil(t, err)
+	assert.Nil(t, clean.Init(newConnect("clean", true)))
+
+	deleted, err := p.New("deleted")
+	assert.Nil(t, err)
+	assert.Nil(t, deleted.Init(newConnect("deleted", false)))
+	assert.Nil(t, p.Save("deleted"))
+	p.Del("deleted")
+
+	// MQTT 5.0 sessions are stored when their expiry interval is above 0
+	for id, expiry := range map[string]uint32{"v5-expiring": 60, "v5-ending": 0} {
+		v5, err := p.New(id)
+		assert.Nil(t, err)
+		connect := newConnect(id, expiry > 0)
+		connect.ProtocolVersion = packets.Version5
+		assert.Nil(t, v5.Init(connect))
+		v5.SetExpiry(expiry)
+		assert.Nil(t, p.Save(id))
+	}
+
+	assert.Nil(t, p.Close())
+
+	p = NewDiskProvider()
+	assert.Nil(t, p.Open(path))
+	defer p.Close()
+
+	assert.Equal(t, 2, p.Count())
+	v5, err := p.Get("v5-expiring")
+	if assert.Nil(t, err) {
+		assert.True(t, v5.Persistent())
+		assert.Equal(t, uint32(60), v5.Expiry())
+	}
+	s, err = p.Get("persistent")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.False(t, s.CleanSession())
+	// credentials and the will are not stored
+	assert.Equal(t, "persistent", s.cmsg.ClientIdentifier)
+	assert.Empty(t, s.cmsg.Username)
+	assert.Empty(t, s.cmsg.Password)
+	assert.False(t, s.cmsg.WillFlag)
+	assert.Empty(t, s.cmsg.WillMessage)
+
+	subs, err := s.Subscriptions()
+	assert.Nil(t, err)
+	assert.Equal(t, []Subscription{{Topic: "a/#", Qos: 1, Options: packets.SubscribeOptions{NoLocal: true}}}, subs)
+
+	// the restored session is offline and keeps queueing
+	assert.True(t, s.Enqueue(newPublish("third")))
+	var payloads []string
+	for _, msg := range s.Resume() {
+		payloads = append(payloads, string(msg.Payload))
+	}
+	assert.Equal(t, []string{"first", "second", "third"}, payloads)
+	assert.Nil(t, s.Resume())
+	assert.False(t, s.Enqueue(newPublish("online")))
+}
+
+func TestDiskProviderCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+
+	p := NewDiskProvider()
+	assert.Nil(t, p.Open(path))
+	defer p.Close()
+
+	s, err := p.New("persistent")
+	assert.Nil(t, err)
+	assert.Nil(t, s.Init(newConnect("persistent", false)))
+	for i := 0; i < 2*compactMinRecords; i++ {
+		assert.Nil(t, s.AddTopic("a/b", byte(i%3)))
+		p.mu.Lock()
+		assert.Nil(t, p.flush())
+		p.mu.Unlock()
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	assert.LessOrEqual(t, p.records, compactMinRecords+1)
+}
+
+func TestSessionQueueLimit(t *testing.T) {
+	s := &Session{}
+	assert.Nil(t, s.Init(newConnect("queue", false)))
+	s.SetQueueLimit(2, DropOldest)
+	s.Suspend(nil)
+	for _, payload := range []string{"1", "2", "3"} {
+		assert.True(t, s.Enqueue(newPublish(payload)))
+	}
+	queued, dropped := s.Queued()
+	assert.Equal(t, 2, queued)
+	assert.Equal(t, uint64(1), dropped)
+	assert.Equal(t, "2", string(s.Resume()[0].Payload))
+
+	s.Suspend(nil)
+	s.SetQueueLimit(2, DropNewest)
+	for _, payload := range []string{"1", "2", "3"} {
+		assert.True(t, s.Enqueue(newPublish(payload)))
+	}
+	assert.Equal(t, "1", string(s.Resume()[0].Payload))
+}
+
+func TestSessionExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+
+	p := NewDiskProvider()
+	assert.Nil(t, p.Open(path))
+
+	s, err := p.New("expiring")
+	assert.Nil(t, err)
+	assert.Nil(t, s.Init(newConnect("expiring", false)))
+	s.SetExpiry(60)
+	assert.False(t, s.Expire(time.Now().Add(time.Hour)), "online sessions do not expire")
+	s.Suspend(nil)
+	assert.True(t, s.Enqueue(newPublish("queued")))
+	assert.Nil(t, p.Save("expiring"))
+	assert.Nil(t, p.Close())
+
+	p = NewDiskProvider()
+	assert.Nil(t, p.Open(path))
+	defer p.Close()
+
+	s, err = p.Get("expiring")
+	if !assert.Nil(t, err) {
+		return
+	}
+	now := time.Now()
+	assert.False(t, s.Expire(now))
+	assert.True(t, s.Expire(now.Add(time.Minute)))
+	assert.False(t, s.Expire(now.Add(time.Minute)), "sessions expire once")
+	assert.False(t, s.Reconnect(now))
+	n, _ := s.Queued()
+	assert.Equal(t, 0, n)
+
+	never, err := p.New("never")
+	assert.Nil(t, err)
+	assert.Nil(t, never.Init(newConnect("never", false)))
+	never.Suspend(nil)
+	assert.False(t, never.Expire(now.Add(24*time.Hour)))
+	assert.True(t, never.Reconnect(now))
+}
+
+func TestDiskProviderInflight(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+
+	p := NewDiskProvider()
+	assert.Nil(t, p.Open(path))
+	defer p.Close()
+
+	s, err := p.New("inflight")
+	assert.Nil(t, err)
+	assert.Nil(t, s.Init(newConnect("inflight", false)))
+	inflight := newPublish("unacknowledged")
+	inflight.Dup = true
+	s.TrackInflight(func() []*packets.PublishPacket {
+		return []*packets.PublishPacket{inflight}
+	})
+	assert.Nil(t, p.Save("inflight"))
+
+	// the messages in flight to a connected client survive a crash
+	crashed := NewDiskProvider()
+	assert.Nil(t, crashed.Open(path))
+	defer crashed.Close()
+	restored, err := crashed.Get("inflight")
+	if !assert.Nil(t, err) {
+		return
+	}
+	msgs := restored.Resume()
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, "unacknowledged", string(msgs[0].Payload))
+		assert.True(t, msgs[0].Dup)
+	}
+
+	// suspending the session queues them instead
+	s.Suspend([]*packets.PublishPacket{inflight})
+	rec, err := s.record()
+	assert.Nil(t, err)
+	assert.Len(t, rec.Queue, 1)
+}
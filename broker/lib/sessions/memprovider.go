@@ -22,6 +22,11 @@ func NewMemProvider() *memProvider {
 	}
 }
 
+// NewProvider returns an empty memProvider for every manager
+func (p *memProvider) NewProvider() SessionsProvider {
+	return NewMemProvider()
+}
+
 func (p *memProvider) New(id string) (*Session, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -53,10 +58,25 @@ func (p *memProvider) Save(id string) error {
 }
 
 func (p *memProvider) Count() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	return len(p.st)
 }
 
+func (p *memProvider) Range(f func(id string, s *Session) bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for id, s := range p.st {
+		if !f(id, s) {
+			return
+		}
+	}
+}
+
 func (p *memProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.st = make(map[string]*Session)
 	return nil
 }
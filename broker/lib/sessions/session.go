@@ -2,17 +2,44 @@ package sessions
 
 import (
 	"fmt"
+	"math"
 	"sync"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/habakke/hmq/broker/lib/packets"
 )
 
 const (
 	// Queue size for the ack queue
 	//lint:ignore U1000 This may be used later
 	defaultQueueSize = 16
+
+	// DefaultMaxQueued is the default number of messages kept for an offline
+	// session
+	DefaultMaxQueued = 1000
+
+	// ExpiryNever is the expiry interval of sessions that are kept until the
+	// client cleans them
+	ExpiryNever = math.MaxUint32
 )
 
+// Drop policies applied when the offline queue of a session is full
+const (
+	// DropOldest discards the oldest queued message to make room
+	DropOldest = "oldest"
+	// DropNewest discards the message being queued
+	DropNewest = "newest"
+)
+
+// Subscription is a subscription kept in the session so that it can be
+// restored when the client resumes the session.
+type Subscription struct {
+	Topic      string
+	Qos        byte
+	Options    packets.SubscribeOptions
+	Identifier int
+}
+
 type Session struct {
 
 	// cmsg is the CONNECT message
@@ -25,7 +52,28 @@ type Session struct {
 	Retained *packets.PublishPacket
 
 	// topics stores all the topis for this session/client
-	topics map[string]byte
+	topics map[string]Subscription
+
+	// queue holds the messages published while the client is offline
+	queue      []*packets.PublishPacket
+	maxQueued  int
+	dropPolicy string
+	dropped    uint64
+	offline    bool
+
+	// expiry is the time in seconds the session is kept after the client
+	// disconnected
+	expiry uint32
+	// disconnected is when the client of the offline session disconnected
+	disconnected time.Time
+	// inflight returns the unacknowledged messages of the connected client,
+	// they are stored in front of the queue
+	inflight func() []*packets.PublishPacket
+	// expired is set once the session expired, it is not resumed anymore
+	expired bool
+
+	// dirty is set when the session changed since it was last stored
+	dirty bool
 
 	// Initialized?
 	initted bool
@@ -54,11 +102,15 @@ func (s *Session) Init(msg *packets.ConnectPacket) error {
 		s.Will.Retain = s.cmsg.WillRetain
 	}
 
-	s.topics = make(map[string]byte, 1)
+	s.topics = make(map[string]Subscription, 1)
+	s.maxQueued = DefaultMaxQueued
+	s.dropPolicy = DropOldest
+	s.expiry = ExpiryNever
 
 	s.id = string(msg.ClientIdentifier)
 
 	s.initted = true
+	s.dirty = true
 
 	return nil
 }
@@ -68,6 +120,7 @@ func (s *Session) Update(msg *packets.ConnectPacket) error {
 	defer s.mu.Unlock()
 
 	s.cmsg = msg
+	s.dirty = true
 	return nil
 }
 
@@ -81,6 +134,10 @@ func (s *Session) RetainMessage(msg *packets.PublishPacket) error {
 }
 
 func (s *Session) AddTopic(topic string, qos byte) error {
+	return s.AddSubscription(Subscription{Topic: topic, Qos: qos})
+}
+
+func (s *Session) AddSubscription(sub Subscription) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -88,7 +145,8 @@ func (s *Session) AddTopic(topic string, qos byte) error {
 		return fmt.Errorf("Session not yet initialized")
 	}
 
-	s.topics[topic] = qos
+	s.topics[sub.Topic] = sub
+	s.dirty = true
 
 	return nil
 }
@@ -102,6 +160,7 @@ func (s *Session) RemoveTopic(topic string) error {
 	}
 
 	delete(s.topics, topic)
+	s.dirty = true
 
 	return nil
 }
@@ -121,12 +180,192 @@ func (s *Session) Topics() ([]string, []byte, error) {
 
 	for k, v := range s.topics {
 		topics = append(topics, k)
-		qoss = append(qoss, v)
+		qoss = append(qoss, v.Qos)
 	}
 
 	return topics, qoss, nil
 }
 
+func (s *Session) Subscriptions() ([]Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.initted {
+		return nil, fmt.Errorf("Session not yet initialized")
+	}
+
+	subs := make([]Subscription, 0, len(s.topics))
+	for _, v := range s.topics {
+		subs = append(subs, v)
+	}
+
+	return subs, nil
+}
+
+// SetQueueLimit sets the maximum number of messages queued while the session
+// is offline and the policy used to drop messages once it is full.
+func (s *Session) SetQueueLimit(max int, policy string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxQueued = max
+	s.dropPolicy = policy
+}
+
+// SetExpiry sets the time in seconds the session is kept after the client
+// disconnected, ExpiryNever keeps it until the client cleans it.
+func (s *Session) SetExpiry(interval uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expiry = interval
+	s.dirty = true
+}
+
+// Expiry returns the time in seconds the session is kept after the client
+// disconnected
+func (s *Session) Expiry() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiry
+}
+
+// Reconnect stops the expiry of the session for a client connecting to it. It
+// returns false when the session already expired and must not be resumed.
+func (s *Session) Reconnect(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expired || s.expiredAt(now) {
+		s.expired = true
+		return false
+	}
+	s.disconnected = time.Time{}
+	return true
+}
+
+// Expire reports whether the session expired at now. An expired session
+// drops its queued messages and is not resumed anymore.
+func (s *Session) Expire(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expired || !s.expiredAt(now) {
+		return false
+	}
+	s.expired = true
+	s.queue = nil
+	return true
+}
+
+// expiredAt reports whether the client disconnected longer than the expiry
+// interval before now, s.mu must be held
+func (s *Session) expiredAt(now time.Time) bool {
+	if s.expiry == ExpiryNever || s.disconnected.IsZero() {
+		return false
+	}
+	return !now.Before(s.disconnected.Add(time.Duration(s.expiry) * time.Second))
+}
+
+// Suspend marks the session offline, messages passed to Enqueue are queued
+// until the session is resumed. Unacknowledged messages are put in front of
+// the queue. The expiry interval of the session starts.
+func (s *Session) Suspend(inflight []*packets.PublishPacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.offline = true
+	s.disconnected = time.Now()
+	s.inflight = nil
+	s.dirty = true
+	if len(inflight) > 0 {
+		s.queue = append(inflight, s.queue...)
+		s.trim()
+	}
+}
+
+// TrackInflight makes the session store the messages returned by inflight,
+// the unacknowledged messages of the connected client, until it is
+// suspended
+func (s *Session) TrackInflight(inflight func() []*packets.PublishPacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inflight = inflight
+	s.dirty = true
+}
+
+// InflightChanged marks the session modified when the messages in flight to
+// its client changed
+func (s *Session) InflightChanged() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inflight != nil {
+		s.dirty = true
+	}
+}
+
+// Enqueue queues msg if the session is offline and reports whether it did
+// so. QoS 0 messages are discarded while offline.
+func (s *Session) Enqueue(msg *packets.PublishPacket) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.offline {
+		return false
+	}
+	if msg.Qos == 0 || s.expired {
+		return true
+	}
+	s.dirty = true
+
+	if s.maxQueued > 0 && len(s.queue) >= s.maxQueued && s.dropPolicy == DropNewest {
+		s.dropped++
+		return true
+	}
+	s.queue = append(s.queue, msg)
+	s.trim()
+
+	return true
+}
+
+// Resume returns the queued messages in order. Messages published while the
+// returned ones are delivered are queued as well, so Resume must be called
+// until it returns no messages, at which point the session is online again.
+func (s *Session) Resume() []*packets.PublishPacket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dirty = true
+	if len(s.queue) == 0 {
+		s.offline = false
+		return nil
+	}
+
+	msgs := s.queue
+	s.queue = nil
+	return msgs
+}
+
+// Queued returns the number of queued messages and the number of messages
+// dropped because the queue was full.
+func (s *Session) Queued() (int, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue), s.dropped
+}
+
+// trim drops the oldest messages above the queue limit, s.mu must be held
+func (s *Session) trim() {
+	if s.maxQueued <= 0 || len(s.queue) <= s.maxQueued {
+		return
+	}
+	n := len(s.queue) - s.maxQueued
+	s.dropped += uint64(n)
+	s.queue = append([]*packets.PublishPacket(nil), s.queue[n:]...)
+}
+
 func (s *Session) ID() string {
 	return s.cmsg.ClientIdentifier
 }
@@ -143,6 +382,26 @@ func (s *Session) SetWillFlag(v bool) {
 	s.cmsg.WillFlag = v
 }
 
+// Persistent reports whether the session outlives the connection of its
+// client: MQTT 5.0 sessions with an expiry interval above 0, or the ones of
+// MQTT 3.1.1 clients connecting without CleanSession.
+func (s *Session) Persistent() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.persistent()
+}
+
+// persistent is Persistent with s.mu held
+func (s *Session) persistent() bool {
+	if s.cmsg == nil {
+		return false
+	}
+	if s.cmsg.ProtocolVersion == packets.Version5 {
+		return s.expiry > 0
+	}
+	return !s.cmsg.CleanSession
+}
+
 func (s *Session) CleanSession() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -21,9 +21,22 @@ type SessionsProvider interface {
 	Del(id string)
 	Save(id string) error
 	Count() int
+	Range(f func(id string, s *Session) bool)
 	Close() error
 }
 
+// Factory is implemented by providers that give every manager an instance of
+// its own, so that brokers in the same process do not share their sessions
+type Factory interface {
+	NewProvider() SessionsProvider
+}
+
+// Opener is implemented by providers that store sessions at a path which
+// must be opened before the provider is used.
+type Opener interface {
+	Open(path string) error
+}
+
 // Register makes a session provider available by the provided name.
 // If a Register is called twice with the same name or if the driver is nil,
 // it panics.
@@ -52,6 +65,9 @@ func NewManager(providerName string) (*Manager, error) {
 	if !ok {
 		return nil, fmt.Errorf("session: unknown provider %q", providerName)
 	}
+	if f, ok := p.(Factory); ok {
+		p = f.NewProvider()
+	}
 
 	return &Manager{p: p}, nil
 }
@@ -75,6 +91,19 @@ func (m *Manager) Save(id string) error {
 	return m.p.Save(id)
 }
 
+// Open opens the provider at path if it implements Opener
+func (m *Manager) Open(path string) error {
+	if o, ok := m.p.(Opener); ok {
+		return o.Open(path)
+	}
+	return nil
+}
+
+// Range calls f for every session until f returns false
+func (m *Manager) Range(f func(id string, s *Session) bool) {
+	m.p.Range(f)
+}
+
 func (m *Manager) Count() int {
 	return m.p.Count()
 }
@@ -0,0 +1,367 @@
+package topics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+)
+
+var _ TopicsProvider = (*diskTopics)(nil)
+
+func init() {
+	Register("disk", NewDiskProvider())
+}
+
+const (
+	// compactMinRecords is the number of records the retained log must
+	// hold before it is compacted
+	compactMinRecords = 1024
+
+	// syncInterval is how often the records written to the log are synced
+	// to disk
+	syncInterval = time.Second
+)
+
+var ErrProviderNotOpen = errors.New("topics: disk provider not open")
+
+// retainRecord is a line of the retained message log. The log is replayed in
+// order on open, the last record of a topic wins.
+type retainRecord struct {
+	Topic string `json:"topic"`
+	Msg   []byte `json:"msg,omitempty"`
+	// Expiry is when the message expires in Unix seconds, 0 never
+	Expiry int64 `json:"expiry,omitempty"`
+}
+
+func newRetainRecord(msg *packets.PublishPacket, data []byte) retainRecord {
+	rec := retainRecord{Topic: msg.TopicName, Msg: data}
+	if !msg.Expiry.IsZero() {
+		rec.Expiry = msg.Expiry.Unix()
+	}
+	return rec
+}
+
+// diskTopics keeps subscriptions in memory like memTopics and writes retained
+// messages through to an append only log, so they survive restarts. The log
+// is synced every syncInterval, and rewritten with only the current messages
+// when it holds more than twice as many records as there are retained
+// messages.
+type diskTopics struct {
+	*memTopics
+
+	// fmu protects the log, it is taken after rmu
+	fmu      sync.Mutex
+	path     string
+	file     *os.File
+	records  int
+	unsynced bool
+	retained map[string]struct{}
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewDiskProvider returns a TopicsProvider storing retained messages on disk.
+// It must be opened with the path of the log before it is used.
+func NewDiskProvider() *diskTopics {
+	return &diskTopics{
+		memTopics: NewMemProvider(),
+		retained:  make(map[string]struct{}),
+	}
+}
+
+// NewProvider returns a diskTopics to open for every manager
+func (t *diskTopics) NewProvider() TopicsProvider {
+	return NewDiskProvider()
+}
+
+// Open loads the retained messages stored at path and writes new ones to it
+func (t *diskTopics) Open(path string) error {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+	t.fmu.Lock()
+	defer t.fmu.Unlock()
+
+	if t.file != nil {
+		return fmt.Errorf("topics: disk provider already open at %s", t.path)
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	t.path = path
+	t.rroot = newRNode()
+	t.retained = make(map[string]struct{})
+	if err := t.load(); err != nil {
+		return err
+	}
+	if err := t.compact(); err != nil {
+		return err
+	}
+
+	t.quit = make(chan struct{})
+	t.done = make(chan struct{})
+	go t.syncLoop(t.quit, t.done)
+	return nil
+}
+
+func (t *diskTopics) Retain(msg *packets.PublishPacket) error {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+	t.fmu.Lock()
+	defer t.fmu.Unlock()
+
+	if t.file == nil {
+		return ErrProviderNotOpen
+	}
+
+	rec := newRetainRecord(msg, nil)
+	if len(msg.Payload) == 0 {
+		if _, ok := t.retained[msg.TopicName]; !ok {
+			return nil
+		}
+		if err := t.rroot.rremove([]byte(msg.TopicName)); err != nil {
+			return err
+		}
+		delete(t.retained, msg.TopicName)
+	} else {
+		var buf bytes.Buffer
+		if err := msg.Encode(&buf, packets.Version5); err != nil {
+			return err
+		}
+		rec.Msg = buf.Bytes()
+		if err := t.rroot.rinsertOrUpdate([]byte(msg.TopicName), msg); err != nil {
+			return err
+		}
+		t.retained[msg.TopicName] = struct{}{}
+	}
+
+	if err := t.write(rec); err != nil {
+		return err
+	}
+	if t.records > compactMinRecords && t.records > 2*len(t.retained) {
+		return t.compact()
+	}
+	return nil
+}
+
+// ExpireRetained removes the retained messages that expired at now and
+// records their removal in the log
+func (t *diskTopics) ExpireRetained(now time.Time) []string {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+	t.fmu.Lock()
+	defer t.fmu.Unlock()
+
+	var topics []string
+	t.rroot.rexpire(now, &topics)
+	for _, topic := range topics {
+		delete(t.retained, topic)
+		if t.file == nil {
+			continue
+		}
+		if err := t.write(retainRecord{Topic: topic}); err != nil {
+			// the message expires again when the log is loaded
+			break
+		}
+	}
+	return topics
+}
+
+// Close compacts and closes the log
+func (t *diskTopics) Close() error {
+	t.fmu.Lock()
+	if t.file == nil {
+		t.fmu.Unlock()
+		return nil
+	}
+	quit, done := t.quit, t.done
+	t.quit = nil
+	t.fmu.Unlock()
+
+	if quit != nil {
+		close(quit)
+		<-done
+	}
+
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+	t.fmu.Lock()
+	defer t.fmu.Unlock()
+
+	if err := t.compact(); err != nil {
+		return err
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// write appends rec to the log, it is synced by the sync loop. t.fmu must
+// be held.
+func (t *diskTopics) write(rec retainRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := t.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	t.records++
+	t.unsynced = true
+	return nil
+}
+
+func (t *diskTopics) syncLoop(quit, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			t.fmu.Lock()
+			// a failed sync is retried with the next tick, Close compacts
+			// the log
+			if t.unsynced && t.file.Sync() == nil {
+				t.unsynced = false
+			}
+			t.fmu.Unlock()
+		}
+	}
+}
+
+// load replays the log at t.path. A trailing record without newline was cut
+// short by a crash and is ignored.
+func (t *diskTopics) load() error {
+	f, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec retainRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("topics: %s:%d: %v", t.path, line, err)
+		}
+		if len(rec.Msg) == 0 {
+			if _, ok := t.retained[rec.Topic]; ok {
+				_ = t.rroot.rremove([]byte(rec.Topic))
+				delete(t.retained, rec.Topic)
+			}
+			continue
+		}
+
+		p, err := packets.ReadPacketVersion(bytes.NewReader(rec.Msg), packets.Version5)
+		if err != nil {
+			return fmt.Errorf("topics: %s:%d: %v", t.path, line, err)
+		}
+		msg, ok := p.(*packets.PublishPacket)
+		if !ok {
+			return fmt.Errorf("topics: %s:%d: stored message is not a PUBLISH packet", t.path, line)
+		}
+		if rec.Expiry != 0 {
+			msg.Expiry = time.Unix(rec.Expiry, 0)
+		}
+		if err := t.rroot.rinsertOrUpdate([]byte(rec.Topic), msg); err != nil {
+			return fmt.Errorf("topics: %s:%d: %v", t.path, line, err)
+		}
+		t.retained[rec.Topic] = struct{}{}
+	}
+}
+
+// compact rewrites the log with the current retained messages and reopens
+// it for appending, t.rmu and t.fmu must be held
+func (t *diskTopics) compact() error {
+	var msgs []*packets.PublishPacket
+	t.rroot.allRetained(&msgs)
+
+	tmp := t.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, msg := range msgs {
+		var buf bytes.Buffer
+		if err := msg.Encode(&buf, packets.Version5); err != nil {
+			f.Close()
+			return err
+		}
+		data, err := json.Marshal(newRetainRecord(msg, buf.Bytes()))
+		if err != nil {
+			f.Close()
+			return err
+		}
+		_, _ = w.Write(data)
+		_ = w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if t.file != nil {
+		_ = t.file.Close()
+		t.file = nil
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		// keep appending to the old log
+		_ = os.Remove(tmp)
+		if rerr := t.reopen(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := t.reopen(); err != nil {
+		return err
+	}
+	t.records = len(msgs)
+	t.unsynced = false
+	return nil
+}
+
+// reopen opens the log at t.path for appending, t.fmu must be held
+func (t *diskTopics) reopen() error {
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	t.file = f
+	return nil
+}
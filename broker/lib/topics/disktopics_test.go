@@ -0,0 +1,121 @@
+package topics
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRetained(topic, payload string) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.Retain = true
+	p.Qos = 1
+	p.MessageID = 1
+	p.TopicName = topic
+	p.Payload = []byte(payload)
+	return p
+}
+
+func TestDiskTopicsRetained(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retained.log")
+
+	p := NewDiskProvider()
+	assert.Nil(t, p.Open(path))
+	assert.Nil(t, p.Retain(newRetained("config/a", "1")))
+	assert.Nil(t, p.Retain(newRetained("config/a", "2")))
+	assert.Nil(t, p.Retain(newRetained("config/b", "3")))
+	assert.Nil(t, p.Retain(newRetained("config/c", "4")))
+	assert.Nil(t, p.Retain(newRetained("config/c", "")))
+	assert.Nil(t, p.Retain(newRetained("config/unknown", "")))
+	assert.Nil(t, p.Close())
+
+	p = NewDiskProvider()
+	assert.Nil(t, p.Open(path))
+	defer p.Close()
+
+	var msgs []*packets.PublishPacket
+	assert.Nil(t, p.Retained([]byte("config/#"), &msgs))
+	payloads := make(map[string]string)
+	for _, msg := range msgs {
+		payloads[msg.TopicName] = string(msg.Payload)
+	}
+	assert.Equal(t, map[string]string{"config/a": "2", "config/b": "3"}, payloads)
+}
+
+func TestDiskTopicsSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retained.log")
+
+	p := NewDiskProvider()
+	assert.Nil(t, p.Open(path))
+	defer p.Close()
+
+	// records are written right away and synced in the background
+	assert.Nil(t, p.Retain(newRetained("config/a", "1")))
+	synced := func() bool {
+		p.fmu.Lock()
+		defer p.fmu.Unlock()
+		return !p.unsynced
+	}
+	assert.False(t, synced())
+	assert.Eventually(t, synced, 5*syncInterval, syncInterval/10)
+
+	reopened := NewDiskProvider()
+	assert.Nil(t, reopened.Open(path))
+	defer reopened.Close()
+	var msgs []*packets.PublishPacket
+	assert.Nil(t, reopened.Retained([]byte("config/a"), &msgs))
+	assert.Len(t, msgs, 1)
+}
+
+func TestDiskTopicsCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retained.log")
+
+	p := NewDiskProvider()
+	assert.Nil(t, p.Open(path))
+	defer p.Close()
+
+	for i := 0; i < 2*compactMinRecords; i++ {
+		assert.Nil(t, p.Retain(newRetained("config/a", "value")))
+	}
+	assert.LessOrEqual(t, p.records, compactMinRecords+1)
+}
+
+func TestDiskTopicsExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retained.log")
+	now := time.Now()
+
+	p := NewDiskProvider()
+	assert.Nil(t, p.Open(path))
+	expired := newRetained("sensor/a", "1")
+	expired.Expiry = now.Add(-time.Second)
+	live := newRetained("sensor/b", "2")
+	live.Expiry = now.Add(time.Hour)
+	later := newRetained("sensor/c/d", "3")
+	later.Expiry = now.Add(2 * time.Second)
+	assert.Nil(t, p.Retain(expired))
+	assert.Nil(t, p.Retain(live))
+	assert.Nil(t, p.Retain(later))
+
+	var msgs []*packets.PublishPacket
+	assert.Nil(t, p.Retained([]byte("sensor/#"), &msgs))
+	assert.Len(t, msgs, 2)
+
+	assert.Equal(t, []string{"sensor/a"}, p.ExpireRetained(now))
+	assert.Equal(t, []string{"sensor/c/d"}, p.ExpireRetained(now.Add(time.Minute)))
+	_, ok := p.rroot.rnodes["sensor"].rnodes["c"]
+	assert.False(t, ok)
+	assert.Nil(t, p.Close())
+
+	p = NewDiskProvider()
+	assert.Nil(t, p.Open(path))
+	defer p.Close()
+	msgs = nil
+	assert.Nil(t, p.Retained([]byte("sensor/#"), &msgs))
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, "sensor/b", msgs[0].TopicName)
+		assert.Equal(t, live.Expiry.Unix(), msgs[0].Expiry.Unix())
+	}
+}
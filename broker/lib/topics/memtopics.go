@@ -3,9 +3,11 @@ package topics
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/habakke/hmq/broker/lib/packets"
 )
 
 const (
@@ -44,6 +46,11 @@ func NewMemProvider() *memTopics {
 	}
 }
 
+// NewProvider returns an empty memTopics for every manager
+func (t *memTopics) NewProvider() TopicsProvider {
+	return NewMemProvider()
+}
+
 func ValidQos(qos byte) bool {
 	return qos == QosAtMostOnce || qos == QosAtLeastOnce || qos == QosExactlyOnce
 }
@@ -90,6 +97,18 @@ func (t *memTopics) Subscribers(topic []byte, qos byte, subs *[]interface{}, qos
 	*subs = (*subs)[0:0]
 	*qoss = (*qoss)[0:0]
 
+	// Topics starting with $ are not matched by wildcards on the first level
+	if len(topic) > 0 && topic[0] == SYS[0] {
+		ntl, rem, err := nextTopicLevel(topic)
+		if err != nil {
+			return err
+		}
+		if n, ok := t.sroot.snodes[string(ntl)]; ok {
+			return n.smatch(rem, qos, subs, qoss)
+		}
+		return nil
+	}
+
 	return t.sroot.smatch(topic, qos, subs, qoss)
 }
 
@@ -111,12 +130,62 @@ func (t *memTopics) Retained(topic []byte, msgs *[]*packets.PublishPacket) error
 	t.rmu.RLock()
 	defer t.rmu.RUnlock()
 
+	// Wildcards on the first level do not match topics starting with $
+	if len(topic) > 0 && (topic[0] == MWC[0] || topic[0] == SWC[0]) {
+		ntl, rem, err := nextTopicLevel(topic)
+		if err != nil {
+			return err
+		}
+		if string(ntl) == MWC {
+			appendRetained(msgs, t.rroot.msg)
+		}
+		for level, n := range t.rroot.rnodes {
+			if strings.HasPrefix(level, SYS) {
+				continue
+			}
+			if string(ntl) == MWC {
+				n.allRetained(msgs)
+			} else if err := n.rmatch(rem, msgs); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	return t.rroot.rmatch(topic, msgs)
 }
 
+// ExpireRetained removes the retained messages that expired at now and
+// returns their topics
+func (t *memTopics) ExpireRetained(now time.Time) []string {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+
+	var topics []string
+	t.rroot.rexpire(now, &topics)
+	return topics
+}
+
+// Counts returns the number of subscriptions and retained messages
+func (t *memTopics) Counts() (int, int) {
+	t.smu.RLock()
+	subscriptions := t.sroot.count()
+	t.smu.RUnlock()
+
+	t.rmu.RLock()
+	retained := t.rroot.count()
+	t.rmu.RUnlock()
+
+	return subscriptions, retained
+}
+
 func (t *memTopics) Close() error {
-	t.sroot = nil
-	t.rroot = nil
+	t.smu.Lock()
+	t.sroot = newSNode()
+	t.smu.Unlock()
+	t.rmu.Lock()
+	t.rroot = newRNode()
+	t.rmu.Unlock()
 	return nil
 }
 
@@ -136,6 +205,15 @@ func newSNode() *snode {
 	}
 }
 
+// count returns the number of subscribers in this snode and below
+func (s *snode) count() int {
+	n := len(s.subs)
+	for _, sn := range s.snodes {
+		n += sn.count()
+	}
+	return n
+}
+
 func (s *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
 	// If there's no more topic levels, that means we are at the matching snode
 	// to insert the subscriber. So let's see if there's such subscriber,
@@ -286,6 +364,18 @@ func newRNode() *rnode {
 	}
 }
 
+// count returns the number of retained messages in this rnode and below
+func (r *rnode) count() int {
+	n := 0
+	if r.msg != nil {
+		n++
+	}
+	for _, rn := range r.rnodes {
+		n += rn.count()
+	}
+	return n
+}
+
 func (r *rnode) rinsertOrUpdate(topic []byte, msg *packets.PublishPacket) error {
 	// If there's no more topic levels, that means we are at the matching rnode.
 	if len(topic) == 0 {
@@ -362,9 +452,7 @@ func (r *rnode) rmatch(topic []byte, msgs *[]*packets.PublishPacket) error {
 	// If the topic is empty, it means we are at the final matching rnode. If so,
 	// add the retained msg to the list.
 	if len(topic) == 0 {
-		if r.msg != nil {
-			*msgs = append(*msgs, r.msg)
-		}
+		appendRetained(msgs, r.msg)
 		return nil
 	}
 
@@ -399,15 +487,35 @@ func (r *rnode) rmatch(topic []byte, msgs *[]*packets.PublishPacket) error {
 }
 
 func (r *rnode) allRetained(msgs *[]*packets.PublishPacket) {
-	if r.msg != nil {
-		*msgs = append(*msgs, r.msg)
-	}
+	appendRetained(msgs, r.msg)
 
 	for _, n := range r.rnodes {
 		n.allRetained(msgs)
 	}
 }
 
+// appendRetained adds msg to msgs unless there is none or it expired
+func appendRetained(msgs *[]*packets.PublishPacket, msg *packets.PublishPacket) {
+	if msg != nil && !msg.Expired(time.Now()) {
+		*msgs = append(*msgs, msg)
+	}
+}
+
+// rexpire removes the retained messages that expired at now and the rnodes
+// left empty, the topics of the removed messages are added to topics
+func (r *rnode) rexpire(now time.Time, topics *[]string) {
+	if r.msg != nil && r.msg.Expired(now) {
+		*topics = append(*topics, r.msg.TopicName)
+		r.msg = nil
+	}
+	for level, n := range r.rnodes {
+		n.rexpire(now, topics)
+		if n.msg == nil && len(n.rnodes) == 0 {
+			delete(r.rnodes, level)
+		}
+	}
+}
+
 const (
 	stateCHR byte = iota // Regular character
 	stateMWC             // Multi-level wildcard
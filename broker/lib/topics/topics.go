@@ -2,8 +2,9 @@ package topics
 
 import (
 	"fmt"
+	"time"
 
-	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/habakke/hmq/broker/lib/packets"
 )
 
 const (
@@ -37,6 +38,30 @@ type TopicsProvider interface {
 	Close() error
 }
 
+// Counter is implemented by providers that can count their subscriptions and
+// retained messages
+type Counter interface {
+	Counts() (subscriptions int, retained int)
+}
+
+// Expirer is implemented by providers that can remove expired retained
+// messages, it returns the topics of the removed messages
+type Expirer interface {
+	ExpireRetained(now time.Time) []string
+}
+
+// Factory is implemented by providers that give every manager an instance of
+// its own, so that brokers in the same process do not share their state
+type Factory interface {
+	NewProvider() TopicsProvider
+}
+
+// Opener is implemented by providers that store retained messages at a path
+// which must be opened before the provider is used.
+type Opener interface {
+	Open(path string) error
+}
+
 func Register(name string, provider TopicsProvider) {
 	if provider == nil {
 		panic("topics: Register provide is nil")
@@ -62,6 +87,9 @@ func NewManager(providerName string) (*Manager, error) {
 	if !ok {
 		return nil, fmt.Errorf("session: unknown provider %q", providerName)
 	}
+	if f, ok := p.(Factory); ok {
+		p = f.NewProvider()
+	}
 
 	return &Manager{p: p}, nil
 }
@@ -86,6 +114,32 @@ func (m *Manager) Retained(topic []byte, msgs *[]*packets.PublishPacket) error {
 	return m.p.Retained(topic, msgs)
 }
 
+// Open opens the provider at path if it implements Opener
+func (m *Manager) Open(path string) error {
+	if o, ok := m.p.(Opener); ok {
+		return o.Open(path)
+	}
+	return nil
+}
+
+// Counts returns the number of subscriptions and retained messages, or zero
+// when the provider does not implement Counter
+func (m *Manager) Counts() (int, int) {
+	if c, ok := m.p.(Counter); ok {
+		return c.Counts()
+	}
+	return 0, 0
+}
+
+// ExpireRetained removes the retained messages that expired at now if the
+// provider implements Expirer and returns their topics
+func (m *Manager) ExpireRetained(now time.Time) []string {
+	if e, ok := m.p.(Expirer); ok {
+		return e.ExpireRetained(now)
+	}
+	return nil
+}
+
 func (m *Manager) Close() error {
 	return m.p.Close()
 }
@@ -0,0 +1,290 @@
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"github.com/habakke/hmq/plugins/auth"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+// Protocols of client listeners
+const (
+	ListenerTCP = "tcp"
+	ListenerTLS = "tls"
+	ListenerWS  = "ws"
+	ListenerWSS = "wss"
+)
+
+// defaultWsPath is the path websocket listeners serve MQTT on when no path
+// is configured
+const defaultWsPath = "/ws"
+
+func validListener(info ListenerInfo) error {
+	switch info.Protocol {
+	case ListenerTCP, ListenerWS:
+	case ListenerTLS, ListenerWSS:
+		if info.TLS == nil || info.TLS.CertFile == "" || info.TLS.KeyFile == "" {
+			return fmt.Errorf("listener %s: tls config error, no cert or key file", info.Address)
+		}
+	default:
+		return fmt.Errorf("listener %s: unknown protocol %q", info.Address, info.Protocol)
+	}
+	if info.Address == "" {
+		return fmt.Errorf("listener with protocol %s has no address", info.Protocol)
+	}
+	if info.ProxyProtocol && info.Protocol != ListenerTCP && info.Protocol != ListenerTLS {
+		return fmt.Errorf("listener %s: proxy protocol is only supported by tcp and tls listeners", info.Address)
+	}
+	if info.ProxyProtocol && len(info.ProxyTrustedCIDRs) == 0 {
+		return fmt.Errorf("listener %s: proxy protocol needs the trusted networks of the proxies", info.Address)
+	}
+	if _, err := parseCIDRs(info.ProxyTrustedCIDRs); err != nil {
+		return fmt.Errorf("listener %s: %v", info.Address, err)
+	}
+	return nil
+}
+
+// listener accepts client connections as configured by a ListenerInfo
+type listener struct {
+	info      ListenerInfo
+	auth      auth.Auth
+	tlsConfig *tls.Config
+	// proxies are the networks trusted to send PROXY protocol headers
+	proxies []*net.IPNet
+	// conns is the number of open connections
+	conns int64
+}
+
+// newListener prepares the listener described by info. Clients are checked
+// by the auth plugin of the listener configured by authConfig, or by
+// defaultAuth when it has none.
+func newListener(info ListenerInfo, defaultAuth auth.Auth, authConfig auth.Config) (*listener, error) {
+	if err := validListener(info); err != nil {
+		return nil, err
+	}
+
+	l := &listener{info: info, auth: defaultAuth}
+	if info.Auth != "" {
+		l.auth = auth.NewAuthConfig(info.Auth, authConfig)
+	}
+	if info.TLS != nil && (info.Protocol == ListenerTLS || info.Protocol == ListenerWSS) {
+		tlsConfig, err := NewTLSConfig(*info.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", info.Address, err)
+		}
+		l.tlsConfig = tlsConfig
+	}
+	if info.ProxyProtocol {
+		l.proxies, _ = parseCIDRs(info.ProxyTrustedCIDRs)
+	}
+	if l.info.Protocol == ListenerWS || l.info.Protocol == ListenerWSS {
+		if l.info.Path == "" {
+			l.info.Path = defaultWsPath
+		}
+	}
+	return l, nil
+}
+
+// listeners returns the listeners of config, the ones set up by the port,
+// tlsPort and wsPort options come first
+func (config *Config) listeners() []ListenerInfo {
+	var infos []ListenerInfo
+	if config.Port != "" {
+		infos = append(infos, ListenerInfo{
+			Protocol: ListenerTCP,
+			Address:  config.Host + ":" + config.Port,
+		})
+	}
+	if config.TlsPort != "" {
+		tlsInfo := config.TlsInfo
+		infos = append(infos, ListenerInfo{
+			Protocol: ListenerTLS,
+			Address:  config.TlsHost + ":" + config.TlsPort,
+			TLS:      &tlsInfo,
+		})
+	}
+	if config.WsPort != "" {
+		info := ListenerInfo{
+			Protocol: ListenerWS,
+			Address:  ":" + config.WsPort,
+			Path:     config.WsPath,
+		}
+		if config.WsTLS {
+			tlsInfo := config.TlsInfo
+			info.Protocol = ListenerWSS
+			info.TLS = &tlsInfo
+		}
+		infos = append(infos, info)
+	}
+	return append(infos, config.Listeners...)
+}
+
+// admit counts a new connection, it returns false when the listener already
+// has its maximum number of connections
+func (l *listener) admit() bool {
+	n := atomic.AddInt64(&l.conns, 1)
+	if max := l.info.MaxConnections; max > 0 && n > int64(max) {
+		atomic.AddInt64(&l.conns, -1)
+		return false
+	}
+	return true
+}
+
+func (l *listener) release() {
+	atomic.AddInt64(&l.conns, -1)
+}
+
+// serveListener listens on the address of l until the broker shuts down
+func (b *Broker) serveListener(l *listener) {
+	var err error
+	var nl net.Listener
+	// Retry listening indefinitely so that specifying IP addresses
+	// (e.g. --host=10.0.0.217) starts working once the IP address is actually
+	// configured on the interface.
+	for {
+		if b.shuttingDown() {
+			return
+		}
+		// tls listeners start TLS per connection, after the PROXY protocol
+		// header
+		if l.info.Protocol == ListenerWSS {
+			nl, err = tls.Listen("tcp", l.info.Address, l.tlsConfig)
+		} else {
+			nl, err = net.Listen("tcp", l.info.Address)
+		}
+		log.Info("Start Listening client on ", zap.String("hp", l.info.Address), zap.String("protocol", l.info.Protocol))
+		if err != nil {
+			log.Error("Error listening on ", zap.Error(err))
+			time.Sleep(1 * time.Second)
+		} else {
+			break // successfully listening
+		}
+	}
+
+	switch l.info.Protocol {
+	case ListenerWS, ListenerWSS:
+		b.serveWebsocket(l, nl)
+	default:
+		b.acceptClients(l, nl)
+	}
+}
+
+func (b *Broker) acceptClients(l *listener, nl net.Listener) {
+	if !b.trackListener(nl) {
+		return
+	}
+	tmpDelay := 10 * ACCEPT_MIN_SLEEP
+	for {
+		conn, err := nl.Accept()
+		if err != nil {
+			if b.shuttingDown() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Error("Temporary Client Accept Error(%v), sleeping %dms",
+					zap.Error(ne), zap.Duration("sleeping", tmpDelay/time.Millisecond))
+				time.Sleep(tmpDelay)
+				tmpDelay *= 2
+				if tmpDelay > ACCEPT_MAX_SLEEP {
+					tmpDelay = ACCEPT_MAX_SLEEP
+				}
+			} else {
+				log.Error("Accept error: %v", zap.Error(err))
+			}
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+		go b.acceptClient(l, conn)
+	}
+}
+
+// acceptClient reads the PROXY protocol header and starts TLS on a
+// connection accepted by a tcp or tls listener
+func (b *Broker) acceptClient(l *listener, conn net.Conn) {
+	if l.info.ProxyProtocol && l.trusted(conn.RemoteAddr()) {
+		pc, err := readProxyHeader(conn)
+		if err != nil {
+			log.Warn("read proxy protocol header error, connection closed", zap.Error(err), zap.String("remote", conn.RemoteAddr().String()))
+			_ = conn.Close()
+			return
+		}
+		conn = pc
+	}
+	if l.tlsConfig != nil {
+		conn = tls.Server(conn, l.tlsConfig)
+	}
+	b.handleClient(l, conn)
+}
+
+// trusted reports whether addr may send a PROXY protocol header, connections
+// from other addresses are served as direct connections
+func (l *listener) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.proxies {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Broker) serveWebsocket(l *listener, nl net.Listener) {
+	log.Info("Start Websocket Listener on:", zap.String("hp", l.info.Address), zap.String("path", l.info.Path))
+	ws := &websocket.Server{Handler: websocket.Handler(func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		b.handleClient(l, ws)
+	})}
+	mux := http.NewServeMux()
+	mux.Handle(l.info.Path, ws)
+	srv := &http.Server{Handler: mux}
+	if !b.trackServer(srv) {
+		_ = nl.Close()
+		return
+	}
+	if err := srv.Serve(nl); err != nil && err != http.ErrServerClosed {
+		log.Error("Serve:" + err.Error())
+	}
+}
+
+// authPlugin returns the auth plugin checking the client
+func (c *client) authPlugin() auth.Auth {
+	if c.listener != nil {
+		return c.listener.auth
+	}
+	return c.broker.auth
+}
+
+// mount prefixes topic with the mountpoint of the listener of the client
+func (c *client) mount(topic string) string {
+	if c.listener == nil || c.listener.info.Mountpoint == "" {
+		return topic
+	}
+	if strings.HasPrefix(topic, "$share/") {
+		if substr := groupCompile.FindStringSubmatch(topic); len(substr) == 3 {
+			return "$share/" + substr[1] + "/" + c.listener.info.Mountpoint + substr[2]
+		}
+	}
+	return c.listener.info.Mountpoint + topic
+}
+
+// unmount removes the mountpoint of the listener of the client from the
+// topic of packet
+func (c *client) unmount(packet *packets.PublishPacket) *packets.PublishPacket {
+	if c.listener == nil || c.listener.info.Mountpoint == "" || !strings.HasPrefix(packet.TopicName, c.listener.info.Mountpoint) {
+		return packet
+	}
+	p := *packet
+	p.TopicName = strings.TrimPrefix(packet.TopicName, c.listener.info.Mountpoint)
+	return &p
+}
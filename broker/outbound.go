@@ -0,0 +1,356 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"github.com/habakke/hmq/metrics"
+	"go.uber.org/zap"
+)
+
+// Policies applied when the outbound queue of a client is full
+const (
+	// SlowConsumerDropQos0 drops the oldest queued QoS 0 message, a queue
+	// without QoS 0 messages disconnects the client
+	SlowConsumerDropQos0 = "drop-qos0"
+	// SlowConsumerDisconnect disconnects the client
+	SlowConsumerDisconnect = "disconnect"
+	// SlowConsumerBlock waits up to the write timeout for the queue to drain
+	// before disconnecting the client
+	SlowConsumerBlock = "block"
+)
+
+const (
+	// DefaultOutboundQueueSize is the number of packets queued per client
+	DefaultOutboundQueueSize = 1000
+	// DefaultWriteTimeout bounds a single write to a client connection
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+var (
+	errSlowConsumer = errors.New("outbound queue full, slow consumer disconnected")
+	// errExceedsMaxPacketSize is returned for packets larger than the
+	// Maximum Packet Size of the client, they are discarded
+	errExceedsMaxPacketSize = errors.New("packet exceeds client maximum packet size")
+)
+
+func validSlowConsumerPolicy(policy string) error {
+	switch policy {
+	case SlowConsumerDropQos0, SlowConsumerDisconnect, SlowConsumerBlock:
+		return nil
+	}
+	return fmt.Errorf("unknown slow consumer policy %q", policy)
+}
+
+// outQueue holds the packets waiting to be written to a client. It is drained
+// by the writer goroutine of the client, so a slow subscriber never blocks
+// the worker publishing to it.
+type outQueue struct {
+	mu      sync.Mutex
+	packets []packets.ControlPacket
+	max     int
+	policy  string
+	timeout time.Duration
+	closed  bool
+	started bool
+
+	// ready wakes the writer, space wakes blocked producers
+	ready chan struct{}
+	space chan struct{}
+	done  chan struct{}
+}
+
+func newOutQueue(config OutboundInfo) *outQueue {
+	q := &outQueue{
+		max:     config.QueueSize,
+		policy:  config.Policy,
+		timeout: time.Duration(config.WriteTimeout) * time.Second,
+		ready:   make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if q.max <= 0 {
+		q.max = DefaultOutboundQueueSize
+	}
+	if q.policy == "" {
+		q.policy = SlowConsumerDropQos0
+	}
+	if q.timeout <= 0 {
+		q.timeout = DefaultWriteTimeout
+	}
+	return q
+}
+
+// push queues packet for writing. It returns the number of messages dropped
+// to make room and errSlowConsumer when the client must be disconnected.
+func (q *outQueue) push(packet packets.ControlPacket) (int, error) {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	q.mu.Lock()
+	for {
+		if q.closed {
+			q.mu.Unlock()
+			return 0, nil
+		}
+		if len(q.packets) < q.max {
+			q.packets = append(q.packets, packet)
+			q.mu.Unlock()
+			q.signal(q.ready)
+			return 0, nil
+		}
+
+		switch q.policy {
+		case SlowConsumerDropQos0:
+			dropped := q.dropQos0(packet)
+			q.mu.Unlock()
+			if !dropped {
+				return 0, errSlowConsumer
+			}
+			q.signal(q.ready)
+			return 1, nil
+		case SlowConsumerBlock:
+			q.mu.Unlock()
+			if timer == nil {
+				timer = time.NewTimer(q.timeout)
+			}
+			select {
+			case <-q.space:
+			case <-q.done:
+			case <-timer.C:
+				return 0, errSlowConsumer
+			}
+			q.mu.Lock()
+		default:
+			q.mu.Unlock()
+			return 0, errSlowConsumer
+		}
+	}
+}
+
+// dropQos0 makes room for packet by removing the oldest queued QoS 0
+// message, or drops packet itself when it is a QoS 0 message and nothing else
+// can be removed. q.mu must be held.
+func (q *outQueue) dropQos0(packet packets.ControlPacket) bool {
+	for i, p := range q.packets {
+		if pub, ok := p.(*packets.PublishPacket); ok && pub.Qos == QosAtMostOnce {
+			copy(q.packets[i:], q.packets[i+1:])
+			q.packets[len(q.packets)-1] = packet
+			return true
+		}
+	}
+	pub, ok := packet.(*packets.PublishPacket)
+	return ok && pub.Qos == QosAtMostOnce
+}
+
+// pop returns the next packet to write, it waits until one is queued and
+// returns false once the queue is closed and empty
+func (q *outQueue) pop() (packets.ControlPacket, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.packets) > 0 {
+			p := q.packets[0]
+			q.packets[0] = nil
+			q.packets = q.packets[1:]
+			q.mu.Unlock()
+			q.signal(q.space)
+			return p, true
+		}
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+		<-q.ready
+	}
+}
+
+func (q *outQueue) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// start marks the writer as running, it reports false when the queue was
+// closed before
+func (q *outQueue) start() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	q.started = true
+	return true
+}
+
+// close stops accepting packets and waits up to the write timeout for the
+// writer to write the queued ones
+func (q *outQueue) close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	started := q.started
+	q.mu.Unlock()
+
+	if !started {
+		close(q.done)
+		return
+	}
+	q.signal(q.ready)
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	select {
+	case <-q.done:
+	case <-timer.C:
+	}
+}
+
+// discard closes the queue and drops the queued packets
+func (q *outQueue) discard() {
+	q.mu.Lock()
+	q.closed = true
+	q.packets = nil
+	q.mu.Unlock()
+	q.signal(q.ready)
+}
+
+// startWriter starts writing the queued packets to the connection. Packets
+// written before, like the CONNACK, go out first.
+func (c *client) startWriter() {
+	if c.out == nil || !c.out.start() {
+		return
+	}
+	go c.writeLoop(c.conn, c.out)
+}
+
+func (c *client) writeLoop(conn net.Conn, q *outQueue) {
+	defer close(q.done)
+
+	for {
+		packet, ok := q.pop()
+		if !ok {
+			return
+		}
+		if err := conn.SetWriteDeadline(time.Now().Add(q.timeout)); err != nil {
+			log.Error("set write timeout error: ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+		}
+		err := c.write(conn, packet)
+		if err == errExceedsMaxPacketSize {
+			c.discardOversized(packet)
+			continue
+		}
+		if err != nil {
+			log.Error("write packet error: ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+			// the read loop notices the closed connection and disconnects
+			// the client
+			q.discard()
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// write encodes packet to conn
+func (c *client) write(conn net.Conn, packet packets.ControlPacket) error {
+	var stats *brokerStats
+	if c.broker != nil {
+		stats = c.broker.stats
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats.sent(packet)
+	if c.info.maxPacketSize == 0 {
+		return packet.Encode(stats.writer(conn), c.info.protocolVersion)
+	}
+
+	// MQTT 5.0 clients may limit the size of packets they accept, packets
+	// exceeding the limit are discarded
+	var buf bytes.Buffer
+	if err := packet.Encode(&buf, c.info.protocolVersion); err != nil {
+		return err
+	}
+	if uint32(buf.Len()) > c.info.maxPacketSize {
+		log.Warn("packet exceeds client maximum packet size, discarded", zap.Int("size", buf.Len()), zap.String("ClientID", c.info.clientID))
+		return errExceedsMaxPacketSize
+	}
+	_, err := buf.WriteTo(stats.writer(conn))
+	return err
+}
+
+// queuePacket hands packet to the writer of the client and applies the slow
+// consumer policy when its queue is full
+func (c *client) queuePacket(packet packets.ControlPacket) error {
+	dropped, err := c.out.push(packet)
+	b := c.broker
+	for i := 0; i < dropped; i++ {
+		b.stats.dropped()
+		_ = b.metrics.Inc(metrics.MetricNumberOfDroppedMessages)
+	}
+	if err != errSlowConsumer {
+		return err
+	}
+
+	log.Warn("slow consumer, disconnecting", zap.String("ClientID", c.info.clientID), zap.Int("queued", c.out.max))
+	_ = b.metrics.Inc(metrics.MetricNumberOfSlowConsumers)
+	c.out.discard()
+	if conn := c.conn; conn != nil {
+		_ = conn.Close()
+	}
+	return err
+}
+
+// discardOversized counts a packet discarded because of the Maximum Packet
+// Size of the client as dropped. A QoS 1 or 2 message is removed from the
+// inflight window by the worker of the client, as if it was acknowledged,
+// so that it is not sent again.
+func (c *client) discardOversized(packet packets.ControlPacket) {
+	pub, ok := packet.(*packets.PublishPacket)
+	if !ok {
+		return
+	}
+	b := c.broker
+	if b == nil {
+		return
+	}
+	b.stats.dropped()
+	_ = b.metrics.Inc(metrics.MetricNumberOfDroppedMessages)
+	if pub.Qos > QosAtMostOnce {
+		b.wpool.Submit(c.info.clientID, func() {
+			c.discardInflight(pub)
+		})
+	}
+}
+
+// closeConn closes the connection once the queued packets are written or the
+// write timeout elapsed. It does not wait for the writer, the connection is
+// closed in the background.
+func (c *client) closeConn() {
+	out, conn := c.out, c.conn
+	if out == nil {
+		if conn != nil {
+			_ = conn.Close()
+		}
+		return
+	}
+	go func() {
+		out.close()
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+}
@@ -0,0 +1,276 @@
+package broker
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"github.com/habakke/hmq/metrics"
+	"github.com/habakke/hmq/plugins/auth"
+	"go.uber.org/zap"
+)
+
+// Policies applied when a client publishes faster than its limits
+const (
+	// PublishThrottle stops reading from the client until it is within its
+	// limits again
+	PublishThrottle = "throttle"
+	// PublishDisconnect disconnects the client
+	PublishDisconnect = "disconnect"
+)
+
+func validPublishPolicy(policy string) error {
+	switch policy {
+	case PublishThrottle, PublishDisconnect:
+		return nil
+	}
+	return fmt.Errorf("unknown publish limit policy %q", policy)
+}
+
+// rateBucket is a token bucket shared by the goroutines reading from
+// clients. Throttled clients take tokens in advance and wait for the debt to
+// be paid back, the debt is capped at one burst.
+type rateBucket struct {
+	mu    sync.Mutex
+	rate  float64
+	burst float64
+	tokenBucket
+}
+
+// newRateBucket returns nil when rate is unlimited
+func newRateBucket(rate float64, burst int, now time.Time) *rateBucket {
+	if rate <= 0 {
+		return nil
+	}
+	rb := &rateBucket{tokenBucket: tokenBucket{last: now}}
+	rb.set(rate, burst)
+	rb.tokens = rb.burst
+	return rb
+}
+
+// set changes the rate and burst, the burst is the rate rounded up when 0
+func (rb *rateBucket) set(rate float64, burst int) {
+	rb.rate = rate
+	rb.burst = float64(burst)
+	if burst <= 0 {
+		rb.burst = math.Max(1, math.Ceil(rate))
+	}
+}
+
+// allows reports whether cost can be taken without going into debt, costs
+// above the burst need a full bucket
+func (rb *rateBucket) allows(cost float64, now time.Time) bool {
+	if rb == nil {
+		return true
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.refill(now, rb.rate, rb.burst)
+	return rb.tokens >= math.Min(cost, rb.burst)
+}
+
+// take removes cost from the bucket and returns how long to wait until the
+// bucket is out of debt. No tokens are taken once the debt reached one
+// burst, so the wait never exceeds the time to refill one burst.
+func (rb *rateBucket) take(cost float64, now time.Time) time.Duration {
+	if rb == nil {
+		return 0
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.refill(now, rb.rate, rb.burst)
+	if rb.tokens > -rb.burst {
+		rb.tokens = math.Max(rb.tokens-cost, -rb.burst)
+	}
+	if rb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rb.tokens / rb.rate * float64(time.Second))
+}
+
+// publishLimits are the buckets a client publishes through, its own ones
+// and the ones shared by the clients of its username
+type publishLimits struct {
+	policy   string
+	messages []*rateBucket
+	bytes    []*rateBucket
+}
+
+func (pl *publishLimits) add(messages, bytes *rateBucket) {
+	if messages != nil {
+		pl.messages = append(pl.messages, messages)
+	}
+	if bytes != nil {
+		pl.bytes = append(pl.bytes, bytes)
+	}
+}
+
+func (pl *publishLimits) empty() bool {
+	return len(pl.messages) == 0 && len(pl.bytes) == 0
+}
+
+// take accounts for packet, it returns how long reading from the client has
+// to wait, or the reason code to disconnect the client with. The byte
+// buckets are charged the topic and payload bytes.
+func (pl *publishLimits) take(packet *packets.PublishPacket, now time.Time) (time.Duration, byte) {
+	size := float64(len(packet.TopicName) + len(packet.Payload))
+	if pl.policy == PublishDisconnect {
+		for _, rb := range pl.messages {
+			if !rb.allows(1, now) {
+				return 0, packets.ReasonMessageRateTooHigh
+			}
+		}
+		for _, rb := range pl.bytes {
+			if !rb.allows(size, now) {
+				return 0, packets.ReasonQuotaExceeded
+			}
+		}
+	}
+
+	var wait time.Duration
+	for _, rb := range pl.messages {
+		if d := rb.take(1, now); d > wait {
+			wait = d
+		}
+	}
+	for _, rb := range pl.bytes {
+		if d := rb.take(size, now); d > wait {
+			wait = d
+		}
+	}
+	return wait, 0
+}
+
+// userLimits holds the buckets shared by the clients of a username while
+// one of them is connected
+type userLimits struct {
+	mu    sync.Mutex
+	users map[string]*userBuckets
+}
+
+type userBuckets struct {
+	refs     int
+	messages *rateBucket
+	bytes    *rateBucket
+}
+
+// acquire returns the buckets of username, the limits of the last client
+// connecting apply to all of them. A zero rate keeps the bucket of the
+// clients connected before.
+func (ul *userLimits) acquire(username string, limits auth.Limits, now time.Time) (*rateBucket, *rateBucket) {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	ub, ok := ul.users[username]
+	if !ok {
+		ub = &userBuckets{}
+		ul.users[username] = ub
+	}
+	ub.refs++
+	ub.messages = updateBucket(ub.messages, limits.MessageRate, limits.MessageBurst, now)
+	ub.bytes = updateBucket(ub.bytes, limits.ByteRate, limits.ByteBurst, now)
+	return ub.messages, ub.bytes
+}
+
+func (ul *userLimits) release(username string) {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	if ub, ok := ul.users[username]; ok {
+		if ub.refs--; ub.refs <= 0 {
+			delete(ul.users, username)
+		}
+	}
+}
+
+// updateBucket sets the rate and burst of rb, or creates it when missing
+func updateBucket(rb *rateBucket, rate float64, burst int, now time.Time) *rateBucket {
+	if rb == nil {
+		return newRateBucket(rate, burst, now)
+	}
+	if rate <= 0 {
+		return rb
+	}
+	rb.mu.Lock()
+	rb.set(rate, burst)
+	rb.mu.Unlock()
+	return rb
+}
+
+// override replaces the limits set by the auth plugin
+func override(limits auth.Limits, with auth.Limits) auth.Limits {
+	if with.MessageRate > 0 {
+		limits.MessageRate = with.MessageRate
+		limits.MessageBurst = with.MessageBurst
+	}
+	if with.ByteRate > 0 {
+		limits.ByteRate = with.ByteRate
+		limits.ByteBurst = with.ByteBurst
+	}
+	return limits
+}
+
+// publishLimits returns the publish limits of a client accepted by a, or nil
+// when it is not limited. Limits returned by the auth plugin for the user
+// replace the configured client and username limits.
+func (b *Broker) publishLimits(a auth.Auth, c *client) *publishLimits {
+	config := b.config.PublishLimits
+	clientLimits, usernameLimits := config.Client, config.Username
+	if la, ok := a.(auth.LimitedAuth); ok {
+		if limits, ok := la.Limits(c.info.clientID, c.info.username); ok {
+			clientLimits = override(clientLimits, limits)
+			if c.info.username != "" {
+				usernameLimits = override(usernameLimits, limits)
+			}
+		}
+	}
+
+	now := time.Now()
+	pl := &publishLimits{policy: config.Policy}
+	pl.add(newRateBucket(clientLimits.MessageRate, clientLimits.MessageBurst, now),
+		newRateBucket(clientLimits.ByteRate, clientLimits.ByteBurst, now))
+	if c.info.username != "" && (usernameLimits.MessageRate > 0 || usernameLimits.ByteRate > 0) {
+		c.limitedUser = true
+		pl.add(b.userLimits.acquire(c.info.username, usernameLimits, now))
+	}
+	if pl.empty() {
+		return nil
+	}
+	return pl
+}
+
+// limitPublish applies the publish limits of the client to packet before it
+// is routed. A throttled client is not read from until it is within its
+// limits again or the broker shuts down. It returns false when the client is
+// disconnected.
+func (c *client) limitPublish(packet *packets.PublishPacket) bool {
+	if c.limits == nil {
+		return true
+	}
+
+	wait, reason := c.limits.take(packet, time.Now())
+	b := c.broker
+	if reason != 0 {
+		log.Warn("client exceeds its publish limits, disconnecting", zap.String("ClientID", c.info.clientID), zap.String("username", c.info.username))
+		_ = b.metrics.Inc(metrics.MetricNumberOfRateLimitedClients)
+		c.sendDisconnect(reason)
+		return false
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	_ = b.metrics.Inc(metrics.MetricNumberOfThrottledMessages)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.ctx.Done():
+		return false
+	case <-b.quit:
+		return false
+	}
+}
@@ -1,6 +1,19 @@
 package broker
 
-import "github.com/eclipse/paho.mqtt.golang/packets"
+import (
+	"strings"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"github.com/habakke/hmq/broker/lib/sessions"
+	"github.com/habakke/hmq/metrics"
+	"github.com/habakke/hmq/plugins/auth"
+	"github.com/habakke/hmq/plugins/bridge"
+	"go.uber.org/zap"
+)
+
+// DefaultSessionReapInterval is how often expired sessions are removed
+const DefaultSessionReapInterval = time.Minute
 
 func (b *Broker) getSession(cli *client, req *packets.ConnectPacket, resp *packets.ConnackPacket) error {
 	// If CleanSession is set to 0, the server MUST resume communications with the
@@ -28,10 +41,16 @@ func (b *Broker) getSession(cli *client, req *packets.ConnectPacket, resp *packe
 	// If found, return it.
 	if !req.CleanSession {
 		if cli.session, err = b.sessionMgr.Get(cid); err == nil {
-			resp.SessionPresent = true
+			if cli.session.Reconnect(time.Now()) {
+				resp.SessionPresent = true
 
-			if err := cli.session.Update(req); err != nil {
-				return err
+				if err := cli.session.Update(req); err != nil {
+					return err
+				}
+			} else {
+				// the session expired before the reaper removed it
+				b.expireSession(cid, cli.session)
+				cli.session = nil
 			}
 		}
 	}
@@ -49,5 +68,268 @@ func (b *Broker) getSession(cli *client, req *packets.ConnectPacket, resp *packe
 		}
 	}
 
+	cli.session.SetQueueLimit(b.config.Session.MaxQueuedMessages, b.config.Session.QueueDropPolicy)
+	cli.session.SetExpiry(b.sessionExpiry(cli, req))
+
 	return nil
 }
+
+// sessionExpiry returns the session expiry interval of a connecting client:
+// the one of the auth plugin, else the Session Expiry Interval of an MQTT 5.0
+// client, 0 when it is absent, else the configured one.
+func (b *Broker) sessionExpiry(c *client, req *packets.ConnectPacket) uint32 {
+	interval := uint32(sessions.ExpiryNever)
+	if b.config.Session.ExpiryInterval > 0 {
+		interval = uint32(b.config.Session.ExpiryInterval)
+	}
+	if req.ProtocolVersion == packets.Version5 {
+		interval = 0
+		if req.Properties != nil && req.Properties.SessionExpiryInterval != nil {
+			interval = *req.Properties.SessionExpiryInterval
+		}
+	}
+	if sa, ok := c.authPlugin().(auth.SessionAuth); ok {
+		if i, ok := sa.SessionExpiry(c.info.clientID, c.info.username); ok {
+			interval = i
+		}
+	}
+	return interval
+}
+
+// sessionLoop removes the expired sessions every interval
+func (b *Broker) sessionLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.quit:
+			return
+		case now := <-ticker.C:
+			b.reapSessions(now)
+		}
+	}
+}
+
+// reapSessions removes the sessions whose clients stayed disconnected longer
+// than their expiry interval
+func (b *Broker) reapSessions(now time.Time) {
+	expired := make(map[string]*sessions.Session)
+	b.sessionMgr.Range(func(id string, s *sessions.Session) bool {
+		if s.Expire(now) {
+			expired[id] = s
+		}
+		return true
+	})
+	for id, s := range expired {
+		b.expireSession(id, s)
+	}
+}
+
+// expireSession removes the expired session s of clientID with its
+// subscriptions and queued messages
+func (b *Broker) expireSession(clientID string, s *sessions.Session) {
+	log.Info("session expired", zap.String("ClientID", clientID))
+	if cur, err := b.sessionMgr.Get(clientID); err == nil && cur == s {
+		b.sessionMgr.Del(clientID)
+	}
+	// the will of the client is due when its session ends
+	b.publishPendingWill(clientID)
+	b.discardSession(clientID)
+	b.hooks.onSessionExpired(clientID)
+	_ = b.metrics.Inc(metrics.MetricNumberOfExpiredSessions)
+	b.publishBridge(&bridge.Elements{
+		ClientID:  clientID,
+		Action:    bridge.SessionExpired,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// isPersistent reports whether the session of c outlives its connection
+func (c *client) isPersistent() bool {
+	return c.typ == CLIENT && c.session != nil && c.session.Persistent()
+}
+
+// suspendSession keeps the subscriptions of a disconnecting client with a
+// persistent session in the topic tree and queues the messages they receive
+// until the session is resumed. Unacknowledged messages are queued for
+// redelivery.
+func (c *client) suspendSession() {
+	c.inflightMu.Lock()
+	inflight := c.unacknowledged()
+	c.inflight = make(map[uint16]*inflightElem)
+	c.pending = nil
+	c.inflightMu.Unlock()
+
+	c.session.Suspend(inflight)
+	c.broker.offlineClients.Store(c.info.clientID, c)
+}
+
+// unacknowledged returns the messages to deliver again when the session of c
+// is resumed, the ones sent but not acknowledged followed by the pending
+// ones. c.inflightMu must be held.
+func (c *client) unacknowledged() []*packets.PublishPacket {
+	var msgs []*packets.PublishPacket
+	for _, elem := range c.inflight {
+		if elem.status == Publish {
+			p := *elem.packet
+			p.Dup = true
+			msgs = append(msgs, &p)
+		}
+	}
+	return append(msgs, c.pending...)
+}
+
+// trackInflight makes the session of c store the unacknowledged messages of
+// c while it is connected, so that they survive a restart
+func (c *client) trackInflight() {
+	c.session.TrackInflight(func() []*packets.PublishPacket {
+		c.inflightMu.Lock()
+		defer c.inflightMu.Unlock()
+		return c.unacknowledged()
+	})
+}
+
+// inflightChanged marks the session of c modified after its inflight window
+// or pending messages changed
+func (c *client) inflightChanged() {
+	if c.session != nil {
+		c.session.InflightChanged()
+	}
+}
+
+// resumeSession replaces the subscriptions of the previous connection of a
+// persistent session with ones of c and delivers the messages queued while
+// the client was offline. Subscriptions are restored from the session store
+// when the previous connection is not known, e.g. after a restart.
+func (c *client) resumeSession() {
+	b := c.broker
+	if old, ok := b.offlineClients.LoadAndDelete(c.info.clientID); ok {
+		ol := old.(*client)
+		for t, sub := range ol.subMap {
+			c.resumeSubscription(t, sub)
+		}
+	} else {
+		subs, err := c.session.Subscriptions()
+		if err != nil {
+			log.Error("restore subscriptions error", zap.Error(err), zap.String("ClientID", c.info.clientID))
+		}
+		for _, s := range subs {
+			c.restoreSubscription(s)
+		}
+	}
+
+	for {
+		msgs := c.session.Resume()
+		if len(msgs) == 0 {
+			break
+		}
+		for _, msg := range msgs {
+			c.deliver(msg)
+		}
+	}
+}
+
+// resumeSubscription subscribes c to the topic of sub, a subscription of the
+// previous connection, and unsubscribes sub. Subscriptions in the topic tree
+// are never modified since workers may be delivering to them. Both queue to
+// the session, which stays offline until it is resumed, so a message
+// published in between is queued twice rather than lost.
+func (c *client) resumeSubscription(t string, sub *subscription) {
+	resumed := *sub
+	resumed.client = c
+	if _, err := c.subscribe(&resumed); err != nil {
+		log.Error("resume subscription error", zap.Error(err), zap.String("ClientID", c.info.clientID), zap.String("topic", t))
+		return
+	}
+	if err := c.unsubscribe(sub); err != nil {
+		log.Error("unsubscribe error, ", zap.Error(err), zap.String("ClientID", c.info.clientID))
+	}
+	c.subMap[t] = &resumed
+}
+
+func (c *client) restoreSubscription(s sessions.Subscription) {
+	sub := &subscription{
+		topic:             s.Topic,
+		qos:               s.Qos,
+		client:            c,
+		noLocal:           s.Options.NoLocal,
+		retainAsPublished: s.Options.RetainAsPublished,
+		retainHandling:    s.Options.RetainHandling,
+		identifier:        s.Identifier,
+	}
+	if strings.HasPrefix(s.Topic, "$share/") {
+		substr := groupCompile.FindStringSubmatch(s.Topic)
+		if len(substr) != 3 {
+			return
+		}
+		sub.share = true
+		sub.groupName = substr[1]
+		sub.topic = substr[2]
+	}
+
+	if _, err := c.subscribe(sub); err != nil {
+		log.Error("restore subscription error", zap.Error(err), zap.String("ClientID", c.info.clientID), zap.String("topic", s.Topic))
+		return
+	}
+	c.subMap[s.Topic] = sub
+}
+
+// restoreSessions subscribes the persistent sessions loaded from the session
+// store on behalf of their offline clients, so that messages are queued
+// until the clients reconnect.
+func (b *Broker) restoreSessions() {
+	b.sessionMgr.Range(func(id string, s *sessions.Session) bool {
+		if !s.Persistent() {
+			return true
+		}
+		s.SetQueueLimit(b.config.Session.MaxQueuedMessages, b.config.Session.QueueDropPolicy)
+
+		c := &client{
+			typ:       CLIENT,
+			broker:    b,
+			status:    Disconnected,
+			session:   s,
+			info:      info{clientID: id},
+			subMap:    make(map[string]*subscription),
+			topicsMgr: b.topicsMgr,
+			inflight:  make(map[uint16]*inflightElem),
+		}
+		subs, err := s.Subscriptions()
+		if err != nil {
+			log.Error("restore subscriptions error", zap.Error(err), zap.String("ClientID", id))
+		}
+		for _, sub := range subs {
+			c.restoreSubscription(sub)
+		}
+		b.offlineClients.Store(id, c)
+		return true
+	})
+}
+
+// deleteSession removes the clean session of c from the store unless it was
+// already replaced by a new connection with the same client identifier.
+func (b *Broker) deleteSession(c *client) {
+	if c.session == nil {
+		return
+	}
+	if s, err := b.sessionMgr.Get(c.info.clientID); err == nil && s == c.session {
+		b.sessionMgr.Del(c.info.clientID)
+	}
+}
+
+// discardSession removes the subscriptions left behind by an offline client
+// whose persistent session was replaced by a clean one or expired.
+func (b *Broker) discardSession(clientID string) {
+	old, ok := b.offlineClients.LoadAndDelete(clientID)
+	if !ok {
+		return
+	}
+	ol := old.(*client)
+	for _, sub := range ol.subMap {
+		if err := ol.unsubscribe(sub); err != nil {
+			log.Error("unsubscribe error, ", zap.Error(err), zap.String("ClientID", clientID))
+		}
+	}
+	b.BroadcastUnSubscribe(ol.subMap)
+}
@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/segmentio/fasthash/fnv1a"
+)
+
+// Strategies used to pick the member of a share group receiving a message
+const (
+	ShareRandom        = "random"
+	ShareRoundRobin    = "round-robin"
+	ShareSticky        = "sticky"
+	ShareHash          = "hash"
+	ShareLeastInflight = "least-inflight"
+)
+
+func validShareStrategy(strategy string) error {
+	switch strategy {
+	case ShareRandom, ShareRoundRobin, ShareSticky, ShareHash, ShareLeastInflight:
+		return nil
+	}
+	return fmt.Errorf("unknown shared subscription strategy %q", strategy)
+}
+
+// shareDispatcher picks one subscriber per share group for every message
+type shareDispatcher struct {
+	mu       sync.Mutex
+	strategy string
+	groups   map[string]string
+	// next is the round-robin position per share group
+	next map[string]int
+	// sticky is the client receiving the messages of a share group
+	sticky map[string]string
+	// members is the number of subscriptions of a share group, the state of
+	// a group is removed with its last member
+	members map[string]int
+}
+
+func newShareDispatcher(config SharedInfo) *shareDispatcher {
+	return &shareDispatcher{
+		strategy: config.Strategy,
+		groups:   config.Groups,
+		next:     make(map[string]int),
+		sticky:   make(map[string]string),
+		members:  make(map[string]int),
+	}
+}
+
+// join counts a new member of the share group key
+func (d *shareDispatcher) join(key string) {
+	d.mu.Lock()
+	d.members[key]++
+	d.mu.Unlock()
+}
+
+// leave counts a member leaving the share group key and forgets the group
+// when it was the last one
+func (d *shareDispatcher) leave(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.members[key] > 1 {
+		d.members[key]--
+		return
+	}
+	delete(d.members, key)
+	delete(d.next, key)
+	delete(d.sticky, key)
+}
+
+// shareGroupKey identifies a share group, the same group name used with
+// different topic filters forms different groups.
+func shareGroupKey(sub *subscription) string {
+	return sub.groupName + "/" + sub.topic
+}
+
+// pick returns the member of the share group that receives a message
+// published by publisherID. Connected members are preferred over members
+// with an offline persistent session.
+func (d *shareDispatcher) pick(key string, subs []*subscription, publisherID string) *subscription {
+	if len(subs) == 1 {
+		return subs[0]
+	}
+
+	online := subs[:0:0]
+	for _, sub := range subs {
+		if sub.client.status == Connected {
+			online = append(online, sub)
+		}
+	}
+	if len(online) > 0 {
+		subs = online
+	}
+
+	strategy := d.strategy
+	if s, ok := d.groups[subs[0].groupName]; ok {
+		strategy = s
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch strategy {
+	case ShareRoundRobin:
+		i := d.next[key] % len(subs)
+		d.next[key] = i + 1
+		return subs[i]
+	case ShareSticky:
+		if id, ok := d.sticky[key]; ok {
+			for _, sub := range subs {
+				if sub.client.info.clientID == id {
+					return sub
+				}
+			}
+		}
+		sub := subs[r.Intn(len(subs))]
+		d.sticky[key] = sub.client.info.clientID
+		return sub
+	case ShareHash:
+		sorted := append(subs[:0:0], subs...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].client.info.clientID < sorted[j].client.info.clientID
+		})
+		return sorted[fnv1a.HashString64(publisherID)%uint64(len(sorted))]
+	case ShareLeastInflight:
+		var least *subscription
+		leastInflight := 0
+		for _, sub := range subs {
+			sub.client.inflightMu.RLock()
+			n := len(sub.client.inflight)
+			sub.client.inflightMu.RUnlock()
+			if least == nil || n < leastInflight {
+				least, leastInflight = sub, n
+			}
+		}
+		return least
+	default:
+		return subs[r.Intn(len(subs))]
+	}
+}
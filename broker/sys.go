@@ -0,0 +1,272 @@
+package broker
+
+import (
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"go.uber.org/zap"
+)
+
+// Version is reported in $SYS/broker/version, it is set at build time
+var Version = "unknown"
+
+const (
+	// sysPrefix is the root of the broker statistics tree
+	sysPrefix = "$SYS/broker/"
+
+	// defaultSysInterval is how often the statistics are published when
+	// sysInterval is not configured
+	defaultSysInterval = 10 * time.Second
+)
+
+// loadWindows are the periods the load averages are computed over
+var loadWindows = []struct {
+	name   string
+	period time.Duration
+}{
+	{"1min", time.Minute},
+	{"5min", 5 * time.Minute},
+	{"15min", 15 * time.Minute},
+}
+
+// brokerStats counts the traffic of the broker. The counters are updated
+// from the client paths and published periodically under $SYS/broker/.
+// A nil *brokerStats ignores all updates.
+type brokerStats struct {
+	start time.Time
+
+	messagesReceived uint64
+	messagesSent     uint64
+	publishReceived  uint64
+	publishSent      uint64
+	bytesReceived    uint64
+	bytesSent        uint64
+	connections      uint64
+	publishDropped   uint64
+
+	// mu protects the load averages and the last published values
+	mu        sync.Mutex
+	lastTick  time.Time
+	lastCount map[string]uint64
+	load      map[string][]float64
+	published map[string]string
+}
+
+func newBrokerStats() *brokerStats {
+	now := time.Now()
+	return &brokerStats{
+		start:     now,
+		lastTick:  now,
+		lastCount: make(map[string]uint64),
+		load:      make(map[string][]float64),
+		published: make(map[string]string),
+	}
+}
+
+func (s *brokerStats) received(packet packets.ControlPacket) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.messagesReceived, 1)
+	if _, ok := packet.(*packets.PublishPacket); ok {
+		atomic.AddUint64(&s.publishReceived, 1)
+	}
+}
+
+func (s *brokerStats) sent(packet packets.ControlPacket) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.messagesSent, 1)
+	if _, ok := packet.(*packets.PublishPacket); ok {
+		atomic.AddUint64(&s.publishSent, 1)
+	}
+}
+
+func (s *brokerStats) dropped() {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.publishDropped, 1)
+}
+
+func (s *brokerStats) connected() {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.connections, 1)
+}
+
+// countReader counts the bytes read from a client connection
+type countReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (c countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
+
+// countWriter counts the bytes written to a client connection
+type countWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (c countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
+
+// reader returns r counting into the bytes received
+func (s *brokerStats) reader(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return countReader{r: r, n: &s.bytesReceived}
+}
+
+// writer returns w counting into the bytes sent
+func (s *brokerStats) writer(w io.Writer) io.Writer {
+	if s == nil {
+		return w
+	}
+	return countWriter{w: w, n: &s.bytesSent}
+}
+
+// updateLoad folds the counters since the last call into the exponentially
+// weighted load averages, which are rates per minute like mosquitto's
+func (s *brokerStats) updateLoad(now time.Time, counters map[string]uint64) {
+	elapsed := now.Sub(s.lastTick)
+	if elapsed <= 0 {
+		return
+	}
+	s.lastTick = now
+
+	for name, count := range counters {
+		last, seen := s.lastCount[name]
+		s.lastCount[name] = count
+		if !seen {
+			last = 0
+		}
+		rate := float64(count-last) / elapsed.Minutes()
+
+		avgs, ok := s.load[name]
+		if !ok {
+			avgs = make([]float64, len(loadWindows))
+			s.load[name] = avgs
+		}
+		for i, w := range loadWindows {
+			k := math.Exp(-float64(elapsed) / float64(w.period))
+			avgs[i] = avgs[i]*k + rate*(1-k)
+		}
+	}
+}
+
+// collect returns the current value of every statistics topic
+func (b *Broker) collect(now time.Time) map[string]string {
+	s := b.stats
+
+	connected, disconnected := 0, 0
+	b.clients.Range(func(_, _ interface{}) bool {
+		connected++
+		return true
+	})
+	b.offlineClients.Range(func(_, _ interface{}) bool {
+		disconnected++
+		return true
+	})
+	subscriptions, retained := b.topicsMgr.Counts()
+
+	counters := map[string]uint64{
+		"messages/received":         atomic.LoadUint64(&s.messagesReceived),
+		"messages/sent":             atomic.LoadUint64(&s.messagesSent),
+		"publish/messages/received": atomic.LoadUint64(&s.publishReceived),
+		"publish/messages/sent":     atomic.LoadUint64(&s.publishSent),
+		"publish/messages/dropped":  atomic.LoadUint64(&s.publishDropped),
+		"bytes/received":            atomic.LoadUint64(&s.bytesReceived),
+		"bytes/sent":                atomic.LoadUint64(&s.bytesSent),
+		"connections":               atomic.LoadUint64(&s.connections),
+	}
+
+	values := map[string]string{
+		"version":                   Version,
+		"uptime":                    strconv.Itoa(int(now.Sub(s.start).Seconds())) + " seconds",
+		"clients/connected":         strconv.Itoa(connected),
+		"clients/disconnected":      strconv.Itoa(disconnected),
+		"clients/total":             strconv.Itoa(connected + disconnected),
+		"subscriptions/count":       strconv.Itoa(subscriptions),
+		"retained messages/count":   strconv.Itoa(retained),
+		"connections/total":         strconv.FormatUint(counters["connections"], 10),
+		"messages/received":         strconv.FormatUint(counters["messages/received"], 10),
+		"messages/sent":             strconv.FormatUint(counters["messages/sent"], 10),
+		"publish/messages/received": strconv.FormatUint(counters["publish/messages/received"], 10),
+		"publish/messages/sent":     strconv.FormatUint(counters["publish/messages/sent"], 10),
+		"publish/messages/dropped":  strconv.FormatUint(counters["publish/messages/dropped"], 10),
+		"bytes/received":            strconv.FormatUint(counters["bytes/received"], 10),
+		"bytes/sent":                strconv.FormatUint(counters["bytes/sent"], 10),
+	}
+
+	s.updateLoad(now, counters)
+	for name, avgs := range s.load {
+		for i, w := range loadWindows {
+			values["load/"+name+"/"+w.name] = strconv.FormatFloat(avgs[i], 'f', 2, 64)
+		}
+	}
+
+	return values
+}
+
+// publishStats publishes the statistics topics whose value changed since
+// they were last published as retained messages. The messages are published
+// without holding s.mu, publishing may block on slow subscribers.
+func (b *Broker) publishStats() {
+	s := b.stats
+	var changed []*packets.PublishPacket
+	s.mu.Lock()
+	for topic, value := range b.collect(time.Now()) {
+		if s.published[topic] == value {
+			continue
+		}
+		s.published[topic] = value
+
+		packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		packet.TopicName = sysPrefix + topic
+		packet.Qos = 0
+		packet.Retain = true
+		packet.Payload = []byte(value)
+		changed = append(changed, packet)
+	}
+	s.mu.Unlock()
+
+	for _, packet := range changed {
+		if err := b.topicsMgr.Retain(packet); err != nil {
+			log.Error("retain $SYS message error", zap.Error(err), zap.String("topic", packet.TopicName))
+		}
+		b.PublishMessage(packet)
+	}
+}
+
+// sysLoop publishes the statistics every interval until the broker shuts down
+func (b *Broker) sysLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	b.publishStats()
+	for {
+		select {
+		case <-b.quit:
+			return
+		case <-ticker.C:
+			b.publishStats()
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/habakke/hmq/broker/lib/packets"
+	"github.com/habakke/hmq/plugins/bridge"
+	"go.uber.org/zap"
+)
+
+// pendingWill is a will message waiting for its delay to pass
+type pendingWill struct {
+	client *client
+	will   *packets.PublishPacket
+	timer  *time.Timer
+}
+
+// newWill returns the will message of connect, nil when it has none
+func newWill(connect *packets.ConnectPacket) *packets.PublishPacket {
+	if !connect.WillFlag {
+		return nil
+	}
+	will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	will.Qos = connect.WillQos
+	will.TopicName = connect.WillTopic
+	will.Retain = connect.WillRetain
+	will.Payload = connect.WillMessage
+	will.Dup = connect.Dup
+	if connect.WillProperties != nil {
+		// the will delay is not a property of the published message
+		will.Properties = connect.WillProperties.Copy()
+		will.Properties.WillDelayInterval = nil
+	}
+	return will
+}
+
+// willDelay returns the time in seconds the will of a connecting client is
+// delayed: the Will Delay Interval of an MQTT 5.0 client or the configured
+// delay. MQTT 5.0 wills are published when the session ends at the latest.
+func (b *Broker) willDelay(c *client, connect *packets.ConnectPacket) uint32 {
+	if !connect.WillFlag {
+		return 0
+	}
+	delay := uint32(b.config.WillDelay)
+	if connect.WillProperties != nil && connect.WillProperties.WillDelayInterval != nil {
+		delay = *connect.WillProperties.WillDelayInterval
+	}
+	if c.info.protocolVersion >= packets.Version5 {
+		expiry := uint32(0)
+		if c.isPersistent() {
+			expiry = c.session.Expiry()
+		}
+		if expiry < delay {
+			delay = expiry
+		}
+	}
+	return delay
+}
+
+// discardWill drops the will message of the client, it is not published
+// when the connection closes
+func (c *client) discardWill() {
+	c.mu.Lock()
+	c.info.willMsg = nil
+	c.mu.Unlock()
+}
+
+// takeWill returns the will message of the client and drops it
+func (c *client) takeWill() *packets.PublishPacket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	will := c.info.willMsg
+	c.info.willMsg = nil
+	return will
+}
+
+// pendingWills holds the will messages waiting for their delay by client
+// identifier. Whoever removes a will from it publishes or drops it.
+type pendingWills struct {
+	mu    sync.Mutex
+	wills map[string]*pendingWill
+}
+
+// swap stores pw and returns the will it replaced
+func (pws *pendingWills) swap(clientID string, pw *pendingWill) *pendingWill {
+	pws.mu.Lock()
+	defer pws.mu.Unlock()
+	if pws.wills == nil {
+		pws.wills = make(map[string]*pendingWill)
+	}
+	old := pws.wills[clientID]
+	pws.wills[clientID] = pw
+	return old
+}
+
+// remove removes the will of clientID if it is pw, or any will when pw is
+// nil, and returns it
+func (pws *pendingWills) remove(clientID string, pw *pendingWill) *pendingWill {
+	pws.mu.Lock()
+	defer pws.mu.Unlock()
+	old, ok := pws.wills[clientID]
+	if !ok || (pw != nil && old != pw) {
+		return nil
+	}
+	delete(pws.wills, clientID)
+	old.timer.Stop()
+	return old
+}
+
+// scheduleWill publishes the will message of the closed client c once its
+// delay passed, unless the client reconnects before
+func (b *Broker) scheduleWill(c *client, will *packets.PublishPacket) {
+	if c.info.willDelay == 0 {
+		c.publishWill(will)
+		return
+	}
+
+	pw := &pendingWill{client: c, will: will}
+	clientID := c.info.clientID
+	pw.timer = time.AfterFunc(time.Duration(c.info.willDelay)*time.Second, func() {
+		if b.wills.remove(clientID, pw) != nil && !b.shuttingDown() {
+			c.publishWill(will)
+		}
+	})
+	if old := b.wills.swap(clientID, pw); old != nil {
+		// the earlier connection is gone for longer, its will is due
+		old.timer.Stop()
+		old.client.publishWill(old.will)
+	}
+}
+
+// cancelWill drops the pending will message of a reconnecting client
+func (b *Broker) cancelWill(clientID string) {
+	if b.wills.remove(clientID, nil) != nil {
+		log.Debug("will message cancelled, client reconnected", zap.String("ClientID", clientID))
+	}
+}
+
+// publishPendingWill publishes the pending will message of clientID without
+// waiting for its delay, e.g. when the session of the client ends
+func (b *Broker) publishPendingWill(clientID string) {
+	if pw := b.wills.remove(clientID, nil); pw != nil {
+		pw.client.publishWill(pw.will)
+	}
+}
+
+// publishWill publishes the will message of the client like a message the
+// client published: it is mounted, checked by the hooks and the auth plugin
+// and retained if requested.
+func (c *client) publishWill(will *packets.PublishPacket) {
+	b := c.broker
+	if b == nil {
+		return
+	}
+	will.TopicName = c.mount(will.TopicName)
+	if !b.hooks.onPublish(c.hookInfo(), will) {
+		return
+	}
+	if !checkTopicAuth(c.authPlugin(), PUB, c.info.clientID, c.info.username, c.info.remoteIP, will.TopicName) {
+		log.Error("Will Topic Auth failed, ", zap.String("topic", will.TopicName), zap.String("ClientID", c.info.clientID))
+		return
+	}
+	b.publishBridge(&bridge.Elements{
+		ClientID:  c.info.clientID,
+		Username:  c.info.username,
+		Action:    bridge.Publish,
+		Timestamp: time.Now().Unix(),
+		Payload:   string(will.Payload),
+		Topic:     will.TopicName,
+	})
+	c.ProcessPublishMessage(will)
+}
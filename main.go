@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/habakke/hmq/broker"
 )
 
+// version is set at build time
+var version = "unknown"
+
+// shutdownTimeout bounds how long the broker may take to shut down gracefully
+const shutdownTimeout = 30 * time.Second
+
 func init() {
 	ConfigureMaxProcs()
 }
@@ -20,26 +28,48 @@ func ConfigureMaxProcs() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "passwd" {
+		passwd(os.Args[2:])
+	}
+
 	config, err := broker.ConfigureConfig(os.Args[1:])
 	if err != nil {
 		log.Fatal("configure broker config error: ", err)
 	}
 
+	broker.Version = version
 	b, err := broker.NewBroker(config)
 	if err != nil {
 		log.Fatal("New Broker error: ", err)
 	}
 	b.Start()
 
-	s := waitForSignal()
-	log.Println("signal received, broker closed.", s)
+	s := waitForSignal(b)
+	log.Println("signal received, shutting down broker.", s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := b.Shutdown(ctx); err != nil {
+		log.Println("broker shutdown error: ", err)
+	}
+	log.Println("broker closed.")
 }
 
-func waitForSignal() os.Signal {
+// waitForSignal returns the signal stopping the broker, SIGHUP reloads the
+// rules of the auth plugins
+func waitForSignal(b *broker.Broker) os.Signal {
 	signalChan := make(chan os.Signal, 1)
 	defer close(signalChan)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	s := <-signalChan
-	signal.Stop(signalChan)
-	return s
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
+	for {
+		s := <-signalChan
+		if s == syscall.SIGHUP {
+			if err := b.ReloadAuth(); err != nil {
+				log.Println("reload auth error: ", err)
+			}
+			continue
+		}
+		signal.Stop(signalChan)
+		return s
+	}
 }
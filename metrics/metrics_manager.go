@@ -7,6 +7,10 @@ import (
 	"github.com/prometheus/common/log"
 )
 
+var errNotInitialised = errors.New("metrics has not been initialised yet")
+
+// Manager is nil when the HTTP server is not started, the update methods of a
+// nil Manager do nothing
 type Manager struct {
 	prom *ginprom.Prometheus
 }
@@ -14,6 +18,19 @@ type Manager struct {
 const (
 	MetricNumberOfMessages = "number_of_messages"
 	MetricNumberOfClients  = "number_of_clients"
+
+	MetricNumberOfDroppedMessages = "number_of_dropped_messages"
+	MetricNumberOfSlowConsumers   = "number_of_slow_consumers"
+
+	MetricNumberOfRefusedConnections     = "number_of_refused_connections"
+	MetricNumberOfRateLimitedConnections = "number_of_rate_limited_connections"
+	MetricNumberOfConnectTimeouts        = "number_of_connect_timeouts"
+	MetricNumberOfOversizedPackets       = "number_of_oversized_packets"
+	MetricNumberOfThrottledMessages      = "number_of_throttled_messages"
+	MetricNumberOfRateLimitedClients     = "number_of_rate_limited_clients"
+	MetricNumberOfDeadLetters            = "number_of_dead_letters"
+	MetricNumberOfExpiredMessages        = "number_of_expired_messages"
+	MetricNumberOfExpiredSessions        = "number_of_expired_sessions"
 )
 
 func (m *Manager) Init(e *gin.Engine) {
@@ -42,6 +59,9 @@ func (m *Manager) Add(name string, help string) error {
 }
 
 func (m *Manager) Inc(name string) error {
+	if m == nil {
+		return errNotInitialised
+	}
 	if m.prom == nil {
 		log.Error("metrics has not been initialised yet")
 		return errors.New("metrics has not been initialised yet")
@@ -51,6 +71,9 @@ func (m *Manager) Inc(name string) error {
 }
 
 func (m *Manager) Dec(name string) error {
+	if m == nil {
+		return errNotInitialised
+	}
 	if m.prom == nil {
 		log.Error("metrics has not been initialised yet")
 		return errors.New("metrics has not been initialised yet")
@@ -60,6 +83,9 @@ func (m *Manager) Dec(name string) error {
 }
 
 func (m *Manager) Set(name string, value float64) error {
+	if m == nil {
+		return errNotInitialised
+	}
 	if m.prom == nil {
 		log.Error("metrics has not been initialised yet")
 		return errors.New("metrics has not been initialised yet")
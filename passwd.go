@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	acl "github.com/habakke/hmq/plugins/auth/authfile"
+	"golang.org/x/term"
+)
+
+const passwdUsage = `Usage: hmq passwd [options] <passwordfile> <username> [password]
+
+Adds or updates the user in the password file of the authfile plugin. The
+password is asked for twice unless -b is given, without echo on a terminal.
+
+Options:
+    -c              Create a new password file, overwriting an existing one
+    -D              Delete the user
+    -b              Take the password from the command line
+    -H <hash>       Hash of the password, pbkdf2 or bcrypt (default pbkdf2)
+    -I <rounds>     PBKDF2 iterations or bcrypt cost (default 101 and 10)
+`
+
+// runPasswd runs the passwd subcommand with args, the password is read from
+// stdin unless it is given in args
+func runPasswd(args []string, stdin io.Reader, stderr io.Writer) error {
+	fs := flag.NewFlagSet("passwd", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, passwdUsage) }
+	create := fs.Bool("c", false, "")
+	del := fs.Bool("D", false, "")
+	batch := fs.Bool("b", false, "")
+	hash := fs.String("H", acl.HashPBKDF2, "")
+	rounds := fs.Int("I", 0, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	want := 2
+	if *batch {
+		want = 3
+	}
+	if fs.NArg() != want || (*del && (*batch || *create)) {
+		fs.Usage()
+		return errors.New("invalid arguments")
+	}
+	file, username := fs.Arg(0), fs.Arg(1)
+
+	pf := acl.NewPasswordFile(file)
+	if !*create {
+		var err error
+		if pf, err = acl.LoadPasswordFile(file); err != nil {
+			return err
+		}
+	}
+
+	if *del {
+		if !pf.Delete(username) {
+			return fmt.Errorf("user %s not found", username)
+		}
+		return pf.Save()
+	}
+
+	password := fs.Arg(2)
+	if !*batch {
+		var err error
+		if password, err = readPassword(stdin, stderr); err != nil {
+			return err
+		}
+	}
+	if password == "" {
+		return errors.New("empty password")
+	}
+	if err := pf.Set(username, password, *hash, *rounds); err != nil {
+		return err
+	}
+	return pf.Save()
+}
+
+// readPassword asks for the password twice like mosquitto_passwd, it is not
+// echoed when stdin is a terminal
+func readPassword(stdin io.Reader, stderr io.Writer) (string, error) {
+	var readLine func() (string, error)
+	if f, ok := stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		readLine = func() (string, error) {
+			password, err := term.ReadPassword(int(f.Fd()))
+			fmt.Fprintln(stderr)
+			return string(password), err
+		}
+	} else {
+		r := bufio.NewReader(stdin)
+		readLine = func() (string, error) {
+			line, err := r.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return "", err
+			}
+			return strings.TrimRight(line, "\r\n"), nil
+		}
+	}
+
+	fmt.Fprint(stderr, "Password: ")
+	password, err := readLine()
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(stderr, "Reenter password: ")
+	again, err := readLine()
+	if err != nil {
+		return "", err
+	}
+	if password != again {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
+// passwd runs the passwd subcommand and exits
+func passwd(args []string) {
+	if err := runPasswd(args, os.Stdin, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "hmq passwd:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
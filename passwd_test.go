@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	acl "github.com/habakke/hmq/plugins/auth/authfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunPasswd(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "passwd")
+	run := func(stdin string, args ...string) error {
+		return runPasswd(args, strings.NewReader(stdin), ioutil.Discard)
+	}
+	load := func() *acl.PasswordFile {
+		pf, err := acl.LoadPasswordFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pf
+	}
+
+	// create
+	assert.Nil(t, run("", "-c", "-b", file, "alice", "secret"))
+	assert.True(t, load().Check("alice", "secret"))
+
+	// add and update with the password asked for twice
+	assert.Nil(t, run("s3cret\ns3cret\n", file, "bob"))
+	assert.Nil(t, run("changed\nchanged\n", "-H", acl.HashBcrypt, "-I", "4", file, "alice"))
+	pf := load()
+	assert.True(t, pf.Check("alice", "changed"))
+	assert.True(t, pf.Check("bob", "s3cret"))
+
+	assert.NotNil(t, run("one\nother\n", file, "alice"), "passwords do not match")
+	assert.NotNil(t, run("\n\n", file, "alice"), "empty password")
+	assert.True(t, load().Check("alice", "changed"))
+
+	// delete
+	assert.Nil(t, run("", "-D", file, "bob"))
+	assert.Equal(t, []string{"alice"}, load().Users())
+	assert.NotNil(t, run("", "-D", file, "bob"))
+	assert.NotNil(t, run("", "-D", "-b", file, "alice", "secret"))
+}
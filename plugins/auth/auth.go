@@ -1,8 +1,12 @@
 package auth
 
 import (
+	"errors"
+	"strings"
+
 	authfile "github.com/habakke/hmq/plugins/auth/authfile"
 	"github.com/habakke/hmq/plugins/auth/authhttp"
+	"github.com/habakke/hmq/plugins/auth/limits"
 )
 
 const (
@@ -10,17 +14,96 @@ const (
 	AuthFile = "authfile"
 )
 
+var (
+	// ErrUnsupportedMethod is returned by EnhancedAuth plugins for an
+	// authentication method they do not implement
+	ErrUnsupportedMethod = errors.New("auth: unsupported authentication method")
+)
+
 type Auth interface {
 	CheckACL(action, clientID, username, ip, topic string) bool
 	CheckConnect(clientID, username, password string) bool
 }
 
+// ConnectInfoAuth is implemented by auth plugins checking the connection of
+// a client besides its credentials. CheckConnectInfo is called instead of
+// CheckConnect with the remote IP address, the protocol version and the
+// common name of the client certificate, if any.
+type ConnectInfoAuth interface {
+	CheckConnectInfo(clientID, username, password, ip string, protocol byte, certCN string) bool
+}
+
+// Config configures the auth plugins from the broker config
+type Config struct {
+	// HTTP configures authhttp, it is read from HTTPFile when nil
+	HTTP *authhttp.Config `json:"authhttp"`
+	// HTTPFile is the config file of authhttp
+	HTTPFile string `json:"authhttpConfig"`
+	// File configures the files of authfile
+	File authfile.Config `json:"authfile"`
+}
+
+// EnhancedAuth is implemented by auth plugins supporting MQTT 5.0 enhanced
+// authentication. Authenticate is called with the authentication data of the
+// CONNECT or AUTH packet and returns the data to send back to the client and
+// whether the exchange is complete. A failed authentication is reported
+// through err.
+type EnhancedAuth interface {
+	Authenticate(clientID, method string, data []byte) (response []byte, done bool, err error)
+}
+
+// Limits are the publish limits of a user
+type Limits = limits.Limits
+
+// LimitedAuth is implemented by auth plugins overriding the publish limits
+// per user. Limits is called once CheckConnect accepted the client, ok is
+// false when the user has no limits of its own.
+type LimitedAuth interface {
+	Limits(clientID, username string) (limits Limits, ok bool)
+}
+
+// SessionAuth is implemented by auth plugins overriding the session expiry
+// interval per client. SessionExpiry is called once CheckConnect accepted the
+// client and returns the interval in seconds, ok is false when the client
+// has no interval of its own.
+type SessionAuth interface {
+	SessionExpiry(clientID, username string) (interval uint32, ok bool)
+}
+
+// DisconnectAuth is implemented by auth plugins holding state for connected
+// clients. Disconnected is called when an accepted client is gone, unless a
+// new connection of the same client and username took it over.
+type DisconnectAuth interface {
+	Disconnected(clientID, username string)
+}
+
+// Reloader is implemented by auth plugins reading their rules from files,
+// Reload reads them again. The rules loaded before are kept when it fails.
+type Reloader interface {
+	Reload() error
+}
+
 func NewAuth(name string) Auth {
+	return NewAuthConfig(name, Config{})
+}
+
+// NewAuthConfig returns the auth plugin name configured by config. A comma
+// separated list of names returns a chain asking the plugins in order.
+func NewAuthConfig(name string, config Config) Auth {
+	if strings.Contains(name, ",") {
+		return newChain(name, config)
+	}
 	switch name {
 	case AuthHTTP:
+		if config.HTTP != nil {
+			return authhttp.InitConfig(*config.HTTP)
+		}
+		if config.HTTPFile != "" {
+			return authhttp.InitFile(config.HTTPFile)
+		}
 		return authhttp.Init()
 	case AuthFile:
-		return authfile.Init()
+		return authfile.InitConfig(config.File)
 	default:
 		return &mockAuth{}
 	}
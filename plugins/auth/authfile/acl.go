@@ -1,29 +1,135 @@
 package acl
 
-import "github.com/habakke/hmq/logger"
+import (
+	"sync"
+	"time"
+
+	"github.com/habakke/hmq/logger"
+	"github.com/habakke/hmq/plugins/auth/decision"
+)
+
+// DefaultACLFile is read when the config names no ACL file
+const DefaultACLFile = "./plugins/auth/authfile/acl.conf"
 
 var (
 	log = logger.Get().Named("authfile")
 )
 
+// Config configures the files of the plugin
+type Config struct {
+	// ACLFile holds the ACL rules
+	ACLFile string `json:"aclFile"`
+	// PasswordFile holds the users, clients are not authenticated without
+	// one
+	PasswordFile string `json:"passwordFile"`
+	// AllowAnonymous accepts clients without username when there is a
+	// password file
+	AllowAnonymous bool `json:"allowAnonymous"`
+	// ReloadInterval is how often in seconds the files are checked for
+	// changes, negative values do not watch the files
+	ReloadInterval int `json:"reloadInterval"`
+}
+
 type aclAuth struct {
-	config *ACLConfig
+	files     Config
+	anonymous bool
+
+	mu        sync.RWMutex
+	acl       *ACLConfig
+	passwords *PasswordFile
+
+	quit      chan struct{}
+	closeOnce sync.Once
 }
 
 func Init() *aclAuth {
-	aclConfig, err := AclConfigLoad("./plugins/auth/authfile/acl.conf")
+	return InitConfig(Config{})
+}
+
+// InitConfig creates the plugin from config, it panics when a file cannot
+// be read
+func InitConfig(config Config) *aclAuth {
+	a, err := New(config)
 	if err != nil {
 		panic(err)
 	}
-	return &aclAuth{
-		config: aclConfig,
+	return a
+}
+
+// New creates the plugin from config and watches its files unless the
+// reload interval is negative
+func New(config Config) (*aclAuth, error) {
+	if config.ACLFile == "" {
+		config.ACLFile = DefaultACLFile
+	}
+	aclConfig, passwords, err := load(config)
+	if err != nil {
+		return nil, err
 	}
+	if passwords == nil {
+		log.Warn("no password file configured, clients are not authenticated")
+	}
+	a := &aclAuth{
+		files:     config,
+		anonymous: config.AllowAnonymous,
+		acl:       aclConfig,
+		passwords: passwords,
+		quit:      make(chan struct{}),
+	}
+
+	if config.ReloadInterval >= 0 {
+		interval := DefaultReloadInterval
+		if config.ReloadInterval > 0 {
+			interval = time.Duration(config.ReloadInterval) * time.Second
+		}
+		go a.watch(interval)
+	}
+	return a, nil
+}
+
+// rules returns the rules and users currently loaded
+func (a *aclAuth) rules() (*ACLConfig, *PasswordFile) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.acl, a.passwords
 }
 
 func (a *aclAuth) CheckConnect(clientID, username, password string) bool {
-	return true
+	return a.ConnectDecision(clientID, username, password, "", 0, "") == decision.Allow
+}
+
+// ConnectDecision checks the password of username, users missing from the
+// password file are left to the next auth plugin
+func (a *aclAuth) ConnectDecision(clientID, username, password, ip string, protocol byte, certCN string) decision.Decision {
+	_, passwords := a.rules()
+	switch {
+	case passwords == nil:
+		return decision.Allow
+	case username == "" && a.anonymous:
+		return decision.Allow
+	case !passwords.Has(username):
+		return decision.Ignore
+	case passwords.Check(username, password):
+		return decision.Allow
+	}
+	return decision.Deny
 }
 
 func (a *aclAuth) CheckACL(action, clientID, username, ip, topic string) bool {
-	return checkTopicAuth(a.config, action, ip, username, clientID, topic)
+	acl, _ := a.rules()
+	return checkTopicAuth(acl, action, ip, username, clientID, topic)
+}
+
+// ACLDecision checks the topic access with the ACL rules, topics no rule
+// matches are left to the next auth plugin
+func (a *aclAuth) ACLDecision(action, clientID, username, ip, topic string) decision.Decision {
+	acl, _ := a.rules()
+	match, allow := matchTopicAuth(acl, action, ip, username, clientID, topic)
+	switch {
+	case !match:
+		return decision.Ignore
+	case allow:
+		return decision.Allow
+	}
+	return decision.Deny
 }
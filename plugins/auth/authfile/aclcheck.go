@@ -3,24 +3,31 @@ package acl
 import "strings"
 
 func checkTopicAuth(ACLInfo *ACLConfig, action, ip, username, clientid, topic string) bool {
+	_, auth := matchTopicAuth(ACLInfo, action, ip, username, clientid, topic)
+	return auth
+}
+
+// matchTopicAuth returns whether a rule matches and the access of the first
+// matching rule
+func matchTopicAuth(ACLInfo *ACLConfig, action, ip, username, clientid, topic string) (bool, bool) {
 	for _, info := range ACLInfo.Info {
 		ctyp := info.Typ
 		switch ctyp {
 		case CLIENTID:
 			if match, auth := info.checkWithClientID(action, clientid, topic); match {
-				return auth
+				return true, auth
 			}
 		case USERNAME:
 			if match, auth := info.checkWithUsername(action, username, topic); match {
-				return auth
+				return true, auth
 			}
 		case IP:
 			if match, auth := info.checkWithIP(action, ip, topic); match {
-				return auth
+				return true, auth
 			}
 		}
 	}
-	return false
+	return false, false
 }
 
 func (a *AuthInfo) checkWithClientID(action, clientid, topic string) (bool, bool) {
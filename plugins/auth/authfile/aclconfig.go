@@ -2,9 +2,7 @@ package acl
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
-	"io"
 	"os"
 	"strings"
 )
@@ -45,71 +43,65 @@ func AclConfigLoad(file string) (*ACLConfig, error) {
 	return aclconifg, err
 }
 
+// Prase reads the rules of the file, it reports every line in error
 func (c *ACLConfig) Prase() error {
 	f, err := os.Open(c.File)
+	if err != nil {
+		return err
+	}
 	defer func() {
 		if err := f.Close(); err != nil {
 			log.Error(fmt.Sprintf("Error closing file: %s\n", err.Error()))
 		}
 	}()
-	if err != nil {
-		return err
-	}
-	buf := bufio.NewReader(f)
-	var parseErr error
-	for {
-		line, err := buf.ReadString('\n')
-		line = strings.TrimSpace(line)
-		if isCommentOut(line) {
+
+	var parseErr ParseError
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || isCommentOut(line) {
 			continue
 		}
-		if line == "" {
-			return parseErr
-		}
-		// fmt.Println(line)
-		tmpArr := strings.Fields(line)
-		if len(tmpArr) != 5 {
-			parseErr = errors.New("\"" + line + "\" format is error")
-			break
-		}
-		if tmpArr[0] != ALLOW && tmpArr[0] != DENY {
-			parseErr = errors.New("\"" + line + "\" format is error")
-			break
-		}
-		if tmpArr[1] != CLIENTID && tmpArr[1] != USERNAME && tmpArr[1] != IP {
-			parseErr = errors.New("\"" + line + "\" format is error")
-			break
-		}
-		if tmpArr[3] != PUB && tmpArr[3] != SUB && tmpArr[3] != PUBSUB {
-			parseErr = errors.New("\"" + line + "\" format is error")
-			break
-		}
-		// var pubsub int
-		// pubsub, err = strconv.Atoi(tmpArr[3])
-		// if err != nil {
-		// 	parseErr = errors.New("\"" + line + "\" format is error")
-		// 	break
-		// }
-		topicStr := strings.Replace(tmpArr[4], " ", "", -1)
-		topicStr = strings.Replace(topicStr, "\n", "", -1)
-		topics := strings.Split(topicStr, ",")
-		tmpAuth := &AuthInfo{
-			Auth:   tmpArr[0],
-			Typ:    tmpArr[1],
-			Val:    tmpArr[2],
-			Topics: topics,
-			PubSub: tmpArr[3],
-		}
-		c.Info = append(c.Info, tmpAuth)
+		info, err := parseRule(line)
 		if err != nil {
-			if err != io.EOF {
-				parseErr = err
-			}
-			break
+			parseErr = append(parseErr, &LineError{File: c.File, Line: n, Err: err})
+			continue
 		}
+		c.Info = append(c.Info, info)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(parseErr) > 0 {
+		return parseErr
+	}
+	return nil
+}
+
+// parseRule parses the rule "allow|deny type value pubsub topics"
+func parseRule(line string) (*AuthInfo, error) {
+	tmpArr := strings.Fields(line)
+	if len(tmpArr) != 5 {
+		return nil, fmt.Errorf("%q has %d fields, want 5", line, len(tmpArr))
+	}
+	if tmpArr[0] != ALLOW && tmpArr[0] != DENY {
+		return nil, fmt.Errorf("%q: unknown permission %q", line, tmpArr[0])
 	}
-	return parseErr
+	if tmpArr[1] != CLIENTID && tmpArr[1] != USERNAME && tmpArr[1] != IP {
+		return nil, fmt.Errorf("%q: unknown type %q", line, tmpArr[1])
+	}
+	if tmpArr[3] != PUB && tmpArr[3] != SUB && tmpArr[3] != PUBSUB {
+		return nil, fmt.Errorf("%q: unknown pubsub %q", line, tmpArr[3])
+	}
+	return &AuthInfo{
+		Auth:   tmpArr[0],
+		Typ:    tmpArr[1],
+		Val:    tmpArr[2],
+		Topics: strings.Split(tmpArr[4], ","),
+		PubSub: tmpArr[3],
+	}, nil
 }
+
 func isCommentOut(line string) bool {
 	if strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "//") || strings.HasPrefix(line, "*") {
 		return true
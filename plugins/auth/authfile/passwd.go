@@ -0,0 +1,264 @@
+package acl
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Hash algorithms of the password file
+const (
+	// HashPBKDF2 is PBKDF2-SHA512 like mosquitto_passwd writes it
+	HashPBKDF2 = "pbkdf2"
+	// HashBcrypt is bcrypt
+	HashBcrypt = "bcrypt"
+)
+
+// DefaultIterations is the number of PBKDF2 iterations of new hashes
+const DefaultIterations = 101
+
+const (
+	saltSize    = 12
+	pbkdf2Size  = sha512.Size
+	hashSHA512  = "6"
+	hashPBKDF2  = "7"
+	maxUsername = 65535
+)
+
+// errUnknownHash is returned for hashes in an unsupported format
+var errUnknownHash = errors.New("unknown password hash")
+
+// PasswordFile holds the users of a mosquitto compatible password file, one
+// "username:hash" line per user. Hashes are salted SHA512 ($6$), PBKDF2-SHA512
+// ($7$) or bcrypt ($2a$, $2b$, $2y$).
+type PasswordFile struct {
+	File   string
+	users  []string
+	hashes map[string]string
+}
+
+// NewPasswordFile returns an empty password file stored at file
+func NewPasswordFile(file string) *PasswordFile {
+	return &PasswordFile{File: file, hashes: make(map[string]string)}
+}
+
+// LoadPasswordFile reads the password file at file
+func LoadPasswordFile(file string) (*PasswordFile, error) {
+	f, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Error(fmt.Sprintf("Error closing file: %s\n", err.Error()))
+		}
+	}()
+
+	pf := NewPasswordFile(file)
+	var parseErr ParseError
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := pf.parseLine(line); err != nil {
+			parseErr = append(parseErr, &LineError{File: file, Line: n, Err: err})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(parseErr) > 0 {
+		return nil, parseErr
+	}
+	return pf, nil
+}
+
+// parseLine adds the user of the line "username:hash"
+func (pf *PasswordFile) parseLine(line string) error {
+	i := strings.LastIndex(line, ":")
+	if i <= 0 {
+		return errors.New("missing password hash")
+	}
+	username, hash := line[:i], line[i+1:]
+	if _, err := parseHash(hash); err != nil {
+		return err
+	}
+	if _, ok := pf.hashes[username]; ok {
+		return fmt.Errorf("duplicate user %q", username)
+	}
+	pf.users = append(pf.users, username)
+	pf.hashes[username] = hash
+	return nil
+}
+
+// Users returns the users in the order of the file
+func (pf *PasswordFile) Users() []string {
+	return append([]string(nil), pf.users...)
+}
+
+// Has reports whether username is in the file
+func (pf *PasswordFile) Has(username string) bool {
+	_, ok := pf.hashes[username]
+	return ok
+}
+
+// Check reports whether password is the one of username
+func (pf *PasswordFile) Check(username, password string) bool {
+	hash, ok := pf.hashes[username]
+	if !ok {
+		return false
+	}
+	return checkHash(hash, password)
+}
+
+// Set adds username or updates its password, hashed with the algorithm
+// named by hash. rounds is the number of PBKDF2 iterations or the bcrypt
+// cost, zero uses the default.
+func (pf *PasswordFile) Set(username, password, hash string, rounds int) error {
+	if username == "" || len(username) > maxUsername || strings.ContainsAny(username, ":\r\n") {
+		return fmt.Errorf("invalid username %q", username)
+	}
+	h, err := newHash(password, hash, rounds)
+	if err != nil {
+		return err
+	}
+	if _, ok := pf.hashes[username]; !ok {
+		pf.users = append(pf.users, username)
+	}
+	pf.hashes[username] = h
+	return nil
+}
+
+// Delete removes username, it reports whether the user was in the file
+func (pf *PasswordFile) Delete(username string) bool {
+	if _, ok := pf.hashes[username]; !ok {
+		return false
+	}
+	delete(pf.hashes, username)
+	for i, u := range pf.users {
+		if u == username {
+			pf.users = append(pf.users[:i], pf.users[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Save writes the file, it is replaced atomically
+func (pf *PasswordFile) Save() error {
+	var b strings.Builder
+	for _, u := range pf.users {
+		b.WriteString(u + ":" + pf.hashes[u] + "\n")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(pf.File), filepath.Base(pf.File)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), pf.File)
+}
+
+// hashInfo is a parsed salted hash
+type hashInfo struct {
+	typ        string
+	iterations int
+	salt, sum  []byte
+}
+
+// parseHash parses the salted SHA512 and PBKDF2 hashes of mosquitto, bcrypt
+// hashes are only checked for their prefix
+func parseHash(hash string) (hashInfo, error) {
+	if strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") {
+		return hashInfo{typ: HashBcrypt}, nil
+	}
+	parts := strings.Split(hash, "$")
+	var info hashInfo
+	switch {
+	case len(parts) == 4 && parts[0] == "" && parts[1] == hashSHA512:
+		info = hashInfo{typ: hashSHA512}
+		parts = parts[2:]
+	case len(parts) == 5 && parts[0] == "" && parts[1] == hashPBKDF2:
+		iterations, err := strconv.Atoi(parts[2])
+		if err != nil || iterations <= 0 {
+			return info, errors.New("invalid PBKDF2 iterations")
+		}
+		info = hashInfo{typ: hashPBKDF2, iterations: iterations}
+		parts = parts[3:]
+	default:
+		return info, errUnknownHash
+	}
+
+	var err error
+	if info.salt, err = base64.StdEncoding.DecodeString(parts[0]); err != nil {
+		return info, errors.New("invalid salt")
+	}
+	if info.sum, err = base64.StdEncoding.DecodeString(parts[1]); err != nil || len(info.sum) == 0 {
+		return info, errors.New("invalid hash")
+	}
+	return info, nil
+}
+
+func checkHash(hash, password string) bool {
+	info, err := parseHash(hash)
+	if err != nil {
+		return false
+	}
+	var sum []byte
+	switch info.typ {
+	case HashBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case hashSHA512:
+		h := sha512.New()
+		h.Write([]byte(password))
+		h.Write(info.salt)
+		sum = h.Sum(nil)
+	case hashPBKDF2:
+		sum = pbkdf2.Key([]byte(password), info.salt, info.iterations, len(info.sum), sha512.New)
+	}
+	return subtle.ConstantTimeCompare(sum, info.sum) == 1
+}
+
+func newHash(password, hash string, rounds int) (string, error) {
+	switch hash {
+	case "", HashPBKDF2:
+		if rounds <= 0 {
+			rounds = DefaultIterations
+		}
+		salt := make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		sum := pbkdf2.Key([]byte(password), salt, rounds, pbkdf2Size, sha512.New)
+		return fmt.Sprintf("$%s$%d$%s$%s", hashPBKDF2, rounds,
+			base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(sum)), nil
+	case HashBcrypt:
+		if rounds <= 0 {
+			rounds = bcrypt.DefaultCost
+		}
+		sum, err := bcrypt.GenerateFromPassword([]byte(password), rounds)
+		return string(sum), err
+	}
+	return "", fmt.Errorf("unsupported hash %q", hash)
+}
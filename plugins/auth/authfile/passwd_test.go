@@ -0,0 +1,87 @@
+package acl
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/habakke/hmq/plugins/auth/decision"
+	"github.com/stretchr/testify/assert"
+)
+
+// passwd holds the password secret for every user, as mosquitto_passwd
+// writes it and as bcrypt
+const passwd = `pbkdf2:$7$101$MDEyMzQ1Njc4OWFi$EO/lLlkeUgIiBaS8G8UK0ZMP1u508TA7Tl+AdJ1cEsmlbGyEPAERErpfq84j1kepISs0UzmcdL4ucgZ2uodxfQ==
+sha512:$6$MDEyMzQ1Njc4OWFi$qEXipeLbgxRlwd06QHfY5WITkUZg0jLg9SZbXzq3ifXjfj+v3GbJGrSfC5PAg3UNCS+UFfbhUIZX4bmIAs330w==
+bcrypt:$2y$04$LDfCiiBUkDRJlKuaC6H4q.xNQHhu/sZaDmfR11nLJLDRUz3VsHbBy
+`
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPasswordFile(t *testing.T) {
+	pf, err := LoadPasswordFile(writeFile(t, "passwd", passwd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"pbkdf2", "sha512", "bcrypt"} {
+		assert.True(t, pf.Check(user, "secret"), user)
+		assert.False(t, pf.Check(user, "wrong"), user)
+	}
+	assert.False(t, pf.Check("unknown", "secret"))
+
+	assert.Nil(t, pf.Set("pbkdf2", "changed", "", 0))
+	assert.Nil(t, pf.Set("new", "secret", HashBcrypt, 4))
+	assert.NotNil(t, pf.Set("a:b", "secret", "", 0))
+	assert.True(t, pf.Delete("sha512"))
+	assert.False(t, pf.Delete("sha512"))
+	assert.Nil(t, pf.Save())
+
+	pf, err = LoadPasswordFile(pf.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"pbkdf2", "bcrypt", "new"}, pf.Users())
+	assert.True(t, pf.Check("pbkdf2", "changed"))
+	assert.True(t, pf.Check("new", "secret"))
+
+	_, err = LoadPasswordFile(writeFile(t, "passwd", "alice:secret\n"))
+	assert.Contains(t, err.Error(), "passwd:1: unknown password hash")
+}
+
+func TestAuthFileConnect(t *testing.T) {
+	aclFile := writeFile(t, "acl.conf", "allow username pbkdf2 3 #\ndeny username sha512 3 #\n")
+	a, err := New(Config{ACLFile: aclFile, PasswordFile: writeFile(t, "passwd", passwd), ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, a.CheckConnect("c1", "pbkdf2", "secret"))
+	assert.False(t, a.CheckConnect("c1", "pbkdf2", "wrong"))
+	assert.Equal(t, decision.Deny, a.ConnectDecision("c1", "sha512", "wrong", "", 0, ""))
+	assert.Equal(t, decision.Ignore, a.ConnectDecision("c1", "unknown", "secret", "", 0, ""))
+	assert.False(t, a.CheckConnect("c1", "", ""))
+
+	assert.Equal(t, decision.Allow, a.ACLDecision(PUB, "c1", "pbkdf2", "", "a/b"))
+	assert.Equal(t, decision.Deny, a.ACLDecision(PUB, "c1", "sha512", "", "a/b"))
+	assert.Equal(t, decision.Ignore, a.ACLDecision(PUB, "c1", "bcrypt", "", "a/b"))
+
+	a, err = New(Config{ACLFile: aclFile, PasswordFile: writeFile(t, "passwd", passwd), AllowAnonymous: true, ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, a.CheckConnect("c1", "", ""))
+
+	a, err = New(Config{ACLFile: aclFile, ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, a.CheckConnect("c1", "unknown", ""), "no password file")
+
+	_, err = New(Config{ACLFile: aclFile, PasswordFile: filepath.Join(t.TempDir(), "missing"), ReloadInterval: -1})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,120 @@
+package acl
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultReloadInterval is how often the files are checked for changes
+const DefaultReloadInterval = 10 * time.Second
+
+// LineError is an error in a line of a file
+type LineError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// ParseError holds the errors of all lines of a file that failed to parse
+type ParseError []*LineError
+
+func (e ParseError) Error() string {
+	msgs := make([]string, len(e))
+	for i, le := range e {
+		msgs[i] = le.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// load reads the files of config
+func load(config Config) (*ACLConfig, *PasswordFile, error) {
+	aclConfig, err := AclConfigLoad(config.ACLFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.PasswordFile == "" {
+		return aclConfig, nil, nil
+	}
+	passwords, err := LoadPasswordFile(config.PasswordFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aclConfig, passwords, nil
+}
+
+// Reload reads the files again. The rules and users are replaced when both
+// files parse, else the ones loaded before are kept.
+func (a *aclAuth) Reload() error {
+	aclConfig, passwords, err := load(a.files)
+	if err != nil {
+		log.Error("reload failed, keeping the rules and users loaded before", zap.Error(err))
+		return err
+	}
+
+	a.mu.Lock()
+	a.acl, a.passwords = aclConfig, passwords
+	a.mu.Unlock()
+	log.Info("reloaded", zap.String("aclFile", a.files.ACLFile), zap.String("passwordFile", a.files.PasswordFile),
+		zap.Int("rules", len(aclConfig.Info)))
+	return nil
+}
+
+// Close stops watching the files
+func (a *aclAuth) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.quit)
+	})
+	return nil
+}
+
+// fileStamp identifies the version of a file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// stamps returns the stamps of the files, missing files have zero stamps
+func (a *aclAuth) stamps() [2]fileStamp {
+	var stamps [2]fileStamp
+	for i, file := range []string{a.files.ACLFile, a.files.PasswordFile} {
+		if file == "" {
+			continue
+		}
+		if fi, err := os.Stat(file); err == nil {
+			stamps[i] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return stamps
+}
+
+// watch reloads the files every interval when one of them changed. A change
+// is reloaded once, a failed reload is retried by the next change.
+func (a *aclAuth) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := a.stamps()
+	for {
+		select {
+		case <-a.quit:
+			return
+		case <-ticker.C:
+			if stamps := a.stamps(); stamps != last {
+				last = stamps
+				_ = a.Reload()
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package acl
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACLLineErrors(t *testing.T) {
+	file := writeFile(t, "acl.conf", "# rules\n\nallow username alice 3 #\nallow user bob 3 #\nallow username carol 4 #\ndeny clientid *\n")
+	_, err := AclConfigLoad(file)
+	var parseErr ParseError
+	if assert.True(t, errors.As(err, &parseErr)) && assert.Len(t, parseErr, 3) {
+		assert.Equal(t, []int{4, 5, 6}, []int{parseErr[0].Line, parseErr[1].Line, parseErr[2].Line})
+		assert.Contains(t, parseErr[0].Error(), "acl.conf:4: ")
+		assert.Contains(t, parseErr[0].Error(), `unknown type "user"`)
+	}
+
+	_, err = LoadPasswordFile(writeFile(t, "passwd", passwd+"alice\nbob:$7$x$y$z\n"))
+	if assert.True(t, errors.As(err, &parseErr)) && assert.Len(t, parseErr, 2) {
+		assert.Equal(t, 4, parseErr[0].Line)
+		assert.Equal(t, 5, parseErr[1].Line)
+	}
+}
+
+func TestReload(t *testing.T) {
+	aclFile := writeFile(t, "acl.conf", "allow username alice 3 #\n")
+	pwFile := writeFile(t, "passwd", passwd)
+	a, err := New(Config{ACLFile: aclFile, PasswordFile: pwFile, ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	assert.True(t, a.CheckACL(PUB, "c1", "alice", "", "a"))
+	assert.False(t, a.CheckACL(PUB, "c1", "bob", "", "a"))
+
+	write := func(path, content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// rules in error keep the ones loaded before
+	write(aclFile, "allow username bob 3 #\nallow nobody\n")
+	assert.NotNil(t, a.Reload())
+	assert.True(t, a.CheckACL(PUB, "c1", "alice", "", "a"))
+	assert.False(t, a.CheckACL(PUB, "c1", "bob", "", "a"))
+
+	write(aclFile, "allow username bob 3 #\n")
+	write(pwFile, "")
+	assert.Nil(t, a.Reload())
+	assert.False(t, a.CheckACL(PUB, "c1", "alice", "", "a"))
+	assert.True(t, a.CheckACL(PUB, "c1", "bob", "", "a"))
+	assert.False(t, a.CheckConnect("c1", "pbkdf2", "secret"))
+
+	// changed files are reloaded
+	go a.watch(10 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	write(pwFile, passwd)
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(pwFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool {
+		return a.CheckConnect("c1", "pbkdf2", "secret")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = New(Config{ACLFile: filepath.Join(t.TempDir(), "missing")})
+	assert.NotNil(t, err)
+}
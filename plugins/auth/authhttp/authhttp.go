@@ -2,189 +2,319 @@ package authhttp
 
 import (
 	"encoding/json"
-	"fmt"
-	"io"
+	"errors"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/habakke/hmq/logger"
+	"github.com/habakke/hmq/plugins/auth/decision"
+	"github.com/habakke/hmq/plugins/auth/limits"
 	"go.uber.org/zap"
 )
 
-//Config device kafka config
+// DefaultConfigFile is read when the broker config has no authhttp section
+const DefaultConfigFile = "./plugins/auth/authhttp/http.json"
+
+// Config device kafka config
 type Config struct {
 	AuthURL  string `json:"auth"`
 	ACLURL   string `json:"acl"`
 	SuperURL string `json:"super"`
+	// AuthRequest, ACLRequest and SuperRequest configure the requests sent
+	// to the endpoints
+	AuthRequest  RequestConfig `json:"authRequest"`
+	ACLRequest   RequestConfig `json:"aclRequest"`
+	SuperRequest RequestConfig `json:"superRequest"`
+	// Headers are added to every request
+	Headers map[string]string `json:"headers"`
+	// BearerToken is sent in the Authorization header of every request
+	BearerToken string `json:"bearerToken"`
+	// TLS configures the connection to an HTTPS auth service
+	TLS *TLSConfig `json:"tls"`
+	// Timeout bounds a request in seconds
+	Timeout int `json:"timeout"`
+	// Cache configures the cache of the decisions of the auth service
+	Cache CacheConfig `json:"cache"`
+	// OnFailure is the failure policy applied when the auth service cannot
+	// be reached or answers with a server error: deny, allow, next or stale
+	OnFailure string `json:"onFailure"`
+	// Retries is the number of times a failed request is retried
+	Retries int `json:"retries"`
+	// RetryBackoff is the wait in milliseconds before the first retry
+	RetryBackoff int `json:"retryBackoff"`
+	// Breaker configures the circuit breaker in front of the auth service
+	Breaker BreakerConfig `json:"breaker"`
 }
 
 type authHTTP struct {
-	client *http.Client
+	client  *http.Client
+	config  Config
+	cache   *authCache
+	breaker *breaker
+	// clients holds the connections of the accepted clients, for the
+	// variables of their ACL requests
+	clients sync.Map
+	// attributes holds the attributes of the connected clients by
+	// attrKey, they are only granted to the username they were returned for.
+	// They include the publish limits and session expiry interval.
+	attributes sync.Map
 }
 
-var (
-	config     Config
-	log        = logger.Get().Named("authhttp")
-	httpClient *http.Client
-)
+// attrKey identifies the client attributes are held for
+type attrKey struct {
+	clientID string
+	username string
+}
+
+// connInfo describes the connection of an accepted client
+type connInfo struct {
+	protocol byte
+	certCN   string
+}
+
+// maxResponseSize bounds the part of a response body that is read
+const maxResponseSize = 64 * 1024
 
-//Init init kafak client
+var log = logger.Get().Named("authhttp")
+
+// Init init kafak client
 func Init() *authHTTP {
-	content, err := ioutil.ReadFile("./plugins/auth/authhttp/http.json")
+	return InitFile(DefaultConfigFile)
+}
+
+// InitFile creates the plugin from the config file at path
+func InitFile(path string) *authHTTP {
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Fatal("Read config file error: ", zap.Error(err))
 	}
 	// log.Info(string(content))
 
+	var config Config
 	err = json.Unmarshal(content, &config)
 	if err != nil {
 		log.Fatal("Unmarshal config file error: ", zap.Error(err))
 	}
-	// fmt.Println("http: config: ", config)
+	return InitConfig(config)
+}
+
+// InitConfig creates the plugin from config
+func InitConfig(config Config) *authHTTP {
+	a, err := New(config)
+	if err != nil {
+		log.Fatal("authhttp config error: ", zap.Error(err))
+	}
+	return a
+}
+
+// New creates the plugin from config, requests left out of config are sent
+// like before they were configurable
+func New(config Config) (*authHTTP, error) {
+	if config.AuthURL == "" {
+		return nil, errors.New("missing auth url")
+	}
+	var err error
+	if config.AuthRequest, err = config.AuthRequest.withDefaults(defaultAuthRequest); err != nil {
+		return nil, err
+	}
+	if config.ACLRequest, err = config.ACLRequest.withDefaults(defaultACLRequest); err != nil {
+		return nil, err
+	}
+	if config.SuperRequest, err = config.SuperRequest.withDefaults(defaultSuperRequest); err != nil {
+		return nil, err
+	}
+	if err = validFailurePolicy(config.OnFailure); err != nil {
+		return nil, err
+	}
 
-	httpClient = &http.Client{
-		Transport: &http.Transport{
-			MaxConnsPerHost:     100,
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 100,
-		},
-		Timeout: time.Second * 100,
+	client, err := newHTTPClient(config)
+	if err != nil {
+		return nil, err
 	}
-	return &authHTTP{client: httpClient}
+	return &authHTTP{
+		client:  client,
+		config:  config,
+		cache:   newAuthCache(config.Cache),
+		breaker: newBreaker(config.Breaker),
+	}, nil
 }
 
-//CheckAuth check mqtt connect
+// CheckAuth check mqtt connect
 func (a *authHTTP) CheckConnect(clientID, username, password string) bool {
-	action := "connect"
-	{
-		aCache := checkCache(action, clientID, username, password, "")
-		if aCache != nil {
-			if aCache.password == password && aCache.username == username && aCache.action == action {
-				return true
-			}
-		}
+	return a.CheckConnectInfo(clientID, username, password, "", 0, "")
+}
+
+// CheckConnectInfo checks a connecting client with the auth endpoint, the
+// connection is described to the endpoint by the variables ${ip},
+// ${protocol} and ${cn}
+func (a *authHTTP) CheckConnectInfo(clientID, username, password, ip string, protocol byte, certCN string) bool {
+	return a.ConnectDecision(clientID, username, password, ip, protocol, certCN) == decision.Allow
+}
+
+// ConnectDecision is CheckConnectInfo leaving the decision to the next auth
+// plugin when the auth service ignores the client or fails with the next
+// failure policy
+func (a *authHTTP) ConnectDecision(clientID, username, password, ip string, protocol byte, certCN string) decision.Decision {
+	v := vars{
+		"clientid": clientID,
+		"username": username,
+		"password": password,
+		"ip":       ip,
+		"protocol": protocolVar(protocol),
+		"cn":       certCN,
 	}
+	key := newCacheKey("connect", a.config.AuthURL, a.config.AuthRequest.params(v))
+	ak := attrKey{clientID: clientID, username: username}
+	// whatever the client was granted by an earlier connect is dropped, the
+	// attributes are only restored from the decision allowing it now
+	a.attributes.Delete(ak)
 
-	data := url.Values{}
-	data.Add("username", username)
-	data.Add("clientid", clientID)
-	data.Add("password", password)
+	if allow, attrs, found := a.cache.lookup(key, time.Now()); found {
+		if allow {
+			a.connected(ak, connInfo{protocol: protocol, certCN: certCN}, attrs)
+			return decision.Allow
+		}
+		return decision.Deny
+	}
 
-	req, err := http.NewRequest("POST", config.AuthURL, strings.NewReader(data.Encode()))
+	status, body, err := a.request(a.config.AuthRequest, a.config.AuthURL, v)
 	if err != nil {
-		log.Error("new request super: ", zap.Error(err))
-		return false
+		d := a.failed(key, clientID, err)
+		if d == decision.Allow {
+			a.connected(ak, connInfo{protocol: protocol, certCN: certCN}, attributes{})
+		}
+		return d
+	}
+
+	d, resp := parseResponse(status, body)
+	switch d {
+	case decision.Allow:
+		attrs := newAttributes(resp)
+		a.connected(ak, connInfo{protocol: protocol, certCN: certCN}, attrs)
+		a.cache.addAttributes(key, true, attrs, time.Now())
+	case decision.Deny:
+		a.cache.add(key, false, time.Now())
+	}
+	return d
+}
+
+// connected keeps the connection and the attributes of an accepted client
+func (a *authHTTP) connected(ak attrKey, ci connInfo, attrs attributes) {
+	a.clients.Store(ak.clientID, ci)
+	if !attrs.empty() {
+		a.attributes.Store(ak, attrs)
+	}
+}
+
+// Disconnected drops the connection and the attributes of a client
+func (a *authHTTP) Disconnected(clientID, username string) {
+	a.clients.Delete(clientID)
+	a.attributes.Delete(attrKey{clientID: clientID, username: username})
+}
+
+func protocolVar(protocol byte) string {
+	if protocol == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(protocol))
+}
+
+// Limits returns the publish limits of a connected client found in its
+// connect response like {"limits": {"messageRate": 10}}
+func (a *authHTTP) Limits(clientID, username string) (limits.Limits, bool) {
+	attrs, ok := a.attributes.Load(attrKey{clientID: clientID, username: username})
+	if !ok || attrs.(attributes).limits == nil {
+		return limits.Limits{}, false
+	}
+	return *attrs.(attributes).limits, true
+}
+
+// SessionExpiry returns the session expiry interval of a connected client
+// found in its connect response like {"sessionExpiry": 3600}
+func (a *authHTTP) SessionExpiry(clientID, username string) (uint32, bool) {
+	attrs, ok := a.attributes.Load(attrKey{clientID: clientID, username: username})
+	if !ok || attrs.(attributes).sessionExpiry == nil {
+		return 0, false
+	}
+	return *attrs.(attributes).sessionExpiry, true
+}
+
+// isSuperuser checks the client with the superuser endpoint, superusers
+// pass all ACL checks. Failed requests do not make superusers.
+func (a *authHTTP) isSuperuser(clientID, username string, v vars) bool {
+	key := newCacheKey("super", a.config.SuperURL, a.config.SuperRequest.params(v))
+	if super, found := a.cache.get(key, time.Now()); found {
+		return super
 	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
 
-	resp, err := a.client.Do(req)
+	status, body, err := a.request(a.config.SuperRequest, a.config.SuperURL, v)
 	if err != nil {
 		log.Error("request super: ", zap.Error(err))
 		return false
 	}
+	d, _ := parseResponse(status, body)
+	super := d == decision.Allow
+	a.cache.add(key, super, time.Now())
+	return super
+}
 
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Error(fmt.Sprintf("Error closing file: %s\n", err.Error()))
-		}
-	}()
-
-	_, _ = io.Copy(ioutil.Discard, resp.Body)
-	if resp.StatusCode == http.StatusOK {
-		addCache(action, clientID, username, password, "")
-		return true
-	}
-
-	return false
-}
-
-// //CheckSuper check mqtt connect
-// func CheckSuper(clientID, username, password string) bool {
-// 	action := "connect"
-// 	{
-// 		aCache := checkCache(action, clientID, username, password, "")
-// 		if aCache != nil {
-// 			if aCache.password == password && aCache.username == username && aCache.action == action {
-// 				return true
-// 			}
-// 		}
-// 	}
-
-// 	data := url.Values{}
-// 	data.Add("username", username)
-// 	data.Add("clientid", clientID)
-// 	data.Add("password", password)
-
-// 	req, err := http.NewRequest("POST", config.SuperURL, strings.NewReader(data.Encode()))
-// 	if err != nil {
-// 		log.Error("new request super: ", zap.Error(err))
-// 		return false
-// 	}
-// 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-// 	req.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
-
-// 	resp, err := httpClient.Do(req)
-// 	if err != nil {
-// 		log.Error("request super: ", zap.Error(err))
-// 		return false
-// 	}
-
-// 	defer resp.Body.Close()
-// 	io.Copy(ioutil.Discard, resp.Body)
-
-// 	if resp.StatusCode == http.StatusOK {
-// 		return true
-// 	}
-// 	return false
-// }
-
-//CheckACL check mqtt connect
+// CheckACL check mqtt connect
 func (a *authHTTP) CheckACL(action, clientID, username, ip, topic string) bool {
+	return a.ACLDecision(action, clientID, username, ip, topic) == decision.Allow
+}
 
-	{
-		aCache := checkCache(action, "", username, "", topic)
-		if aCache != nil {
-			if aCache.topic == topic && aCache.action == action {
-				return true
+// ACLDecision is CheckACL leaving the decision to the next auth plugin when
+// the auth service ignores the access or fails with the next failure policy.
+// Superusers and clients with an ACL list in their connect response are
+// decided without asking the auth service.
+func (a *authHTTP) ACLDecision(action, clientID, username, ip, topic string) decision.Decision {
+	if attrs, ok := a.attributes.Load(attrKey{clientID: clientID, username: username}); ok {
+		attrs := attrs.(attributes)
+		if attrs.superuser {
+			return decision.Allow
+		}
+		if attrs.hasACL {
+			if attrs.checkACL(action, clientID, username, topic) {
+				return decision.Allow
 			}
+			return decision.Deny
 		}
 	}
 
-	req, err := http.NewRequest("GET", config.ACLURL, nil)
-	if err != nil {
-		log.Error("get acl: ", zap.Error(err))
-		return false
+	v := vars{
+		"clientid": clientID,
+		"username": username,
+		"ip":       ip,
+		"topic":    topic,
+		"access":   action,
 	}
-
-	data := req.URL.Query()
-
-	data.Add("username", username)
-	data.Add("topic", topic)
-	data.Add("access", action)
-	req.URL.RawQuery = data.Encode()
-	// fmt.Println("req:", req)
-	resp, err := a.client.Do(req)
-	if err != nil {
-		log.Error("request acl: ", zap.Error(err))
-		return false
+	if ci, ok := a.clients.Load(clientID); ok {
+		v["protocol"] = protocolVar(ci.(connInfo).protocol)
+		v["cn"] = ci.(connInfo).certCN
+	}
+	if a.config.SuperURL != "" && a.isSuperuser(clientID, username, v) {
+		return decision.Allow
 	}
 
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Error(fmt.Sprintf("Error closing file: %s\n", err.Error()))
+	key := newCacheKey(action, a.config.ACLURL, a.config.ACLRequest.params(v))
+	if allow, found := a.cache.get(key, time.Now()); found {
+		if allow {
+			return decision.Allow
 		}
-	}()
+		return decision.Deny
+	}
 
-	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	status, body, err := a.request(a.config.ACLRequest, a.config.ACLURL, v)
+	if err != nil {
+		return a.failed(key, clientID, err)
+	}
 
-	if resp.StatusCode == http.StatusOK {
-		addCache(action, "", username, "", topic)
-		return true
+	d, _ := parseResponse(status, body)
+	if d != decision.Ignore {
+		a.cache.add(key, d == decision.Allow, time.Now())
 	}
-	return false
+	return d
 }
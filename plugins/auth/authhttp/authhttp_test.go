@@ -0,0 +1,471 @@
+package authhttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/habakke/hmq/plugins/auth/decision"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer allows user alice with password secret to connect and to
+// publish to topic allowed
+func newTestServer(requests *int32) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		_ = r.ParseForm()
+		if r.Form.Get("username") != "alice" || r.Form.Get("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	mux.HandleFunc("/acl", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		q := r.URL.Query()
+		if q.Get("username") != "alice" || q.Get("topic") != "allowed" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+func newTestAuth(t *testing.T, config Config) *authHTTP {
+	a, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAuthHTTPCache(t *testing.T) {
+	var requests int32
+	srv := newTestServer(&requests)
+	defer srv.Close()
+
+	a := newTestAuth(t, Config{AuthURL: srv.URL + "/auth", ACLURL: srv.URL + "/acl"})
+	checks := []struct {
+		name     string
+		check    func() bool
+		allow    bool
+		requests int32
+	}{
+		{"connect", func() bool { return a.CheckConnect("c1", "alice", "secret") }, true, 1},
+		{"cached connect", func() bool { return a.CheckConnect("c1", "alice", "secret") }, true, 1},
+		{"wrong password", func() bool { return a.CheckConnect("c1", "alice", "wrong") }, false, 2},
+		{"cached denial", func() bool { return a.CheckConnect("c1", "alice", "wrong") }, false, 2},
+		{"other client", func() bool { return a.CheckConnect("c2", "alice", "secret") }, true, 3},
+		{"acl not served by connect", func() bool { return a.CheckACL("1", "c1", "alice", "", "denied") }, false, 4},
+		{"cached acl denial", func() bool { return a.CheckACL("1", "c1", "alice", "", "denied") }, false, 4},
+		{"acl", func() bool { return a.CheckACL("1", "c1", "alice", "", "allowed") }, true, 5},
+		{"acl per action", func() bool { return a.CheckACL("2", "c1", "alice", "", "allowed") }, true, 6},
+		{"cached acl", func() bool { return a.CheckACL("1", "c1", "alice", "", "allowed") }, true, 6},
+	}
+	for _, c := range checks {
+		assert.Equal(t, c.allow, c.check(), c.name)
+		assert.Equal(t, c.requests, atomic.LoadInt32(&requests), c.name)
+	}
+
+	disabled := newTestAuth(t, Config{AuthURL: srv.URL + "/auth", Cache: CacheConfig{Disabled: true}})
+	assert.True(t, disabled.CheckConnect("c1", "alice", "secret"))
+	assert.True(t, disabled.CheckConnect("c1", "alice", "secret"))
+	assert.Equal(t, int32(8), atomic.LoadInt32(&requests))
+
+	// decisions are cached per request sent, including the connection
+	// variables
+	byIP := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_ = r.ParseForm()
+		if r.Form.Get("ip") != "10.0.0.1" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer byIP.Close()
+	a = newTestAuth(t, Config{AuthURL: byIP.URL, AuthRequest: RequestConfig{Params: map[string]string{"username": "${username}", "ip": "${ip}"}}})
+	assert.True(t, a.CheckConnectInfo("c1", "alice", "secret", "10.0.0.1", 4, ""))
+	assert.False(t, a.CheckConnectInfo("c1", "alice", "secret", "10.0.0.2", 4, ""))
+	assert.True(t, a.CheckConnectInfo("c2", "alice", "other", "10.0.0.1", 4, ""), "parameters not sent do not matter")
+	assert.Equal(t, int32(10), atomic.LoadInt32(&requests))
+}
+
+func TestAuthCacheBounds(t *testing.T) {
+	now := time.Now()
+	ac := newAuthCache(CacheConfig{AllowTTL: 60, DenyTTL: 5, Size: 2})
+
+	allowed := newCacheKey("connect", "/auth", map[string]string{"username": "alice", "password": "secret"})
+	denied := newCacheKey("connect", "/auth", map[string]string{"username": "alice", "password": "wrong"})
+	ac.add(allowed, true, now)
+	ac.add(denied, false, now)
+
+	allow, found := ac.get(denied, now.Add(4*time.Second))
+	assert.True(t, found)
+	assert.False(t, allow)
+	_, found = ac.get(denied, now.Add(5*time.Second))
+	assert.False(t, found, "denials expire after the deny TTL")
+	allow, found = ac.get(allowed, now.Add(59*time.Second))
+	assert.True(t, found)
+	assert.True(t, allow)
+
+	// the least recently used decision is evicted
+	ac.add(denied, false, now)
+	ac.add(newCacheKey("connect", "/auth", map[string]string{"username": "bob", "password": "secret"}), true, now)
+	assert.Equal(t, 2, ac.len())
+	_, found = ac.get(allowed, now)
+	assert.False(t, found)
+
+	noDenials := newAuthCache(CacheConfig{DenyTTL: -1})
+	noDenials.add(denied, false, now)
+	assert.Equal(t, 0, noDenials.len())
+}
+
+func TestAuthHTTPRequests(t *testing.T) {
+	type request struct {
+		path    string
+		method  string
+		params  map[string]string
+		headers http.Header
+	}
+	requests := make(chan request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{path: r.URL.Path, method: r.Method, headers: r.Header, params: map[string]string{}}
+		if r.Header.Get("Content-Type") == "application/json" {
+			_ = json.NewDecoder(r.Body).Decode(&req.params)
+		} else {
+			_ = r.ParseForm()
+			for name := range r.Form {
+				req.params[name] = r.Form.Get(name)
+			}
+		}
+		requests <- req
+		if r.URL.Path == "/super" && req.params["user"] != "admin" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		if r.URL.Path == "/acl" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	a := newTestAuth(t, Config{
+		AuthURL:  srv.URL + "/auth",
+		ACLURL:   srv.URL + "/acl",
+		SuperURL: srv.URL + "/super",
+		AuthRequest: RequestConfig{
+			Encoding: EncodingJSON,
+			Params:   map[string]string{"id": "${clientid}", "from": "${ip}", "cert": "${cn}", "v": "mqtt${protocol}"},
+		},
+		ACLRequest:   RequestConfig{Method: "post", Params: map[string]string{"t": "${topic}", "cert": "${cn}"}},
+		SuperRequest: RequestConfig{Method: "GET", Params: map[string]string{"user": "${username}"}},
+		Headers:      map[string]string{"X-Broker": "hmq"},
+		BearerToken:  "token",
+		Cache:        CacheConfig{Disabled: true},
+	})
+	next := func() request {
+		select {
+		case req := <-requests:
+			return req
+		case <-time.After(5 * time.Second):
+			t.Fatal("no request")
+			return request{}
+		}
+	}
+
+	assert.True(t, a.CheckConnectInfo("c1", "alice", "secret", "10.0.0.1", 5, "device-1"))
+	req := next()
+	assert.Equal(t, http.MethodPost, req.method)
+	assert.Equal(t, map[string]string{"id": "c1", "from": "10.0.0.1", "cert": "device-1", "v": "mqtt5"}, req.params)
+	assert.Equal(t, "hmq", req.headers.Get("X-Broker"))
+	assert.Equal(t, "Bearer token", req.headers.Get("Authorization"))
+
+	// the ACL endpoint is asked once the client is no superuser
+	assert.False(t, a.CheckACL("2", "c1", "alice", "10.0.0.1", "a/b"))
+	req = next()
+	assert.Equal(t, "/super", req.path)
+	assert.Equal(t, http.MethodGet, req.method)
+	assert.Equal(t, map[string]string{"user": "alice"}, req.params)
+	req = next()
+	assert.Equal(t, "/acl", req.path)
+	assert.Equal(t, http.MethodPost, req.method)
+	assert.Equal(t, map[string]string{"t": "a/b", "cert": "device-1"}, req.params)
+
+	// superusers pass all ACL checks
+	assert.True(t, a.CheckACL("2", "c2", "admin", "10.0.0.2", "a/b"))
+	assert.Equal(t, "/super", next().path)
+	select {
+	case req := <-requests:
+		t.Fatalf("unexpected request to %s", req.path)
+	default:
+	}
+
+	_, err := New(Config{AuthURL: srv.URL, AuthRequest: RequestConfig{Method: "PUT"}})
+	assert.NotNil(t, err)
+	_, err = New(Config{AuthURL: srv.URL, ACLRequest: RequestConfig{Encoding: "xml"}})
+	assert.NotNil(t, err)
+}
+
+func TestAuthHTTPTimeoutAndTLS(t *testing.T) {
+	block := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer slow.Close()
+	defer close(block)
+
+	a := newTestAuth(t, Config{AuthURL: slow.URL, Timeout: 1})
+	start := time.Now()
+	assert.False(t, a.CheckConnect("c1", "alice", "secret"))
+	assert.Less(t, int64(time.Since(start)), int64(3*time.Second))
+
+	// the auth service requires a client certificate
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "hmq" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", srv.Certificate().Raw)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hmq"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+	a = newTestAuth(t, Config{AuthURL: srv.URL, TLS: &TLSConfig{CaFile: caFile, CertFile: certFile, KeyFile: keyFile}})
+	assert.True(t, a.CheckConnect("c1", "alice", "secret"))
+	a = newTestAuth(t, Config{AuthURL: srv.URL, TLS: &TLSConfig{CaFile: caFile}})
+	assert.False(t, a.CheckConnect("c1", "alice", "secret"))
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthHTTPResponseDecisions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		switch r.Form.Get("username") {
+		case "ignored":
+			_, _ = w.Write([]byte(`{"result": "ignore"}`))
+		case "denied":
+			_, _ = w.Write([]byte(`{"result": "deny"}`))
+		case "admin":
+			_, _ = w.Write([]byte(`{"result": "allow", "superuser": true}`))
+		case "device":
+			_, _ = w.Write([]byte(`{"acl": [{"topic": "devices/%c/#", "access": "2"}, {"topic": "cmd/+", "access": "3"}]}`))
+		case "plain":
+			_, _ = w.Write([]byte("ok"))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"result": "ignore"}`))
+		}
+	}))
+	defer srv.Close()
+
+	a := newTestAuth(t, Config{AuthURL: srv.URL + "/auth", ACLURL: srv.URL + "/acl"})
+	assert.Equal(t, decision.Ignore, a.ConnectDecision("c1", "ignored", "", "", 0, ""))
+	assert.Equal(t, decision.Ignore, a.ConnectDecision("c1", "other", "", "", 0, ""))
+	assert.Equal(t, decision.Deny, a.ConnectDecision("c1", "denied", "", "", 0, ""))
+	assert.Equal(t, decision.Allow, a.ConnectDecision("c1", "plain", "", "", 0, ""))
+	assert.False(t, a.CheckConnect("c1", "ignored", ""))
+
+	// the attributes of the connect response decide the ACL checks
+	assert.True(t, a.CheckConnect("admin1", "admin", ""))
+	assert.True(t, a.CheckACL("1", "admin1", "admin", "", "any/topic"))
+	assert.True(t, a.CheckConnect("d1", "device", ""))
+	assert.True(t, a.CheckACL("2", "d1", "device", "", "devices/d1/temp"))
+	assert.False(t, a.CheckACL("1", "d1", "device", "", "devices/d1/temp"))
+	assert.False(t, a.CheckACL("2", "d1", "device", "", "devices/d2/temp"))
+	assert.True(t, a.CheckACL("1", "d1", "device", "", "cmd/reboot"))
+	assert.False(t, a.CheckACL("1", "d1", "device", "", "cmd/#"))
+}
+
+func TestAuthHTTPFailurePolicy(t *testing.T) {
+	var requests int32
+	var failing int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		policy string
+		want   decision.Decision
+	}{
+		{"", decision.Deny},
+		{FailureAllow, decision.Allow},
+		{FailureNext, decision.Ignore},
+	} {
+		atomic.StoreInt32(&failing, 1)
+		a := newTestAuth(t, Config{AuthURL: srv.URL, OnFailure: c.policy, Cache: CacheConfig{Disabled: true}})
+		assert.Equal(t, c.want, a.ConnectDecision("c1", "alice", "secret", "", 0, ""), c.policy)
+	}
+	_, err := New(Config{AuthURL: srv.URL, OnFailure: "maybe"})
+	assert.NotNil(t, err)
+
+	// failed requests are retried
+	atomic.StoreInt32(&requests, 0)
+	a := newTestAuth(t, Config{AuthURL: srv.URL, Retries: 2, RetryBackoff: 1, Cache: CacheConfig{Disabled: true}})
+	assert.False(t, a.CheckConnect("c1", "alice", "secret"))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// the retries take no longer than the request timeout
+	start := time.Now()
+	a = newTestAuth(t, Config{AuthURL: srv.URL, Timeout: 1, Retries: 10, RetryBackoff: 400, Cache: CacheConfig{Disabled: true}})
+	assert.False(t, a.CheckConnect("c1", "alice", "secret"))
+	assert.Less(t, int64(time.Since(start)), int64(1500*time.Millisecond))
+
+	// the stale policy serves expired decisions
+	atomic.StoreInt32(&failing, 0)
+	a = newTestAuth(t, Config{AuthURL: srv.URL, OnFailure: FailureStale})
+	assert.True(t, a.CheckConnect("c1", "alice", "secret"))
+	a.cache.allowTTL = time.Nanosecond
+	v := vars{"clientid": "c1", "username": "alice", "password": "secret"}
+	a.cache.add(newCacheKey("connect", a.config.AuthURL, a.config.AuthRequest.params(v)), true, time.Now().Add(-time.Second))
+	atomic.StoreInt32(&failing, 1)
+	assert.True(t, a.CheckConnect("c1", "alice", "secret"))
+	assert.False(t, a.CheckConnect("c2", "alice", "secret"))
+}
+
+func TestAuthHTTPBreaker(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	a := newTestAuth(t, Config{AuthURL: srv.URL, Breaker: BreakerConfig{Failures: 2}, Cache: CacheConfig{Disabled: true}})
+	for i := 0; i < 4; i++ {
+		assert.False(t, a.CheckConnect("c1", "alice", "secret"))
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests), "open breaker sends no requests")
+
+	// a single request probes the service after the cooldown
+	now := time.Now()
+	br := newBreaker(BreakerConfig{Failures: 1, Cooldown: 10})
+	br.failure(now)
+	assert.False(t, br.allow(now.Add(9*time.Second)))
+	assert.True(t, br.allow(now.Add(10*time.Second)))
+	assert.False(t, br.allow(now.Add(10*time.Second)))
+	br.success()
+	assert.True(t, br.allow(now.Add(10*time.Second)))
+	assert.True(t, br.allow(now.Add(10*time.Second)))
+}
+
+func TestAuthHTTPAttributesPerUser(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		switch {
+		case r.URL.Path == "/acl":
+			w.WriteHeader(http.StatusForbidden)
+		case r.Form.Get("username") == "admin" && r.Form.Get("password") == "secret":
+			_, _ = w.Write([]byte(`{"superuser": true}`))
+		case r.Form.Get("username") == "admin":
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	a := newTestAuth(t, Config{AuthURL: srv.URL + "/auth", ACLURL: srv.URL + "/acl"})
+	assert.True(t, a.CheckConnect("x", "bob", ""))
+	assert.True(t, a.CheckConnect("x", "admin", "secret"))
+	assert.True(t, a.CheckACL("2", "x", "admin", "", "a"))
+
+	// bob reconnects from the cache as the client admin used
+	assert.True(t, a.CheckConnect("x", "bob", ""))
+	assert.False(t, a.CheckACL("2", "x", "bob", "", "a"), "bob must not inherit the superuser of admin")
+
+	// admin keeps its attributes when reconnecting from the cache
+	assert.True(t, a.CheckConnect("x", "admin", "secret"))
+	assert.True(t, a.CheckACL("2", "x", "admin", "", "a"))
+
+	// a denied connect drops them
+	assert.False(t, a.CheckConnect("x", "admin", "wrong"))
+	assert.False(t, a.CheckACL("2", "x", "admin", "", "a"))
+
+	assert.True(t, a.CheckConnect("x", "admin", "secret"))
+	a.Disconnected("x", "admin")
+	assert.False(t, a.CheckACL("2", "x", "admin", "", "a"), "disconnected clients have no attributes")
+}
+
+func TestAuthHTTPLimitsAndSessionExpiry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.Form.Get("password") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"limits": {"messageRate": 10}, "sessionExpiry": 60}`))
+	}))
+	defer srv.Close()
+
+	a := newTestAuth(t, Config{AuthURL: srv.URL})
+	other := newTestAuth(t, Config{AuthURL: srv.URL})
+	assert.True(t, a.CheckConnect("c1", "alice", "secret"))
+	l, ok := a.Limits("c1", "alice")
+	assert.True(t, ok)
+	assert.Equal(t, float64(10), l.MessageRate)
+	expiry, ok := a.SessionExpiry("c1", "alice")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(60), expiry)
+
+	// they are held per plugin and per client
+	_, ok = other.Limits("c1", "alice")
+	assert.False(t, ok)
+	_, ok = a.SessionExpiry("c2", "alice")
+	assert.False(t, ok)
+
+	// a connect allowed from the cache restores them
+	a.Disconnected("c1", "alice")
+	_, ok = a.Limits("c1", "alice")
+	assert.False(t, ok, "disconnected clients have no limits")
+	assert.True(t, a.CheckConnect("c1", "alice", "secret"))
+	_, ok = a.Limits("c1", "alice")
+	assert.True(t, ok)
+
+	// a denied connect drops them
+	assert.False(t, a.CheckConnect("c1", "alice", "wrong"))
+	_, ok = a.SessionExpiry("c1", "alice")
+	assert.False(t, ok)
+}
@@ -0,0 +1,112 @@
+package authhttp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Defaults of the circuit breaker
+const (
+	DefaultBreakerFailures = 5
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// errBreakerOpen fails requests while the auth service is considered down
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// BreakerConfig configures the circuit breaker in front of the auth service
+type BreakerConfig struct {
+	// Disabled sends every request to the auth service
+	Disabled bool `json:"disabled"`
+	// Failures is the number of consecutive failed requests opening the
+	// breaker
+	Failures int `json:"failures"`
+	// Cooldown is how long in seconds the breaker stays open before a
+	// request probes the auth service again
+	Cooldown int `json:"cooldown"`
+}
+
+// breaker fails requests without sending them while the auth service keeps
+// failing. Once the cooldown passed a single request probes the service, it
+// closes the breaker when it succeeds.
+type breaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu          sync.Mutex
+	consecutive int
+	openUntil   time.Time
+	probing     bool
+}
+
+// newBreaker returns nil when the breaker is disabled
+func newBreaker(cfg BreakerConfig) *breaker {
+	if cfg.Disabled {
+		return nil
+	}
+	br := &breaker{
+		failures: cfg.Failures,
+		cooldown: time.Duration(cfg.Cooldown) * time.Second,
+	}
+	if br.failures <= 0 {
+		br.failures = DefaultBreakerFailures
+	}
+	if br.cooldown <= 0 {
+		br.cooldown = DefaultBreakerCooldown
+	}
+	return br
+}
+
+// allow reports whether a request may be sent at now
+func (br *breaker) allow(now time.Time) bool {
+	if br == nil {
+		return true
+	}
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	if br.consecutive < br.failures {
+		return true
+	}
+	if now.Before(br.openUntil) || br.probing {
+		return false
+	}
+	br.probing = true
+	return true
+}
+
+// success records a request answered by the auth service
+func (br *breaker) success() {
+	if br == nil {
+		return
+	}
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	if br.consecutive >= br.failures {
+		log.Info("auth service recovered, circuit breaker closed")
+	}
+	br.consecutive = 0
+	br.probing = false
+}
+
+// failure records a failed request
+func (br *breaker) failure(now time.Time) {
+	if br == nil {
+		return
+	}
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	br.consecutive++
+	br.probing = false
+	if br.consecutive >= br.failures {
+		if br.consecutive == br.failures {
+			log.Warn("auth service failing, circuit breaker opened", zap.Duration("cooldown", br.cooldown))
+		}
+		br.openUntil = now.Add(br.cooldown)
+	}
+}
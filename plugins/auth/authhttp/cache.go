@@ -1,32 +1,192 @@
 package authhttp
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"sort"
+	"sync"
 	"time"
+)
 
-	"github.com/patrickmn/go-cache"
+// Defaults of the decision cache
+const (
+	DefaultAllowTTL  = 5 * time.Minute
+	DefaultDenyTTL   = 30 * time.Second
+	DefaultCacheSize = 10000
 )
 
+// CacheConfig configures the cache of the decisions of the auth service
+type CacheConfig struct {
+	// Disabled sends every check to the auth service
+	Disabled bool `json:"disabled"`
+	// AllowTTL is how long in seconds an allowed request is cached, negative
+	// values do not cache allowed requests
+	AllowTTL int `json:"allowTTL"`
+	// DenyTTL is how long in seconds a denied request is cached, negative
+	// values do not cache denials
+	DenyTTL int `json:"denyTTL"`
+	// Size is the maximum number of cached decisions, the least recently
+	// used ones are evicted first
+	Size int `json:"size"`
+}
+
+// cacheKey identifies a request to the auth service by its action and a
+// hash of its endpoint and parameters, so that requests differing in any
+// variable sent do not share a decision. The password is kept as hash only.
+type cacheKey struct {
+	action  string
+	request [sha256.Size]byte
+}
+
+func newCacheKey(action, endpoint string, params map[string]string) cacheKey {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	h.Write([]byte(endpoint))
+	for _, name := range names {
+		h.Write([]byte{0})
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write([]byte(params[name]))
+	}
+	key := cacheKey{action: action}
+	h.Sum(key.request[:0])
+	return key
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	allow   bool
+	attrs   attributes
+	expires time.Time
+}
+
+// authCache is a size bounded LRU cache of auth decisions
 type authCache struct {
-	action   string
-	username string
-	clientID string
-	password string
-	topic    string
+	allowTTL time.Duration
+	denyTTL  time.Duration
+	size     int
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
 }
 
-var (
-	// cache = make(map[string]authCache)
-	c = cache.New(5*time.Minute, 10*time.Minute)
-)
+// newAuthCache returns nil when the cache is disabled
+func newAuthCache(cfg CacheConfig) *authCache {
+	if cfg.Disabled {
+		return nil
+	}
+	ac := &authCache{
+		allowTTL: time.Duration(cfg.AllowTTL) * time.Second,
+		denyTTL:  time.Duration(cfg.DenyTTL) * time.Second,
+		size:     cfg.Size,
+		entries:  make(map[cacheKey]*list.Element),
+		lru:      list.New(),
+	}
+	if cfg.AllowTTL == 0 {
+		ac.allowTTL = DefaultAllowTTL
+	}
+	if cfg.DenyTTL == 0 {
+		ac.denyTTL = DefaultDenyTTL
+	}
+	if ac.size <= 0 {
+		ac.size = DefaultCacheSize
+	}
+	return ac
+}
+
+// get returns the cached decision for key, found is false when there is
+// none or it expired
+func (ac *authCache) get(key cacheKey, now time.Time) (allow bool, found bool) {
+	allow, _, found = ac.lookup(key, now)
+	return allow, found
+}
+
+// lookup is get also returning the client attributes cached with an allowed
+// connect
+func (ac *authCache) lookup(key cacheKey, now time.Time) (allow bool, attrs attributes, found bool) {
+	if ac == nil {
+		return false, attributes{}, false
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
 
-func checkCache(action, clientID, username, password, topic string) *authCache {
-	authc, found := c.Get(username)
-	if found {
-		return authc.(*authCache)
+	el, ok := ac.entries[key]
+	if !ok {
+		return false, attributes{}, false
 	}
-	return nil
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		// expired decisions are kept for the stale failure policy until
+		// they are evicted
+		return false, attributes{}, false
+	}
+	ac.lru.MoveToFront(el)
+	return e.allow, e.attrs, true
+}
+
+// stale returns the cached decision for key even if it expired
+func (ac *authCache) stale(key cacheKey) (allow bool, found bool) {
+	if ac == nil {
+		return false, false
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	el, ok := ac.entries[key]
+	if !ok {
+		return false, false
+	}
+	return el.Value.(*cacheEntry).allow, true
+}
+
+// add caches the decision for key with the TTL of allowed or denied
+// requests
+func (ac *authCache) add(key cacheKey, allow bool, now time.Time) {
+	ac.addAttributes(key, allow, attributes{}, now)
 }
 
-func addCache(action, clientID, username, password, topic string) {
-	c.Set(username, &authCache{action: action, username: username, clientID: clientID, password: password, topic: topic}, cache.DefaultExpiration)
+// addAttributes is add caching the client attributes with the decision
+func (ac *authCache) addAttributes(key cacheKey, allow bool, attrs attributes, now time.Time) {
+	if ac == nil {
+		return
+	}
+	ttl := ac.allowTTL
+	if !allow {
+		ttl = ac.denyTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	if el, ok := ac.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		e.allow, e.attrs, e.expires = allow, attrs, now.Add(ttl)
+		ac.lru.MoveToFront(el)
+		return
+	}
+	ac.entries[key] = ac.lru.PushFront(&cacheEntry{key: key, allow: allow, attrs: attrs, expires: now.Add(ttl)})
+	for ac.lru.Len() > ac.size {
+		el := ac.lru.Back()
+		ac.lru.Remove(el)
+		delete(ac.entries, el.Value.(*cacheEntry).key)
+	}
+}
+
+// len returns the number of cached decisions, including expired ones
+func (ac *authCache) len() int {
+	if ac == nil {
+		return 0
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.lru.Len()
 }
@@ -0,0 +1,264 @@
+package authhttp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Encodings of the parameters of POST requests
+const (
+	EncodingForm = "form"
+	EncodingJSON = "json"
+)
+
+// DefaultTimeout bounds a request to the auth service
+const DefaultTimeout = 5 * time.Second
+
+// DefaultRetryBackoff is the wait before the first retry of a failed
+// request, it doubles with every further retry
+const DefaultRetryBackoff = 100 * time.Millisecond
+
+// RequestConfig configures the requests sent to an endpoint of the auth
+// service
+type RequestConfig struct {
+	// Method is GET, sending the parameters in the query, or POST
+	Method string `json:"method"`
+	// Encoding of the parameters of POST requests, form or json
+	Encoding string `json:"encoding"`
+	// Params are the parameters sent, their values may reference the
+	// variables ${clientid}, ${username}, ${password}, ${ip}, ${topic},
+	// ${access}, ${protocol} and ${cn}
+	Params map[string]string `json:"params"`
+}
+
+// TLSConfig configures the connection to an HTTPS auth service
+type TLSConfig struct {
+	// CaFile verifies the auth service instead of the system roots
+	CaFile string `json:"caFile"`
+	// CertFile and KeyFile are the client certificate for mutual TLS
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ServerName overrides the name the certificate is verified for
+	ServerName string `json:"serverName"`
+}
+
+var (
+	defaultAuthRequest = RequestConfig{
+		Method:   http.MethodPost,
+		Encoding: EncodingForm,
+		Params:   map[string]string{"username": "${username}", "clientid": "${clientid}", "password": "${password}"},
+	}
+	defaultACLRequest = RequestConfig{
+		Method: http.MethodGet,
+		Params: map[string]string{"username": "${username}", "topic": "${topic}", "access": "${access}"},
+	}
+	defaultSuperRequest = RequestConfig{
+		Method:   http.MethodPost,
+		Encoding: EncodingForm,
+		Params:   map[string]string{"username": "${username}", "clientid": "${clientid}"},
+	}
+)
+
+// withDefaults fills in the parts of rc left out with the ones of def
+func (rc RequestConfig) withDefaults(def RequestConfig) (RequestConfig, error) {
+	if rc.Method == "" {
+		rc.Method = def.Method
+	}
+	rc.Method = strings.ToUpper(rc.Method)
+	if rc.Encoding == "" {
+		rc.Encoding = def.Encoding
+	}
+	if rc.Encoding == "" {
+		rc.Encoding = EncodingForm
+	}
+	if rc.Params == nil {
+		rc.Params = def.Params
+	}
+
+	switch rc.Method {
+	case http.MethodGet, http.MethodPost:
+	default:
+		return rc, fmt.Errorf("unsupported request method %q", rc.Method)
+	}
+	switch rc.Encoding {
+	case EncodingForm, EncodingJSON:
+	default:
+		return rc, fmt.Errorf("unsupported request encoding %q", rc.Encoding)
+	}
+	return rc, nil
+}
+
+// vars are the values of the variables of a request
+type vars map[string]string
+
+// params returns the parameters of rc with the variables replaced
+func (rc RequestConfig) params(v vars) map[string]string {
+	params := make(map[string]string, len(rc.Params))
+	for name, tmpl := range rc.Params {
+		params[name] = os.Expand(tmpl, func(key string) string {
+			return v[key]
+		})
+	}
+	return params
+}
+
+// newRequest builds the request to endpoint with the variables v
+func (a *authHTTP) newRequest(rc RequestConfig, endpoint string, v vars) (*http.Request, error) {
+	params := rc.params(v)
+
+	var req *http.Request
+	var err error
+	switch {
+	case rc.Method == http.MethodGet:
+		req, err = http.NewRequest(http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		query := req.URL.Query()
+		for name, value := range params {
+			query.Add(name, value)
+		}
+		req.URL.RawQuery = query.Encode()
+	case rc.Encoding == EncodingJSON:
+		body, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		req, err = http.NewRequest(rc.Method, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+	default:
+		data := url.Values{}
+		for name, value := range params {
+			data.Add(name, value)
+		}
+		body := data.Encode()
+		req, err = http.NewRequest(rc.Method, endpoint, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	for name, value := range a.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if a.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+a.config.BearerToken)
+	}
+	return req, nil
+}
+
+// do sends the request to endpoint and returns the status code and the
+// start of the response body
+func (a *authHTTP) do(rc RequestConfig, endpoint string, v vars) (int, []byte, error) {
+	req, err := a.newRequest(rc, endpoint, v)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Error(fmt.Sprintf("Error closing file: %s\n", err.Error()))
+		}
+	}()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, body, err
+}
+
+// request sends the request to endpoint through the circuit breaker and
+// retries it when it fails. Server errors count as failures.
+func (a *authHTTP) request(rc RequestConfig, endpoint string, v vars) (int, []byte, error) {
+	if !a.breaker.allow(time.Now()) {
+		return 0, nil, errBreakerOpen
+	}
+
+	backoff := DefaultRetryBackoff
+	if a.config.RetryBackoff > 0 {
+		backoff = time.Duration(a.config.RetryBackoff) * time.Millisecond
+	}
+	// the retries together take no longer than a single request may
+	deadline := time.Now().Add(a.client.Timeout)
+	for attempt := 0; ; attempt++ {
+		status, body, err := a.do(rc, endpoint, v)
+		if err == nil && status < http.StatusInternalServerError {
+			a.breaker.success()
+			return status, body, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("auth service answered %d", status)
+		}
+		wait := backoff << uint(attempt)
+		if attempt >= a.config.Retries || wait <= 0 || time.Now().Add(wait).After(deadline) {
+			a.breaker.failure(time.Now())
+			return 0, nil, err
+		}
+		time.Sleep(wait)
+	}
+}
+
+// newHTTPClient returns the client for the auth service described by
+// config
+func newHTTPClient(config Config) (*http.Client, error) {
+	transport := &http.Transport{
+		MaxConnsPerHost:     100,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 100,
+	}
+	if config.TLS != nil {
+		tlsConfig, err := newTLSConfig(*config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	timeout := DefaultTimeout
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+func newTLSConfig(info TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: info.ServerName}
+	if info.CaFile != "" {
+		pem, err := ioutil.ReadFile(info.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + info.CaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if info.CertFile != "" || info.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(info.CertFile, info.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,153 @@
+package authhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/habakke/hmq/plugins/auth/decision"
+	"github.com/habakke/hmq/plugins/auth/limits"
+	"go.uber.org/zap"
+)
+
+// Access of ACL rules, the values of the ${access} variable
+const (
+	AccessSub    = "1"
+	AccessPub    = "2"
+	AccessPubSub = "3"
+)
+
+// Failure policies applied when the auth service cannot be reached or
+// answers with a server error
+const (
+	// FailureDeny denies the client or the topic access
+	FailureDeny = "deny"
+	// FailureAllow allows the client or the topic access
+	FailureAllow = "allow"
+	// FailureNext leaves the decision to the next auth plugin
+	FailureNext = "next"
+	// FailureStale serves the last decision of the cache even if it
+	// expired, and denies when there is none
+	FailureStale = "stale"
+)
+
+// ACLRule grants a client access to the topics matching Topic, %c and %u
+// are replaced by the client identifier and the username
+type ACLRule struct {
+	Topic  string `json:"topic"`
+	Access string `json:"access"`
+}
+
+// response is the JSON body of a response of the auth service. All fields
+// are optional.
+type response struct {
+	// Result is allow, deny or ignore
+	Result string `json:"result"`
+	// Superuser clients pass every ACL check
+	Superuser bool `json:"superuser"`
+	// ACL replaces the ACL requests of the client when present
+	ACL           []ACLRule      `json:"acl"`
+	Limits        *limits.Limits `json:"limits"`
+	SessionExpiry *uint32        `json:"sessionExpiry"`
+}
+
+// parseResponse returns the decision of a response and its body. The result
+// of the body decides when there is one, else status 200 allows.
+func parseResponse(status int, body []byte) (decision.Decision, response) {
+	var resp response
+	if len(body) > 0 && json.Unmarshal(body, &resp) != nil {
+		resp = response{}
+	}
+	if d, ok := decision.Parse(strings.ToLower(resp.Result)); ok {
+		return d, resp
+	}
+	if status == http.StatusOK {
+		return decision.Allow, resp
+	}
+	return decision.Deny, resp
+}
+
+// attributes are the ones of the connect response of a client
+type attributes struct {
+	superuser     bool
+	acl           []ACLRule
+	hasACL        bool
+	limits        *limits.Limits
+	sessionExpiry *uint32
+}
+
+func newAttributes(resp response) attributes {
+	return attributes{
+		superuser:     resp.Superuser,
+		acl:           resp.ACL,
+		hasACL:        resp.ACL != nil,
+		limits:        resp.Limits,
+		sessionExpiry: resp.SessionExpiry,
+	}
+}
+
+// empty reports whether the connect response granted nothing to keep
+func (attrs attributes) empty() bool {
+	return !attrs.superuser && !attrs.hasACL && attrs.limits == nil && attrs.sessionExpiry == nil
+}
+
+// checkACL checks the topic access with the ACL list of the client, the
+// access is denied when no rule matches
+func (attrs attributes) checkACL(action, clientID, username, topic string) bool {
+	for _, rule := range attrs.acl {
+		if rule.Access != action && rule.Access != AccessPubSub {
+			continue
+		}
+		filter := strings.NewReplacer("%c", clientID, "%u", username).Replace(rule.Topic)
+		if matchFilter(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFilter reports whether the topic filter covers topic, which may be a
+// topic filter of a subscription itself
+func matchFilter(filter, topic string) bool {
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || ts[i] == "#" {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// validFailurePolicy reports an error for unknown failure policies
+func validFailurePolicy(policy string) error {
+	switch policy {
+	case "", FailureDeny, FailureAllow, FailureNext, FailureStale:
+		return nil
+	}
+	return fmt.Errorf("unsupported failure policy %q", policy)
+}
+
+// failed returns the decision of a request to the auth service that failed
+// with err according to the failure policy
+func (a *authHTTP) failed(key cacheKey, clientID string, err error) decision.Decision {
+	d := decision.Deny
+	switch a.config.OnFailure {
+	case FailureAllow:
+		d = decision.Allow
+	case FailureNext:
+		d = decision.Ignore
+	case FailureStale:
+		if allow, found := a.cache.stale(key); found && allow {
+			d = decision.Allow
+		}
+	}
+	log.Error("request "+key.action+": ", zap.Error(err), zap.String("ClientID", clientID), zap.Stringer("decision", d))
+	return d
+}
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/habakke/hmq/plugins/auth/decision"
+)
+
+// Decision is the result of an auth check
+type Decision = decision.Decision
+
+// Decisions of DecisionAuth plugins
+const (
+	Deny   = decision.Deny
+	Allow  = decision.Allow
+	Ignore = decision.Ignore
+)
+
+// DecisionAuth is implemented by auth plugins that may leave a check to the
+// next plugin of a chain by returning Ignore. Outside of a chain ignored
+// checks are denied.
+type DecisionAuth interface {
+	ConnectDecision(clientID, username, password, ip string, protocol byte, certCN string) Decision
+	ACLDecision(action, clientID, username, ip, topic string) Decision
+}
+
+// chain asks its plugins in order until one of them decides. A check all
+// plugins ignore is denied. Limits and session expiry intervals are the ones
+// of the plugin that accepted the client.
+type chain struct {
+	plugins []Auth
+	// accepted holds the index of the plugin that accepted a client
+	accepted sync.Map
+}
+
+// newChain returns the chain of the comma separated plugin names
+func newChain(names string, config Config) *chain {
+	c := &chain{}
+	for _, name := range strings.Split(names, ",") {
+		c.plugins = append(c.plugins, NewAuthConfig(strings.TrimSpace(name), config))
+	}
+	return c
+}
+
+func (c *chain) CheckConnect(clientID, username, password string) bool {
+	return c.CheckConnectInfo(clientID, username, password, "", 0, "")
+}
+
+func (c *chain) CheckConnectInfo(clientID, username, password, ip string, protocol byte, certCN string) bool {
+	return c.ConnectDecision(clientID, username, password, ip, protocol, certCN) == Allow
+}
+
+func (c *chain) ConnectDecision(clientID, username, password, ip string, protocol byte, certCN string) Decision {
+	for i, p := range c.plugins {
+		var d Decision
+		switch p := p.(type) {
+		case DecisionAuth:
+			d = p.ConnectDecision(clientID, username, password, ip, protocol, certCN)
+		case ConnectInfoAuth:
+			d = decide(p.CheckConnectInfo(clientID, username, password, ip, protocol, certCN))
+		default:
+			d = decide(p.CheckConnect(clientID, username, password))
+		}
+		if d == Allow {
+			c.accepted.Store(clientID, i)
+		}
+		if d != Ignore {
+			return d
+		}
+	}
+	return Ignore
+}
+
+func (c *chain) CheckACL(action, clientID, username, ip, topic string) bool {
+	return c.ACLDecision(action, clientID, username, ip, topic) == Allow
+}
+
+func (c *chain) ACLDecision(action, clientID, username, ip, topic string) Decision {
+	for _, p := range c.plugins {
+		var d Decision
+		if da, ok := p.(DecisionAuth); ok {
+			d = da.ACLDecision(action, clientID, username, ip, topic)
+		} else {
+			d = decide(p.CheckACL(action, clientID, username, ip, topic))
+		}
+		if d != Ignore {
+			return d
+		}
+	}
+	return Ignore
+}
+
+// Authenticate runs enhanced authentication with the first plugin
+// supporting it
+func (c *chain) Authenticate(clientID, method string, data []byte) ([]byte, bool, error) {
+	for _, p := range c.plugins {
+		if ea, ok := p.(EnhancedAuth); ok {
+			return ea.Authenticate(clientID, method, data)
+		}
+	}
+	return nil, false, ErrUnsupportedMethod
+}
+
+func (c *chain) Limits(clientID, username string) (Limits, bool) {
+	if la, ok := c.acceptedBy(clientID).(LimitedAuth); ok {
+		return la.Limits(clientID, username)
+	}
+	return Limits{}, false
+}
+
+func (c *chain) SessionExpiry(clientID, username string) (uint32, bool) {
+	if sa, ok := c.acceptedBy(clientID).(SessionAuth); ok {
+		return sa.SessionExpiry(clientID, username)
+	}
+	return 0, false
+}
+
+// Disconnected forgets the plugin that accepted the client and tells the
+// plugins implementing DisconnectAuth
+func (c *chain) Disconnected(clientID, username string) {
+	c.accepted.Delete(clientID)
+	for _, p := range c.plugins {
+		if da, ok := p.(DisconnectAuth); ok {
+			da.Disconnected(clientID, username)
+		}
+	}
+}
+
+// Reload reloads the plugins implementing Reloader, it returns the first
+// error
+func (c *chain) Reload() error {
+	var err error
+	for _, p := range c.plugins {
+		if r, ok := p.(Reloader); ok {
+			if rerr := r.Reload(); rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+	}
+	return err
+}
+
+// Close closes the plugins implementing io.Closer
+func (c *chain) Close() error {
+	var err error
+	for _, p := range c.plugins {
+		if cl, ok := p.(io.Closer); ok {
+			if cerr := cl.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// acceptedBy returns the plugin that accepted clientID, nil if none did
+func (c *chain) acceptedBy(clientID string) Auth {
+	i, ok := c.accepted.Load(clientID)
+	if !ok {
+		return nil
+	}
+	return c.plugins[i.(int)]
+}
+
+func decide(allow bool) Decision {
+	if allow {
+		return Allow
+	}
+	return Deny
+}
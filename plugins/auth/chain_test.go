@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decidingAuth accepts the clients and topics in allow, denies the ones in
+// deny and ignores the others
+type decidingAuth struct {
+	allow, deny map[string]bool
+}
+
+func (a *decidingAuth) decide(name string) Decision {
+	switch {
+	case a.allow[name]:
+		return Allow
+	case a.deny[name]:
+		return Deny
+	}
+	return Ignore
+}
+
+func (a *decidingAuth) CheckConnect(clientID, username, password string) bool {
+	return a.decide(clientID) == Allow
+}
+
+func (a *decidingAuth) CheckACL(action, clientID, username, ip, topic string) bool {
+	return a.decide(topic) == Allow
+}
+
+func (a *decidingAuth) ConnectDecision(clientID, username, password, ip string, protocol byte, certCN string) Decision {
+	return a.decide(clientID)
+}
+
+func (a *decidingAuth) ACLDecision(action, clientID, username, ip, topic string) Decision {
+	return a.decide(topic)
+}
+
+func (a *decidingAuth) SessionExpiry(clientID, username string) (uint32, bool) {
+	return 60, true
+}
+
+func TestChain(t *testing.T) {
+	first := &decidingAuth{allow: map[string]bool{"c1": true, "a": true}, deny: map[string]bool{"c2": true, "b": true}}
+	last := &decidingAuth{allow: map[string]bool{"c2": true, "c3": true, "b": true, "c": true}}
+	c := &chain{plugins: []Auth{first, last}}
+
+	assert.True(t, c.CheckConnect("c1", "", ""))
+	assert.False(t, c.CheckConnect("c2", "", ""), "the first decision wins")
+	assert.True(t, c.CheckConnect("c3", "", ""), "ignored by the first plugin")
+	assert.False(t, c.CheckConnect("c4", "", ""), "ignored by all plugins")
+	assert.Equal(t, Ignore, c.ConnectDecision("c4", "", "", "", 0, ""))
+
+	assert.True(t, c.CheckACL("1", "c1", "", "", "a"))
+	assert.False(t, c.CheckACL("1", "c1", "", "", "b"))
+	assert.True(t, c.CheckACL("1", "c1", "", "", "c"))
+	assert.False(t, c.CheckACL("1", "c1", "", "", "d"))
+
+	// mockAuth decides everything
+	c = &chain{plugins: []Auth{first, &mockAuth{}}}
+	assert.True(t, c.CheckConnect("c4", "", ""))
+	_, ok := c.SessionExpiry("c4", "")
+	assert.False(t, ok, "accepted by a plugin without session expiry")
+	assert.True(t, c.CheckConnect("c1", "", ""))
+	_, ok = c.SessionExpiry("c1", "")
+	assert.True(t, ok)
+
+	_, _, err := c.Authenticate("c1", "SCRAM-SHA-1", nil)
+	assert.Equal(t, ErrUnsupportedMethod, err)
+}
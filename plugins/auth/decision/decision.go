@@ -0,0 +1,38 @@
+// Package decision holds the results of auth checks, it is shared by the
+// auth plugins and the broker.
+package decision
+
+// Decision is the result of an auth check
+type Decision int
+
+const (
+	// Deny rejects the client or the topic access
+	Deny Decision = iota
+	// Allow accepts the client or the topic access
+	Allow
+	// Ignore leaves the decision to the next auth plugin
+	Ignore
+)
+
+// Parse returns the decision named s, ok is false for unknown names
+func Parse(s string) (d Decision, ok bool) {
+	switch s {
+	case "deny":
+		return Deny, true
+	case "allow":
+		return Allow, true
+	case "ignore":
+		return Ignore, true
+	}
+	return Deny, false
+}
+
+func (d Decision) String() string {
+	switch d {
+	case Allow:
+		return "allow"
+	case Ignore:
+		return "ignore"
+	}
+	return "deny"
+}
@@ -0,0 +1,14 @@
+// Package limits holds the publish limits auth plugins may set per user, it
+// is shared by the auth plugins and the broker.
+package limits
+
+// Limits are the publish limits of a user, zero values keep the limits
+// configured in the broker
+type Limits struct {
+	// MessageRate is the number of messages per second
+	MessageRate  float64 `json:"messageRate"`
+	MessageBurst int     `json:"messageBurst"`
+	// ByteRate is the number of topic and payload bytes per second
+	ByteRate  float64 `json:"byteRate"`
+	ByteBurst int     `json:"byteBurst"`
+}
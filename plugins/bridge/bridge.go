@@ -13,6 +13,8 @@ const (
 	Unsubscribe = "unsubscribe"
 	//Disconnect mqtt disconenct
 	Disconnect = "disconnect"
+	//SessionExpired persistent session expired
+	SessionExpired = "session_expired"
 )
 
 var (
@@ -39,6 +41,12 @@ type BridgeMQ interface {
 	Publish(e *Elements) error
 }
 
+// Closer is implemented by bridges holding connections, Close is called
+// when the broker shuts down to flush the buffered messages and close them
+type Closer interface {
+	Close() error
+}
+
 func NewBridgeMQ(name string) BridgeMQ {
 	switch name {
 	case Kafka:
@@ -12,13 +12,14 @@ import (
 )
 
 type kafakConfig struct {
-	Addr             []string          `json:"addr"`
-	ConnectTopic     string            `json:"onConnect"`
-	SubscribeTopic   string            `json:"onSubscribe"`
-	PublishTopic     string            `json:"onPublish"`
-	UnsubscribeTopic string            `json:"onUnsubscribe"`
-	DisconnectTopic  string            `json:"onDisconnect"`
-	DeliverMap       map[string]string `json:"deliverMap"`
+	Addr                []string          `json:"addr"`
+	ConnectTopic        string            `json:"onConnect"`
+	SubscribeTopic      string            `json:"onSubscribe"`
+	PublishTopic        string            `json:"onPublish"`
+	UnsubscribeTopic    string            `json:"onUnsubscribe"`
+	DisconnectTopic     string            `json:"onDisconnect"`
+	SessionExpiredTopic string            `json:"onSessionExpired"`
+	DeliverMap          map[string]string `json:"deliverMap"`
 }
 
 type kafka struct {
@@ -95,6 +96,10 @@ func (k *kafka) Publish(e *Elements) error {
 		if config.DisconnectTopic != "" {
 			topics[config.DisconnectTopic] = true
 		}
+	case SessionExpired:
+		if config.SessionExpiredTopic != "" {
+			topics[config.SessionExpiredTopic] = true
+		}
 	default:
 		return errors.New("error action: " + e.Action)
 	}
@@ -103,6 +108,13 @@ func (k *kafka) Publish(e *Elements) error {
 
 }
 
+var _ Closer = (*kafka)(nil)
+
+//Close flushes buffered messages and closes the kafka producer
+func (k *kafka) Close() error {
+	return k.kafkaClient.Close()
+}
+
 func (k *kafka) publish(topics map[string]bool, key string, msg *Elements) error {
 	payload, err := json.Marshal(msg)
 	if err != nil {
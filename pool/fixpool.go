@@ -1,6 +1,9 @@
 package pool
 
 import (
+	"context"
+	"sync"
+
 	"github.com/segmentio/fasthash/fnv1a"
 )
 
@@ -35,6 +38,48 @@ func (p *WorkerPool) Submit(uid string, task func()) {
 	}
 }
 
+// SubmitContext submits task like Submit, it gives up when ctx is done
+// before the queue of uid has room for the task.
+func (p *WorkerPool) SubmitContext(ctx context.Context, uid string, task func()) error {
+	idx := fnv1a.HashString64(uid) % uint64(p.maxWorkers)
+	if task == nil {
+		return nil
+	}
+	select {
+	case p.taskQueue[idx] <- task:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drain blocks until every task submitted before the call has been executed
+// or ctx is done.
+func (p *WorkerPool) Drain(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i := 0; i < p.maxWorkers; i++ {
+		wg.Add(1)
+		select {
+		case p.taskQueue[i] <- wg.Done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (p *WorkerPool) dispatch() {
 	for i := 0; i < p.maxWorkers; i++ {
 		p.taskQueue[i] = make(chan func(), 1024)